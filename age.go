@@ -0,0 +1,172 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+func init() {
+	keyBackends["age"] = readAgeIdentities
+}
+
+// ageKey encrypts the secrets with age, to the recipients of the identities
+// of an age identities file: native X25519 identities, as written by
+// age-keygen, or plugin identities, which run the matching age-plugin-NAME
+// binary, such as age-plugin-yubikey.
+type ageKey struct {
+	identities []age.Identity
+	recipients []age.Recipient
+	// pub identifies the identities, for the shared secrets.
+	pub ageRecipients
+	// encodings holds the identity lines of the file. Plugin identities
+	// usually refer to a hardware token and are not secret, so names
+	// encrypted with them are only as private as the identities file.
+	encodings []byte
+}
+
+// ageRecipients is the public key of an ageKey: the recipients of its
+// identities, with plugin identities reduced to a fingerprint.
+type ageRecipients string
+
+func (r ageRecipients) Equal(o crypto.PublicKey) bool {
+	return r == o
+}
+
+func (r ageRecipients) fingerprint() string {
+	return string(r)
+}
+
+func (ageRecipients) kind() string {
+	return "AGE"
+}
+
+func readAgeIdentities(fn string) (keyBackend, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read identities file: %s", err)
+	}
+	defer f.Close()
+
+	ui := &plugin.ClientUI{
+		DisplayMessage: func(name, message string) error {
+			fmt.Fprintf(os.Stderr, "age-plugin-%s: %s\n", name, message)
+			return nil
+		},
+		RequestValue: func(name, prompt string, secret bool) (string, error) {
+			if secret {
+				value, err := readPassphrase(fmt.Sprintf("age-plugin-%s: %s ", name, prompt))
+				return string(value), err
+			}
+			fmt.Fprintf(os.Stderr, "age-plugin-%s: %s ", name, prompt)
+			value, err := stdin.ReadString('\n')
+			return strings.TrimSpace(value), err
+		},
+		Confirm: func(name, prompt, yes, no string) (bool, error) {
+			if no == "" {
+				fmt.Fprintf(os.Stderr, "age-plugin-%s: %s [press enter to %s] ", name, prompt, yes)
+				_, err := stdin.ReadString('\n')
+				return err == nil, err
+			}
+			return confirm(fmt.Sprintf("age-plugin-%s: %s (y: %s, n: %s)", name, prompt, yes, no))
+		},
+		WaitTimer: func(name string) {
+			fmt.Fprintf(os.Stderr, "age-plugin-%s: waiting on the plugin...\n", name)
+		},
+	}
+
+	key := &ageKey{}
+	var pubs []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "AGE-PLUGIN-") {
+			id, err := plugin.NewIdentity(line, ui)
+			if err != nil {
+				return nil, fmt.Errorf("invalid identity at line %d of %s: %s", n, fn, err)
+			}
+			key.identities = append(key.identities, id)
+			key.recipients = append(key.recipients, id.Recipient())
+			sum := sha256.Sum256([]byte(line))
+			pubs = append(pubs, fmt.Sprintf("age-plugin-%s:SHA256:%s", id.Name(), base64.RawStdEncoding.EncodeToString(sum[:])))
+		} else {
+			id, err := age.ParseX25519Identity(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid identity at line %d of %s: %s", n, fn, err)
+			}
+			key.identities = append(key.identities, id)
+			key.recipients = append(key.recipients, id.Recipient())
+			pubs = append(pubs, id.Recipient().String())
+		}
+		key.encodings = append(key.encodings, line+"\n"...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read identities file: %s", err)
+	}
+	if len(key.identities) == 0 {
+		return nil, fmt.Errorf("no identities found in %s", fn)
+	}
+	key.pub = ageRecipients(strings.Join(pubs, ","))
+	return key, nil
+}
+
+func (k *ageKey) public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *ageKey) material() ([]byte, error) {
+	return k.encodings, nil
+}
+
+func (k *ageKey) encrypted(in, label []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, k.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(withLabel(in, label)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (k *ageKey) decrypted(in, label []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(in), k.identities...)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return withoutLabel(plain, label)
+}
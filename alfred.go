@@ -0,0 +1,77 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/urfave/cli"
+)
+
+// alfredItem is a result of an Alfred script filter, which Raycast also
+// reads.
+type alfredItem struct {
+	UID      string      `json:"uid,omitempty"`
+	Title    string      `json:"title"`
+	Subtitle string      `json:"subtitle"`
+	Arg      string      `json:"arg,omitempty"`
+	Match    string      `json:"match,omitempty"`
+	Valid    bool        `json:"valid"`
+	Text     *alfredText `json:"text,omitempty"`
+}
+
+// alfredText is what the launcher copies, or shows in large type.
+type alfredText struct {
+	Copy      string `json:"copy"`
+	LargeType string `json:"largetype"`
+}
+
+// printAlfred writes the current codes as the script filter JSON of Alfred:
+// the code is the argument of each item, so the action of the workflow
+// copies or pastes it. The launcher runs the script again every second, to
+// keep the countdown and the codes current.
+func printAlfred(c *cli.Context, w io.Writer) error {
+	codes, failed, err := loadCodes(c)
+	if err != nil {
+		return err
+	}
+	items := make([]alfredItem, 0, len(codes)+1)
+	for _, code := range codes {
+		item := alfredItem{
+			UID:      code.Issuer + "/" + code.Account,
+			Title:    code.Issuer,
+			Subtitle: fmt.Sprintf("%s · %s · %ds left", code.Account, code.Code, code.ExpiresIn),
+			Arg:      code.Code,
+			Match:    code.Issuer + " " + code.Account,
+			Valid:    true,
+			Text:     &alfredText{Copy: code.Code, LargeType: code.Code},
+		}
+		items = append(items, item)
+	}
+	if failed > 0 {
+		// Launchers show nothing when the script fails, so the error
+		// is shown as an item instead.
+		items = append(items, alfredItem{
+			Title:    fmt.Sprintf("%d of %d keys could not be decrypted", failed, len(codes)+failed),
+			Subtitle: "run otp get in a terminal for details",
+		})
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Rerun float64      `json:"rerun"`
+		Items []alfredItem `json:"items"`
+	}{1, items})
+}
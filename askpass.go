@@ -0,0 +1,113 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	// askpassHost finds the host in the prompts of keyboard-interactive
+	// authentication, which OpenSSH prefixes with (user@host).
+	askpassHost = regexp.MustCompile(`^\((?:[^@()]*@)?([^()@]+)\)`)
+
+	// askpassCodePrompt tells the prompts for codes apart from the ones for
+	// passwords, passphrases and host key confirmations.
+	askpassCodePrompt = regexp.MustCompile(`(?i)verification|one[- ]time|\botp\b|token|code|2fa|mfa|authenticator`)
+)
+
+func askpass() cli.Command {
+	return cli.Command{
+		Name:      "askpass",
+		Usage:     "answer the prompts of ssh for verification codes, as SSH_ASKPASS",
+		ArgsUsage: "`prompt`",
+		Description: `ssh runs SSH_ASKPASS with the prompt alone, so otp acts as otp askpass when
+   it runs as otp-askpass:
+
+     ln -s "$(command -v otp)" ~/bin/otp-askpass
+     SSH_ASKPASS=~/bin/otp-askpass SSH_ASKPASS_REQUIRE=force ssh bastion
+
+   The host is taken from the (user@host) that OpenSSH puts before the
+   prompts of keyboard-interactive authentication, or from
+   $OTP_ASKPASS_HOST, and the [askpass] table of the configuration file maps
+   it to the key whose code is printed, by name or by pattern:
+
+     [askpass]
+     "bastion.example.com" = "Example/alice"
+     "*.corp.example.com" = "Corp/alice"
+
+   Other prompts, such as those for passwords or to accept host keys, are
+   passed to the program in $OTP_ASKPASS_FALLBACK, or refused.`,
+		Action: func(c *cli.Context) error {
+			prompt := c.Args().First()
+			if !askpassCodePrompt.MatchString(prompt) {
+				fallback := os.Getenv("OTP_ASKPASS_FALLBACK")
+				if fallback == "" {
+					return fmt.Errorf("not a prompt for a code: %q", prompt)
+				}
+				cmd := exec.Command(fallback, prompt)
+				cmd.Stdin = os.Stdin
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				return cmd.Run()
+			}
+
+			host := os.Getenv("OTP_ASKPASS_HOST")
+			if m := askpassHost.FindStringSubmatch(prompt); host == "" && m != nil {
+				host = m[1]
+			}
+			if host == "" {
+				return errors.New("host is missing; set OTP_ASKPASS_HOST")
+			}
+			cfg, err := loadConfig(c.GlobalString("config"))
+			if err != nil {
+				return err
+			}
+			filter, ok := askpassEntry(cfg.Commands["askpass"], host)
+			if !ok {
+				return fmt.Errorf("no key for %s in the [askpass] table of %s", host, c.GlobalString("config"))
+			}
+			code, err := codeFor(c, filter)
+			if err != nil {
+				return err
+			}
+			fmt.Println(code.Code)
+			return nil
+		},
+	}
+}
+
+// askpassEntry returns the key of the host in the [askpass] table: the one
+// of its name, or else of the longest pattern matching it.
+func askpassEntry(hosts map[string]string, host string) (string, bool) {
+	if filter, ok := hosts[host]; ok {
+		return filter, true
+	}
+	var best string
+	for pattern := range hosts {
+		if ok, _ := path.Match(pattern, host); ok && (len(pattern) > len(best) || len(pattern) == len(best) && pattern < best) {
+			best = pattern
+		}
+	}
+	filter, ok := hosts[best]
+	return filter, ok && best != ""
+}
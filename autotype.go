@@ -0,0 +1,49 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// typeText types the text into the focused window: with System Events on
+// macOS, wtype on Wayland, and else xdotool. The text is given on the
+// standard input, not in the arguments.
+func typeText(text string) error {
+	var cmd *exec.Cmd
+	switch {
+	case runtime.GOOS == "darwin":
+		r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+		cmd = exec.Command("osascript", "-")
+		cmd.Stdin = strings.NewReader(`tell application "System Events" to keystroke "` + r.Replace(text) + `"`)
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		cmd = exec.Command("wtype", "-")
+		cmd.Stdin = strings.NewReader(text)
+	default:
+		if _, err := exec.LookPath("xdotool"); err != nil {
+			return errors.New("no command to type with; install xdotool, or wtype on Wayland")
+		}
+		cmd = exec.Command("xdotool", "type", "--clearmodifiers", "--file", "-")
+		cmd.Stdin = strings.NewReader(text)
+	}
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procSendInput = user32.NewProc("SendInput")
+
+const (
+	inputKeyboard    = 1
+	keyeventfKeyUp   = 0x0002
+	keyeventfUnicode = 0x0004
+)
+
+// keyboardInput is an INPUT of type INPUT_KEYBOARD. The padding makes up
+// for MOUSEINPUT, the largest member of its union.
+type keyboardInput struct {
+	typ uint32
+	ki  keybdInput
+	_   [8]byte
+}
+
+type keybdInput struct {
+	vk, scan    uint16
+	flags, time uint32
+	extraInfo   uintptr
+}
+
+// typeText types the text into the focused window, as Unicode key presses
+// that do not depend on the keyboard layout.
+func typeText(text string) error {
+	units, err := windows.UTF16FromString(text)
+	if err != nil {
+		return err
+	}
+	units = units[:len(units)-1]
+	if len(units) == 0 {
+		return nil
+	}
+	inputs := make([]keyboardInput, 0, 2*len(units))
+	for _, u := range units {
+		inputs = append(inputs,
+			keyboardInput{typ: inputKeyboard, ki: keybdInput{scan: u, flags: keyeventfUnicode}},
+			keyboardInput{typ: inputKeyboard, ki: keybdInput{scan: u, flags: keyeventfUnicode | keyeventfKeyUp}})
+	}
+	n, _, err := procSendInput.Call(uintptr(len(inputs)), uintptr(unsafe.Pointer(&inputs[0])), unsafe.Sizeof(inputs[0]))
+	if int(n) != len(inputs) {
+		return err
+	}
+	return nil
+}
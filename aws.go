@@ -0,0 +1,256 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// awsCacheMargin is how long before they expire cached session credentials
+// are replaced.
+const awsCacheMargin = 5 * time.Minute
+
+// awsProcessCredentials are the output of credential_process.
+type awsProcessCredentials struct {
+	Version         int       `json:"Version"`
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"SessionToken"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func awsCommand() cli.Command {
+	return cli.Command{
+		Name:  "aws",
+		Usage: "print AWS session credentials for credential_process, with the code of the MFA device",
+		Description: `otp calls STS GetSessionToken with the current code of the key matching
+   --filter, which is ISSUER/ACCOUNT or part of the issuer or the account name
+   of exactly one key, and prints the credentials in the JSON format of
+   credential_process. The long-term credentials come from the
+   AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, or
+   from --source-profile in the shared credentials file. In ~/.aws/config:
+
+     [profile mfa]
+     credential_process = otp aws --serial arn:aws:iam::123456789012:mfa/me --filter AWS --source-profile default
+
+   The session credentials are cached, in the runtime directory where there
+   is one, until a few minutes before they expire, as a code cannot be used
+   twice and the AWS CLI runs credential_process for every command.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "serial",
+				Usage:  "ARN of the MFA device",
+				EnvVar: "OTP_AWS_SERIAL",
+			},
+			cli.StringFlag{
+				Name:  "filter",
+				Usage: "ISSUER/ACCOUNT, or part of the issuer or account name, of the key of the MFA device",
+			},
+			cli.StringFlag{
+				Name:  "source-profile",
+				Usage: "profile of the shared credentials file with the long-term credentials, instead of the environment",
+			},
+			cli.DurationFlag{
+				Name:  "duration",
+				Value: 12 * time.Hour,
+				Usage: "how long the session credentials last, from 15m to 36h",
+			},
+			cli.StringFlag{
+				Name:  "region",
+				Usage: "region of the STS endpoint; AWS_REGION by default",
+			},
+			cli.StringFlag{
+				Name:  "endpoint",
+				Usage: "STS endpoint, for other partitions and compatible services",
+			},
+			cli.BoolTFlag{
+				Name:  "cache",
+				Usage: "reuse the session credentials until they are about to expire; --cache=false always asks STS",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			serial, filter := c.String("serial"), c.String("filter")
+			switch {
+			case serial == "":
+				return errors.New("--serial is missing")
+			case filter == "":
+				return errors.New("--filter is missing")
+			}
+			var (
+				creds awsCredentials
+				err   error
+			)
+			if profile := c.String("source-profile"); profile != "" {
+				creds, err = awsCredentialsFromProfile(profile, c.String("region"))
+			} else {
+				creds, err = awsCredentialsFromEnv(c.String("region"))
+			}
+			if err != nil {
+				return err
+			}
+
+			sum := sha256.Sum256([]byte(creds.accessKey + "\x00" + serial))
+			name := "aws-" + hex.EncodeToString(sum[:8]) + ".json"
+			fn := filepath.Join(configDir, name)
+			if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+				fn = filepath.Join(dir, "otp-"+name)
+			}
+			var out awsProcessCredentials
+			if data, err := os.ReadFile(fn); c.BoolT("cache") && err == nil && json.Unmarshal(data, &out) == nil && time.Until(out.Expiration) > awsCacheMargin {
+				return json.NewEncoder(os.Stdout).Encode(out)
+			}
+
+			code, err := codeFor(c, filter)
+			if err != nil {
+				return err
+			}
+			out, err = getSessionToken(creds, c.String("endpoint"), serial, code.Code, c.Duration("duration"))
+			if err != nil {
+				return err
+			}
+			if data, err := json.Marshal(out); err == nil && c.BoolT("cache") {
+				// A cache that cannot be written only costs a code.
+				writeFileAtomic(fn, data, 0o600)
+			}
+			return json.NewEncoder(os.Stdout).Encode(out)
+		},
+	}
+}
+
+// getSessionToken calls STS GetSessionToken with the code of the MFA device.
+func getSessionToken(creds awsCredentials, endpoint, serial, code string, duration time.Duration) (awsProcessCredentials, error) {
+	if endpoint == "" {
+		endpoint = "https://sts." + creds.region + ".amazonaws.com/"
+	}
+	body := []byte(url.Values{
+		"Action":          {"GetSessionToken"},
+		"Version":         {"2011-06-15"},
+		"SerialNumber":    {serial},
+		"TokenCode":       {code},
+		"DurationSeconds": {strconv.Itoa(int(duration.Seconds()))},
+	}.Encode())
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return awsProcessCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	creds.sign(req, body, "sts", time.Now().UTC())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return awsProcessCredentials{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return awsProcessCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &failure) == nil && failure.Code != "" {
+			return awsProcessCredentials{}, fmt.Errorf("STS request failed: %s: %s", failure.Code, failure.Message)
+		}
+		return awsProcessCredentials{}, fmt.Errorf("STS request failed: %s", resp.Status)
+	}
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"GetSessionTokenResult>Credentials"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return awsProcessCredentials{}, fmt.Errorf("invalid STS response: %w", err)
+	}
+	rc := result.Credentials
+	if rc.AccessKeyID == "" {
+		return awsProcessCredentials{}, errors.New("invalid STS response: credentials are missing")
+	}
+	return awsProcessCredentials{
+		Version:         1,
+		AccessKeyID:     rc.AccessKeyID,
+		SecretAccessKey: rc.SecretAccessKey,
+		SessionToken:    rc.SessionToken,
+		Expiration:      rc.Expiration,
+	}, nil
+}
+
+// awsCredentialsFromProfile reads the credentials of a profile from the
+// shared credentials file, AWS_SHARED_CREDENTIALS_FILE or
+// ~/.aws/credentials.
+func awsCredentialsFromProfile(profile, region string) (awsCredentials, error) {
+	fn := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if fn == "" {
+		fn = filepath.Join(homeDir, ".aws", "credentials")
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == profile:
+			if k, v, ok := strings.Cut(line, "="); ok {
+				values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, err
+	}
+	creds := awsCredentials{
+		region:       region,
+		accessKey:    values["aws_access_key_id"],
+		secretKey:    values["aws_secret_access_key"],
+		sessionToken: values["aws_session_token"],
+	}
+	if creds.region == "" {
+		creds.region = cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return awsCredentials{}, fmt.Errorf("profile %s of %s has no aws_access_key_id and aws_secret_access_key", profile, fn)
+	}
+	return creds, nil
+}
@@ -0,0 +1,423 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"modernc.org/sqlite"
+)
+
+// encryptedBackupMagic prefixes backups protected with --encrypt.
+const encryptedBackupMagic = "OTPBACKUP1\n"
+
+func backup() cli.Command {
+	return cli.Command{
+		Name:  "backup",
+		Usage: "take a consistent snapshot of the OTP database",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "out",
+				Usage: "backup file or directory (default: next to the database)",
+			},
+			cli.BoolFlag{
+				Name:  "encrypt",
+				Usage: "encrypt the whole backup with the private key",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			fn, err := sqlitePath(c)
+			if err != nil {
+				return err
+			}
+			db, err := openreadonly(fn)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			out := backupName(fn, time.Now(), c.Bool("encrypt"))
+			if dst := c.String("out"); dst != "" {
+				if fi, err := os.Stat(dst); err == nil && fi.IsDir() || os.IsPathSeparator(dst[len(dst)-1]) {
+					out = filepath.Join(dst, filepath.Base(out))
+				} else {
+					out = dst
+				}
+			}
+
+			if !c.Bool("encrypt") {
+				if err := snapshot(db, out); err != nil {
+					return err
+				}
+				log.Println("database backed up to", out)
+				return nil
+			}
+
+			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+			tmp, err := os.MkdirTemp("", "otp-backup")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmp)
+			plain := filepath.Join(tmp, "auth.db")
+			if err := snapshot(db, plain); err != nil {
+				return err
+			}
+			data, err := os.ReadFile(plain)
+			if err != nil {
+				return err
+			}
+			sealed, err := priv.seal(encryptedBackupMagic, data)
+			if err != nil {
+				return err
+			}
+			if err := writeFileAtomic(out, sealed, 0o600); err != nil {
+				return err
+			}
+			log.Println("database backed up to", out)
+			return nil
+		},
+	}
+}
+
+// backupName derives a timestamped file name for a backup of the database.
+func backupName(dbfn string, t time.Time, encrypted bool) string {
+	ext := filepath.Ext(dbfn)
+	name := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(dbfn, ext), t.Format("20060102-150405.000"), ext)
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// autobackup snapshots the store into the backups directory ahead of a
+// destructive operation, keeping only the most recent backups. Stores that
+// cannot be snapshotted locally are not backed up.
+func autobackup(c *cli.Context, s store) error {
+	keep := c.GlobalInt("backup-keep")
+	snap, ok := basestore(s).(snapshotter)
+	if keep <= 0 || !ok {
+		return nil
+	}
+	fn := storePath(c)
+	dir := c.GlobalString("backup-dir")
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(fn), "otp-backups")
+	}
+	out := filepath.Join(dir, filepath.Base(backupName(fn, time.Now(), false)))
+	if err := snap.Snapshot(out); err != nil {
+		return fmt.Errorf("cannot take automatic backup: %w", err)
+	}
+
+	ext := filepath.Ext(fn)
+	pattern := strings.TrimSuffix(filepath.Base(fn), ext) + "-*" + ext
+	backups, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.RemoveAll(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// snapshot copies the database into the given file with SQLite's online
+// backup API, so the copy is consistent even if another process is writing
+// to the database. The destination file is replaced atomically.
+func snapshot(db *sql.DB, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn any) error {
+		backuper, ok := driverConn.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("database driver does not support online backups")
+		}
+		bck, err := backuper.NewBackup(tmp)
+		if err != nil {
+			return err
+		}
+		for more := true; more; {
+			more, err = bck.Step(-1)
+			if err != nil {
+				bck.Finish()
+				return err
+			}
+		}
+		return bck.Finish()
+	})
+	if err != nil {
+		return fmt.Errorf("cannot back up database: %w", err)
+	}
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// seal encrypts the data with a random AES-256-GCM key, which is in turn
+// encrypted with the public key. The result starts with magic, which
+// identifies the kind of data that was sealed.
+func (p privkey) seal(magic string, data []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := p.encrypted(key, []byte(magic))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(len(wrapped)))
+	buf.Write(wrapped)
+	buf.Write(nonce)
+	buf.Write(aead.Seal(nil, nonce, data, []byte(magic)))
+	return buf.Bytes(), nil
+}
+
+// unseal reverses seal.
+func (p privkey) unseal(magic string, sealed []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(sealed, []byte(magic))
+	if !ok || len(rest) < 2 {
+		return nil, errors.New("not sealed data")
+	}
+	n := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < n {
+		return nil, errors.New("truncated sealed data")
+	}
+	key, err := p.decrypted(rest[:n], []byte(magic))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt key: %w", err)
+	}
+	rest = rest[n:]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("truncated sealed data")
+	}
+	data, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(magic))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt: %s", err)
+	}
+	return data, nil
+}
+
+func restore() cli.Command {
+	return cli.Command{
+		Name:      "restore",
+		Usage:     "replace the OTP database with a backup",
+		ArgsUsage: "`backup-file`",
+		Action: func(c *cli.Context) error {
+			src := c.Args().First()
+			if src == "" {
+				return errors.New("backup file is missing")
+			}
+			fn, err := sqlitePath(c)
+			if err != nil {
+				return err
+			}
+
+			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			if bytes.HasPrefix(data, []byte(encryptedBackupMagic)) {
+				data, err = priv.unseal(encryptedBackupMagic, data)
+				if err != nil {
+					return fmt.Errorf("invalid encrypted backup: %w", err)
+				}
+			}
+
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			staged := fn + ".restore"
+			defer func() {
+				for _, suffix := range []string{"", "-wal", "-shm"} {
+					os.Remove(staged + suffix)
+				}
+			}()
+			if err := os.WriteFile(staged, data, 0o600); err != nil {
+				return err
+			}
+			count, err := validateBackup(staged, priv)
+			if err != nil {
+				return fmt.Errorf("invalid backup %s: %w", src, err)
+			}
+
+			if live, err := openstore(c, true); err == nil {
+				err := autobackup(c, live)
+				live.Close()
+				if err != nil {
+					return err
+				}
+			}
+
+			old := fn + ".old"
+			_, err = os.Stat(fn)
+			replaced := err == nil
+			// rollback puts the old database, and the write-ahead log moved
+			// with it, back in place when it cannot be replaced.
+			var moved []string
+			rollback := func(err error) error {
+				for _, name := range moved {
+					os.Rename(old+strings.TrimPrefix(name, fn), name)
+				}
+				return err
+			}
+			if replaced {
+				if err := os.Rename(fn, old); err != nil {
+					return err
+				}
+				moved = append(moved, fn)
+				// A write-ahead log left behind belongs to the old database
+				// and must not be replayed on top of the restored one.
+				for _, suffix := range []string{"-wal", "-shm"} {
+					os.Remove(old + suffix)
+					err := os.Rename(fn+suffix, old+suffix)
+					if errors.Is(err, os.ErrNotExist) {
+						continue
+					} else if err != nil {
+						return rollback(err)
+					}
+					moved = append(moved, fn+suffix)
+				}
+			}
+			if err := os.Rename(staged, fn); err != nil {
+				return rollback(err)
+			}
+			log.Printf("database restored from %s: %d keys", src, count)
+			if replaced {
+				log.Println("previous database kept at", old)
+			}
+			return nil
+		},
+	}
+}
+
+// validateBackup checks that the backup is a sound database whose entries
+// can be decrypted with the private key, returning the number of entries.
+func validateBackup(fn string, priv *privkey) (int, error) {
+	db, err := sqlopenro(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case version == 0:
+		return 0, errors.New("not an OTP database")
+	case version > len(migrations):
+		return 0, fmt.Errorf("schema version %d is newer than the supported version %d", version, len(migrations))
+	}
+	problems, err := integrityCheck(db)
+	if err != nil {
+		return 0, err
+	}
+	if len(problems) > 0 {
+		return 0, errors.New(problems[0])
+	}
+
+	names := &namesStore{base: newsqlitestore(db), priv: priv}
+	entries, err := names.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if _, err := priv.legacySecret(e); err != nil {
+			return 0, fmt.Errorf("cannot decrypt key for account %q of issuer %q with the current private key", e.Account, e.Issuer)
+		}
+	}
+	return len(entries), nil
+}
+
+// writeFileAtomic writes the file next to its final location and then
+// renames it into place.
+func writeFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0o700); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	defer os.Remove(tmp)
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
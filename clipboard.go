@@ -0,0 +1,66 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// clipboardCommands returns the commands that write and read the clipboard:
+// pbcopy on macOS, wl-copy on Wayland, and else xclip or xsel.
+func clipboardCommands(clear bool) (write, read []string, err error) {
+	switch {
+	case runtime.GOOS == "darwin":
+		return []string{"pbcopy"}, []string{"pbpaste"}, nil
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		if clear {
+			return []string{"wl-copy", "--clear"}, []string{"wl-paste", "--no-newline"}, nil
+		}
+		return []string{"wl-copy"}, []string{"wl-paste", "--no-newline"}, nil
+	}
+	if _, err := exec.LookPath("xclip"); err == nil {
+		return []string{"xclip", "-selection", "clipboard", "-in"}, []string{"xclip", "-selection", "clipboard", "-out"}, nil
+	}
+	if _, err := exec.LookPath("xsel"); err == nil {
+		return []string{"xsel", "--clipboard", "--input"}, []string{"xsel", "--clipboard", "--output"}, nil
+	}
+	return nil, nil, errors.New("no clipboard command; install wl-clipboard, xclip or xsel")
+}
+
+func writeClipboard(text string) error {
+	args, _, err := clipboardCommands(text == "")
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
+
+func readClipboard() (string, error) {
+	_, args, err := clipboardCommands(false)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	return string(bytes.TrimSuffix(out, []byte("\n"))), err
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+func compact() cli.Command {
+	return cli.Command{
+		Name:  "compact",
+		Usage: "reclaim unused space in the OTP database",
+		Action: func(c *cli.Context) error {
+			fn, err := sqlitePath(c)
+			if err != nil {
+				return err
+			}
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			db, err := opendb(fn)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			before := dbsize(fn)
+			if _, err := db.Exec("VACUUM;"); err != nil {
+				return err
+			}
+			if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+				return err
+			}
+			after := dbsize(fn)
+			log.Printf("database compacted from %d to %d bytes: %d bytes reclaimed", before, after, before-after)
+			return nil
+		},
+	}
+}
+
+// dbsize reports the space used by the database, including its write-ahead
+// log.
+func dbsize(fn string) int64 {
+	var size int64
+	for _, f := range []string{fn, fn + "-wal"} {
+		if fi, err := os.Stat(f); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
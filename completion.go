@@ -0,0 +1,165 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/urfave/cli"
+)
+
+var completionScripts = map[string]string{
+	"bash": `_otp_complete() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" word line
+	local -a args=()
+	for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+		# drop the quoting of names like Git\ Hub, unless it could run something
+		[[ $word == *[\;\&\|\<\>\$\(\)]* || $word == *$'\x60'* ]] || eval "word=$word" 2>/dev/null
+		args+=("$word")
+	done
+	COMPREPLY=()
+	while IFS= read -r line; do
+		[[ $line == "$cur"* ]] && COMPREPLY+=("$(printf '%q' "$line")")
+	done < <("${COMP_WORDS[0]}" "${args[@]}" --generate-bash-completion 2>/dev/null)
+}
+complete -o default -F _otp_complete otp
+`,
+	"zsh": `#compdef otp
+_otp() {
+	local -a candidates
+	candidates=("${(@f)$(${(Q)words[1]} ${(Q)words[2,CURRENT-1]} --generate-bash-completion 2>/dev/null)}")
+	compadd -a candidates
+}
+compdef _otp otp
+`,
+	"fish": `function __otp_complete
+	set -l args (commandline -opc)
+	set -l cmd $args[1]
+	set -e args[1]
+	$cmd $args --generate-bash-completion 2>/dev/null
+end
+complete -c otp -f -a '(__otp_complete)'
+`,
+	"powershell": `Register-ArgumentCompleter -Native -CommandName otp -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$words = @($commandAst.CommandElements | ForEach-Object {
+		if ($_ -is [System.Management.Automation.Language.StringConstantExpressionAst]) { $_.Value } else { $_.Extent.Text }
+	})
+	if ($wordToComplete -ne '') { $words = $words[0..($words.Count - 2)] }
+	$rest = if ($words.Count -gt 1) { $words[1..($words.Count - 1)] } else { @() }
+	& $words[0] @rest --generate-bash-completion 2>$null | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+		$text = if ($_ -match '\s') { "'" + ($_ -replace "'", "''") + "'" } else { $_ }
+		[System.Management.Automation.CompletionResult]::new($text, $_, 'ParameterValue', $_)
+	}
+}
+`,
+}
+
+func completion() cli.Command {
+	return cli.Command{
+		Name:      "completion",
+		Usage:     "print the shell completion script",
+		ArgsUsage: "bash|zsh|fish|powershell",
+		Description: `The scripts complete the commands, and the issuers and account names of the
+   store for get, rm, grant, revoke and recipients. Load them with:
+
+     bash:       source <(otp completion bash)
+     zsh:        source <(otp completion zsh)
+     fish:       otp completion fish | source
+     powershell: otp completion powershell | Out-String | Invoke-Expression`,
+		Action: func(c *cli.Context) error {
+			shell := c.Args().First()
+			if shell == "" {
+				return errors.New("shell is missing")
+			}
+			script, ok := completionScripts[shell]
+			if !ok {
+				return fmt.Errorf("unknown shell %q", shell)
+			}
+			fmt.Print(script)
+			return nil
+		},
+	}
+}
+
+// completeEntries completes the issuer and account-name arguments shared by
+// rm, grant, revoke and recipients.
+func completeEntries(c *cli.Context) {
+	var names []string
+	for _, e := range completionEntries(c) {
+		switch c.NArg() {
+		case 0:
+			names = append(names, e.Issuer)
+		case 1:
+			if e.Issuer == c.Args().First() {
+				names = append(names, e.Account)
+			}
+		}
+	}
+	printCandidates(names)
+}
+
+// completeFilter completes the filter of get with both issuers and account
+// names.
+func completeFilter(c *cli.Context) {
+	if c.NArg() > 0 {
+		return
+	}
+	var names []string
+	for _, e := range completionEntries(c) {
+		names = append(names, e.Issuer, e.Account)
+	}
+	printCandidates(names)
+}
+
+func printCandidates(names []string) {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			fmt.Println(name)
+		}
+	}
+}
+
+// completionEntries lists the names in the store. Completion runs without the
+// Before hooks, so the configuration file is applied here; errors are dropped,
+// as anything printed would end up among the candidates of the shell.
+func completionEntries(c *cli.Context) []entry {
+	if c.GlobalString("remote") != "" {
+		return nil
+	}
+	if err := applyConfig(c.Parent()); err != nil {
+		return nil
+	}
+	s, err := openstore(c, false)
+	if err != nil {
+		return nil
+	}
+	defer s.Close()
+	entries, err := s.List()
+	if err != nil {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Issuer != entries[j].Issuer {
+			return entries[i].Issuer < entries[j].Issuer
+		}
+		return entries[i].Account < entries[j].Account
+	})
+	return entries
+}
@@ -0,0 +1,293 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// config holds the settings read from the configuration file. Settings are
+// named after the global flags they provide defaults for.
+type config struct {
+	Settings map[string]string
+
+	// Profiles are named sets of settings, so unrelated sets of tokens can
+	// be kept in isolated stores.
+	Profiles map[string]map[string]string
+
+	// Commands are the settings of the flags of each command, in tables
+	// named after the commands.
+	Commands map[string]map[string]string
+}
+
+// loadConfig reads the configuration file. A missing file is not an error
+// and yields an empty configuration.
+func loadConfig(fn string) (*config, error) {
+	cfg := &config{
+		Settings: make(map[string]string),
+		Profiles: make(map[string]map[string]string),
+		Commands: make(map[string]map[string]string),
+	}
+	fd, err := os.Open(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read configuration file: %s", err)
+	}
+	defer fd.Close()
+
+	sections, err := parseConfig(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %s", fn, err)
+	}
+	for name, kv := range sections {
+		for k, v := range kv {
+			kv[k] = expandHome(v)
+		}
+		if name == "" {
+			cfg.Settings = kv
+			continue
+		}
+		profname, ok := strings.CutPrefix(name, "profiles.")
+		if !ok {
+			cfg.Commands[name] = kv
+			continue
+		}
+		cfg.Profiles[profname] = kv
+	}
+	return cfg, nil
+}
+
+// parseConfig understands the subset of TOML used by the configuration file:
+// comments, [tables], and key = value pairs whose values are strings,
+// integers or booleans. Keys outside of any table belong to the "" section.
+func parseConfig(r io.Reader) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{"": {}}
+	current := ""
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated table header", lineno)
+			}
+			current = strings.TrimSpace(line[1:end])
+			current = strings.ReplaceAll(current, `"`, "")
+			if _, ok := sections[current]; !ok {
+				sections[current] = make(map[string]string)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		v, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		sections[current][key] = v
+	}
+	return sections, scanner.Err()
+}
+
+// parseConfigValue parses the value of a key = value pair. Comments start
+// with a # outside of quotes.
+func parseConfigValue(v string) (string, error) {
+	var (
+		value string
+		err   error
+	)
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := closingQuote(v)
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		if value, err = strconv.Unquote(v[:end+1]); err != nil {
+			return "", err
+		}
+		v = v[end+1:]
+	case strings.HasPrefix(v, "'"):
+		end := strings.Index(v[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		value, v = v[1:end+1], v[end+2:]
+	default:
+		if i := strings.Index(v, "#"); i >= 0 {
+			v = v[:i]
+		}
+		value, v = strings.TrimSpace(v), ""
+		if value == "" {
+			return "", errors.New("missing value")
+		}
+	}
+	if v = strings.TrimSpace(v); v != "" && !strings.HasPrefix(v, "#") {
+		return "", fmt.Errorf("unexpected %q after value", v)
+	}
+	return value, nil
+}
+
+// closingQuote returns the index of the quote that ends the basic string at
+// the start of v, skipping escaped quotes, or -1 if it is unterminated.
+func closingQuote(v string) int {
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// commandSettings are the settings that are not global flags, but defaults
+// for the flag of a command.
+var commandSettings = map[string]struct{ command, flag string }{
+	"output-format":     {"list", "format"},
+	"clipboard-timeout": {"tray", "clear"},
+}
+
+// globalSettings returns the settings without the ones of commandSettings.
+func globalSettings(settings map[string]string) map[string]string {
+	global := make(map[string]string, len(settings))
+	for k, v := range settings {
+		if _, ok := commandSettings[k]; !ok {
+			global[k] = v
+		}
+	}
+	return global
+}
+
+// applyConfig uses the configuration file, and the selected profile within
+// it, as the defaults for the global flags. Explicitly set flags and
+// environment variables take precedence over both.
+func applyConfig(c *cli.Context) error {
+	cfg, err := loadConfig(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	for event := range cfg.Commands["hooks"] {
+		if !hookEvents[event] {
+			return fmt.Errorf("invalid configuration file %s: unknown hook %q", c.String("config"), event)
+		}
+	}
+	for name := range cfg.Commands {
+		if name != "hooks" && c.App.Command(name) == nil {
+			return fmt.Errorf("invalid configuration file %s: unknown table %q", c.String("config"), name)
+		}
+	}
+	// Tell the flags the user set before applying any setting: the ones
+	// set from the configuration file count as set afterwards, and the
+	// profile could not override them.
+	explicit := explicitFlags(c, c.GlobalFlagNames())
+	apply := func(settings map[string]string) error {
+		return applySettings(c, explicit, globalSettings(settings))
+	}
+
+	if err := apply(cfg.Settings); err != nil {
+		return err
+	}
+	name := c.String("profile")
+	if name == "" {
+		return nil
+	}
+	prof, ok := cfg.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	if _, ok := prof["profile"]; ok {
+		return fmt.Errorf("profile %q cannot select another profile", name)
+	}
+	return apply(prof)
+}
+
+// applyCommandConfig uses the table of the command in the configuration file
+// as the defaults for the flags of the command, on top of the commandSettings
+// of the configuration and of the selected profile. It is meant to be the
+// Before of the commands whose flags can be configured.
+func applyCommandConfig(c *cli.Context) error {
+	cfg, err := loadConfig(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]string)
+	for _, kv := range []map[string]string{cfg.Settings, cfg.Profiles[c.GlobalString("profile")]} {
+		for k, v := range kv {
+			if s, ok := commandSettings[k]; ok && s.command == c.Command.Name {
+				settings[s.flag] = v
+			}
+		}
+	}
+	for k, v := range cfg.Commands[c.Command.Name] {
+		settings[k] = v
+	}
+	return applySettings(c, explicitFlags(c, c.FlagNames()), settings)
+}
+
+// explicitFlags tells which of the flags were set on the command line or by
+// their environment variables.
+func explicitFlags(c *cli.Context, names []string) map[string]bool {
+	explicit := make(map[string]bool)
+	for _, name := range names {
+		explicit[name] = c.IsSet(name)
+	}
+	return explicit
+}
+
+// applySettings sets the flags to the settings, unless they were set
+// explicitly.
+func applySettings(c *cli.Context, explicit map[string]bool, settings map[string]string) error {
+	for k, v := range settings {
+		isSet, ok := explicit[k]
+		switch {
+		case !ok, k == "config":
+			return fmt.Errorf("unknown configuration setting %q", k)
+		case isSet:
+			continue
+		}
+		if err := c.Set(k, v); err != nil {
+			return fmt.Errorf("invalid configuration setting %q: %s", k, err)
+		}
+	}
+	return nil
+}
+
+func expandHome(fn string) string {
+	if fn == "~" {
+		return homeDir
+	}
+	if len(fn) > 1 && fn[0] == '~' && os.IsPathSeparator(fn[1]) {
+		return filepath.Join(homeDir, fn[2:])
+	}
+	return fn
+}
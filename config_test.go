@@ -0,0 +1,263 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]map[string]string
+		wantErr string
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: map[string]map[string]string{"": {}},
+		},
+		{
+			name: "comments and blank lines",
+			in:   "# otp\n\n  # indented\ndb = \"otp.db\" # trailing\n",
+			want: map[string]map[string]string{"": {"db": "otp.db"}},
+		},
+		{
+			name: "basic strings",
+			in:   `a = "x \"y\" # z"` + "\n" + `b = "tab\tand \\ and \u00e9"` + "\n" + `c = ""`,
+			want: map[string]map[string]string{"": {"a": `x "y" # z`, "b": "tab\tand \\ and é", "c": ""}},
+		},
+		{
+			name: "literal strings",
+			in:   `a = 'C:\otp\#db' # comment` + "\n" + `b = 'say "hi"'`,
+			want: map[string]map[string]string{"": {"a": `C:\otp\#db`, "b": `say "hi"`}},
+		},
+		{
+			name: "bare values",
+			in:   "keep = 10 # backups\nread-only = true\nurl = a=b",
+			want: map[string]map[string]string{"": {"keep": "10", "read-only": "true", "url": "a=b"}},
+		},
+		{
+			name: "quoted keys",
+			in:   `"db" = x`,
+			want: map[string]map[string]string{"": {"db": "x"}},
+		},
+		{
+			name: "tables",
+			in:   "db = a\n[profiles.work]\ndb = b\n[ \"profiles.home\" ] # comment\ndb = c\n[list]\nformat = json\n[profiles.work]\nprivate-key = k",
+			want: map[string]map[string]string{
+				"":              {"db": "a"},
+				"profiles.work": {"db": "b", "private-key": "k"},
+				"profiles.home": {"db": "c"},
+				"list":          {"format": "json"},
+			},
+		},
+		{
+			name: "last value wins",
+			in:   "db = a\ndb = b",
+			want: map[string]map[string]string{"": {"db": "b"}},
+		},
+		{name: "unterminated table", in: "[list\nformat = json", wantErr: "line 1: unterminated table header"},
+		{name: "missing equals", in: "db = a\ndb", wantErr: "line 2: expected key = value"},
+		{name: "unterminated basic string", in: `db = "otp.db`, wantErr: "line 1: unterminated string"},
+		{name: "unterminated escaped quote", in: `db = "otp.db\"`, wantErr: "line 1: unterminated string"},
+		{name: "unterminated literal string", in: `db = 'otp.db`, wantErr: "line 1: unterminated string"},
+		{name: "missing value", in: "db =", wantErr: "line 1: missing value"},
+		{name: "only a comment", in: "db = # none", wantErr: "line 1: missing value"},
+		{name: "trailing text", in: `db = "a" b`, wantErr: `line 1: unexpected "b" after value`},
+		{name: "invalid escape", in: `db = "\q"`, wantErr: "line 1:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := loadConfig(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatalf("loadConfig(missing file): %v", err)
+	}
+	if len(cfg.Settings) != 0 || len(cfg.Profiles) != 0 || len(cfg.Commands) != 0 {
+		t.Errorf("loadConfig(missing file) = %+v, want an empty configuration", cfg)
+	}
+
+	fn := filepath.Join(dir, "config")
+	data := "db = \"~/otp.db\"\n[profiles.work]\ndb = work.db\n[list]\nformat = json\n"
+	if err := os.WriteFile(fn, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config{
+		Settings: map[string]string{"db": filepath.Join(homeDir, "otp.db")},
+		Profiles: map[string]map[string]string{"work": {"db": "work.db"}},
+		Commands: map[string]map[string]string{"list": {"format": "json"}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loadConfig() = %+v, want %+v", cfg, want)
+	}
+
+	if err := os.WriteFile(fn, []byte("db = \"otp.db"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(fn); err == nil || !strings.Contains(err.Error(), fn) {
+		t.Errorf("loadConfig(invalid file) error = %v, want one naming the file", err)
+	}
+}
+
+// runConfigApp runs the list command of an app with a --db and --profile
+// configured by the file, and returns the values of --db and of the --format
+// of list.
+func runConfigApp(t *testing.T, fn string, args ...string) (db, format string, err error) {
+	t.Helper()
+	app := cli.NewApp()
+	app.Writer, app.ErrWriter = io.Discard, io.Discard
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "db", Value: "default.db", EnvVar: "OTP_DB"},
+		cli.StringFlag{Name: "config", Value: fn},
+		cli.StringFlag{Name: "profile", EnvVar: "OTP_PROFILE"},
+	}
+	app.Before = applyConfig
+	app.Commands = []cli.Command{{
+		Name:   "list",
+		Flags:  []cli.Flag{cli.StringFlag{Name: "format", Value: "text"}},
+		Before: applyCommandConfig,
+		Action: func(c *cli.Context) error {
+			db, format = c.GlobalString("db"), c.String("format")
+			return nil
+		},
+	}}
+	err = app.Run(append([]string{"otp"}, args...))
+	return db, format, err
+}
+
+func TestApplyConfig(t *testing.T) {
+	for _, env := range []string{"OTP_DB", "OTP_PROFILE"} {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	fn := filepath.Join(t.TempDir(), "config")
+	data := `db = config.db
+output-format = json
+
+[profiles.work]
+db = work.db
+output-format = csv
+
+[list]
+format = yaml
+`
+	if err := os.WriteFile(fn, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		args       []string
+		wantDB     string
+		wantFormat string
+	}{
+		{name: "config file", args: []string{"list"}, wantDB: "config.db", wantFormat: "yaml"},
+		{name: "profile", args: []string{"--profile", "work", "list"}, wantDB: "work.db", wantFormat: "yaml"},
+		{name: "profile from the environment", env: map[string]string{"OTP_PROFILE": "work"}, args: []string{"list"}, wantDB: "work.db", wantFormat: "yaml"},
+		{name: "environment over config file", env: map[string]string{"OTP_DB": "env.db"}, args: []string{"list"}, wantDB: "env.db", wantFormat: "yaml"},
+		{name: "environment over profile", env: map[string]string{"OTP_DB": "env.db"}, args: []string{"--profile", "work", "list"}, wantDB: "env.db", wantFormat: "yaml"},
+		{name: "flag over environment", env: map[string]string{"OTP_DB": "env.db"}, args: []string{"--db", "flag.db", "--profile", "work", "list"}, wantDB: "flag.db", wantFormat: "yaml"},
+		{name: "command flag over config file", args: []string{"list", "--format", "text"}, wantDB: "config.db", wantFormat: "text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			db, format, err := runConfigApp(t, fn, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if db != tt.wantDB || format != tt.wantFormat {
+				t.Errorf("--db %q, list --format %q; want %q, %q", db, format, tt.wantDB, tt.wantFormat)
+			}
+		})
+	}
+
+	// Without the [list] table, output-format is the default of list
+	// --format, and the one of the profile overrides it.
+	data = strings.TrimSuffix(data, "[list]\nformat = yaml\n")
+	if err := os.WriteFile(fn, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, format, err := runConfigApp(t, fn, "list"); err != nil || format != "json" {
+		t.Errorf("list --format = %q, %v; want json", format, err)
+	}
+	if _, format, err := runConfigApp(t, fn, "--profile", "work", "list"); err != nil || format != "csv" {
+		t.Errorf("list --format of the profile = %q, %v; want csv", format, err)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		wantErr string
+	}{
+		{name: "unknown setting", config: "database = otp.db", wantErr: `unknown configuration setting "database"`},
+		{name: "config setting", config: "config = other", wantErr: `unknown configuration setting "config"`},
+		{name: "unknown setting of a profile", config: "[profiles.work]\ndatabase = otp.db", args: []string{"--profile", "work"}, wantErr: `unknown configuration setting "database"`},
+		{name: "unknown command flag", config: "[list]\nsort = name", wantErr: `unknown configuration setting "sort"`},
+		{name: "unknown table", config: "[lsit]\nformat = json", wantErr: `unknown table "lsit"`},
+		{name: "unknown hook", config: "[hooks]\npost-get = true", wantErr: `unknown hook "post-get"`},
+		{name: "unknown profile", config: "db = otp.db", args: []string{"--profile", "work"}, wantErr: `unknown profile "work"`},
+		{name: "nested profile", config: "[profiles.work]\nprofile = home", args: []string{"--profile", "work"}, wantErr: `profile "work" cannot select another profile`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(fn, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err := runConfigApp(t, fn, append(tt.args, "list")...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func credentialHelper() cli.Command {
+	return cli.Command{
+		Name:      "credential-helper",
+		Usage:     "answer the credential helper protocol of git with codes",
+		ArgsUsage: "get|store|erase",
+		Description: `otp reads key=value lines up to an empty line, and for get prints them back
+   with password=CODE and password_expiry_utc, when exactly one key matches:
+   issuer=ISSUER, or else host=HOST in the domain of the issuer regardless of
+   case, and username=ACCOUNT or account=ACCOUNT when given: the host of the
+   issuer example.com is example.com or one of its subdomains. With no match,
+   it prints nothing, so other helpers are asked. store and erase do nothing.
+   In ~/.gitconfig:
+
+     [credential "https://git.example.com"]
+       helper = !otp credential-helper
+
+   Issuers that are not domains, such as GitHub, match no host; their hosts,
+   and hosts elsewhere, such as gitlab.example.com for the issuer GitLab, are
+   mapped to the ISSUER/ACCOUNT, or part of it, of their key by the
+   [credential-helper] table of the configuration file, whose names can be
+   patterns, as in the [askpass] table:
+
+     [credential-helper]
+     "github.com" = "GitHub/alice"
+     "gitlab.example.com" = "GitLab/alice"
+     "*.corp.example.com" = "Corp/alice"`,
+		Action: func(c *cli.Context) error {
+			attrs, err := readCredentialAttrs(os.Stdin)
+			if err != nil {
+				return err
+			}
+			switch action := c.Args().First(); action {
+			case "get":
+			case "store", "erase":
+				return nil
+			case "":
+				return errors.New("action is missing")
+			default:
+				return fmt.Errorf("unknown action %q", action)
+			}
+
+			account := attrs.get("account", attrs.get("username", ""))
+			issuer, host := attrs.get("issuer", ""), attrs.get("host", "")
+			answer := func(code apiCode) error {
+				attrs.set("username", code.Account)
+				attrs.set("password", code.Code)
+				attrs.set("password_expiry_utc", fmt.Sprint(time.Now().Unix()+code.ExpiresIn))
+				return attrs.write(os.Stdout)
+			}
+			cfg, err := loadConfig(c.GlobalString("config"))
+			if err != nil {
+				return err
+			}
+			if filter, ok := askpassEntry(cfg.Commands["credential-helper"], credentialHostname(host)); ok && issuer == "" {
+				code, err := codeFor(c, filter)
+				if err != nil {
+					return err
+				}
+				return answer(code)
+			}
+
+			codes, _, err := loadCodes(c)
+			if err != nil {
+				return err
+			}
+			var found []apiCode
+			for _, code := range codes {
+				if account != "" && code.Account != account {
+					continue
+				}
+				ok := credentialHostMatches(host, code.Issuer)
+				if issuer != "" {
+					ok = code.Issuer == issuer
+				}
+				if ok {
+					found = append(found, code)
+				}
+			}
+			if len(found) > 1 {
+				return fmt.Errorf("%d keys match, pick one with username=ACCOUNT", len(found))
+			} else if len(found) == 0 {
+				return nil
+			}
+			return answer(found[0])
+		},
+	}
+}
+
+// credentialAttrs are the key=value lines of the credential helper
+// protocol, in their order. Keys ending in [] may repeat.
+type credentialAttrs [][2]string
+
+func readCredentialAttrs(r io.Reader) (credentialAttrs, error) {
+	var attrs credentialAttrs
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid credential line %q", line)
+		}
+		attrs = append(attrs, [2]string{k, v})
+	}
+	return attrs, scanner.Err()
+}
+
+func (attrs credentialAttrs) get(k, def string) string {
+	for _, kv := range attrs {
+		if kv[0] == k {
+			return kv[1]
+		}
+	}
+	return def
+}
+
+func (attrs *credentialAttrs) set(k, v string) {
+	for i, kv := range *attrs {
+		if kv[0] == k {
+			(*attrs)[i][1] = v
+			return
+		}
+	}
+	*attrs = append(*attrs, [2]string{k, v})
+}
+
+func (attrs credentialAttrs) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, kv := range attrs {
+		if strings.ContainsAny(kv[1], "\n\x00") {
+			return fmt.Errorf("%s has a newline", kv[0])
+		}
+		fmt.Fprintf(bw, "%s=%s\n", kv[0], kv[1])
+	}
+	return bw.Flush()
+}
+
+// credentialHostMatches tells whether the host is in the domain of the
+// issuer, regardless of case: the issuer example.com matches example.com and
+// git.example.com, but not example.com.evil.test nor badexample.com. Issuers
+// that are not domains match no host, as GitHub could be anyone's github.TLD.
+func credentialHostMatches(host, issuer string) bool {
+	host = strings.ToLower(strings.TrimSuffix(credentialHostname(host), "."))
+	issuer = strings.ToLower(strings.TrimSuffix(issuer, "."))
+	if host == "" || !strings.Contains(issuer, ".") || strings.ContainsAny(issuer, " /") {
+		return false
+	}
+	return host == issuer || strings.HasSuffix(host, "."+issuer)
+}
+
+// credentialHostname returns the host without its port.
+func credentialHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
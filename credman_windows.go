@@ -0,0 +1,108 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// keychainStoreLocation names where keychain stores are kept, for messages.
+const keychainStoreLocation = "Credential Manager"
+
+// credMaxBlob is the largest secret of a generic credential.
+const credMaxBlob = 5 * 512
+
+var (
+	advapi32      = windows.NewLazySystemDLL("advapi32.dll")
+	procCredRead  = advapi32.NewProc("CredReadW")
+	procCredWrite = advapi32.NewProc("CredWriteW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+// credential is the CREDENTIALW structure.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+func credTarget(name string) string {
+	return "otp-store:" + name
+}
+
+// readKeychainStore reads the generic credential of a keychain store,
+// failing with errNotFound when there is none.
+func readKeychainStore(name string) ([]byte, error) {
+	target, err := windows.UTF16PtrFromString(credTarget(name))
+	if err != nil {
+		return nil, err
+	}
+	var cred *credential
+	r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if errors.Is(err, windows.ERROR_NOT_FOUND) {
+			return nil, errNotFound
+		}
+		return nil, fmt.Errorf("cannot read credential %s: %w", credTarget(name), err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	return append([]byte(nil), unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)...), nil
+}
+
+// writeKeychainStore adds or replaces the generic credential of a keychain
+// store. It holds at most a few kilobytes, so only small stores fit.
+func writeKeychainStore(name string, data []byte) error {
+	if len(data) > credMaxBlob {
+		return fmt.Errorf("store %s takes %d bytes, more than the %d of a credential", name, len(data), credMaxBlob)
+	}
+	target, err := windows.UTF16PtrFromString(credTarget(name))
+	if err != nil {
+		return err
+	}
+	user, err := windows.UTF16PtrFromString("otp")
+	if err != nil {
+		return err
+	}
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(data)),
+		CredentialBlob:     unsafe.SliceData(data),
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if r, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return fmt.Errorf("cannot write credential %s: %w", credTarget(name), err)
+	}
+	return nil
+}
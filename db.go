@@ -0,0 +1,232 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// busyTimeout is how long a connection waits for another process to release
+// its lock on the database before failing with "database is locked".
+const busyTimeout = 5 * time.Second
+
+// sqlopen opens the database in WAL mode, so readers such as otp http do not
+// block, nor are blocked by, concurrent invocations of the CLI.
+func sqlopen(fn string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)", fn, busyTimeout.Milliseconds())
+	return sql.Open("sqlite", dsn)
+}
+
+// sqlopenro opens the database read-only, so the connection physically
+// cannot modify the store.
+func sqlopenro(fn string) (*sql.DB, error) {
+	// Relative paths would be taken for the host part of the URL.
+	fn, err := filepath.Abs(fn)
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(fn)}
+	if filepath.VolumeName(fn) != "" {
+		u.Path = "/" + u.Path
+	}
+	u.RawQuery = fmt.Sprintf("mode=ro&_pragma=busy_timeout(%d)", busyTimeout.Milliseconds())
+	return sql.Open("sqlite", u.String())
+}
+
+// migrations are the steps that build the database schema. The schema
+// version of a database is the number of steps applied to it, and it is
+// recorded in the schema_version table. Steps must never be changed once
+// released; schema changes go in new steps appended to the list.
+var migrations = [][]string{
+	{
+		"CREATE TABLE IF NOT EXISTS `otps` (`id` INTEGER PRIMARY KEY, `account` char, `issuer` char, `password` blob);",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `otps_account_issuer` ON `otps`(`account`, `issuer`);",
+	},
+	{
+		"CREATE TABLE IF NOT EXISTS `api_tokens` (`id` INTEGER PRIMARY KEY, `name` char, `hash` blob NOT NULL UNIQUE, `scope` char NOT NULL, `created` INTEGER NOT NULL, `expires` INTEGER NOT NULL);",
+	},
+	{
+		"CREATE TABLE IF NOT EXISTS `share_links` (`id` INTEGER PRIMARY KEY, `hash` blob NOT NULL UNIQUE, `account` char, `issuer` char, `expires` INTEGER NOT NULL);",
+	},
+}
+
+// schemaVersion reports how many migration steps were applied to the
+// database. Databases created before the schema_version table existed are
+// reported as version 1.
+func schemaVersion(db *sql.DB) (int, error) {
+	var tables int
+	err := db.QueryRow("SELECT COUNT(*) FROM `sqlite_master` WHERE `type` = 'table' AND `name` = 'schema_version';").Scan(&tables)
+	if err != nil {
+		return 0, err
+	}
+	if tables == 0 {
+		err := db.QueryRow("SELECT COUNT(*) FROM `sqlite_master` WHERE `type` = 'table' AND `name` = 'otps';").Scan(&tables)
+		return tables, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(`version`), 0) FROM `schema_version`;").Scan(&version)
+	return version, err
+}
+
+// migrate applies the pending migration steps, each in its own transaction.
+func migrate(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d; upgrade otp", version, len(migrations))
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS `schema_version` (`version` INTEGER NOT NULL);"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO `schema_version` (`version`) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM `schema_version`);", version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, q := range migrations[version] {
+			if _, err := tx.Exec(q); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("cannot migrate database to schema version %d: %w", version+1, err)
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM `schema_version`;"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO `schema_version` (`version`) VALUES (?);", version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropSchema drops the tables of the store, so it is rebuilt from scratch.
+// The API tokens and share links go with it, as they were issued for the
+// old store.
+func dropSchema(db *sql.DB) error {
+	queries := []string{
+		"DROP INDEX IF EXISTS `otps_account_issuer`;",
+		"DROP TABLE IF EXISTS `otps`;",
+		"DROP TABLE IF EXISTS `api_tokens`;",
+		"DROP TABLE IF EXISTS `share_links`;",
+		"DROP TABLE IF EXISTS `schema_version`;",
+	}
+
+	for _, q := range queries {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// opendb opens an initialized database, upgrading its schema if it was
+// created by an older version of otp.
+func opendb(fn string) (*sql.DB, error) {
+	if _, err := os.Stat(fn); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("database %s is %w", fn, errNotInitialized)
+	}
+	db, err := sqlopen(fn)
+	if err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	switch {
+	case version == 0:
+		db.Close()
+		return nil, fmt.Errorf("database %s is %w", fn, errNotInitialized)
+	case version < len(migrations):
+		if err := migrate(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		log.Printf("database %s upgraded from schema version %d to %d", fn, version, len(migrations))
+	case version > len(migrations):
+		db.Close()
+		return nil, fmt.Errorf("database schema version %d is newer than the supported version %d; upgrade otp", version, len(migrations))
+	}
+	return db, nil
+}
+
+// openreadonly opens an initialized database read-only. As the schema cannot
+// be upgraded in this mode, databases created by older versions of otp are
+// refused.
+func openreadonly(fn string) (*sql.DB, error) {
+	if _, err := os.Stat(fn); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("database %s is %w", fn, errNotInitialized)
+	}
+	db, err := sqlopenro(fn)
+	if err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	switch {
+	case version == 0:
+		db.Close()
+		return nil, fmt.Errorf("database %s is %w", fn, errNotInitialized)
+	case version < len(migrations):
+		db.Close()
+		return nil, fmt.Errorf("database %s uses schema version %d and must be upgraded to %d; run init", fn, version, len(migrations))
+	case version > len(migrations):
+		db.Close()
+		return nil, fmt.Errorf("database schema version %d is newer than the supported version %d; upgrade otp", version, len(migrations))
+	}
+	return db, nil
+}
+
+// stdin is shared by the prompts, so input read ahead by one prompt is not
+// lost to the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks a yes/no question on the terminal, or with the pinentry given
+// by --pinentry. Anything other than an explicit yes is taken as a no.
+func confirm(question string) (bool, error) {
+	if pinentryProgram != "" {
+		return pinentryConfirm(pinentryProgram, question)
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		return false, nil
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// testContext returns a context whose --db is the database.
+func testContext(t *testing.T, fn string) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("otp", flag.ContinueOnError)
+	set.String("db", fn, "")
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestDropSchemaRevokes(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "auth.db")
+	db, err := sqlopen(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	const token = tokenPrefix + "test"
+	_, err = db.Exec("INSERT INTO `api_tokens` (`name`, `hash`, `scope`, `created`, `expires`) VALUES (?, ?, ?, ?, ?);",
+		"ci", hashToken(token), scopeRead, time.Now().Unix(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO `share_links` (`hash`, `account`, `issuer`, `expires`) VALUES (?, ?, ?, ?);",
+		hashToken("link"), "alice", "GitHub", time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO `share_links` (`hash`, `account`, `issuer`, `expires`) VALUES (?, ?, ?, ?);",
+		hashToken("other link"), "alice", "GitHub", time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testContext(t, fn)
+	if _, err := checkAPIToken(c, token); err != nil {
+		t.Fatalf("checkAPIToken() before init --force: %v", err)
+	}
+	if _, _, err := useShareLink(c, "link"); err != nil {
+		t.Fatalf("useShareLink() before init --force: %v", err)
+	}
+
+	// What init --force does.
+	if err := dropSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkAPIToken(c, token); !errors.Is(err, errNotFound) {
+		t.Fatalf("checkAPIToken() after init --force = %v, want errNotFound", err)
+	}
+	if _, _, err := useShareLink(c, "other link"); !errors.Is(err, errNotFound) {
+		t.Fatalf("useShareLink() after init --force = %v, want errNotFound", err)
+	}
+}
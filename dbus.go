@@ -0,0 +1,819 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dbusConn is a connection to the session bus, speaking just enough of the
+// D-Bus protocol for otp to export objects and call other services: the
+// EXTERNAL authentication, and the marshaling of the basic types, arrays,
+// structs, dictionaries and variants. Values are given and returned as
+// byte, bool, int16, uint16, int32, uint32, int64, uint64, float64, string,
+// dbusObjectPath, dbusSignature, dbusVariant, and []any for arrays, structs
+// and dictionary entries; only int16 and uint16 cannot be given.
+type dbusConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	name string
+
+	mu       sync.Mutex
+	serial   uint32
+	calls    map[uint32]chan *dbusMessage
+	handlers map[string]dbusHandler
+	err      error
+}
+
+type (
+	dbusObjectPath string
+	dbusSignature  string
+)
+
+// dbusVariant is a value along with its signature.
+type dbusVariant struct {
+	Sig   string
+	Value any
+}
+
+// dbusHandler answers a method call with the signature and values of the
+// reply.
+type dbusHandler func(m *dbusMessage) (string, []any, error)
+
+// dbusError is an error reply, or the error a dbusHandler returns to reply
+// with a given error name.
+type dbusError struct {
+	Name    string
+	Message string
+}
+
+func (e *dbusError) Error() string {
+	return e.Name + ": " + e.Message
+}
+
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusErrorReply   = 3
+	dbusSignal       = 4
+
+	dbusNoReplyExpected = 1
+)
+
+// dbusMessage is a message with the header fields otp uses.
+type dbusMessage struct {
+	Type        byte
+	Flags       byte
+	Serial      uint32
+	Path        dbusObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   string
+	Body        []any
+}
+
+// dialSessionBus connects to the session bus of DBUS_SESSION_BUS_ADDRESS, or
+// of the bus socket in the runtime directory.
+func dialSessionBus() (*dbusConn, error) {
+	addrs := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if addrs == "" {
+		addrs = "unix:path=" + filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "bus")
+	}
+	var errs []error
+	for _, addr := range strings.Split(addrs, ";") {
+		transport, params, _ := strings.Cut(addr, ":")
+		if transport != "unix" {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			k, v, _ := strings.Cut(param, "=")
+			var conn net.Conn
+			var err error
+			switch k {
+			case "path":
+				conn, err = net.Dial("unix", v)
+			case "abstract":
+				conn, err = net.Dial("unix", "@"+v)
+			default:
+				continue
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			c, err := newDBusConn(conn)
+			if err != nil {
+				conn.Close()
+				errs = append(errs, err)
+				continue
+			}
+			return c, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no unix address in the session bus address %q", addrs)
+	}
+	return nil, fmt.Errorf("cannot connect to the session bus: %w", errors.Join(errs...))
+}
+
+func newDBusConn(conn net.Conn) (*dbusConn, error) {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(conn, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return nil, fmt.Errorf("session bus refused the authentication: %s", strings.TrimSpace(line))
+	}
+	if _, err := io.WriteString(conn, "BEGIN\r\n"); err != nil {
+		return nil, err
+	}
+	c := &dbusConn{
+		conn:     conn,
+		r:        r,
+		calls:    make(map[uint32]chan *dbusMessage),
+		handlers: make(map[string]dbusHandler),
+	}
+	go c.readLoop()
+	out, err := c.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "")
+	if err != nil {
+		return nil, err
+	}
+	c.name, _ = out[0].(string)
+	return c, nil
+}
+
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// RequestName asks for a well-known name, failing if another connection
+// owns it.
+func (c *dbusConn) RequestName(name string) error {
+	out, err := c.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "RequestName", "su", name, uint32(4))
+	if err != nil {
+		return err
+	}
+	if code, _ := out[0].(uint32); code != 1 && code != 4 {
+		return fmt.Errorf("the name %s is owned by another program", name)
+	}
+	return nil
+}
+
+// Export makes the handler answer the calls of the method of the interface
+// at the path.
+func (c *dbusConn) Export(path dbusObjectPath, iface, member string, h dbusHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[string(path)+"\x00"+iface+"."+member] = h
+}
+
+// Call calls a method and waits for its reply.
+func (c *dbusConn) Call(dest string, path dbusObjectPath, iface, member, sig string, args ...any) ([]any, error) {
+	reply := make(chan *dbusMessage, 1)
+	err := c.send(&dbusMessage{
+		Type:        dbusMethodCall,
+		Path:        path,
+		Interface:   iface,
+		Member:      member,
+		Destination: dest,
+		Signature:   sig,
+		Body:        args,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := <-reply
+	if !ok {
+		return nil, c.readErr()
+	}
+	if m.Type == dbusErrorReply {
+		msg, _ := firstString(m.Body)
+		return nil, &dbusError{Name: m.ErrorName, Message: msg}
+	}
+	return m.Body, nil
+}
+
+// Emit sends a signal.
+func (c *dbusConn) Emit(path dbusObjectPath, iface, member, sig string, args ...any) error {
+	return c.send(&dbusMessage{Type: dbusSignal, Path: path, Interface: iface, Member: member, Signature: sig, Body: args}, nil)
+}
+
+// Wait blocks until the connection is closed.
+func (c *dbusConn) Wait() error {
+	reply := make(chan *dbusMessage)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.calls[0] = reply
+	c.mu.Unlock()
+	<-reply
+	return c.readErr()
+}
+
+func (c *dbusConn) readErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func firstString(body []any) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	s, ok := body[0].(string)
+	return s, ok
+}
+
+func (c *dbusConn) send(m *dbusMessage, reply chan *dbusMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.serial++
+	m.Serial = c.serial
+	data, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		c.calls[m.Serial] = reply
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		delete(c.calls, m.Serial)
+		return err
+	}
+	return nil
+}
+
+func (c *dbusConn) readLoop() {
+	for {
+		m, err := readDBusMessage(c.r)
+		if err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("session bus connection lost: %w", err)
+			for serial, ch := range c.calls {
+				close(ch)
+				delete(c.calls, serial)
+			}
+			c.mu.Unlock()
+			return
+		}
+		switch m.Type {
+		case dbusMethodReturn, dbusErrorReply:
+			c.mu.Lock()
+			ch := c.calls[m.ReplySerial]
+			delete(c.calls, m.ReplySerial)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- m
+			}
+		case dbusMethodCall:
+			go c.dispatch(m)
+		}
+	}
+}
+
+// dispatch answers a method call with its handler, or with an
+// UnknownMethod error.
+func (c *dbusConn) dispatch(m *dbusMessage) {
+	c.mu.Lock()
+	h := c.handlers[string(m.Path)+"\x00"+m.Interface+"."+m.Member]
+	c.mu.Unlock()
+	reply := &dbusMessage{Type: dbusMethodReturn, ReplySerial: m.Serial, Destination: m.Sender}
+	if m.Interface == "org.freedesktop.DBus.Peer" && m.Member == "Ping" {
+		// Every peer answers pings.
+	} else if h == nil {
+		reply.Type = dbusErrorReply
+		reply.ErrorName = "org.freedesktop.DBus.Error.UnknownMethod"
+		reply.Signature = "s"
+		reply.Body = []any{fmt.Sprintf("no method %s.%s at %s", m.Interface, m.Member, m.Path)}
+	} else if sig, body, err := safeDBusCall(h, m); err != nil {
+		reply.Type = dbusErrorReply
+		reply.ErrorName = "org.freedesktop.DBus.Error.Failed"
+		var dErr *dbusError
+		if errors.As(err, &dErr) {
+			reply.ErrorName, err = dErr.Name, errors.New(dErr.Message)
+		}
+		reply.Signature = "s"
+		reply.Body = []any{err.Error()}
+	} else {
+		reply.Signature, reply.Body = sig, body
+	}
+	if m.Flags&dbusNoReplyExpected == 0 {
+		c.send(reply, nil)
+	}
+}
+
+// safeDBusCall calls the handler, turning its panics on unexpected arguments
+// into errors.
+func safeDBusCall(h dbusHandler, m *dbusMessage) (sig string, body []any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			sig, body, err = "", nil, &dbusError{"org.freedesktop.DBus.Error.InvalidArgs", fmt.Sprintf("invalid arguments %q", m.Signature)}
+		}
+	}()
+	return h(m)
+}
+
+// Marshaling.
+
+// dbusWriter marshals values in little-endian order.
+type dbusWriter struct {
+	buf []byte
+}
+
+func (w *dbusWriter) align(n int) {
+	for len(w.buf)%n != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *dbusWriter) uint32(v uint32) {
+	w.align(4)
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *dbusWriter) write(sig string, v any) error {
+	bad := func() error {
+		return fmt.Errorf("cannot marshal %T as D-Bus type %s", v, sig)
+	}
+	switch sig[0] {
+	case 'y':
+		b, ok := v.(byte)
+		if !ok {
+			return bad()
+		}
+		w.buf = append(w.buf, b)
+	case 'b':
+		b, ok := v.(bool)
+		if !ok {
+			return bad()
+		}
+		if b {
+			w.uint32(1)
+		} else {
+			w.uint32(0)
+		}
+	case 'i':
+		i, ok := v.(int32)
+		if !ok {
+			return bad()
+		}
+		w.uint32(uint32(i))
+	case 'u':
+		u, ok := v.(uint32)
+		if !ok {
+			return bad()
+		}
+		w.uint32(u)
+	case 'x', 't', 'd':
+		var u uint64
+		switch n := v.(type) {
+		case int64:
+			u = uint64(n)
+		case uint64:
+			u = n
+		case float64:
+			u = math.Float64bits(n)
+		default:
+			return bad()
+		}
+		w.align(8)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, u)
+	case 's', 'o':
+		var s string
+		switch t := v.(type) {
+		case string:
+			s = t
+		case dbusObjectPath:
+			s = string(t)
+		default:
+			return bad()
+		}
+		w.uint32(uint32(len(s)))
+		w.buf = append(append(w.buf, s...), 0)
+	case 'g':
+		s, ok := v.(dbusSignature)
+		if !ok {
+			return bad()
+		}
+		w.buf = append(append(append(w.buf, byte(len(s))), s...), 0)
+	case 'v':
+		vv, ok := v.(dbusVariant)
+		if !ok {
+			return bad()
+		}
+		if err := w.write("g", dbusSignature(vv.Sig)); err != nil {
+			return err
+		}
+		return w.write(vv.Sig, vv.Value)
+	case 'a':
+		elems, ok := v.([]any)
+		if !ok {
+			return bad()
+		}
+		elem := sig[1:]
+		w.uint32(0)
+		lenAt := len(w.buf) - 4
+		w.align(dbusAlignment(elem))
+		start := len(w.buf)
+		for _, e := range elems {
+			if err := w.write(elem, e); err != nil {
+				return err
+			}
+		}
+		binary.LittleEndian.PutUint32(w.buf[lenAt:], uint32(len(w.buf)-start))
+	case '(', '{':
+		fields, ok := v.([]any)
+		if !ok {
+			return bad()
+		}
+		w.align(8)
+		sigs, err := dbusSplit(sig[1 : len(sig)-1])
+		if err != nil {
+			return err
+		}
+		if len(sigs) != len(fields) {
+			return bad()
+		}
+		for i, f := range fields {
+			if err := w.write(sigs[i], f); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported D-Bus type %s", sig)
+	}
+	return nil
+}
+
+func dbusAlignment(sig string) int {
+	switch sig[0] {
+	case 'y', 'g', 'v':
+		return 1
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 4
+}
+
+// dbusSplit splits a signature into its complete types.
+func dbusSplit(sig string) ([]string, error) {
+	var out []string
+	for sig != "" {
+		n, err := dbusTypeLen(sig)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sig[:n])
+		sig = sig[n:]
+	}
+	return out, nil
+}
+
+func dbusTypeLen(sig string) (int, error) {
+	if sig == "" {
+		return 0, errors.New("truncated D-Bus signature")
+	}
+	switch sig[0] {
+	case 'a':
+		n, err := dbusTypeLen(sig[1:])
+		return n + 1, err
+	case '(', '{':
+		end := byte(')')
+		if sig[0] == '{' {
+			end = '}'
+		}
+		i := 1
+		for i < len(sig) && sig[i] != end {
+			n, err := dbusTypeLen(sig[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+		if i >= len(sig) {
+			return 0, fmt.Errorf("unterminated D-Bus signature %s", sig)
+		}
+		return i + 1, nil
+	}
+	return 1, nil
+}
+
+func (m *dbusMessage) marshal() ([]byte, error) {
+	var body dbusWriter
+	sigs, err := dbusSplit(m.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if len(sigs) != len(m.Body) {
+		return nil, fmt.Errorf("%d D-Bus values for signature %q", len(m.Body), m.Signature)
+	}
+	for i, v := range m.Body {
+		if err := body.write(sigs[i], v); err != nil {
+			return nil, err
+		}
+	}
+
+	var fields []any
+	field := func(code byte, sig string, v any) {
+		fields = append(fields, []any{code, dbusVariant{sig, v}})
+	}
+	if m.Path != "" {
+		field(1, "o", m.Path)
+	}
+	if m.Interface != "" {
+		field(2, "s", m.Interface)
+	}
+	if m.Member != "" {
+		field(3, "s", m.Member)
+	}
+	if m.ErrorName != "" {
+		field(4, "s", m.ErrorName)
+	}
+	if m.ReplySerial != 0 {
+		field(5, "u", m.ReplySerial)
+	}
+	if m.Destination != "" {
+		field(6, "s", m.Destination)
+	}
+	if m.Signature != "" {
+		field(8, "g", dbusSignature(m.Signature))
+	}
+	w := dbusWriter{buf: []byte{'l', m.Type, m.Flags, 1}}
+	w.uint32(uint32(len(body.buf)))
+	w.uint32(m.Serial)
+	if err := w.write("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	w.align(8)
+	return append(w.buf, body.buf...), nil
+}
+
+// Unmarshaling.
+
+// dbusReader unmarshals values; offsets are from the start of the message,
+// which alignment is relative to.
+type dbusReader struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errDBusShort = errors.New("truncated D-Bus message")
+
+func (r *dbusReader) align(n int) error {
+	for r.pos%n != 0 {
+		r.pos++
+	}
+	if r.pos > len(r.buf) {
+		return errDBusShort
+	}
+	return nil
+}
+
+func (r *dbusReader) take(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.buf) {
+		return nil, errDBusShort
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *dbusReader) uint32() (uint32, error) {
+	if err := r.align(4); err != nil {
+		return 0, err
+	}
+	b, err := r.take(4)
+	if err != nil {
+		return 0, err
+	}
+	return r.order.Uint32(b), nil
+}
+
+func (r *dbusReader) read(sig string) (any, error) {
+	switch sig[0] {
+	case 'y':
+		b, err := r.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		u, err := r.uint32()
+		return u != 0, err
+	case 'i':
+		u, err := r.uint32()
+		return int32(u), err
+	case 'u', 'h':
+		return r.uint32()
+	case 'n', 'q':
+		if err := r.align(2); err != nil {
+			return nil, err
+		}
+		b, err := r.take(2)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'n' {
+			return int16(r.order.Uint16(b)), nil
+		}
+		return r.order.Uint16(b), nil
+	case 'x', 't', 'd':
+		if err := r.align(8); err != nil {
+			return nil, err
+		}
+		b, err := r.take(8)
+		if err != nil {
+			return nil, err
+		}
+		switch sig[0] {
+		case 'x':
+			return int64(r.order.Uint64(b)), nil
+		case 'd':
+			return math.Float64frombits(r.order.Uint64(b)), nil
+		}
+		return r.order.Uint64(b), nil
+	case 's', 'o':
+		n, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.take(int(n) + 1)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'o' {
+			return dbusObjectPath(b[:n]), nil
+		}
+		return string(b[:n]), nil
+	case 'g':
+		n, err := r.take(1)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.take(int(n[0]) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return dbusSignature(b[:n[0]]), nil
+	case 'v':
+		s, err := r.read("g")
+		if err != nil {
+			return nil, err
+		}
+		sig := string(s.(dbusSignature))
+		if n, err := dbusTypeLen(sig); err != nil || n != len(sig) {
+			return nil, fmt.Errorf("invalid D-Bus variant signature %q", sig)
+		}
+		v, err := r.read(sig)
+		return dbusVariant{sig, v}, err
+	case 'a':
+		n, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		elem := sig[1:]
+		if err := r.align(dbusAlignment(elem)); err != nil {
+			return nil, err
+		}
+		end := r.pos + int(n)
+		if end > len(r.buf) {
+			return nil, errDBusShort
+		}
+		elems := []any{}
+		for r.pos < end {
+			v, err := r.read(elem)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, v)
+		}
+		return elems, nil
+	case '(', '{':
+		if err := r.align(8); err != nil {
+			return nil, err
+		}
+		sigs, err := dbusSplit(sig[1 : len(sig)-1])
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]any, len(sigs))
+		for i, s := range sigs {
+			if fields[i], err = r.read(s); err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("unsupported D-Bus type %s", sig)
+}
+
+// dbusMaxMessage bounds the messages otp reads.
+const dbusMaxMessage = 1 << 24
+
+func readDBusMessage(br *bufio.Reader) (*dbusMessage, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if head[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodyLen := int(order.Uint32(head[4:]))
+	fieldsLen := int(order.Uint32(head[12:]))
+	headerLen := 16 + fieldsLen
+	headerLen += (8 - headerLen%8) % 8
+	if bodyLen > dbusMaxMessage || fieldsLen > dbusMaxMessage {
+		return nil, errors.New("D-Bus message too large")
+	}
+	buf := make([]byte, headerLen+bodyLen)
+	copy(buf, head)
+	if _, err := io.ReadFull(br, buf[16:]); err != nil {
+		return nil, err
+	}
+	m := &dbusMessage{Type: buf[1], Flags: buf[2], Serial: order.Uint32(buf[8:])}
+	r := &dbusReader{buf: buf[:16+fieldsLen], pos: 12, order: order}
+	fields, err := r.read("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields.([]any) {
+		f := f.([]any)
+		v := f[1].(dbusVariant).Value
+		switch f[0].(byte) {
+		case 1:
+			m.Path, _ = v.(dbusObjectPath)
+		case 2:
+			m.Interface, _ = v.(string)
+		case 3:
+			m.Member, _ = v.(string)
+		case 4:
+			m.ErrorName, _ = v.(string)
+		case 5:
+			m.ReplySerial, _ = v.(uint32)
+		case 6:
+			m.Destination, _ = v.(string)
+		case 7:
+			m.Sender, _ = v.(string)
+		case 8:
+			s, _ := v.(dbusSignature)
+			m.Signature = string(s)
+		}
+	}
+	if m.Signature != "" {
+		sigs, err := dbusSplit(m.Signature)
+		if err != nil {
+			return nil, err
+		}
+		r = &dbusReader{buf: buf, pos: headerLen, order: order}
+		for _, s := range sigs {
+			v, err := r.read(s)
+			if err != nil {
+				return nil, err
+			}
+			m.Body = append(m.Body, v)
+		}
+	}
+	return m, nil
+}
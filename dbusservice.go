@@ -0,0 +1,46 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/urfave/cli"
+)
+
+func dbusService() cli.Command {
+	return cli.Command{
+		Name:  "dbus",
+		Usage: "serve the keys on the session bus as io.cirello.OTP",
+		Description: `The object /io/cirello/OTP has the methods of the io.cirello.OTP interface:
+
+     ListEntries() -> a(ss)    the issuers and account names
+     GetCode(s issuer, s account) -> (s code, u expires_in)
+
+   Every GetCode is confirmed with pinentry, which names the program that
+   calls, unless the user allowed it for the same key within --remember.
+   The service is served on Linux and the BSDs.`,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "remember",
+				Usage: "how long an allowed program gets the code of the same key again without asking; 0 asks every time",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if _, err := privkeyfile(c.GlobalString("private-key")); err != nil {
+				return err
+			}
+			return serveDBus(c, c.Duration("remember"))
+		},
+	}
+}
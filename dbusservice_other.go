@@ -0,0 +1,28 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || windows
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func serveDBus(*cli.Context, time.Duration) error {
+	return errors.New("the D-Bus service is only served on Linux and the BSDs")
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	otpBusName                = "io.cirello.OTP"
+	otpBusPath dbusObjectPath = "/io/cirello/OTP"
+)
+
+const otpBusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="io.cirello.OTP">
+    <method name="ListEntries">
+      <arg name="entries" type="a(ss)" direction="out"/>
+    </method>
+    <method name="GetCode">
+      <arg name="issuer" type="s" direction="in"/>
+      <arg name="account" type="s" direction="in"/>
+      <arg name="code" type="s" direction="out"/>
+      <arg name="expires_in" type="u" direction="out"/>
+    </method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect">
+      <arg name="xml" type="s" direction="out"/>
+    </method>
+  </interface>
+</node>
+`
+
+// otpBus answers the calls of io.cirello.OTP, one at a time, so the store
+// is read and the user asked once at a time.
+type otpBus struct {
+	c        *cli.Context
+	conn     *dbusConn
+	remember time.Duration
+
+	mu      sync.Mutex
+	allowed map[string]time.Time
+}
+
+func serveDBus(c *cli.Context, remember time.Duration) error {
+	conn, err := dialSessionBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b := &otpBus{c: c, conn: conn, remember: remember, allowed: make(map[string]time.Time)}
+	conn.Export(otpBusPath, otpBusName, "ListEntries", b.listEntries)
+	conn.Export(otpBusPath, otpBusName, "GetCode", b.getCode)
+	conn.Export(otpBusPath, "org.freedesktop.DBus.Introspectable", "Introspect", func(*dbusMessage) (string, []any, error) {
+		return "s", []any{otpBusIntrospection}, nil
+	})
+	if err := conn.RequestName(otpBusName); err != nil {
+		return err
+	}
+	return conn.Wait()
+}
+
+func (b *otpBus) listEntries(*dbusMessage) (string, []any, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries, err := listEntries(b.c)
+	if err != nil {
+		return "", nil, err
+	}
+	out := make([]any, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, []any{e.Issuer, e.Account})
+	}
+	return "a(ss)", []any{out}, nil
+}
+
+func (b *otpBus) getCode(m *dbusMessage) (string, []any, error) {
+	if m.Signature != "ss" {
+		return "", nil, &dbusError{"org.freedesktop.DBus.Error.InvalidArgs", "GetCode takes the issuer and the account name"}
+	}
+	issuer, account := m.Body[0].(string), m.Body[1].(string)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok, err := entryExists(b.c, issuer, account); err != nil {
+		return "", nil, err
+	} else if !ok {
+		return "", nil, &dbusError{otpBusName + ".Error.NotFound", fmt.Sprintf("%s/%s: %v", issuer, account, errNotFound)}
+	}
+
+	// The unique name of the caller is never reused within the session of
+	// the bus, so it identifies the process for --remember.
+	key := m.Sender + "\x00" + issuer + "\x00" + account
+	if time.Now().After(b.allowed[key]) {
+		program, ok := usePinentry(false)
+		if !ok {
+			return "", nil, errors.New("cannot ask the user to confirm: install pinentry or set --pinentry")
+		}
+		allowed, err := pinentryConfirm(program, fmt.Sprintf("%s asks for the OTP code of %s/%s. Allow?", b.caller(m.Sender), issuer, account))
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot ask the user to confirm: %w", err)
+		}
+		if !allowed {
+			return "", nil, &dbusError{otpBusName + ".Error.Denied", "the user refused to share the code"}
+		}
+		if b.remember > 0 {
+			b.allowed[key] = time.Now().Add(b.remember)
+		}
+	}
+	code, err := entryCode(b.c, issuer, account)
+	if err != nil {
+		return "", nil, err
+	}
+	return "su", []any{code.Code, uint32(code.ExpiresIn)}, nil
+}
+
+// caller describes the process behind the unique name of a connection for
+// the user: its command name and process id, where the bus tells it.
+func (b *otpBus) caller(sender string) string {
+	out, err := b.conn.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "GetConnectionUnixProcessID", "s", sender)
+	if err != nil {
+		return "A program on the session bus (" + sender + ")"
+	}
+	pid, _ := out[0].(uint32)
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		return fmt.Sprintf("%s (pid %d)", strings.TrimSpace(string(comm)), pid)
+	}
+	return fmt.Sprintf("The program with pid %d", pid)
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func init() {
+	keyBackends["dpapi"] = openDPAPIKey
+}
+
+// dpapiEntropy is mixed into the DPAPI blobs made by otp, so other programs
+// of the same user cannot unprotect them without knowing it.
+var dpapiEntropy = []byte("otp store key")
+
+// openDPAPIKey unprotects the random secret in the file given by
+// --private-key, and makes the file when it does not exist yet. The secrets
+// are encrypted with AES-256-GCM under a key derived from it. Only the same
+// Windows user can unprotect the secret, so the protection is that of the
+// Windows login, be it a password or Windows Hello.
+func openDPAPIKey(fn string) (keyBackend, error) {
+	key, err := opensymmetrickey("DPAPI", "otp dpapi aes-256-gcm", symmetricSecret{
+		load: func() ([]byte, error) {
+			blob, err := os.ReadFile(fn)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, errNotFound
+			} else if err != nil {
+				return nil, fmt.Errorf("cannot read key file: %s", err)
+			}
+			secret, err := dpapiUnprotect(blob)
+			if err != nil {
+				return nil, fmt.Errorf("cannot unprotect it; was it protected by another Windows user? %w", err)
+			}
+			return secret, nil
+		},
+		store: func(secret []byte) error {
+			blob, err := dpapiProtect(secret)
+			if err != nil {
+				return fmt.Errorf("cannot protect store key: %w", err)
+			}
+			if err := os.WriteFile(fn, blob, 0o600); err != nil {
+				return fmt.Errorf("cannot write key file: %s", err)
+			}
+			fmt.Fprintf(os.Stderr, "store key protected with DPAPI written to %s\n", fn)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return key, nil
+}
+
+func dpapiProtect(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptProtectData(dataBlob(data), nil, dataBlob(dpapiEntropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&out), nil
+}
+
+func dpapiUnprotect(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptUnprotectData(dataBlob(data), nil, dataBlob(dpapiEntropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&out), nil
+}
+
+func dataBlob(b []byte) *windows.DataBlob {
+	return &windows.DataBlob{Size: uint32(len(b)), Data: unsafe.SliceData(b)}
+}
+
+// takeDataBlob copies a blob allocated by DPAPI, and frees it.
+func takeDataBlob(b *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.Data)))
+	return append([]byte(nil), unsafe.Slice(b.Data, b.Size)...)
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base32"
+	"errors"
+	"log"
+	"os/user"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	// duressDB is the decoy store given by --duress-db.
+	duressDB string
+
+	// lastPassphrase is the passphrase last typed, kept when a duress store
+	// is configured so it can be tried on the duress key.
+	lastPassphrase []byte
+
+	// duressPassphrase is the passphrase of the duress store once it is
+	// unlocked.
+	duressPassphrase []byte
+)
+
+// decoyIssuers are the issuers of the dummy keys added by decoy.
+var decoyIssuers = []string{
+	"GitHub",
+	"Google",
+	"Microsoft",
+	"Amazon Web Services",
+	"Dropbox",
+	"Facebook",
+	"Discord",
+	"Reddit",
+}
+
+// storeCommands are the commands that open the store, which the duress store
+// stands in for.
+var storeCommands = map[string]bool{
+	"init":              true,
+	"add":               true,
+	"get":               true,
+	"list":              true,
+	"qr":                true,
+	"rm":                true,
+	"fsck":              true,
+	"backup":            true,
+	"restore":           true,
+	"import":            true,
+	"log":               true,
+	"checkout":          true,
+	"sync":              true,
+	"serve-sync":        true,
+	"rekey":             true,
+	"passwd":            true,
+	"agent":             true,
+	"grant":             true,
+	"revoke":            true,
+	"recipients":        true,
+	"compact":           true,
+	"http":              true,
+	"grpc-server":       true,
+	"mcp":               true,
+	"share":             true,
+	"shell":             true,
+	"exec":              true,
+	"aws":               true,
+	"credential-helper": true,
+	"askpass":           true,
+	"tray":              true,
+	"dbus":              true,
+}
+
+// unlockDuress unlocks the private key ahead of the command when a duress
+// store is configured. If the passphrase typed does not unlock the private
+// key but unlocks the duress key, the command runs on the duress store
+// instead, without a word about it; otherwise, the command runs as usual.
+// Only the storeCommands unlock the key, unless they are asked for help or
+// run with --remote.
+func unlockDuress(c *cli.Context) error {
+	if duressDB == "" || !storeCommands[c.Args().First()] || c.String("remote") != "" {
+		return nil
+	}
+	for _, arg := range c.Args().Tail() {
+		if arg == "-h" || arg == "--help" {
+			return nil
+		}
+	}
+	ctx := cli.NewContext(c.App, nil, c)
+	keyfile := c.String("private-key")
+	err := checkUnlock(ctx, keyfile, false)
+	if !errors.Is(err, errWrongPassphrase) || lastPassphrase == nil {
+		return err
+	}
+	duressKey := keyfile
+	if keyBackendName != "passphrase" {
+		duressKey = expandHome(c.String("duress-key"))
+		if duressKey == "" {
+			return err
+		}
+	}
+	db := c.String("db")
+	duressPassphrase = lastPassphrase
+	c.Set("db", duressDB)
+	c.Set("private-key", duressKey)
+	if checkUnlock(ctx, duressKey, true) != nil {
+		duressPassphrase = nil
+		c.Set("db", db)
+		c.Set("private-key", keyfile)
+		closePrivkey(duressKey)
+		return err
+	}
+	return nil
+}
+
+// checkUnlock loads the private key. As any passphrase makes a key with
+// --encryption passphrase, the key must also decrypt a secret of the store,
+// if it has any; when strict is set, the store must have one.
+func checkUnlock(c *cli.Context, keyfile string, strict bool) error {
+	priv, err := privkeyfile(keyfile)
+	if err != nil || keyBackendName != "passphrase" {
+		return err
+	}
+	var entries []entry
+	if s, err := openstore(c, false); err == nil {
+		entries, _ = s.List()
+		s.Close()
+	}
+	for _, e := range entries {
+		secret, err := priv.legacySecret(e)
+		if errors.Is(err, errWrongPassphrase) {
+			return err
+		} else if err == nil {
+			wipe(secret)
+			return nil
+		}
+	}
+	if strict {
+		return errWrongPassphrase
+	}
+	return nil
+}
+
+func decoy() cli.Command {
+	return cli.Command{
+		Name:  "decoy",
+		Usage: "add plausible dummy keys to the duress store",
+		Description: `The duress store, given by --duress-db, is opened instead of the database
+   when the passphrase typed is not the one of the private key but the one of
+   --duress-key, so a user who is compelled to unlock otp can show it instead
+   of the real keys. With --encryption passphrase, the duress store is simply
+   encrypted with another passphrase, which decoy asks for.
+
+   Keys already in the duress store are kept. Other keys can be added to it
+   with --db and --private-key pointing to the duress store and key.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "account",
+				Usage: "account name of the dummy keys (default: the user name)",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if duressDB == "" {
+				return errors.New("--duress-db is missing")
+			}
+			keyfile := c.GlobalString("private-key")
+			if keyBackendName != "passphrase" {
+				keyfile = expandHome(c.GlobalString("duress-key"))
+				if keyfile == "" {
+					return errors.New("--duress-key is missing")
+				}
+			}
+			account := c.String("account")
+			if account == "" {
+				u, err := user.Current()
+				if err != nil {
+					return err
+				}
+				account = u.Username
+			}
+			if err := c.GlobalSet("db", duressDB); err != nil {
+				return err
+			}
+			if err := c.GlobalSet("private-key", keyfile); err != nil {
+				return err
+			}
+			priv, err := privkeyfile(keyfile)
+			if err != nil {
+				return err
+			}
+
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			s, err := autoinit(c, true)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+
+			var added int
+			err = s.Tx(func(tx store) error {
+				added = 0
+				entries, err := tx.List()
+				if err != nil {
+					return err
+				}
+				existing := make(map[string]bool)
+				for _, e := range entries {
+					existing[e.Account+"\x00"+e.Issuer] = true
+				}
+				for _, issuer := range decoyIssuers {
+					if existing[account+"\x00"+issuer] {
+						continue
+					}
+					secret := []byte(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes(20)))
+					password, err := priv.encrypted(secret, cryptlabel(account, issuer))
+					if err != nil {
+						return err
+					}
+					password = tagged(secret, account, issuer, priv.public(), password)
+					wipe(secret)
+					if err := tx.Put(entry{Account: account, Issuer: issuer, Password: password}); err != nil {
+						return err
+					}
+					added++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			log.Printf("%d dummy keys added to %s", added, storeName(c))
+			return nil
+		},
+	}
+}
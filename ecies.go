@@ -0,0 +1,152 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Ed25519 and ECDSA keys only sign, so secrets are encrypted to them with an
+// ECIES envelope instead: an ephemeral key on the same curve agrees on a
+// shared secret with the ECDH counterpart of the key, and HKDF-SHA256 derives
+// from that secret the single-use AES-256-GCM key and nonce that encrypt the
+// data. The ciphertext is prefixed with the ephemeral public key.
+
+// eciesInfo holds the HKDF info of each curve.
+var eciesInfo = map[ecdh.Curve]string{
+	ecdh.X25519(): "otp x25519 aes-256-gcm",
+	ecdh.P256():   "otp p256 aes-256-gcm",
+	ecdh.P384():   "otp p384 aes-256-gcm",
+	ecdh.P521():   "otp p521 aes-256-gcm",
+}
+
+func encryptECDH(recipient *ecdh.PublicKey, in, label []byte) ([]byte, error) {
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	aead, nonce, err := eciesAEAD(recipient.Curve(), shared, ephemeralPub, recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(ephemeralPub, nonce, in, label), nil
+}
+
+// ecdhDecrypter is the private side of encryptECDH. It is implemented by
+// *ecdh.PrivateKey, and by keys kept in tokens.
+type ecdhDecrypter interface {
+	Curve() ecdh.Curve
+	PublicKey() *ecdh.PublicKey
+	ECDH(remote *ecdh.PublicKey) ([]byte, error)
+}
+
+func decryptECDH(key ecdhDecrypter, in, label []byte) ([]byte, error) {
+	// Both public keys are encoded with the same length.
+	own := key.PublicKey().Bytes()
+	if len(in) < len(own) {
+		return nil, errors.New("ciphertext too short")
+	}
+	ephemeralPub, in := in[:len(own)], in[len(own):]
+	ephemeral, err := key.Curve().NewPublicKey(ephemeralPub)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, nonce, err := eciesAEAD(key.Curve(), shared, ephemeralPub, own)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, in, label)
+}
+
+func eciesAEAD(curve ecdh.Curve, shared, ephemeralPub, recipientPub []byte) (cipher.AEAD, []byte, error) {
+	info, ok := eciesInfo[curve]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported curve %s", curve)
+	}
+	salt := append(append([]byte{}, ephemeralPub...), recipientPub...)
+	kdf := hkdf.New(sha256.New, shared, salt, []byte(info))
+	keyNonce := make([]byte, 32+12)
+	if _, err := io.ReadFull(kdf, keyNonce); err != nil {
+		return nil, nil, err
+	}
+	gcm, err := newGCM(keyNonce[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, keyNonce[32:], nil
+}
+
+// ecdhPublicKey returns the ECDH counterpart of an Ed25519 or ECDSA public
+// key.
+func ecdhPublicKey(pub crypto.PublicKey) (*ecdh.PublicKey, error) {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return x25519PublicKey(pub)
+	case *ecdsa.PublicKey:
+		return pub.ECDH()
+	}
+	return nil, fmt.Errorf("unsupported public key %T", pub)
+}
+
+// ecdhPrivateKey returns the ECDH counterpart of an Ed25519 or ECDSA private
+// key.
+func ecdhPrivateKey(priv crypto.Signer) (*ecdh.PrivateKey, error) {
+	switch priv := priv.(type) {
+	case ed25519.PrivateKey:
+		return x25519PrivateKey(priv)
+	case *ecdsa.PrivateKey:
+		return priv.ECDH()
+	}
+	return nil, fmt.Errorf("unsupported private key %T", priv)
+}
+
+// x25519PublicKey converts the Edwards point of the Ed25519 public key into
+// the Montgomery form of X25519.
+func x25519PublicKey(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	p, err := new(edwards25519.Point).SetBytes(pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 public key: %s", err)
+	}
+	return ecdh.X25519().NewPublicKey(p.BytesMontgomery())
+}
+
+// x25519PrivateKey derives the X25519 key that matches x25519PublicKey from
+// the seed of the Ed25519 key, as RFC 8032 derives the signing scalar.
+func x25519PrivateKey(priv ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(priv.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
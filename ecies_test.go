@@ -0,0 +1,163 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+// testEnvelope checks that the key decrypts what it encrypts, and that
+// other keys, other labels and any change to the ciphertext are rejected.
+func testEnvelope(t *testing.T, key, other keyBackend) {
+	t.Helper()
+	label := cryptlabel("alice", "GitHub")
+	for _, secret := range [][]byte{[]byte("JBSWY3DPEHPK3PXP"), {}, bytes.Repeat([]byte("A"), 1000)} {
+		ct, err := key.encrypted(secret, label)
+		if err != nil {
+			t.Fatalf("encrypted(%d bytes): %v", len(secret), err)
+		}
+		pt, err := key.decrypted(ct, label)
+		if err != nil {
+			t.Fatalf("decrypted(encrypted(%d bytes)): %v", len(secret), err)
+		}
+		if !bytes.Equal(pt, secret) {
+			t.Fatalf("decrypted(encrypted(%q)) = %q", secret, pt)
+		}
+		again, err := key.encrypted(secret, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(again, ct) {
+			t.Errorf("encrypting %d bytes twice gave the same ciphertext", len(secret))
+		}
+		if _, err := key.decrypted(ct, cryptlabel("bob", "GitHub")); err == nil {
+			t.Errorf("decrypted %d bytes with another label", len(secret))
+		}
+		if _, err := other.decrypted(ct, label); err == nil {
+			t.Errorf("decrypted %d bytes with another key", len(secret))
+		}
+	}
+
+	ct, err := key.encrypted([]byte("JBSWY3DPEHPK3PXP"), label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ct {
+		tampered := bytes.Clone(ct)
+		tampered[i] ^= 0x01
+		if _, err := key.decrypted(tampered, label); err == nil {
+			t.Errorf("decrypted the ciphertext with byte %d changed", i)
+		}
+	}
+	for _, n := range []int{0, 1, len(ct) / 2, len(ct) - 1} {
+		if _, err := key.decrypted(ct[:n], label); err == nil {
+			t.Errorf("decrypted the ciphertext truncated to %d bytes", n)
+		}
+	}
+	if _, err := key.decrypted(append(bytes.Clone(ct), 0), label); err == nil {
+		t.Error("decrypted the ciphertext with a trailing byte")
+	}
+}
+
+// testSignerKey returns the signerKey of the private key.
+func testSignerKey(t *testing.T, key any) signerKey {
+	t.Helper()
+	k, err := newsignerkey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func testEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestECIESEd25519(t *testing.T) {
+	testEnvelope(t, testSignerKey(t, testEd25519Key(t)), testSignerKey(t, testEd25519Key(t)))
+}
+
+func testECDSAKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestECIESECDSA(t *testing.T) {
+	tests := []struct {
+		name         string
+		curve, other elliptic.Curve
+	}{
+		{"P-256", elliptic.P256(), elliptic.P256()},
+		{"P-384", elliptic.P384(), elliptic.P384()},
+		{"P-521", elliptic.P521(), elliptic.P521()},
+		{"P-256 to P-384", elliptic.P256(), elliptic.P384()},
+		{"P-384 to P-256", elliptic.P384(), elliptic.P256()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := testSignerKey(t, testECDSAKey(t, tt.curve))
+			testEnvelope(t, key, testSignerKey(t, testECDSAKey(t, tt.other)))
+		})
+	}
+	// The envelopes of other key types are not mistaken for ECDSA ones.
+	key := testSignerKey(t, testECDSAKey(t, elliptic.P256()))
+	ct, err := testSignerKey(t, testEd25519Key(t)).encrypted([]byte("JBSWY3DPEHPK3PXP"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.decrypted(ct, nil); err == nil {
+		t.Error("ECDSA key decrypted the envelope of an Ed25519 key")
+	}
+	if _, err := newsignerkey(testECDSAKey(t, elliptic.P224())); err == nil {
+		t.Error("accepted a P-224 key, which has no ECDH counterpart")
+	}
+}
+
+func TestX25519Keys(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		key := testEd25519Key(t)
+		priv, err := x25519PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := x25519PublicKey(key.Public().(ed25519.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !priv.PublicKey().Equal(pub) {
+			t.Fatalf("X25519 key of the Ed25519 seed does not match the X25519 key of the public key")
+		}
+	}
+	// y = 2 is not on the curve.
+	invalid := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	invalid[0] = 2
+	if _, err := x25519PublicKey(invalid); err == nil {
+		t.Error("converted an invalid Ed25519 public key")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// entryKeyMagic prefixes the secrets of the keys added with add --key, which
+// are encrypted with their own private key instead of --private-key. The key
+// backend and the private key follow, and then the tagged secret, whose tag
+// covers them. Secrets recorded before the tag covered the private key start
+// with entryKeyV1Magic.
+const (
+	entryKeyMagic   = "OTPKEYREF2\n"
+	entryKeyV1Magic = "OTPKEYREF1\n"
+)
+
+// entryKeys are the private keys, by key backend and name, that the keys of
+// the store may be encrypted with, as given by --entry-keys.
+var entryKeys map[string]bool
+
+// parseEntryKeys parses --entry-keys: a comma-separated list of
+// ENCRYPTION=KEY, or of just KEY for the key backend of --encryption.
+func parseEntryKeys(list string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		backend, fn, ok := strings.Cut(item, "=")
+		if !ok {
+			backend, fn = keyBackendName, item
+		}
+		keys[entryKeyID(backend, entryKeyPath(expandHome(fn)))] = true
+	}
+	return keys
+}
+
+func entryKeyID(backend, fn string) string {
+	return backend + "=" + fn
+}
+
+// readEntryKey reads the private key recorded with an entry. The store is not
+// trusted to pick it: only the keys of --entry-keys are read, so whoever can
+// write to the store cannot make otp run another key backend, such as an
+// otp-plugin-* executable, or read another key.
+func readEntryKey(backend, fn string) (*privkey, error) {
+	if !entryKeys[entryKeyID(backend, fn)] {
+		return nil, fmt.Errorf("private key %s of the entry is not one of --entry-keys; add %s to it if you added the key with it", fn, entryKeyID(backend, fn))
+	}
+	key, err := privkeywith(backend, fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read private key %s of the entry: %w", fn, err)
+	}
+	return key, nil
+}
+
+// withEntryKey tags the secret encrypted by the private key, binding the
+// private key into the tag, and records the private key.
+func withEntryKey(backend, fn string, secret []byte, account, issuer string, key crypto.PublicKey, password []byte) []byte {
+	ref := binary.AppendUvarint(nil, uint64(len(backend)))
+	ref = append(ref, backend...)
+	ref = binary.AppendUvarint(ref, uint64(len(fn)))
+	ref = append(ref, fn...)
+	out := append([]byte(entryKeyMagic), ref...)
+	return append(out, taggedRef(secret, account, issuer, key, ref, password)...)
+}
+
+// entryKeyRef returns the private key recorded by withEntryKey as covered by
+// the integrity tag, or nil when the tag does not cover it.
+func entryKeyRef(password []byte) []byte {
+	ref, ok := bytes.CutPrefix(password, []byte(entryKeyMagic))
+	if !ok {
+		return nil
+	}
+	_, _, rest, ok := cutEntryKey(password)
+	if !ok {
+		return nil
+	}
+	return ref[:len(ref)-len(rest)]
+}
+
+// unboundEntryKey tells the secrets whose private key was recorded before the
+// integrity tag covered it.
+func unboundEntryKey(password []byte) bool {
+	return bytes.HasPrefix(password, []byte(entryKeyV1Magic))
+}
+
+// cutEntryKey returns the private key recorded by withEntryKey, and the
+// secret without it.
+func cutEntryKey(password []byte) (backend, fn string, rest []byte, ok bool) {
+	rest, ok = bytes.CutPrefix(password, []byte(entryKeyMagic))
+	if !ok {
+		rest, ok = bytes.CutPrefix(password, []byte(entryKeyV1Magic))
+	}
+	if !ok {
+		return "", "", password, false
+	}
+	var fields [2]string
+	for i := range fields {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || uint64(len(rest)-size) < n {
+			return "", "", password, false
+		}
+		fields[i] = string(rest[size : size+int(n)])
+		rest = rest[size+int(n):]
+	}
+	return fields[0], fields[1], rest, true
+}
+
+// entryKeyPath makes the path of key files absolute, so the key is found
+// from any directory. Key IDs, URIs and account names are kept as given.
+func entryKeyPath(fn string) string {
+	if _, err := os.Stat(fn); err != nil {
+		return fn
+	}
+	if abs, err := filepath.Abs(fn); err == nil {
+		return abs
+	}
+	return fn
+}
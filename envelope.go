@@ -0,0 +1,126 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"log"
+
+	"github.com/urfave/cli"
+)
+
+// rsaEnvelopeMagic prefixes the secrets encrypted to RSA keys with a data
+// key. Secrets encrypted before it are bare RSA-OAEP ciphertexts, which are
+// as long as the modulus, and limited to about 190 bytes with a 2048-bit key.
+const rsaEnvelopeMagic = "OTPRSA1\n"
+
+// encryptRSA encrypts in with a random AES-256-GCM data key, which is in turn
+// encrypted to the RSA key with RSA-OAEP. Both are bound to the label.
+func encryptRSA(pub *rsa.PublicKey, in, label []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, dataKey, label)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealGCM(dataKey, in, label)
+	wipe(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(rsaEnvelopeMagic), wrapped...)
+	return append(out, sealed...), nil
+}
+
+// decryptRSA reverses encryptRSA, and decrypts the bare RSA-OAEP ciphertexts
+// too. unwrap does the RSA-OAEP decryption with the private key of the
+// given size.
+func decryptRSA(size int, in, label []byte, unwrap func(in []byte) ([]byte, error)) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(in, []byte(rsaEnvelopeMagic))
+	if !ok || len(rest) < size {
+		return unwrap(in)
+	}
+	dataKey, err := unwrap(rest[:size])
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(dataKey)
+	return openGCM(dataKey, rest[size:], label)
+}
+
+// isBareRSA tells whether the secret may be a bare RSA-OAEP ciphertext, by
+// its size.
+func isBareRSA(password []byte) bool {
+	_, ok := cutTag(password)
+	return !ok && !isShared(password) && !bytes.HasPrefix(password, []byte(rsaEnvelopeMagic)) &&
+		len(password) >= 128 && len(password)%64 == 0
+}
+
+// upgradeSecrets encrypts again, with the RSA envelope, the secrets that
+// are bare RSA-OAEP ciphertexts. The private key is only read when the store
+// may have any.
+func upgradeSecrets(c *cli.Context, s store) error {
+	entries, err := s.List()
+	if err != nil {
+		return err
+	}
+	maybe := false
+	for _, e := range entries {
+		blinded := e.Issuer == encryptedNamesIssuer && bytes.HasPrefix(e.Password, []byte(encryptedNamesMagic))
+		maybe = maybe || blinded || isBareRSA(e.Password)
+	}
+	if !maybe {
+		return nil
+	}
+	priv, err := privkeyfile(c.GlobalString("private-key"))
+	if err != nil {
+		return err
+	}
+	if _, ok := priv.public().(*rsa.PublicKey); !ok {
+		return nil
+	}
+	names := &namesStore{base: s, priv: priv}
+	bare := 0
+	for _, e := range entries {
+		plain, err := names.unseal(e)
+		if err != nil {
+			return err
+		}
+		if isBareRSA(plain.Password) {
+			bare++
+		}
+	}
+	if bare == 0 {
+		return nil
+	}
+	if err := autobackup(c, s); err != nil {
+		return err
+	}
+	err = s.Tx(func(tx store) error {
+		_, err := rekeyEntries(tx, priv, priv)
+		return err
+	})
+	if err != nil {
+		return errors.Join(errors.New("cannot upgrade secrets to the RSA envelope"), err)
+	}
+	log.Printf("encrypted %d keys again with a data key, which lifts the size limit of RSA", bare)
+	return nil
+}
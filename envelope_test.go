@@ -0,0 +1,66 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+)
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRSAEnvelope(t *testing.T) {
+	key, other := testSignerKey(t, testRSAKey(t)), testSignerKey(t, testRSAKey(t))
+	testEnvelope(t, key, other)
+
+	// Secrets encrypted before the envelope are bare RSA-OAEP ciphertexts.
+	label := cryptlabel("alice", "GitHub")
+	secret := []byte("JBSWY3DPEHPK3PXP")
+	bare, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.Public().(*rsa.PublicKey), secret, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBareRSA(bare) {
+		t.Error("isBareRSA(RSA-OAEP ciphertext) = false")
+	}
+	pt, err := key.decrypted(bare, label)
+	if err != nil {
+		t.Fatalf("decrypted(RSA-OAEP ciphertext): %v", err)
+	}
+	if !bytes.Equal(pt, secret) {
+		t.Errorf("decrypted(RSA-OAEP ciphertext) = %q, want %q", pt, secret)
+	}
+	if _, err := other.decrypted(bare, label); err == nil {
+		t.Error("decrypted the RSA-OAEP ciphertext with another key")
+	}
+
+	ct, err := key.encrypted(secret, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isBareRSA(ct) {
+		t.Error("isBareRSA(envelope) = true")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+func execCode() cli.Command {
+	return cli.Command{
+		Name:           "exec",
+		Usage:          "run a command with the current code of a key",
+		ArgsUsage:      "`filter` -- `command` [`arguments`]",
+		SkipArgReorder: true,
+		Description: `The filter is ISSUER/ACCOUNT, or part of the issuer or the account name of
+   exactly one key. The command gets the code as $OTP_CODE, with
+   $OTP_ISSUER, $OTP_ACCOUNT and $OTP_EXPIRES_IN, and {code} in its arguments
+   is replaced by it too:
+
+     otp exec AWS -- aws sts get-session-token --token-code {code} ...
+
+   otp exits with the exit status of the command.`,
+		Action: func(c *cli.Context) error {
+			args := c.Args()
+			if len(args) == 0 {
+				return errors.New("filter is missing")
+			}
+			filter, args := args[0], args[1:]
+			if len(args) > 0 && args[0] == "--" {
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				return errors.New("command is missing")
+			}
+
+			code, err := codeFor(c, filter)
+			if err != nil {
+				return err
+			}
+			for i, arg := range args {
+				args[i] = strings.ReplaceAll(arg, "{code}", code.Code)
+			}
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Stdin = os.Stdin
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.Env = append(os.Environ(),
+				"OTP_CODE="+code.Code,
+				"OTP_ISSUER="+code.Issuer,
+				"OTP_ACCOUNT="+code.Account,
+				"OTP_EXPIRES_IN="+strconv.FormatInt(code.ExpiresIn, 10),
+			)
+			err = cmd.Run()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return cli.NewExitError("", exitErr.ExitCode())
+			}
+			return err
+		},
+	}
+}
+
+// codeFor returns the current code of the only key matching the filter,
+// which is either ISSUER/ACCOUNT or part of the issuer or the account name.
+func codeFor(c *cli.Context, filter string) (apiCode, error) {
+	codes, failed, err := loadCodes(c)
+	if err != nil {
+		return apiCode{}, err
+	}
+	var found []apiCode
+	for _, code := range codes {
+		if code.Issuer+"/"+code.Account == filter {
+			return code, nil
+		}
+		if strings.Contains(code.Issuer, filter) || strings.Contains(code.Account, filter) {
+			found = append(found, code)
+		}
+	}
+	switch len(found) {
+	case 0:
+		if failed > 0 {
+			return apiCode{}, fmt.Errorf("no key matches %q, and %d keys could not be decrypted", filter, failed)
+		}
+		return apiCode{}, fmt.Errorf("no key matches %q", filter)
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, len(found))
+	for i, code := range found {
+		names[i] = code.Issuer + "/" + code.Account
+	}
+	return apiCode{}, fmt.Errorf("%q matches %d keys: %s", filter, len(found), strings.Join(names, ", "))
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	keyBackends["fido2"] = openFIDO2Key
+}
+
+// fido2RelyingParty is the relying party of the FIDO2 credentials made for
+// otp.
+const fido2RelyingParty = "otp"
+
+// fido2CredentialFile is the --private-key file of the fido2 backend. It
+// holds nothing secret: the hmac-secret cannot be computed without the
+// security key.
+type fido2CredentialFile struct {
+	RelyingParty string `json:"rp"`
+	Credential   []byte `json:"credential"`
+	Salt         []byte `json:"salt"`
+}
+
+// openFIDO2Key is the key backend that encrypts the secrets with
+// AES-256-GCM, under a key derived from the hmac-secret a FIDO2 security key
+// computes for a credential it made, so there is no private key at all: the
+// security key must be plugged in, and tapped, once per run. It goes through
+// fido2-cred and fido2-assert, which come with libfido2, and which ask for
+// the PIN when the security key has one. The fingerprint of the key is the
+// one of the credential ID.
+//
+// The credential file is read, or a new credential is registered with the
+// security key when the file does not exist yet.
+func openFIDO2Key(fn string) (keyBackend, error) {
+	device, err := fido2Device()
+	if err != nil {
+		return nil, err
+	}
+	var cred fido2CredentialFile
+	data, err := os.ReadFile(fn)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		cred, err = registerFIDO2(fn, device)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("cannot read credential file: %s", err)
+	default:
+		if err := json.Unmarshal(data, &cred); err != nil {
+			return nil, fmt.Errorf("invalid credential file %s: %s", fn, err)
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "touch your security key")
+	b64 := base64.StdEncoding.EncodeToString
+	input := fido2Input(b64(randomBytes(32)), cred.RelyingParty, b64(cred.Credential), b64(cred.Salt))
+	out, err := fido2Tool(input, "fido2-assert", "-G", "-h", "-p", device)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	secret, err := base64.StdEncoding.DecodeString(lines[len(lines)-1])
+	if err != nil || len(secret) != 32 {
+		return nil, errors.New("fido2-assert did not return the hmac-secret")
+	}
+	sum := sha256.Sum256(cred.Credential)
+	return newsymmetrickey("FIDO2", "SHA256:"+base64.RawStdEncoding.EncodeToString(sum[:]), secret, "otp fido2 aes-256-gcm")
+}
+
+func registerFIDO2(fn, device string) (fido2CredentialFile, error) {
+	ok, err := confirm(fmt.Sprintf("no FIDO2 credential in %s; register one with the security key %s?", fn, device))
+	if err != nil {
+		return fido2CredentialFile{}, err
+	}
+	if !ok {
+		return fido2CredentialFile{}, errors.New("aborted")
+	}
+	fmt.Fprintln(os.Stderr, "touch your security key")
+	// The input is the client data hash, the relying party, the user name
+	// and the user ID.
+	b64 := base64.StdEncoding.EncodeToString
+	input := fido2Input(b64(randomBytes(32)), fido2RelyingParty, "otp", b64(randomBytes(32)))
+	out, err := fido2Tool(input, "fido2-cred", "-M", "-h", device)
+	if err != nil {
+		return fido2CredentialFile{}, err
+	}
+	// The output is the client data hash, the relying party, the format,
+	// the authenticator data, and then the credential ID.
+	lines := strings.Split(string(out), "\n")
+	if len(lines) < 5 {
+		return fido2CredentialFile{}, errors.New("fido2-cred did not return the credential")
+	}
+	id, err := base64.StdEncoding.DecodeString(lines[4])
+	if err != nil {
+		return fido2CredentialFile{}, fmt.Errorf("invalid credential ID: %s", err)
+	}
+	cred := fido2CredentialFile{RelyingParty: fido2RelyingParty, Credential: id, Salt: randomBytes(32)}
+	data, err := json.MarshalIndent(cred, "", "\t")
+	if err != nil {
+		return fido2CredentialFile{}, err
+	}
+	if err := os.WriteFile(fn, append(data, '\n'), 0o600); err != nil {
+		return fido2CredentialFile{}, fmt.Errorf("cannot write credential file: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "FIDO2 credential written to %s\n", fn)
+	return cred, nil
+}
+
+// fido2Device is $OTP_FIDO2_DEVICE, or else the first security key listed by
+// fido2-token.
+func fido2Device() (string, error) {
+	if device := os.Getenv("OTP_FIDO2_DEVICE"); device != "" {
+		return device, nil
+	}
+	out, err := fido2Tool(nil, "fido2-token", "-L")
+	if err != nil {
+		return "", err
+	}
+	device, _, ok := strings.Cut(string(out), ": ")
+	if !ok {
+		return "", errors.New("no FIDO2 security key found; plug one in or set $OTP_FIDO2_DEVICE")
+	}
+	return device, nil
+}
+
+// fido2Input is the input of fido2-cred and fido2-assert: a line per
+// parameter, with binary ones encoded in base64.
+func fido2Input(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func fido2Tool(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("%s not found; install the libfido2 tools", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
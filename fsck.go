@@ -0,0 +1,156 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+)
+
+func fsck() cli.Command {
+	return cli.Command{
+		Name:  "fsck",
+		Usage: "check the integrity of the OTP store",
+		Action: func(c *cli.Context) error {
+			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+
+			s, err := openstore(c, false)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+
+			var problems []string
+			report := func(account, issuer, problem string) {
+				problems = append(problems, fmt.Sprintf("%s\t%s\t%s", account, issuer, problem))
+			}
+
+			if checker, ok := basestore(s).(interface{ IntegrityCheck() ([]string, error) }); ok {
+				integrity, err := checker.IntegrityCheck()
+				if err != nil {
+					return err
+				}
+				for _, msg := range integrity {
+					report("-", "-", msg)
+				}
+			}
+
+			entries, err := s.List()
+			if err != nil {
+				return err
+			}
+
+			for _, e := range entries {
+				var problem string
+				switch {
+				case e.Account == "":
+					problem = "account name is missing"
+				case e.Issuer == "":
+					problem = "issuer is missing"
+				case len(e.Password) == 0:
+					problem = "secret is missing"
+				}
+				if problem != "" {
+					report(e.Account, e.Issuer, problem)
+					continue
+				}
+
+				if _, ok := cutTag(e.Password); !ok {
+					report(e.Account, e.Issuer, "integrity tag is missing; run init to add it")
+					continue
+				}
+				decrypted, err := priv.secret(e)
+				if err != nil {
+					problem = "cannot decrypt: wrong private key or corrupted secret"
+					if fp := keyFingerprint(e); fp != "-" && fp != fingerprint(priv.public()) {
+						problem = fmt.Sprintf("cannot decrypt: encrypted with key %s, not with the current private key", fp)
+					}
+					if errors.Is(err, errTampered) {
+						problem = "integrity tag does not match: entry was renamed or swapped with another"
+					}
+					for _, other := range entries {
+						if _, err := priv.legacySecret(entry{Account: other.Account, Issuer: other.Issuer, Password: e.Password}); err == nil {
+							problem = fmt.Sprintf("label mismatch: secret belongs to account %q of issuer %q", other.Account, other.Issuer)
+							break
+						}
+					}
+					report(e.Account, e.Issuer, problem)
+					continue
+				}
+
+				if err := validSecret(string(decrypted)); err != nil {
+					report(e.Account, e.Issuer, err.Error())
+				}
+			}
+
+			if len(problems) > 0 {
+				w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "account\tissuer\tproblem")
+				for _, line := range problems {
+					fmt.Fprintln(w, line)
+				}
+				w.Flush()
+				return fmt.Errorf("%d problems found in %d entries", len(problems), len(entries))
+			}
+			log.Printf("%d entries checked, no problems found", len(entries))
+			return nil
+		},
+	}
+}
+
+// integrityCheck runs SQLite's own consistency checks, returning the
+// problems it reports.
+func integrityCheck(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("PRAGMA integrity_check;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, "integrity check: "+msg)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// validSecret checks whether the secret is valid base32, after the same
+// normalization applied when generating codes.
+func validSecret(secret string) error {
+	key := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	if key == "" {
+		return errors.New("secret is empty")
+	}
+	if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(key, "=")); err != nil {
+		return fmt.Errorf("secret is not valid base32: %s", err)
+	}
+	return nil
+}
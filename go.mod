@@ -1,10 +1,18 @@
 module cirello.io/otp
 
-go 1.23.2
+go 1.24.0
 
 require (
+	filippo.io/age v1.2.1
+	filippo.io/edwards25519 v1.1.0
+	github.com/go-sql-driver/mysql v1.8.1
+	github.com/lib/pq v1.10.9
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/pquerna/otp v1.4.0
 	github.com/urfave/cli v1.22.15
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
 	modernc.org/sqlite v1.33.1
 	rsc.io/qr v0.2.0
 )
@@ -19,7 +27,6 @@ require (
 	github.com/ncruces/go-strftime v0.1.9 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
 	modernc.org/libc v1.55.3 // indirect
 	modernc.org/mathutil v1.6.0 // indirect
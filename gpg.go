@@ -0,0 +1,111 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	keyBackends["gpg"] = newgpgkey
+}
+
+// gpgKey encrypts the secrets with gpg, to the OpenPGP key named by
+// --private-key with anything gpg takes as a user ID: a fingerprint, a key ID
+// or an email address. Decryption goes through gpg-agent, so the key may live
+// on a smartcard, and the PIN is asked by pinentry.
+type gpgKey struct {
+	fpr gpgFingerprint
+}
+
+// gpgFingerprint is the public key of a gpgKey.
+type gpgFingerprint string
+
+func (f gpgFingerprint) Equal(o crypto.PublicKey) bool {
+	return f == o
+}
+
+func (f gpgFingerprint) fingerprint() string {
+	return string(f)
+}
+
+func (gpgFingerprint) kind() string {
+	return "OPENPGP"
+}
+
+func newgpgkey(id string) (keyBackend, error) {
+	out, err := gpg(nil, "--with-colons", "--list-keys", "--", id)
+	if err != nil {
+		return nil, err
+	}
+	var fprs []string
+	primary := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case fields[0] == "pub":
+			primary = true
+		case fields[0] == "fpr" && primary && len(fields) > 9:
+			fprs = append(fprs, fields[9])
+			primary = false
+		}
+	}
+	switch len(fprs) {
+	case 0:
+		return nil, fmt.Errorf("gpg key %q not found", id)
+	case 1:
+		return &gpgKey{fpr: gpgFingerprint(fprs[0])}, nil
+	}
+	return nil, fmt.Errorf("gpg key %q is ambiguous, it matches %s", id, strings.Join(fprs, ", "))
+}
+
+func gpg(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("gpg", append([]string{"--batch", "--quiet", "--yes"}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("gpg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+func (k *gpgKey) public() crypto.PublicKey {
+	return k.fpr
+}
+
+func (k *gpgKey) material() ([]byte, error) {
+	return nil, errors.New("gpg keys do not reveal any secret")
+}
+
+// encrypted trusts the key regardless of the web of trust: it is the user's
+// own key.
+func (k *gpgKey) encrypted(in, label []byte) ([]byte, error) {
+	return gpg(withLabel(in, label), "--trust-model", "always", "--recipient", string(k.fpr), "--encrypt")
+}
+
+func (k *gpgKey) decrypted(in, label []byte) ([]byte, error) {
+	plain, err := gpg(in, "--decrypt")
+	if err != nil {
+		return nil, err
+	}
+	return withoutLabel(plain, label)
+}
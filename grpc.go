@@ -0,0 +1,668 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	otp "github.com/pquerna/otp/totp"
+	"github.com/urfave/cli"
+)
+
+// grpcService is the name of the service of otp.proto, as in the paths of
+// its methods.
+const grpcService = "/otp.v1.OTP/"
+
+// gRPC status codes.
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcAlreadyExists    = 6
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// grpcError is the status of a failed call.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e grpcError) Error() string {
+	return fmt.Sprintf("%s (gRPC status %d)", e.msg, e.code)
+}
+
+// grpcCode maps the errors of the store and of the HTTP API to gRPC codes.
+func grpcCode(err error) int {
+	switch errorStatus(err) {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcAlreadyExists
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// grpcMethods are the methods of otp.proto, taking and returning encoded
+// messages.
+func grpcMethods(c *cli.Context, readOnly bool) map[string]func(req protoMessage) ([]byte, error) {
+	methods := map[string]func(req protoMessage) ([]byte, error){
+		"List": func(req protoMessage) ([]byte, error) {
+			entries, err := listEntries(c)
+			if err != nil {
+				return nil, err
+			}
+			var out []byte
+			for _, e := range entries {
+				if matches(req.str(1), apiCode{Issuer: e.Issuer, Account: e.Account}) {
+					out = protoAppendBytes(out, 1, encodeEntry(e.Issuer, e.Account))
+				}
+			}
+			return out, nil
+		},
+		"GetCode": func(req protoMessage) ([]byte, error) {
+			code, err := entryCode(c, req.str(1), req.str(2))
+			if err != nil {
+				return nil, err
+			}
+			out := encodeEntry(code.Issuer, code.Account)
+			out = protoAppendString(out, 3, code.Code)
+			return protoAppendVarint(out, 4, uint64(code.ExpiresIn)), nil
+		},
+		"Verify": func(req protoMessage) ([]byte, error) {
+			valid, err := verifyCode(c, req.str(1), req.str(2), req.str(3))
+			if err != nil {
+				return nil, err
+			}
+			return protoAppendBool(nil, 1, valid), nil
+		},
+	}
+	if readOnly {
+		return methods
+	}
+	methods["Add"] = func(req protoMessage) ([]byte, error) {
+		e, err := putEntry(c, apiEntry{Issuer: req.str(1), Account: req.str(2), Secret: req.str(3)}, req.bool(4))
+		if err != nil {
+			return nil, err
+		}
+		return encodeEntry(e.Issuer, e.Account), nil
+	}
+	methods["Remove"] = func(req protoMessage) ([]byte, error) {
+		return nil, deleteEntry(c, req.str(1), req.str(2))
+	}
+	return methods
+}
+
+func encodeEntry(issuer, account string) []byte {
+	return protoAppendString(protoAppendString(nil, 1, issuer), 2, account)
+}
+
+// verifyCode tells whether the code is valid for the entry now.
+func verifyCode(c *cli.Context, issuer, account, code string) (bool, error) {
+	priv, err := privkeyfile(c.GlobalString("private-key"))
+	if err != nil {
+		return false, err
+	}
+	s, err := openstore(c, false)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+	e, err := s.Get(account, issuer)
+	if err != nil {
+		return false, fmt.Errorf("%s/%s: %w", issuer, account, err)
+	}
+	secret, err := priv.secret(e)
+	if err != nil {
+		decryptionErrors.Add(1)
+		return false, secretError(priv, e, err)
+	}
+	key := strings.ToUpper(strings.ReplaceAll(string(secret), " ", ""))
+	wipe(secret)
+	return otp.Validate(strings.TrimSpace(code), key), nil
+}
+
+// grpcReadMethods are the methods read API tokens may call.
+var grpcReadMethods = map[string]bool{"List": true, "GetCode": true, "Verify": true}
+
+// grpcHandler serves the unary calls of otp.proto, as framed by gRPC over
+// HTTP/2. Compressed messages are not supported, and clients do not ask for
+// them unless the server announces it. With apiTokens, the API tokens of
+// otp token create are accepted too.
+func grpcHandler(c *cli.Context, token string, apiTokens, readOnly bool) http.Handler {
+	methods := grpcMethods(c, readOnly)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		status := func(code int, msg string) {
+			w.Header().Set("Grpc-Status", strconv.Itoa(code))
+			if msg != "" {
+				w.Header().Set("Grpc-Message", grpcEscape(msg))
+			}
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, grpcService)
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch {
+		case token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1:
+		case apiTokens:
+			t, err := checkAPIToken(c, bearer)
+			if err != nil {
+				if !errors.Is(err, errNotFound) {
+					log.Println("cannot check API token:", err)
+				}
+				log.Println("unauthenticated gRPC call from", r.RemoteAddr)
+				status(grpcUnauthenticated, "unauthenticated")
+				return
+			}
+			if t.scope == scopeRead && !grpcReadMethods[name] {
+				status(grpcPermissionDenied, "the token is read-only")
+				return
+			}
+		case token != "":
+			log.Println("unauthenticated gRPC call from", r.RemoteAddr)
+			status(grpcUnauthenticated, "unauthenticated")
+			return
+		}
+		method, ok := methods[name]
+		if !ok || !strings.HasPrefix(r.URL.Path, grpcService) {
+			status(grpcUnimplemented, "unknown method "+r.URL.Path)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			status(grpcInvalidArgument, "cannot read request: "+err.Error())
+			return
+		}
+		msg, err := grpcUnframe(body)
+		if err != nil {
+			status(grpcInvalidArgument, err.Error())
+			return
+		}
+		req, err := decodeProto(msg)
+		if err != nil {
+			status(grpcInvalidArgument, err.Error())
+			return
+		}
+		httpMu.Lock()
+		out, err := method(req)
+		httpMu.Unlock()
+		if err != nil {
+			status(grpcCode(err), err.Error())
+			return
+		}
+		w.Write(grpcFrame(out))
+		status(grpcOK, "")
+	})
+}
+
+// grpcFrame prefixes the message with the gRPC header: not compressed, and
+// its length.
+func grpcFrame(msg []byte) []byte {
+	out := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	return append(out, msg...)
+}
+
+func grpcUnframe(b []byte) ([]byte, error) {
+	switch {
+	case len(b) < 5:
+		return nil, errors.New("truncated gRPC message")
+	case b[0] != 0:
+		return nil, errors.New("compressed gRPC messages are not supported")
+	case uint64(binary.BigEndian.Uint32(b[1:5])) != uint64(len(b)-5):
+		return nil, errors.New("gRPC message length does not match; only one message per call is supported")
+	}
+	return b[5:], nil
+}
+
+// grpcEscape percent-encodes the message for the grpc-message trailer.
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if ch := msg[i]; ch < ' ' || ch > '~' || ch == '%' {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		} else {
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+func grpcServer() cli.Command {
+	return cli.Command{
+		Name:  "grpc-server",
+		Usage: "serve the gRPC service of otp.proto",
+		Description: `Without --tls-cert, the service is served over HTTP/2 without TLS, as gRPC
+   clients do with insecure credentials. It listens on localhost by default;
+   other addresses need --auth-token, --api-tokens or --tls-client-ca, and
+   every client address is rate limited, as Verify would otherwise let
+   anyone guess codes. The settings can also be set in the [grpc-server]
+   table of the configuration file.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "addr",
+				Value:  "localhost",
+				Usage:  "address to listen on; empty for all interfaces",
+				EnvVar: "OTP_GRPC_ADDR",
+			},
+			cli.IntFlag{
+				Name:   "port",
+				Value:  9998,
+				Usage:  "port to listen on",
+				EnvVar: "OTP_GRPC_PORT",
+			},
+			cli.StringFlag{
+				Name:   "socket",
+				Usage:  "Unix socket to listen on instead of --addr and --port",
+				EnvVar: "OTP_GRPC_SOCKET",
+			},
+			cli.StringFlag{
+				Name:   "tls-cert",
+				Usage:  "certificate file, to serve over TLS",
+				EnvVar: "OTP_GRPC_TLS_CERT",
+			},
+			cli.StringFlag{
+				Name:   "tls-key",
+				Usage:  "private key file of --tls-cert",
+				EnvVar: "OTP_GRPC_TLS_KEY",
+			},
+			cli.StringFlag{
+				Name:   "tls-client-ca",
+				Usage:  "CA certificates file; only the clients with a certificate issued by one of them are served",
+				EnvVar: "OTP_GRPC_TLS_CLIENT_CA",
+			},
+			cli.StringFlag{
+				Name:   "auth-token",
+				Usage:  "token the clients must send as authorization: Bearer metadata; prefer the environment variable, as command lines are visible to other users",
+				EnvVar: "OTP_GRPC_AUTH_TOKEN",
+			},
+			cli.BoolFlag{
+				Name:   "api-tokens",
+				Usage:  "also accept the API tokens of otp token create",
+				EnvVar: "OTP_GRPC_API_TOKENS",
+			},
+			cli.BoolFlag{
+				Name:   "read-only",
+				Usage:  "only serve List, GetCode and Verify",
+				EnvVar: "OTP_GRPC_READ_ONLY",
+			},
+			cli.Float64Flag{
+				Name:   "rate-limit",
+				Value:  10,
+				Usage:  "calls per second each client address may make; 0 disables the limit",
+				EnvVar: "OTP_GRPC_RATE_LIMIT",
+			},
+			cli.IntFlag{
+				Name:   "rate-burst",
+				Value:  30,
+				Usage:  "calls each client address may make at once, beyond --rate-limit",
+				EnvVar: "OTP_GRPC_RATE_BURST",
+			},
+			cli.DurationFlag{
+				Name:   "shutdown-timeout",
+				Value:  10 * time.Second,
+				Usage:  "how long to wait for the calls in flight on SIGINT or SIGTERM",
+				EnvVar: "OTP_GRPC_SHUTDOWN_TIMEOUT",
+			},
+		},
+		Before: applyCommandConfig,
+		Action: func(c *cli.Context) error {
+			if c.Bool("read-only") {
+				if err := c.GlobalSet("read-only", "true"); err != nil {
+					return err
+				}
+			}
+			if err := checkServing(c); err != nil {
+				return err
+			}
+			if _, err := sqlitePath(c); err != nil && c.Bool("api-tokens") {
+				return fmt.Errorf("--api-tokens: %w", err)
+			}
+			certfn, keyfn := expandHome(c.String("tls-cert")), expandHome(c.String("tls-key"))
+			switch {
+			case (certfn == "") != (keyfn == ""):
+				return errors.New("--tls-cert and --tls-key go together")
+			case certfn == "" && c.String("tls-client-ca") != "":
+				return errors.New("--tls-client-ca needs --tls-cert and --tls-key")
+			}
+			socket := expandHome(c.String("socket"))
+			l, err := listenHTTP(net.JoinHostPort(c.String("addr"), strconv.Itoa(c.Int("port"))), socket, 0o600)
+			if err != nil {
+				return err
+			}
+			if socket != "" && l.Addr().Network() == "unix" {
+				defer os.Remove(socket)
+			}
+			authenticated := c.String("auth-token") != "" || c.Bool("api-tokens") || c.String("tls-client-ca") != ""
+			if addr, ok := l.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && !authenticated {
+				l.Close()
+				return fmt.Errorf("%s is not a loopback address; serving it needs --auth-token, --api-tokens or --tls-client-ca", l.Addr())
+			}
+			handler := grpcHandler(c, c.String("auth-token"), c.Bool("api-tokens"), c.Bool("read-only"))
+			srv := &http.Server{Handler: httpLimit(handler, c.Float64("rate-limit"), c.Int("rate-burst"), 0, 0)}
+			if certfn != "" {
+				srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+				if fn := expandHome(c.String("tls-client-ca")); fn != "" {
+					pemdata, err := os.ReadFile(fn)
+					if err != nil {
+						return fmt.Errorf("cannot read client CA file: %s", err)
+					}
+					pool := x509.NewCertPool()
+					if !pool.AppendCertsFromPEM(pemdata) {
+						return fmt.Errorf("no certificates found in %s", fn)
+					}
+					srv.TLSConfig.ClientCAs = pool
+					srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+				log.Println("serving gRPC on", l.Addr(), "over TLS")
+				return serveUntilSignal(srv, func() error { return srv.ServeTLS(l, certfn, keyfn) }, c.Duration("shutdown-timeout"))
+			}
+			srv.Protocols = new(http.Protocols)
+			srv.Protocols.SetUnencryptedHTTP2(true)
+			log.Println("serving gRPC on", l.Addr())
+			return serveUntilSignal(srv, func() error { return srv.Serve(l) }, c.Duration("shutdown-timeout"))
+		},
+	}
+}
+
+// grpcClient calls the service of otp grpc-server.
+type grpcClient struct {
+	base  string
+	token string
+	hc    *http.Client
+}
+
+func newGRPCClient(c *cli.Context) (*grpcClient, error) {
+	server := c.GlobalString("server")
+	for p := c.Parent(); p != nil && server == ""; p = p.Parent() {
+		server = p.String("server")
+	}
+	parent := c.Parent()
+	useTLS, cafn, token := parent.Bool("tls"), expandHome(parent.String("ca")), parent.String("token")
+	certfn, keyfn := expandHome(parent.String("cert")), expandHome(parent.String("key"))
+	if server == "" {
+		return nil, errors.New("--server is missing")
+	}
+	if (certfn == "") != (keyfn == "") {
+		return nil, errors.New("--cert and --key go together")
+	}
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	scheme := "http"
+	if useTLS || cafn != "" || certfn != "" {
+		scheme = "https"
+		tr.Protocols.SetHTTP2(true)
+		tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if cafn != "" {
+			pemdata, err := os.ReadFile(cafn)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read CA file: %s", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pemdata) {
+				return nil, fmt.Errorf("no certificates found in %s", cafn)
+			}
+			tr.TLSClientConfig.RootCAs = pool
+		}
+		if certfn != "" {
+			cert, err := tls.LoadX509KeyPair(certfn, keyfn)
+			if err != nil {
+				return nil, err
+			}
+			tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+	} else {
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return &grpcClient{base: scheme + "://" + server, token: token, hc: &http.Client{Transport: tr, Timeout: time.Minute}}, nil
+}
+
+func (g *grpcClient) call(method string, req []byte) (protoMessage, error) {
+	hreq, err := http.NewRequest(http.MethodPost, g.base+grpcService+method, bytes.NewReader(grpcFrame(req)))
+	if err != nil {
+		return protoMessage{}, err
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+	if g.token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	resp, err := g.hc.Do(hreq)
+	if err != nil {
+		return protoMessage{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return protoMessage{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return protoMessage{}, fmt.Errorf("server answered %s", resp.Status)
+	}
+	// Calls that fail right away carry their status in the headers.
+	st, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if st == "" {
+		st, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(st)
+	if err != nil {
+		return protoMessage{}, errors.New("response without gRPC status")
+	}
+	if code != grpcOK {
+		if unescaped, err := url.PathUnescape(msg); err == nil {
+			msg = unescaped
+		}
+		return protoMessage{}, grpcError{code: code, msg: msg}
+	}
+	out, err := grpcUnframe(body)
+	if err != nil {
+		return protoMessage{}, err
+	}
+	return decodeProto(out)
+}
+
+func grpcClientCommand() cli.Command {
+	issuerAccount := func(c *cli.Context) (string, string, error) {
+		issuer, account := c.Args().Get(0), c.Args().Get(1)
+		switch {
+		case issuer == "":
+			return "", "", errors.New("issuer is missing")
+		case account == "":
+			return "", "", errors.New("account name is missing")
+		}
+		return issuer, account, nil
+	}
+	return cli.Command{
+		Name:  "grpc-client",
+		Usage: "call the gRPC service of otp grpc-server",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "server",
+				Value:  "localhost:9998",
+				Usage:  "host:port of otp grpc-server",
+				EnvVar: "OTP_GRPC_SERVER",
+			},
+			cli.StringFlag{
+				Name:   "token",
+				Usage:  "token of the server, as given to its --auth-token",
+				EnvVar: "OTP_GRPC_TOKEN",
+			},
+			cli.BoolFlag{
+				Name:   "tls",
+				Usage:  "connect over TLS",
+				EnvVar: "OTP_GRPC_TLS",
+			},
+			cli.StringFlag{
+				Name:   "ca",
+				Usage:  "CA certificates file to verify the server with, instead of the system ones; implies --tls",
+				EnvVar: "OTP_GRPC_CA",
+			},
+			cli.StringFlag{
+				Name:   "cert",
+				Usage:  "client certificate file, for a server with --tls-client-ca; implies --tls",
+				EnvVar: "OTP_GRPC_CERT",
+			},
+			cli.StringFlag{
+				Name:   "key",
+				Usage:  "private key file of --cert",
+				EnvVar: "OTP_GRPC_KEY",
+			},
+		},
+		Subcommands: []cli.Command{
+			{
+				Name:      "list",
+				Usage:     "list the entries",
+				ArgsUsage: "[`query`]",
+				Action: func(c *cli.Context) error {
+					g, err := newGRPCClient(c)
+					if err != nil {
+						return err
+					}
+					resp, err := g.call("List", protoAppendString(nil, 1, c.Args().First()))
+					if err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+					defer w.Flush()
+					fmt.Fprintln(w, "account\tissuer")
+					for _, data := range resp.repeated[1] {
+						e, err := decodeProto(data)
+						if err != nil {
+							return err
+						}
+						fmt.Fprintf(w, "%s\t%s\n", e.str(2), e.str(1))
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "code",
+				Usage:     "print the current code of an entry",
+				ArgsUsage: "`issuer` `account-name`",
+				Action: func(c *cli.Context) error {
+					issuer, account, err := issuerAccount(c)
+					if err != nil {
+						return err
+					}
+					g, err := newGRPCClient(c)
+					if err != nil {
+						return err
+					}
+					resp, err := g.call("GetCode", encodeEntry(issuer, account))
+					if err != nil {
+						return err
+					}
+					fmt.Println(resp.str(3))
+					return nil
+				},
+			},
+			{
+				Name:      "add",
+				Usage:     "add an entry",
+				ArgsUsage: "`secret` `issuer` `account-name`",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "replace",
+						Usage: "replace the entry if it exists",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					secret := c.Args().First()
+					if secret == "" {
+						return errors.New("secret key is missing")
+					}
+					issuer, account := c.Args().Get(1), c.Args().Get(2)
+					g, err := newGRPCClient(c)
+					if err != nil {
+						return err
+					}
+					req := protoAppendString(encodeEntry(issuer, account), 3, secret)
+					_, err = g.call("Add", protoAppendBool(req, 4, c.Bool("replace")))
+					return err
+				},
+			},
+			{
+				Name:      "rm",
+				Usage:     "delete an entry",
+				ArgsUsage: "`issuer` `account-name`",
+				Action: func(c *cli.Context) error {
+					issuer, account, err := issuerAccount(c)
+					if err != nil {
+						return err
+					}
+					g, err := newGRPCClient(c)
+					if err != nil {
+						return err
+					}
+					_, err = g.call("Remove", encodeEntry(issuer, account))
+					return err
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "check a code of an entry, failing if it is not valid",
+				ArgsUsage: "`issuer` `account-name` `code`",
+				Action: func(c *cli.Context) error {
+					issuer, account, err := issuerAccount(c)
+					if err != nil {
+						return err
+					}
+					g, err := newGRPCClient(c)
+					if err != nil {
+						return err
+					}
+					resp, err := g.call("Verify", protoAppendString(encodeEntry(issuer, account), 3, c.Args().Get(2)))
+					if err != nil {
+						return err
+					}
+					if !resp.bool(1) {
+						return errors.New("code is not valid")
+					}
+					fmt.Println("code is valid")
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProtoRoundTrip(t *testing.T) {
+	var msg []byte
+	msg = protoAppendString(msg, 1, "GitHub")
+	msg = protoAppendString(msg, 2, "")
+	msg = protoAppendVarint(msg, 3, 150)
+	msg = protoAppendVarint(msg, 4, 0)
+	msg = protoAppendVarint(msg, 5, 1<<63)
+	msg = protoAppendBool(msg, 6, true)
+	msg = protoAppendBool(msg, 7, false)
+	msg = protoAppendBytes(msg, 8, encodeEntry("GitHub", "alice"))
+	msg = protoAppendBytes(msg, 8, encodeEntry("GitLab", "bob"))
+	got, err := decodeProto(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.str(1) != "GitHub" || got.str(2) != "" {
+		t.Errorf("strings = %q, %q", got.str(1), got.str(2))
+	}
+	if got.int64(3) != 150 || got.int64(4) != 0 || got.varints[5] != 1<<63 {
+		t.Errorf("varints = %v", got.varints)
+	}
+	if _, ok := got.varints[4]; ok {
+		t.Error("zero varint was encoded")
+	}
+	if !got.bool(6) || got.bool(7) {
+		t.Errorf("bools = %v, %v", got.bool(6), got.bool(7))
+	}
+	var entries []string
+	for _, b := range got.repeated[8] {
+		e, err := decodeProto(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e.str(1)+":"+e.str(2))
+	}
+	if want := []string{"GitHub:alice", "GitLab:bob"}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("repeated = %q, want %q", entries, want)
+	}
+}
+
+func TestDecodeProto(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		str     map[int]string
+		varints map[int]uint64
+		wantErr bool
+	}{
+		{name: "empty", in: nil},
+		{name: "varint", in: []byte{0x08, 0x96, 0x01}, varints: map[int]uint64{1: 150}},
+		{name: "string", in: []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}, str: map[int]string{2: "testing"}},
+		{name: "unknown fixed64", in: []byte{0x09, 1, 2, 3, 4, 5, 6, 7, 8, 0x08, 0x01}, varints: map[int]uint64{1: 1}},
+		{name: "unknown fixed32", in: []byte{0x0d, 1, 2, 3, 4, 0x08, 0x01}, varints: map[int]uint64{1: 1}},
+		{name: "unknown field number", in: []byte{0xf8, 0x07, 0x05, 0x12, 0x01, 'x'}, str: map[int]string{2: "x"}, varints: map[int]uint64{127: 5}},
+		{name: "truncated varint", in: []byte{0x08, 0x96}, wantErr: true},
+		{name: "truncated key", in: []byte{0x80}, wantErr: true},
+		{name: "overlong varint", in: []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, wantErr: true},
+		{name: "truncated string", in: []byte{0x12, 0x07, 't', 'e'}, wantErr: true},
+		{name: "oversized length", in: []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 'x'}, wantErr: true},
+		{name: "oversized 32-bit length", in: []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0x0f, 'x'}, wantErr: true},
+		{name: "truncated fixed64", in: []byte{0x09, 1, 2, 3}, wantErr: true},
+		{name: "truncated fixed32", in: []byte{0x0d, 1, 2}, wantErr: true},
+		{name: "start group", in: []byte{0x0b}, wantErr: true},
+		{name: "end group", in: []byte{0x0c}, wantErr: true},
+		{name: "wire type 6", in: []byte{0x0e}, wantErr: true},
+		{name: "wire type 7", in: []byte{0x0f}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeProto(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeProto(%x) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for n, want := range tt.str {
+				if got.str(n) != want {
+					t.Errorf("field %d = %q, want %q", n, got.str(n), want)
+				}
+			}
+			for n, want := range tt.varints {
+				if got.varints[n] != want {
+					t.Errorf("field %d = %d, want %d", n, got.varints[n], want)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCFrame(t *testing.T) {
+	for _, msg := range [][]byte{nil, {0x08, 0x01}, bytes.Repeat([]byte{'x'}, 70000)} {
+		framed := grpcFrame(msg)
+		if len(framed) != len(msg)+5 || framed[0] != 0 {
+			t.Fatalf("grpcFrame(%d bytes) = %x...", len(msg), framed[:5])
+		}
+		got, err := grpcUnframe(framed)
+		if err != nil {
+			t.Fatalf("grpcUnframe(grpcFrame(%d bytes)): %v", len(msg), err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("grpcUnframe(grpcFrame(%d bytes)) = %d bytes", len(msg), len(got))
+		}
+	}
+
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"truncated prefix", []byte{0, 0, 0}},
+		{"compressed", []byte{1, 0, 0, 0, 0}},
+		{"truncated message", []byte{0, 0, 0, 0, 3, 0x08}},
+		{"oversized length", []byte{0, 0xff, 0xff, 0xff, 0xff, 0x08, 0x01}},
+		{"two messages", append(grpcFrame([]byte{0x08, 0x01}), grpcFrame([]byte{0x08, 0x02})...)},
+	}
+	for _, tt := range tests {
+		if _, err := grpcUnframe(tt.in); err == nil {
+			t.Errorf("grpcUnframe(%s) did not fail", tt.name)
+		}
+	}
+}
+
+func TestGRPCEscape(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"unknown method /otp.OTP/Nope", "unknown method /otp.OTP/Nope"},
+		{"100% done", "100%25 done"},
+		{"line\nbreak", "line%0Abreak"},
+		{"café", "caf%C3%A9"},
+	}
+	for _, tt := range tests {
+		if got := grpcEscape(tt.in); got != tt.want {
+			t.Errorf("grpcEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGRPCHandler(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "grpc.db")
+	db, err := sqlopen(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO `otps` (`account`, `issuer`, `password`) VALUES (?, ?, ?), (?, ?, ?);",
+		"alice", "GitHub", []byte("sealed"), "bob", "GitLab", []byte("sealed"))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := grpcHandler(testContext(t, fn), "secret", false, true)
+
+	list := grpcFrame(protoAppendString(nil, 1, "GitHub"))
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		token       string
+		body        []byte
+		httpStatus  int
+		grpcStatus  string
+	}{
+		{name: "not gRPC", path: grpcService + "List", contentType: "application/json", token: "secret", body: list, httpStatus: http.StatusUnsupportedMediaType},
+		{name: "unauthenticated", path: grpcService + "List", token: "wrong", body: list, grpcStatus: "16"},
+		{name: "unknown method", path: grpcService + "Nope", token: "secret", body: list, grpcStatus: "12"},
+		{name: "read-only", path: grpcService + "Remove", token: "secret", body: list, grpcStatus: "12"},
+		{name: "other service", path: "/other.Service/List", token: "secret", body: list, grpcStatus: "12"},
+		{name: "truncated frame", path: grpcService + "List", token: "secret", body: list[:3], grpcStatus: "3"},
+		{name: "compressed frame", path: grpcService + "List", token: "secret", body: append([]byte{1}, list[1:]...), grpcStatus: "3"},
+		{name: "oversized length", path: grpcService + "List", token: "secret", body: []byte{0, 0xff, 0xff, 0xff, 0xff, 0x0a}, grpcStatus: "3"},
+		{name: "malformed message", path: grpcService + "List", token: "secret", body: grpcFrame([]byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f}), grpcStatus: "3"},
+		{name: "list", path: grpcService + "List", token: "secret", body: list, grpcStatus: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			if tt.contentType == "" {
+				tt.contentType = "application/grpc"
+			}
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			resp := w.Result()
+			if tt.httpStatus == 0 {
+				tt.httpStatus = http.StatusOK
+			}
+			if resp.StatusCode != tt.httpStatus {
+				t.Fatalf("HTTP status = %d, want %d", resp.StatusCode, tt.httpStatus)
+			}
+			status := resp.Trailer.Get("Grpc-Status")
+			if status == "" {
+				status = resp.Header.Get("Grpc-Status")
+			}
+			if status != tt.grpcStatus {
+				t.Fatalf("grpc-status = %q, want %q (%s)", status, tt.grpcStatus, resp.Header.Get("Grpc-Message"))
+			}
+			if tt.grpcStatus != "0" {
+				return
+			}
+			msg, err := grpcUnframe(w.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeProto(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.repeated[1]) != 1 {
+				t.Fatalf("List(GitHub) returned %d entries, want 1", len(got.repeated[1]))
+			}
+			e, err := decodeProto(got.repeated[1][0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.str(1) != "GitHub" || e.str(2) != "alice" {
+				t.Errorf("List(GitHub) = %s:%s, want GitHub:alice", e.str(1), e.str(2))
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/urfave/cli"
+)
+
+// hookEvents are the events the [hooks] table of the configuration file may
+// run commands on. The pre- hooks can stop the command by failing.
+var hookEvents = map[string]bool{
+	"post-add":  true,
+	"post-rm":   true,
+	"pre-get":   true,
+	"post-sync": true,
+}
+
+// runHook runs the command of the event in the [hooks] table, if any, with
+// the shell, with OTP_HOOK, OTP_STORE and vars, given as KEY=value, in its
+// environment. Its output goes to the standard error, so it does not mix
+// with the codes.
+func runHook(c *cli.Context, event string, vars ...string) error {
+	cfg, err := loadConfig(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	command := cfg.Commands["hooks"][event]
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Env = append(os.Environ(), "OTP_HOOK="+event, "OTP_STORE="+storeName(c))
+	cmd.Env = append(cmd.Env, vars...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook: %w", event, err)
+	}
+	return nil
+}
+
+// runPostHook runs the hook of an event that already happened, so its
+// failure is only reported.
+func runPostHook(c *cli.Context, event string, vars ...string) {
+	if err := runHook(c, event, vars...); err != nil {
+		log.Print(err)
+	}
+}
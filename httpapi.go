@@ -0,0 +1,420 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// httpMu serializes the access of the HTTP handlers to the store and the
+// private key, neither of which is safe for concurrent use.
+var httpMu sync.Mutex
+
+// apiEntry is an entry as exposed by the JSON API. The secret is only ever
+// read from requests.
+type apiEntry struct {
+	Account string `json:"account"`
+	Issuer  string `json:"issuer"`
+	Secret  string `json:"secret,omitempty"`
+	// Owner is the user who shared the entry, with otp http --users.
+	Owner string `json:"owner,omitempty"`
+}
+
+// apiCode is the current code of an entry.
+type apiCode struct {
+	Account   string `json:"account"`
+	Issuer    string `json:"issuer"`
+	Code      string `json:"code"`
+	ExpiresIn int64  `json:"expires_in"`
+	Owner     string `json:"owner,omitempty"`
+}
+
+// registerAPI adds the JSON API to the mux:
+//
+//	GET    /api/entries                          list the entries
+//	POST   /api/entries                          add an entry
+//	GET    /api/entries/{issuer}/{account}/code  current code of an entry
+//	PUT    /api/entries/{issuer}/{account}       add or replace an entry
+//	DELETE /api/entries/{issuer}/{account}       delete an entry
+//
+// and GET /{issuer}/{account}, the current code of an entry in plain text,
+// or in JSON if asked with Accept: application/json or ?format=json. With
+// serveQR, GET /{issuer}/{account}/qr.png serves its provisioning QR code,
+// which holds the secret. With readOnly, the routes that modify the store are
+// left out.
+func registerAPI(mux *http.ServeMux, c *cli.Context, readOnly, serveQR bool) {
+	if serveQR {
+		registerQR(mux, c)
+	}
+	mux.HandleFunc("GET /{issuer}/{account}", func(w http.ResponseWriter, r *http.Request) {
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		code, err := tenantOf(r).code(c, r.PathValue("issuer"), r.PathValue("account"), r.URL.Query().Get("owner"))
+		if err == nil {
+			audit(r).servedCode(code.Issuer, code.Account)
+		}
+		asJSON := r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+		switch {
+		case err != nil && asJSON:
+			apiError(w, err)
+		case err != nil:
+			http.Error(w, err.Error(), errorStatus(err))
+		case asJSON:
+			writeJSON(w, http.StatusOK, code)
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, code.Code)
+		}
+	})
+	mux.HandleFunc("GET /api/entries", func(w http.ResponseWriter, r *http.Request) {
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		out, err := listEntries(c)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tenantOf(r).entries(out))
+	})
+	mux.HandleFunc("GET /api/entries/{issuer}/{account}/code", func(w http.ResponseWriter, r *http.Request) {
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		code, err := tenantOf(r).code(c, r.PathValue("issuer"), r.PathValue("account"), r.URL.Query().Get("owner"))
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		audit(r).servedCode(code.Issuer, code.Account)
+		writeJSON(w, http.StatusOK, code)
+	})
+	if readOnly {
+		return
+	}
+	mux.HandleFunc("POST /api/entries", func(w http.ResponseWriter, r *http.Request) {
+		var in apiEntry
+		if err := readJSON(w, r, &in); err != nil {
+			apiError(w, err)
+			return
+		}
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		issuer := in.Issuer
+		in.Issuer = tenantOf(r).own(issuer)
+		created, err := putEntry(c, in, false)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		in.Issuer, created.Issuer = issuer, issuer
+		w.Header().Set("Location", entryURL(in.Issuer, in.Account))
+		writeJSON(w, http.StatusCreated, created)
+	})
+	mux.HandleFunc("PUT /api/entries/{issuer}/{account}", func(w http.ResponseWriter, r *http.Request) {
+		var in apiEntry
+		if err := readJSON(w, r, &in); err != nil {
+			apiError(w, err)
+			return
+		}
+		issuer, account := r.PathValue("issuer"), r.PathValue("account")
+		if (in.Issuer != "" && in.Issuer != issuer) || (in.Account != "" && in.Account != account) {
+			apiError(w, apiStatus(http.StatusBadRequest, errors.New("issuer and account of the body do not match the URL")))
+			return
+		}
+		in.Issuer, in.Account = tenantOf(r).own(issuer), account
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		existed, err := entryExists(c, in.Issuer, account)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		out, err := putEntry(c, in, true)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		out.Issuer = issuer
+		status := http.StatusOK
+		if !existed {
+			w.Header().Set("Location", entryURL(issuer, account))
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, out)
+	})
+	mux.HandleFunc("DELETE /api/entries/{issuer}/{account}", func(w http.ResponseWriter, r *http.Request) {
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		if err := deleteEntry(c, tenantOf(r).own(r.PathValue("issuer")), r.PathValue("account")); err != nil {
+			apiError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// registerQR serves the provisioning QR codes of the entries. They hold the
+// secrets, so they are only served behind authentication, and never to read
+// API tokens.
+func registerQR(mux *http.ServeMux, c *cli.Context) {
+	mux.HandleFunc("GET /{issuer}/{account}/qr.png", func(w http.ResponseWriter, r *http.Request) {
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		png, err := entryQR(c, tenantOf(r).own(r.PathValue("issuer")), r.PathValue("account"))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		audit(r).servedSecret(r.PathValue("issuer"), r.PathValue("account"))
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(png)
+	})
+}
+
+func entryURL(issuer, account string) string {
+	return "/api/entries/" + url.PathEscape(issuer) + "/" + url.PathEscape(account)
+}
+
+// listEntries returns the names of the entries, without their secrets.
+func listEntries(c *cli.Context) ([]apiEntry, error) {
+	s, err := openstore(c, false)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]apiEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, apiEntry{Account: e.Account, Issuer: e.Issuer})
+	}
+	return out, nil
+}
+
+// entryCode returns the current code of the entry.
+func entryCode(c *cli.Context, issuer, account string) (apiCode, error) {
+	priv, err := privkeyfile(c.GlobalString("private-key"))
+	if err != nil {
+		return apiCode{}, err
+	}
+	s, err := openstore(c, false)
+	if err != nil {
+		return apiCode{}, err
+	}
+	defer s.Close()
+	e, err := s.Get(account, issuer)
+	if err != nil {
+		return apiCode{}, fmt.Errorf("%s/%s: %w", issuer, account, err)
+	}
+	secret, err := priv.secret(e)
+	if err != nil {
+		decryptionErrors.Add(1)
+		return apiCode{}, secretError(priv, e, err)
+	}
+	code, err := currentCode(secret)
+	if err != nil {
+		return apiCode{}, err
+	}
+	return apiCode{Account: account, Issuer: issuer, Code: code, ExpiresIn: 30 - time.Now().Unix()%30}, nil
+}
+
+// entryQR returns the provisioning QR code of the entry, as PNG.
+func entryQR(c *cli.Context, issuer, account string) ([]byte, error) {
+	priv, err := privkeyfile(c.GlobalString("private-key"))
+	if err != nil {
+		return nil, err
+	}
+	s, err := openstore(c, false)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	e, err := s.Get(account, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", issuer, account, err)
+	}
+	secret, err := priv.secret(e)
+	if err != nil {
+		decryptionErrors.Add(1)
+		return nil, secretError(priv, e, err)
+	}
+	code, err := provisioningQR(issuer, account, string(secret))
+	wipe(secret)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(), nil
+}
+
+func entryExists(c *cli.Context, issuer, account string) (bool, error) {
+	s, err := openstore(c, false)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+	_, err = s.Get(account, issuer)
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// putEntry adds the entry like otp add does. Existing entries are only
+// replaced when replace is set, after an automatic backup.
+func putEntry(c *cli.Context, in apiEntry, replace bool) (apiEntry, error) {
+	switch {
+	case in.Secret == "":
+		return apiEntry{}, apiStatus(http.StatusBadRequest, errors.New("secret key is missing"))
+	case in.Issuer == "":
+		return apiEntry{}, apiStatus(http.StatusBadRequest, errors.New("issuer is missing"))
+	case in.Account == "":
+		return apiEntry{}, apiStatus(http.StatusBadRequest, errors.New("account name is missing"))
+	}
+	if err := validSecret(in.Secret); err != nil {
+		return apiEntry{}, apiStatus(http.StatusBadRequest, err)
+	}
+	if c.GlobalBool("read-only") {
+		return apiEntry{}, apiStatus(http.StatusForbidden, errors.New("cannot modify the store in read-only mode"))
+	}
+	priv, err := privkeyfile(c.GlobalString("private-key"))
+	if err != nil {
+		return apiEntry{}, err
+	}
+	enckey, err := priv.encrypted([]byte(in.Secret), cryptlabel(in.Account, in.Issuer))
+	if err != nil {
+		return apiEntry{}, err
+	}
+	enckey = tagged([]byte(in.Secret), in.Account, in.Issuer, priv.public(), enckey)
+
+	unlock, err := lockdb(c)
+	if err != nil {
+		return apiEntry{}, err
+	}
+	defer unlock()
+	s, err := openstore(c, true)
+	if err != nil {
+		return apiEntry{}, err
+	}
+	defer s.Close()
+	if _, err := s.Get(in.Account, in.Issuer); err == nil {
+		if !replace {
+			return apiEntry{}, apiStatus(http.StatusConflict, fmt.Errorf("%s/%s already exists", in.Issuer, in.Account))
+		}
+		if err := autobackup(c, s); err != nil {
+			return apiEntry{}, err
+		}
+	} else if !errors.Is(err, errNotFound) {
+		return apiEntry{}, err
+	}
+	if err := s.Put(entry{Account: in.Account, Issuer: in.Issuer, Password: enckey}); err != nil {
+		return apiEntry{}, err
+	}
+	return apiEntry{Account: in.Account, Issuer: in.Issuer}, nil
+}
+
+// deleteEntry deletes the entry like otp rm does.
+func deleteEntry(c *cli.Context, issuer, account string) error {
+	if c.GlobalBool("read-only") {
+		return apiStatus(http.StatusForbidden, errors.New("cannot modify the store in read-only mode"))
+	}
+	unlock, err := lockdb(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := openstore(c, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if _, err := s.Get(account, issuer); err != nil {
+		return fmt.Errorf("%s/%s: %w", issuer, account, err)
+	}
+	if err := autobackup(c, s); err != nil {
+		return err
+	}
+	return s.Delete(account, issuer)
+}
+
+// statusError is an error with the HTTP status it is reported with.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e statusError) Error() string { return e.err.Error() }
+func (e statusError) Unwrap() error { return e.err }
+
+func apiStatus(status int, err error) error {
+	return statusError{status: status, err: err}
+}
+
+// readJSON decodes the body of the request, which must be sent as
+// application/json: the browsers send other types cross-origin without asking
+// first, as simple requests.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return apiStatus(http.StatusUnsupportedMediaType, errors.New("the request body must be application/json"))
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apiStatus(http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+	}
+	return nil
+}
+
+// errorStatus returns the status of statusError, or the one that fits the
+// store errors. Unexpected errors are logged.
+func errorStatus(err error) int {
+	var se statusError
+	switch {
+	case errors.As(err, &se):
+		return se.status
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNotInitialized):
+		return http.StatusServiceUnavailable
+	}
+	log.Println(err)
+	return http.StatusInternalServerError
+}
+
+// apiError reports the error as {"error": "..."}. Unexpected errors, which
+// may tell about the store and the keys, are only logged.
+func apiError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	msg := err.Error()
+	var se statusError
+	if status == http.StatusInternalServerError && !errors.As(err, &se) {
+		msg = http.StatusText(status)
+	}
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
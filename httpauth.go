@@ -0,0 +1,90 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// httpAuth only lets through the requests that carry the bearer token, or
+// the basic authentication credentials, given to otp http. basicAuth is
+// user:hash, with a bcrypt hash of the password as written by htpasswd -B.
+// With apiTokens, the API tokens it finds are taken too, and read tokens are
+// only let through for GET and HEAD requests, but never for the QR codes.
+// Without any of them, every request is let through.
+func httpAuth(next http.Handler, token, basicAuth string, apiTokens func(string) (apiToken, error)) (http.Handler, error) {
+	var user string
+	var hash []byte
+	if basicAuth != "" {
+		u, h, ok := strings.Cut(basicAuth, ":")
+		if !ok || u == "" {
+			return nil, errors.New("--basic-auth must be user:hash")
+		}
+		if _, err := bcrypt.Cost([]byte(h)); err != nil {
+			return nil, errors.New("--basic-auth needs a bcrypt hash of the password, as made by htpasswd -nbB")
+		}
+		user, hash = u, []byte(h)
+	}
+	if token == "" && hash == nil && apiTokens == nil {
+		return next, nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+			if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+				audit(r).authenticated("token")
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && apiTokens != nil {
+			t, err := apiTokens(bearer)
+			switch {
+			case err == nil && t.scope == scopeRead && r.Method != http.MethodGet && r.Method != http.MethodHead:
+				audit(r).authenticated("token:" + strconv.FormatInt(t.id, 10))
+				http.Error(w, "the token is read-only", http.StatusForbidden)
+				return
+			case err == nil && t.scope == scopeRead && strings.HasSuffix(r.URL.Path, "/qr.png"):
+				audit(r).authenticated("token:" + strconv.FormatInt(t.id, 10))
+				http.Error(w, "the token is read-only and cannot get the secrets of the QR codes", http.StatusForbidden)
+				return
+			case err == nil:
+				audit(r).authenticated("token:" + strconv.FormatInt(t.id, 10))
+				next.ServeHTTP(w, r)
+				return
+			case !errors.Is(err, errNotFound):
+				log.Println("cannot check API token:", err)
+			}
+		}
+		if u, password, ok := r.BasicAuth(); ok && hash != nil {
+			userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+			if bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && userOK {
+				audit(r).authenticated("basic:" + u)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if hash != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="otp", charset="UTF-8"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}), nil
+}
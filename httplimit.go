@@ -0,0 +1,168 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// httpLimiter limits the rate of the requests of every client address, and
+// locks out for a while the addresses that fail to authenticate too many
+// times, as told by the 401 responses of the handlers it wraps.
+type httpLimiter struct {
+	next     http.Handler
+	rate     float64
+	burst    float64
+	failures int
+	lockout  time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*httpClient
+	lastSweep time.Time
+}
+
+type httpClient struct {
+	tokens   float64
+	seen     time.Time
+	failed   []time.Time
+	lockedTo time.Time
+}
+
+// httpLimit wraps next with the limits: rate requests per second with bursts
+// of burst requests, and a lockout after failures failed authentications
+// within the lockout duration. A zero rate or failures disables each limit.
+func httpLimit(next http.Handler, rate float64, burst, failures int, lockout time.Duration) http.Handler {
+	if rate <= 0 && failures <= 0 {
+		return next
+	}
+	return &httpLimiter{
+		next:     next,
+		rate:     rate,
+		burst:    math.Max(float64(burst), 1),
+		failures: failures,
+		lockout:  lockout,
+		clients:  make(map[string]*httpClient),
+	}
+}
+
+func (l *httpLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if wait := l.admit(addr, time.Now()); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	l.next.ServeHTTP(rec, r)
+	if rec.status == http.StatusUnauthorized && l.failures > 0 {
+		l.fail(addr, time.Now())
+	}
+}
+
+// admit takes a token of the client, returning how long it has to wait
+// when it is locked out or out of tokens.
+func (l *httpLimiter) admit(addr string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	cl, ok := l.clients[addr]
+	if !ok {
+		cl = &httpClient{tokens: l.burst, seen: now}
+		l.clients[addr] = cl
+	}
+	if now.Before(cl.lockedTo) {
+		return cl.lockedTo.Sub(now)
+	}
+	if l.rate <= 0 {
+		cl.seen = now
+		return 0
+	}
+	cl.tokens = math.Min(l.burst, cl.tokens+now.Sub(cl.seen).Seconds()*l.rate)
+	cl.seen = now
+	if cl.tokens < 1 {
+		return time.Duration((1 - cl.tokens) / l.rate * float64(time.Second))
+	}
+	cl.tokens--
+	return 0
+}
+
+func (l *httpLimiter) fail(addr string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cl, ok := l.clients[addr]
+	if !ok {
+		return
+	}
+	recent := cl.failed[:0]
+	for _, t := range cl.failed {
+		if now.Sub(t) < l.lockout {
+			recent = append(recent, t)
+		}
+	}
+	cl.failed = append(recent, now)
+	if len(cl.failed) >= l.failures {
+		cl.failed = nil
+		cl.lockedTo = now.Add(l.lockout)
+		log.Printf("locked out %s for %s after %d failed authentications", addr, l.lockout, l.failures)
+	}
+}
+
+// sweep forgets the clients that are neither limited nor locked out.
+func (l *httpLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for addr, cl := range l.clients {
+		idle := now.Sub(cl.seen)
+		refilled := l.rate <= 0 || cl.tokens+idle.Seconds()*l.rate >= l.burst
+		if refilled && idle >= l.lockout && now.After(cl.lockedTo) {
+			delete(l.clients, addr)
+		}
+	}
+}
+
+// statusRecorder records the status of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
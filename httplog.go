@@ -0,0 +1,126 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord collects what the handlers know of a request for the access
+// log: who made it, and which entries it was served.
+type auditRecord struct {
+	mu        sync.Mutex
+	principal string
+	codes     []string
+	secrets   []string
+}
+
+type auditKey struct{}
+
+// audit returns the record of the request, which is nil, and ignores
+// everything, when there is no access log.
+func audit(r *http.Request) *auditRecord {
+	rec, _ := r.Context().Value(auditKey{}).(*auditRecord)
+	return rec
+}
+
+// authenticated records who made the request.
+func (a *auditRecord) authenticated(principal string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.principal = principal
+}
+
+// servedCode records that the current code of the entry was served.
+func (a *auditRecord) servedCode(issuer, account string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.codes = append(a.codes, issuer+"/"+account)
+}
+
+// servedSecret records that the secret of the entry was served, as by its
+// QR code.
+func (a *auditRecord) servedSecret(issuer, account string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.secrets = append(a.secrets, issuer+"/"+account)
+}
+
+// accessLog logs every request as a JSON line to the file, or to the
+// standard error if the file is "-".
+func accessLog(next http.Handler, fn string) (http.Handler, io.Closer, error) {
+	var out io.WriteCloser = nopWriteCloser{os.Stderr}
+	if fn != "-" {
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot open access log: %w", err)
+		}
+		out = f
+	}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &auditRecord{principal: "anonymous"}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			rec.principal = "cert:" + r.TLS.PeerCertificates[0].Subject.String()
+		}
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("client", r.RemoteAddr),
+			slog.String("principal", rec.principal),
+			slog.Int("status", sw.status),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if len(rec.codes) > 0 {
+			attrs = append(attrs, slog.Any("codes", rec.codes))
+		}
+		if len(rec.secrets) > 0 {
+			attrs = append(attrs, slog.Any("secrets", rec.secrets))
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	}), out, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,543 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	otp "github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	loginCookie     = "otp_session"
+	loginChallenges = 2 * time.Minute
+)
+
+// webLogin gates the web interface behind a login page: the master
+// passphrase, checked against its bcrypt hash, plus either a code of a TOTP
+// dedicated to the login or an enrolled security key (WebAuthn). Sessions
+// expire after being idle for a while.
+type webLogin struct {
+	hash      []byte
+	totp      string
+	credsfn   string
+	canEnroll bool
+	idle      time.Duration
+	// origin and rpID are the origin of the web interface and the relying
+	// party ID of the security keys, as configured rather than taken from
+	// the requests.
+	origin, rpID string
+
+	mu       sync.Mutex
+	lastStep int64
+	sessions map[string]*loginSession
+	// challenges are the pending WebAuthn ceremonies, by challenge.
+	challenges map[string]time.Time
+
+	// credsMu serializes the updates of the security keys file.
+	credsMu sync.Mutex
+}
+
+func newWebLogin(hash, totpSecret, credsfn string, canEnroll bool, idle time.Duration, origin, rpID string) (*webLogin, error) {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return nil, errors.New("--login-passphrase-hash needs a bcrypt hash of the passphrase, as made by htpasswd -nbB")
+	}
+	totpSecret = strings.ToUpper(strings.ReplaceAll(totpSecret, " ", ""))
+	if totpSecret != "" {
+		if err := validSecret(totpSecret); err != nil {
+			return nil, errors.New("--login-totp-secret: " + err.Error())
+		}
+	}
+	if idle <= 0 {
+		return nil, errors.New("--session-idle must be positive")
+	}
+	l := &webLogin{
+		hash:       []byte(hash),
+		totp:       totpSecret,
+		credsfn:    credsfn,
+		canEnroll:  canEnroll,
+		idle:       idle,
+		origin:     origin,
+		rpID:       rpID,
+		sessions:   make(map[string]*loginSession),
+		challenges: make(map[string]time.Time),
+	}
+	creds, err := readWebAuthnCredentials(credsfn)
+	if err != nil {
+		return nil, err
+	}
+	if origin != "" || rpID != "" || canEnroll || len(creds) > 0 {
+		if l.origin, l.rpID, err = webauthnOrigin(origin, rpID); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case totpSecret != "" || len(creds) > 0:
+	case canEnroll:
+		log.Println("warning: no second factor yet, the passphrase alone logs in until a security key is enrolled at /login/enroll")
+	default:
+		return nil, errors.New("the login needs --login-totp-secret, an enrolled security key, or --webauthn-enroll to enroll one")
+	}
+	return l, nil
+}
+
+// handler serves the login pages and lets through only the requests of
+// live sessions.
+func (l *webLogin) handler(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /login", l.page)
+	mux.HandleFunc("POST /login", l.login)
+	mux.HandleFunc("POST /login/challenge", l.challenge)
+	mux.HandleFunc("POST /login/webauthn", l.loginWebAuthn)
+	mux.HandleFunc("POST /logout", l.logout)
+	enroll := http.NewServeMux()
+	enroll.HandleFunc("GET /login/enroll", l.enrollPage)
+	enroll.HandleFunc("POST /login/enroll", l.enroll)
+	enroll.Handle("/", next)
+	mux.Handle("/", l.session(enroll))
+	return mux
+}
+
+// loginSession is a live session, and how it was logged in, for the access
+// log.
+type loginSession struct {
+	seen time.Time
+	how  string
+}
+
+func (l *webLogin) session(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(loginCookie)
+		if err != nil {
+			cookie = &http.Cookie{}
+		}
+		if how, ok := l.touch(cookie.Value); ok {
+			audit(r).authenticated("login:" + how)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// touch reports whether the session is live, and how it was logged in, and
+// keeps it alive.
+func (l *webLogin) touch(id string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for s, sess := range l.sessions {
+		if now.Sub(sess.seen) > l.idle {
+			delete(l.sessions, s)
+		}
+	}
+	sess, ok := l.sessions[id]
+	if !ok {
+		return "", false
+	}
+	sess.seen = now
+	return sess.how, true
+}
+
+// start logs in a new session; how tells the factor used.
+func (l *webLogin) start(w http.ResponseWriter, r *http.Request, how string) {
+	id := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	l.mu.Lock()
+	l.sessions[id] = &loginSession{seen: time.Now(), how: how}
+	l.mu.Unlock()
+	audit(r).authenticated("login:" + how)
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (l *webLogin) logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(loginCookie); err == nil {
+		l.mu.Lock()
+		delete(l.sessions, cookie.Value)
+		l.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (l *webLogin) checkPassphrase(passphrase string) bool {
+	return bcrypt.CompareHashAndPassword(l.hash, []byte(passphrase)) == nil
+}
+
+// checkTOTP accepts the codes of the previous, current and next time steps,
+// but never a code of a step already used.
+func (l *webLogin) checkTOTP(code string) bool {
+	if l.totp == "" || code == "" {
+		return false
+	}
+	now := time.Now()
+	step := now.Unix() / 30
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for skew := int64(-1); skew <= 1; skew++ {
+		if step+skew <= l.lastStep {
+			continue
+		}
+		want, err := otp.GenerateCode(l.totp, now.Add(time.Duration(skew)*30*time.Second))
+		if err == nil && hmac.Equal([]byte(code), []byte(want)) {
+			l.lastStep = step + skew
+			return true
+		}
+	}
+	return false
+}
+
+func (l *webLogin) bootstrapping() bool {
+	if l.totp != "" || !l.canEnroll {
+		return false
+	}
+	creds, err := readWebAuthnCredentials(l.credsfn)
+	return err == nil && len(creds) == 0
+}
+
+func (l *webLogin) login(w http.ResponseWriter, r *http.Request) {
+	passphrase, code := r.PostFormValue("passphrase"), strings.TrimSpace(r.PostFormValue("code"))
+	okPassphrase := l.checkPassphrase(passphrase)
+	how := "totp"
+	switch {
+	case okPassphrase && l.bootstrapping():
+		log.Println("login with the passphrase alone: enroll a security key")
+		how = "passphrase"
+	case okPassphrase && l.checkTOTP(code):
+	default:
+		log.Println("failed login from", r.RemoteAddr)
+		l.renderPage(w, http.StatusUnauthorized, "wrong passphrase or code")
+		return
+	}
+	l.start(w, r, how)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// newChallenge returns a challenge for a WebAuthn ceremony, valid for a
+// single use in the next couple of minutes.
+func (l *webLogin) newChallenge() []byte {
+	challenge := randomBytes(32)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for ch, expires := range l.challenges {
+		if now.After(expires) {
+			delete(l.challenges, ch)
+		}
+	}
+	l.challenges[string(challenge)] = now.Add(loginChallenges)
+	return challenge
+}
+
+func (l *webLogin) useChallenge(clientDataJSON []byte) ([]byte, bool) {
+	var cd webauthnClientData
+	if json.Unmarshal(clientDataJSON, &cd) != nil {
+		return nil, false
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil {
+		return nil, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires, ok := l.challenges[string(challenge)]
+	delete(l.challenges, string(challenge))
+	return challenge, ok && time.Now().Before(expires)
+}
+
+// webauthnOrigin checks the origin of the web interface given by
+// --webauthn-origin, and the relying party ID given by --webauthn-rp-id, which
+// defaults to the host name of the origin. They are never taken from the
+// requests, whose Host header the client picks.
+func webauthnOrigin(origin, rpID string) (string, string, error) {
+	u, err := url.Parse(origin)
+	if origin == "" || err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return "", "", errors.New("security keys need --webauthn-origin, the URL the browser opens the web interface at, such as https://otp.example.com")
+	}
+	host := u.Hostname()
+	if rpID == "" {
+		rpID = host
+	}
+	if host != rpID && !strings.HasSuffix(host, "."+rpID) {
+		return "", "", fmt.Errorf("--webauthn-rp-id %s must be the host name of --webauthn-origin or one of its parent domains", rpID)
+	}
+	return u.Scheme + "://" + u.Host, rpID, nil
+}
+
+type webauthnOptions struct {
+	Challenge   []byte   `json:"challenge"`
+	RPID        string   `json:"rp_id"`
+	Credentials [][]byte `json:"credentials,omitempty"`
+}
+
+// challenge starts the login with a security key, once the passphrase is
+// known to be right.
+func (l *webLogin) challenge(w http.ResponseWriter, r *http.Request) {
+	if !l.checkPassphrase(r.PostFormValue("passphrase")) {
+		log.Println("failed login from", r.RemoteAddr)
+		http.Error(w, "wrong passphrase", http.StatusUnauthorized)
+		return
+	}
+	creds, err := readWebAuthnCredentials(l.credsfn)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "cannot read security keys", http.StatusInternalServerError)
+		return
+	} else if len(creds) == 0 {
+		http.Error(w, "no security key enrolled", http.StatusBadRequest)
+		return
+	} else if l.origin == "" {
+		http.Error(w, "security keys need --webauthn-origin", http.StatusBadRequest)
+		return
+	}
+	opts := webauthnOptions{Challenge: l.newChallenge(), RPID: l.rpID}
+	for _, cred := range creds {
+		opts.Credentials = append(opts.Credentials, cred.ID)
+	}
+	writeJSON(w, http.StatusOK, opts)
+}
+
+type webauthnResponse struct {
+	CredentialID      []byte `json:"credential_id"`
+	ClientDataJSON    []byte `json:"client_data"`
+	AuthenticatorData []byte `json:"authenticator_data"`
+	Signature         []byte `json:"signature"`
+	AttestationObject []byte `json:"attestation_object"`
+}
+
+func (l *webLogin) loginWebAuthn(w http.ResponseWriter, r *http.Request) {
+	var resp webauthnResponse
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&resp); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	challenge, ok := l.useChallenge(resp.ClientDataJSON)
+	if !ok {
+		http.Error(w, "challenge expired, try again", http.StatusUnauthorized)
+		return
+	}
+	// The passphrase was checked when the challenge was issued.
+	l.credsMu.Lock()
+	defer l.credsMu.Unlock()
+	creds, err := readWebAuthnCredentials(l.credsfn)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "cannot read security keys", http.StatusInternalServerError)
+		return
+	}
+	for i := range creds {
+		if !bytes.Equal(creds[i].ID, resp.CredentialID) {
+			continue
+		}
+		if err := webauthnVerify(&creds[i], resp.ClientDataJSON, resp.AuthenticatorData, resp.Signature, challenge, l.origin, l.rpID); err != nil {
+			log.Println("failed login from", r.RemoteAddr+":", err)
+			http.Error(w, "security key not accepted", http.StatusUnauthorized)
+			return
+		}
+		if err := writeWebAuthnCredentials(l.credsfn, creds); err != nil {
+			log.Println(err)
+			http.Error(w, "cannot update security keys", http.StatusInternalServerError)
+			return
+		}
+		l.start(w, r, "webauthn:"+hex.EncodeToString(creds[i].ID[:min(len(creds[i].ID), 8)]))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Println("failed login from", r.RemoteAddr+": unknown security key")
+	http.Error(w, "security key not accepted", http.StatusUnauthorized)
+}
+
+func (l *webLogin) enrollPage(w http.ResponseWriter, r *http.Request) {
+	if !l.canEnroll {
+		http.Error(w, "enrolling is disabled; restart otp http with --webauthn-enroll", http.StatusForbidden)
+		return
+	}
+	renderLogin(w, http.StatusOK, loginPage{Enroll: true, Options: webauthnOptions{Challenge: l.newChallenge(), RPID: l.rpID}})
+}
+
+func (l *webLogin) enroll(w http.ResponseWriter, r *http.Request) {
+	if !l.canEnroll {
+		http.Error(w, "enrolling is disabled; restart otp http with --webauthn-enroll", http.StatusForbidden)
+		return
+	}
+	var resp webauthnResponse
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&resp); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	challenge, ok := l.useChallenge(resp.ClientDataJSON)
+	if !ok {
+		http.Error(w, "challenge expired, reload the page", http.StatusBadRequest)
+		return
+	}
+	cred, err := webauthnRegister(resp.ClientDataJSON, resp.AttestationObject, challenge, l.origin, l.rpID)
+	if err != nil {
+		http.Error(w, "security key not accepted: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.credsMu.Lock()
+	defer l.credsMu.Unlock()
+	creds, err := readWebAuthnCredentials(l.credsfn)
+	if err == nil {
+		err = writeWebAuthnCredentials(l.credsfn, append(creds, cred))
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "cannot save security key", http.StatusInternalServerError)
+		return
+	}
+	log.Println("security key enrolled from", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+type loginPage struct {
+	Error     string
+	TOTP      bool
+	WebAuthn  bool
+	Bootstrap bool
+	Enroll    bool
+	Options   webauthnOptions
+}
+
+func (l *webLogin) page(w http.ResponseWriter, r *http.Request) {
+	l.renderPage(w, http.StatusOK, "")
+}
+
+func (l *webLogin) renderPage(w http.ResponseWriter, status int, msg string) {
+	creds, _ := readWebAuthnCredentials(l.credsfn)
+	renderLogin(w, status, loginPage{
+		Error:     msg,
+		TOTP:      l.totp != "",
+		WebAuthn:  len(creds) > 0,
+		Bootstrap: l.bootstrapping(),
+	})
+}
+
+func renderLogin(w http.ResponseWriter, status int, p loginPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginTemplate.Execute(w, p); err != nil {
+		log.Println(err)
+	}
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>otp</title></head><body>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+{{if .Enroll}}
+<p>Touch the security key to enroll it for the login.</p>
+<button id="enroll">Enroll security key</button>
+<p id="status"></p>
+{{else}}
+<form method="post" action="/login">
+<p><label>Passphrase <input type="password" name="passphrase" id="passphrase" autofocus required></label></p>
+{{if .TOTP}}<p><label>Code <input name="code" inputmode="numeric" autocomplete="one-time-code"></label></p>
+<p><button type="submit">Log in</button></p>{{end}}
+{{if .Bootstrap}}<p>No second factor is enrolled yet: log in with the passphrase, then enroll a security key at <a href="/login/enroll">/login/enroll</a>.</p>
+<p><button type="submit">Log in</button></p>{{end}}
+</form>
+{{if .WebAuthn}}<p><button id="webauthn">Log in with a security key</button></p>
+<p id="status"></p>{{end}}
+{{end}}
+<script>
+const b64 = s => Uint8Array.from(atob(s), c => c.charCodeAt(0));
+const enc = b => btoa(String.fromCharCode(...new Uint8Array(b)));
+const status = msg => document.getElementById("status").textContent = msg;
+{{if .Enroll}}
+document.getElementById("enroll").onclick = async () => {
+	const opts = {{.Options}};
+	try {
+		const cred = await navigator.credentials.create({publicKey: {
+			challenge: b64(opts.challenge),
+			rp: {id: opts.rp_id, name: "otp"},
+			user: {id: crypto.getRandomValues(new Uint8Array(16)), name: "otp", displayName: "otp"},
+			pubKeyCredParams: [{type: "public-key", alg: -7}, {type: "public-key", alg: -8}],
+			attestation: "none",
+		}});
+		const resp = await fetch("/login/enroll", {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify({
+			client_data: enc(cred.response.clientDataJSON),
+			attestation_object: enc(cred.response.attestationObject),
+		})});
+		status(resp.ok ? "Security key enrolled." : await resp.text());
+	} catch (e) {
+		status(e.message);
+	}
+};
+{{else if .WebAuthn}}
+document.getElementById("webauthn").onclick = async () => {
+	try {
+		let resp = await fetch("/login/challenge", {method: "POST", body: new URLSearchParams({passphrase: document.getElementById("passphrase").value})});
+		if (!resp.ok) {
+			status(await resp.text());
+			return;
+		}
+		const opts = await resp.json();
+		const cred = await navigator.credentials.get({publicKey: {
+			challenge: b64(opts.challenge),
+			rpId: opts.rp_id,
+			allowCredentials: opts.credentials.map(id => ({type: "public-key", id: b64(id)})),
+		}});
+		resp = await fetch("/login/webauthn", {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify({
+			credential_id: enc(cred.rawId),
+			client_data: enc(cred.response.clientDataJSON),
+			authenticator_data: enc(cred.response.authenticatorData),
+			signature: enc(cred.response.signature),
+		})});
+		if (resp.ok) {
+			location = "/";
+		} else {
+			status(await resp.text());
+		}
+	} catch (e) {
+		status(e.message);
+	}
+};
+{{end}}
+</script>
+</body></html>
+`))
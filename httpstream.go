@@ -0,0 +1,107 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// registerStream adds GET /stream, which pushes the codes as server-sent
+// events: a "codes" event, like the response of /api/codes, when the stream
+// starts and at every new time step, and a "tick" event with the seconds
+// left every second in between. The stream is limited to the entries given
+// as ?entry=ISSUER/ACCOUNT, which may be repeated, and to those matching
+// ?q=.
+func registerStream(mux *http.ServeMux, c *cli.Context) {
+	mux.HandleFunc("GET /stream", func(w http.ResponseWriter, r *http.Request) {
+		subscribed := make(map[[2]string]bool)
+		for _, e := range r.URL.Query()["entry"] {
+			issuer, account, ok := strings.Cut(e, "/")
+			if !ok {
+				http.Error(w, "entry must be ISSUER/ACCOUNT", http.StatusBadRequest)
+				return
+			}
+			subscribed[[2]string{issuer, account}] = true
+		}
+		query := r.URL.Query().Get("q")
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+		send := func(event string, v any) error {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		audited := false
+		step := int64(-1)
+		for {
+			var err error
+			now := time.Now()
+			if now.Unix()/30 != step {
+				step = now.Unix() / 30
+				codes, cerr := currentCodes(c)
+				if cerr == nil {
+					codes, cerr = codes.view(tenantOf(r))
+				}
+				if cerr != nil {
+					// The error may tell about the store and the keys.
+					log.Println(cerr)
+					err = send("error", map[string]string{"error": "cannot generate the codes"})
+				} else {
+					filtered := make([]apiCode, 0, len(codes.Codes))
+					for _, code := range codes.Codes {
+						if (len(subscribed) == 0 || subscribed[[2]string{code.Issuer, code.Account}]) && matches(query, code) {
+							filtered = append(filtered, code)
+							if !audited {
+								audit(r).servedCode(code.Issuer, code.Account)
+							}
+						}
+					}
+					audited = true
+					codes.Codes = filtered
+					err = send("codes", codes)
+				}
+			} else {
+				err = send("tick", map[string]int64{"expires_in": 30 - now.Unix()%30})
+			}
+			if err != nil {
+				// The client went away.
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -0,0 +1,379 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// httpUsers are the users of otp http --users, and the entries shared
+// between them. Each user has a namespace in the store: the issuers of
+// their entries are prefixed with their name and a slash, as in
+// alice/GitHub. With ldap or oidc, users are also logged in by the
+// directory or the provider, and need not be listed. The names of the users
+// of the provider end with its scope, which the other users cannot log in
+// as.
+type httpUsers struct {
+	fn   string
+	ldap *ldapAuth
+	oidc *oidcLogin
+
+	mu     sync.Mutex
+	Users  map[string]*httpUser `json:"users"`
+	Shares []httpShare          `json:"shares"`
+}
+
+// httpUser is a user of otp http --users, with a bcrypt hash of their
+// password as made by htpasswd -nbB, unless they log in with LDAP or OIDC.
+// Admins manage the shares.
+type httpUser struct {
+	Password string `json:"password,omitempty"`
+	Admin    bool   `json:"admin,omitempty"`
+}
+
+// httpShare grants User read-only access to the entry Issuer/Account of
+// Owner.
+type httpShare struct {
+	User    string `json:"user"`
+	Owner   string `json:"owner"`
+	Issuer  string `json:"issuer"`
+	Account string `json:"account"`
+}
+
+// dummyHash is compared against for unknown users, so they take as long to
+// reject as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("otp"), bcrypt.DefaultCost)
+
+func loadHTTPUsers(fn string, ldap *ldapAuth, oidc *oidcLogin) (*httpUsers, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read users: %w", err)
+	}
+	users := &httpUsers{fn: fn, ldap: ldap, oidc: oidc}
+	external := ldap != nil || oidc != nil
+	if err := json.Unmarshal(data, users); err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %w", fn, err)
+	}
+	if len(users.Users) == 0 && !external {
+		return nil, fmt.Errorf("no users in %s", fn)
+	}
+	for name, u := range users.Users {
+		if name == "" || strings.ContainsAny(name, "/:") {
+			return nil, fmt.Errorf("invalid user name %q: it cannot be empty or have / or :", name)
+		}
+		if u == nil {
+			u = &httpUser{}
+			users.Users[name] = u
+		}
+		if oidc != nil && strings.HasSuffix(name, oidc.scope) {
+			if u.Password != "" {
+				return nil, fmt.Errorf("user %s is a user of the OIDC provider and cannot have a password", name)
+			}
+			continue
+		}
+		if u.Password == "" && external {
+			// Logged in by the directory or the provider.
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return nil, fmt.Errorf("user %s needs a bcrypt hash of the password, as made by htpasswd -nbB", name)
+		}
+	}
+	return users, nil
+}
+
+// save writes the users file back, after the shares change.
+func (u *httpUsers) save() error {
+	data, err := json.MarshalIndent(u, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(u.fn, append(data, '\n'), 0o600)
+}
+
+func (u *httpUsers) shared(user, owner, issuer, account string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, s := range u.Shares {
+		if s == (httpShare{User: user, Owner: owner, Issuer: issuer, Account: account}) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler lets through the requests of the users, who are then the tenants
+// of the requests: with the basic authentication of a user with a password,
+// or checked against the LDAP directory, or of a session logged in with the
+// OIDC provider.
+func (u *httpUsers) handler(next http.Handler) http.Handler {
+	serve := func(w http.ResponseWriter, r *http.Request, name string) {
+		t := &tenant{name: name, users: u}
+		if user, ok := u.Users[name]; ok {
+			t.admin = user.Admin
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+	}
+	authed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u.oidc != nil {
+			if name, ok := u.oidc.user(r); ok {
+				audit(r).authenticated("oidc:" + name)
+				serve(w, r, name)
+				return
+			}
+		}
+		if name, password, ok := r.BasicAuth(); ok {
+			if how, ok := u.checkPassword(name, password); ok {
+				audit(r).authenticated(how + ":" + name)
+				serve(w, r, name)
+				return
+			}
+		}
+		if u.oidc != nil && r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") {
+			http.Redirect(w, r, "/login/oidc", http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="otp", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+	if u.oidc == nil {
+		return authed
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /login/oidc", u.oidc.start)
+	mux.HandleFunc("GET /login/oidc/callback", u.oidc.callback)
+	mux.HandleFunc("POST /logout", u.oidc.logout)
+	mux.Handle("/", authed)
+	return mux
+}
+
+// checkPassword checks the password against the hash of the user, or
+// without one, against the LDAP directory, and tells which did.
+func (u *httpUsers) checkPassword(name, password string) (how string, ok bool) {
+	user, known := u.Users[name]
+	if u.oidc != nil && strings.HasSuffix(name, u.oidc.scope) {
+		// Only the provider logs its users in.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", false
+	}
+	if (!known || user.Password == "") && u.ldap != nil {
+		if strings.ContainsAny(name, "/:") {
+			return "", false
+		}
+		err := u.ldap.check(name, password)
+		if err != nil && !errors.Is(err, errLDAPInvalidCredentials) {
+			log.Println("LDAP:", err)
+		}
+		return "ldap", err == nil
+	}
+	hash := dummyHash
+	if known && user.Password != "" {
+		hash = []byte(user.Password)
+	}
+	return "user", bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && known && user.Password != ""
+}
+
+// tenant is the user a request of otp http --users is served to. The nil
+// tenant, without --users, sees the whole store.
+type tenant struct {
+	name  string
+	admin bool
+	users *httpUsers
+}
+
+type tenantKey struct{}
+
+func tenantOf(r *http.Request) *tenant {
+	t, _ := r.Context().Value(tenantKey{}).(*tenant)
+	return t
+}
+
+// own returns the issuer of the entry of the tenant, as stored.
+func (t *tenant) own(issuer string) string {
+	if t == nil {
+		return issuer
+	}
+	return t.name + "/" + issuer
+}
+
+// readable returns the issuer, as stored, of the entry the tenant reads: one
+// of their own, or with owner, one shared with them.
+func (t *tenant) readable(issuer, account, owner string) (string, error) {
+	if t == nil || owner == "" || owner == t.name {
+		return t.own(issuer), nil
+	}
+	if !t.users.shared(t.name, owner, issuer, account) {
+		return "", fmt.Errorf("%s/%s: %w", issuer, account, errNotFound)
+	}
+	return owner + "/" + issuer, nil
+}
+
+// visible tells whether the tenant sees the entry, and how it is named to
+// them.
+func (t *tenant) visible(storedIssuer, account string) (issuer, owner string, ok bool) {
+	if t == nil {
+		return storedIssuer, "", true
+	}
+	owner, issuer, found := strings.Cut(storedIssuer, "/")
+	switch {
+	case !found:
+		return "", "", false
+	case owner == t.name:
+		return issuer, "", true
+	}
+	return issuer, owner, t.users.shared(t.name, owner, issuer, account)
+}
+
+func (t *tenant) codes(in []apiCode) []apiCode {
+	out := make([]apiCode, 0, len(in))
+	for _, code := range in {
+		if issuer, owner, ok := t.visible(code.Issuer, code.Account); ok {
+			code.Issuer, code.Owner = issuer, owner
+			out = append(out, code)
+		}
+	}
+	return out
+}
+
+func (t *tenant) entries(in []apiEntry) []apiEntry {
+	out := make([]apiEntry, 0, len(in))
+	for _, e := range in {
+		if issuer, owner, ok := t.visible(e.Issuer, e.Account); ok {
+			e.Issuer, e.Owner = issuer, owner
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// code returns the current code of the entry the tenant reads, as named to
+// them.
+func (t *tenant) code(c *cli.Context, issuer, account, owner string) (apiCode, error) {
+	stored, err := t.readable(issuer, account, owner)
+	if err != nil {
+		return apiCode{}, err
+	}
+	code, err := entryCode(c, stored, account)
+	if err != nil {
+		return apiCode{}, err
+	}
+	code.Issuer = issuer
+	if t != nil && owner != t.name {
+		code.Owner = owner
+	}
+	return code, nil
+}
+
+// registerShares adds the routes admins manage the shares with:
+//
+//	GET    /api/shares                                  list the shares
+//	POST   /api/shares                                  share an entry
+//	DELETE /api/shares/{user}/{owner}/{issuer}/{account} stop sharing it
+func registerShares(mux *http.ServeMux, c *cli.Context, users *httpUsers) {
+	admin := func(r *http.Request) error {
+		if t := tenantOf(r); t == nil || !t.admin {
+			return apiStatus(http.StatusForbidden, errors.New("only admins manage shares"))
+		}
+		return nil
+	}
+	mux.HandleFunc("GET /api/shares", func(w http.ResponseWriter, r *http.Request) {
+		if err := admin(r); err != nil {
+			apiError(w, err)
+			return
+		}
+		users.mu.Lock()
+		defer users.mu.Unlock()
+		writeJSON(w, http.StatusOK, append([]httpShare{}, users.Shares...))
+	})
+	mux.HandleFunc("POST /api/shares", func(w http.ResponseWriter, r *http.Request) {
+		var in httpShare
+		if err := admin(r); err != nil {
+			apiError(w, err)
+			return
+		}
+		if err := readJSON(w, r, &in); err != nil {
+			apiError(w, err)
+			return
+		}
+		_, userOK := users.Users[in.User]
+		_, ownerOK := users.Users[in.Owner]
+		switch {
+		case !userOK || !ownerOK:
+			apiError(w, apiStatus(http.StatusBadRequest, errors.New("user and owner must be users")))
+			return
+		case in.User == in.Owner:
+			apiError(w, apiStatus(http.StatusBadRequest, errors.New("entries cannot be shared with their owner")))
+			return
+		}
+		httpMu.Lock()
+		exists, err := entryExists(c, in.Owner+"/"+in.Issuer, in.Account)
+		httpMu.Unlock()
+		if err != nil {
+			apiError(w, err)
+			return
+		} else if !exists {
+			apiError(w, fmt.Errorf("%s/%s of %s: %w", in.Issuer, in.Account, in.Owner, errNotFound))
+			return
+		}
+		if users.shared(in.User, in.Owner, in.Issuer, in.Account) {
+			apiError(w, apiStatus(http.StatusConflict, errors.New("already shared")))
+			return
+		}
+		users.mu.Lock()
+		defer users.mu.Unlock()
+		users.Shares = append(users.Shares, in)
+		if err := users.save(); err != nil {
+			users.Shares = users.Shares[:len(users.Shares)-1]
+			apiError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, in)
+	})
+	mux.HandleFunc("DELETE /api/shares/{user}/{owner}/{issuer}/{account}", func(w http.ResponseWriter, r *http.Request) {
+		if err := admin(r); err != nil {
+			apiError(w, err)
+			return
+		}
+		share := httpShare{User: r.PathValue("user"), Owner: r.PathValue("owner"), Issuer: r.PathValue("issuer"), Account: r.PathValue("account")}
+		users.mu.Lock()
+		defer users.mu.Unlock()
+		for i, s := range users.Shares {
+			if s != share {
+				continue
+			}
+			previous := users.Shares
+			users.Shares = append(append([]httpShare{}, previous[:i]...), previous[i+1:]...)
+			if err := users.save(); err != nil {
+				users.Shares = previous
+				apiError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		apiError(w, fmt.Errorf("share: %w", errNotFound))
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// sqliteMagic starts every SQLite database file.
+const sqliteMagic = "SQLite format 3\x00"
+
+func importBundle() cli.Command {
+	return cli.Command{
+		Name:      "import",
+		Usage:     "copy the keys of a bundle into the store",
+		ArgsUsage: "`bundle` [`filter`]",
+		Description: `The bundle is a SQLite database, a backup taken with "otp backup",
+   encrypted or not, or a sealed store file. Keys that already exist in the
+   store are handled as told by --on-conflict; an automatic backup is taken
+   before any key is written.
+
+   With --db :memory: the keys are only kept in memory, so nothing is written
+   to disk; the codes are printed right away, as with "otp get [filter]".`,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "initialize the store without asking, if needed",
+			},
+			cli.StringFlag{
+				Name:  "on-conflict",
+				Value: "overwrite",
+				Usage: "what to do with the keys that already exist in the store: overwrite, skip, or fail without importing anything",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			fn := c.Args().First()
+			if fn == "" {
+				return errors.New("bundle is missing")
+			}
+			onConflict := c.String("on-conflict")
+			switch onConflict {
+			case "overwrite", "skip", "fail":
+			default:
+				return fmt.Errorf("unknown --on-conflict %q", onConflict)
+			}
+			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+			entries, err := readBundle(priv, fn, data)
+			if err != nil {
+				return fmt.Errorf("cannot read bundle %s: %w", fn, err)
+			}
+			for i, e := range entries {
+				secret, err := priv.legacySecret(e)
+				if errors.Is(err, errTampered) {
+					return fmt.Errorf("key for account %q of issuer %q: %w", e.Account, e.Issuer, err)
+				} else if err != nil {
+					return fmt.Errorf("cannot decrypt key for account %q of issuer %q with the current private key", e.Account, e.Issuer)
+				}
+				// Bundles exported before integrity tags existed are tagged
+				// on the way in.
+				if _, ok := cutTag(e.Password); !ok {
+					entries[i].Password = tagged(secret, e.Account, e.Issuer, priv.public(), e.Password)
+				}
+				wipe(secret)
+			}
+
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			s, err := autoinit(c, c.Bool("yes"))
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			if err := autobackup(c, s); err != nil {
+				return err
+			}
+			var imported, skipped int
+			err = s.Tx(func(tx store) error {
+				imported, skipped = 0, 0
+				for _, e := range entries {
+					_, err := tx.Get(e.Account, e.Issuer)
+					switch {
+					case err == nil && onConflict == "skip":
+						skipped++
+						continue
+					case err == nil && onConflict == "fail":
+						return fmt.Errorf("key for account %q of issuer %q already exists", e.Account, e.Issuer)
+					case err != nil && !errors.Is(err, errNotFound):
+						return err
+					}
+					if err := tx.Put(e); err != nil {
+						return err
+					}
+					imported++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if c.GlobalString("db") != memoryStoreName {
+				log.Printf("%d keys imported into %s, %d existing keys skipped", imported, storeName(c), skipped)
+				return nil
+			}
+			return printCodes(c, c.Args().Get(1))
+		},
+	}
+}
+
+// readBundle returns the entries of a bundle, with their names decrypted.
+// SQLite databases are read from the file fn, if given, so that changes still
+// in the write-ahead log are seen too.
+func readBundle(priv *privkey, fn string, data []byte) ([]entry, error) {
+	var base store
+	switch {
+	case bytes.HasPrefix(data, []byte(encryptedBackupMagic)):
+		plain, err := priv.unseal(encryptedBackupMagic, data)
+		if err != nil {
+			return nil, err
+		}
+		return readBundle(priv, "", plain)
+	case bytes.HasPrefix(data, []byte(sealedStoreMagic)):
+		plain, err := priv.unseal(sealedStoreMagic, data)
+		if err != nil {
+			return nil, err
+		}
+		var entries []entry
+		if err := json.Unmarshal(plain, &entries); err != nil {
+			return nil, err
+		}
+		base = newmemstore(entries)
+	case bytes.HasPrefix(data, []byte(sqliteMagic)):
+		open := func() (*sql.DB, error) { return sqldeserialize(data) }
+		if fn != "" {
+			open = func() (*sql.DB, error) { return sqlopenro(fn) }
+		}
+		db, err := open()
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		version, err := schemaVersion(db)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case version == 0:
+			return nil, errors.New("not an OTP database")
+		case version > len(migrations):
+			return nil, fmt.Errorf("schema version %d is newer than the supported version %d", version, len(migrations))
+		}
+		base = newsqlitestore(db)
+	default:
+		return nil, errors.New("unknown format")
+	}
+	names := &namesStore{base: base, priv: priv}
+	return names.List()
+}
+
+// sqldeserialize opens an in-memory copy of the SQLite database.
+func sqldeserialize(data []byte) (*sql.DB, error) {
+	data = bytes.Clone(data)
+	if len(data) > 19 {
+		// WAL databases cannot be opened from memory; mark it as a
+		// rollback journal database instead.
+		data[18], data[19] = 1, 1
+	}
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Every connection would have its own in-memory database.
+	db.SetMaxOpenConns(1)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn any) error {
+		deserializer, ok := driverConn.(interface{ Deserialize([]byte) error })
+		if !ok {
+			return errors.New("database driver does not support in-memory databases")
+		}
+		return deserializer.Deserialize(data)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
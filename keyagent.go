@@ -0,0 +1,339 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// keyAgentSocket is the socket of otp agent given by --agent-socket. Empty
+// when the key must not be asked to the agent.
+var keyAgentSocket string
+
+func defaultKeyAgentSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "otp-agent.sock")
+	}
+	return filepath.Join(configDir, "agent.sock")
+}
+
+// keyAgentRequest is a request to otp agent, which is sent as a line of
+// JSON, as is its response.
+type keyAgentRequest struct {
+	// Op is one of hello, encrypt, decrypt, blind and stop.
+	Op string `json:"op"`
+	// Key tells the key the client wants, which must be the one of the
+	// agent.
+	Key   string `json:"key"`
+	In    []byte `json:"in,omitempty"`
+	Label []byte `json:"label,omitempty"`
+}
+
+type keyAgentResponse struct {
+	Out   []byte `json:"out,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// The public key, in the response to hello: the PKIX encoding of
+	// plain keys, or else the kind and fingerprint of the key.
+	Public      []byte `json:"public,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Hybrid      bool   `json:"hybrid,omitempty"`
+}
+
+// keyAgentID names the key otp would read, with the global flags that
+// choose it.
+func keyAgentID(fn string) string {
+	return fmt.Sprintf("%s %s %s", keyBackendName, fn, pqKeyFile)
+}
+
+func keyagent() cli.Command {
+	return cli.Command{
+		Name:  "agent",
+		Usage: "keep the unlocked private key in memory for other otp commands",
+		Description: `The agent reads the private key, asking its passphrase once, and serves it
+   on the socket given by --agent-socket until the TTL expires. Meanwhile
+   other otp commands that would read the same key ask the agent to decrypt
+   instead, without asking for the passphrase. The key never leaves the
+   agent.
+
+   The agent runs in the foreground; run it as "otp agent &", or from the
+   session manager.`,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "ttl",
+				Value: 15 * time.Minute,
+				Usage: "how long the key is kept, after which the agent exits",
+			},
+			cli.BoolFlag{
+				Name:  "stop",
+				Usage: "stop the running agent, which forgets the key",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			sock := keyAgentSocket
+			if sock == "" {
+				return errors.New("--agent-socket is empty")
+			}
+			if c.Bool("stop") {
+				client, err := dialKeyAgent(sock)
+				if err != nil {
+					return fmt.Errorf("no agent is running on %s", sock)
+				}
+				defer client.conn.Close()
+				_, err = client.call(keyAgentRequest{Op: "stop"})
+				return err
+			}
+
+			if client, err := dialKeyAgent(sock); err == nil {
+				client.conn.Close()
+				return fmt.Errorf("an agent is already running on %s", sock)
+			}
+			// The agent reads the key itself.
+			keyAgentSocket = ""
+			id := keyAgentID(c.GlobalString("private-key"))
+			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+
+			os.Remove(sock)
+			if err := os.MkdirAll(filepath.Dir(sock), 0o700); err != nil {
+				return err
+			}
+			l, err := net.Listen("unix", sock)
+			if err != nil {
+				return err
+			}
+			if err := os.Chmod(sock, 0o600); err != nil {
+				l.Close()
+				return err
+			}
+			defer os.Remove(sock)
+
+			ttl := c.Duration("ttl")
+			timer := time.AfterFunc(ttl, func() { l.Close() })
+			defer timer.Stop()
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-sigs
+				l.Close()
+			}()
+			log.Printf("agent listening on %s; the key is forgotten in %s", sock, ttl)
+
+			a := &keyAgent{id: id, priv: priv, stop: func() { l.Close() }}
+			for {
+				conn, err := l.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					log.Print("agent stopped")
+					return nil
+				} else if err != nil {
+					return err
+				}
+				go a.serve(conn)
+			}
+		},
+	}
+}
+
+// keyAgent serves the key to the clients of otp agent. Key backends are not
+// safe for concurrent use, so the requests are served one at a time.
+type keyAgent struct {
+	mu   sync.Mutex
+	id   string
+	priv *privkey
+	stop func()
+}
+
+func (a *keyAgent) serve(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req keyAgentRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		resp, err := a.handle(req)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+		if req.Op == "stop" {
+			a.stop()
+			return
+		}
+	}
+}
+
+func (a *keyAgent) handle(req keyAgentRequest) (keyAgentResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if req.Op == "stop" {
+		return keyAgentResponse{}, nil
+	}
+	if req.Key != a.id {
+		return keyAgentResponse{}, errKeyAgentOtherKey
+	}
+	var (
+		resp keyAgentResponse
+		err  error
+	)
+	switch req.Op {
+	case "hello":
+		pub := a.priv.public()
+		if k, ok := pub.(describedKey); ok {
+			resp.Kind, resp.Fingerprint = k.kind(), k.fingerprint()
+		} else {
+			resp.Public, err = x509.MarshalPKIXPublicKey(pub)
+		}
+		resp.Hybrid = isHybrid(a.priv.keyBackend)
+	case "encrypt":
+		resp.Out, err = a.priv.encrypted(req.In, req.Label)
+	case "decrypt":
+		resp.Out, err = a.priv.decrypted(req.In, req.Label)
+	case "blind":
+		resp.Out, err = blindName(a.priv.keyBackend, req.In)
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	return resp, err
+}
+
+// errKeyAgentOtherKey is returned by the agent to the clients that want
+// another key than its own.
+var errKeyAgentOtherKey = errors.New("the agent holds another key")
+
+// keyAgentClient is the key backend of the commands that find the key in
+// otp agent.
+type keyAgentClient struct {
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	id     string
+	pub    crypto.PublicKey
+	hybrid bool
+}
+
+func dialKeyAgent(sock string) (*keyAgentClient, error) {
+	conn, err := net.DialTimeout("unix", sock, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &keyAgentClient{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}, nil
+}
+
+// openKeyAgentKey asks the agent for the key named by fn, and fails when the
+// agent is not running or holds another key.
+func openKeyAgentKey(fn string) (*keyAgentClient, error) {
+	k, err := dialKeyAgent(keyAgentSocket)
+	if err != nil {
+		return nil, err
+	}
+	k.id = keyAgentID(fn)
+	resp, err := k.call(keyAgentRequest{Op: "hello"})
+	if err != nil {
+		k.conn.Close()
+		return nil, err
+	}
+	if resp.Public != nil {
+		k.pub, err = x509.ParsePKIXPublicKey(resp.Public)
+		if err != nil {
+			k.conn.Close()
+			return nil, err
+		}
+	} else {
+		k.pub = keyAgentPublicKey{kindName: resp.Kind, fpr: resp.Fingerprint}
+	}
+	k.hybrid = resp.Hybrid
+	return k, nil
+}
+
+func (k *keyAgentClient) call(req keyAgentRequest) (keyAgentResponse, error) {
+	req.Key = k.id
+	if err := k.enc.Encode(req); err != nil {
+		return keyAgentResponse{}, fmt.Errorf("agent: %w", err)
+	}
+	var resp keyAgentResponse
+	if err := k.dec.Decode(&resp); err != nil {
+		return keyAgentResponse{}, fmt.Errorf("agent: %w", err)
+	}
+	if resp.Error != "" {
+		return keyAgentResponse{}, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+func (k *keyAgentClient) public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *keyAgentClient) encrypted(in, label []byte) ([]byte, error) {
+	resp, err := k.call(keyAgentRequest{Op: "encrypt", In: in, Label: label})
+	return resp.Out, err
+}
+
+func (k *keyAgentClient) decrypted(in, label []byte) ([]byte, error) {
+	resp, err := k.call(keyAgentRequest{Op: "decrypt", In: in, Label: label})
+	return resp.Out, err
+}
+
+// material fails, as the key never leaves the agent; names are blinded by
+// the agent instead.
+func (k *keyAgentClient) material() ([]byte, error) {
+	return nil, errors.New("the key of otp agent cannot be revealed")
+}
+
+func (k *keyAgentClient) blind(name []byte) ([]byte, error) {
+	resp, err := k.call(keyAgentRequest{Op: "blind", In: name})
+	return resp.Out, err
+}
+
+// keyAgentPublicKey is the public key of the agent's key, when the backend
+// does not use a plain public key.
+type keyAgentPublicKey struct {
+	kindName string
+	fpr      string
+}
+
+func (k keyAgentPublicKey) Equal(o crypto.PublicKey) bool {
+	d, ok := o.(describedKey)
+	return ok && d.kind() == k.kindName && d.fingerprint() == k.fpr
+}
+
+func (k keyAgentPublicKey) fingerprint() string {
+	return k.fpr
+}
+
+func (k keyAgentPublicKey) kind() string {
+	return k.kindName
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	keyBackends["keychain"] = openKeychainKey
+}
+
+// keychainService is the service of the Keychain items made by otp.
+const keychainService = "otp"
+
+// keychainAuthScript asks the user to authenticate with Touch ID, or with
+// the login password where there is no Touch ID or it is locked out, through
+// the LocalAuthentication framework and the Objective-C bridge of JavaScript
+// for Automation, as otp does not link the Security framework. The reason is
+// given as argument; the script fails unless the user authenticates.
+const keychainAuthScript = `ObjC.import('LocalAuthentication');
+ObjC.import('Foundation');
+function run(argv) {
+	const ctx = $.LAContext.alloc.init;
+	let done = false, ok = false, reason = '';
+	// LAPolicyDeviceOwnerAuthentication: biometrics, or else the password.
+	ctx.evaluatePolicyLocalizedReasonReply(2, argv[0], function (success, error) {
+		ok = success;
+		if (!success && error) {
+			reason = ObjC.unwrap(error.localizedDescription);
+		}
+		done = true;
+	});
+	while (!done) {
+		$.NSRunLoop.currentRunLoop.runUntilDate($.NSDate.dateWithTimeIntervalSinceNow(0.1));
+	}
+	if (!ok) {
+		throw new Error(reason || 'authentication failed');
+	}
+}`
+
+// openKeychainKey asks for Touch ID, and then reads the random secret kept
+// in a generic password item of the macOS Keychain, whose account is given
+// by --private-key, making the item when it does not exist yet. The secrets
+// are encrypted with AES-256-GCM under a key derived from it.
+//
+// The item trusts no application, so macOS also asks for approval, with the
+// login password, every time otp reads it. Secure Enclave keys would need
+// the Security framework, which otp does not link; Touch ID gates the item
+// instead.
+func openKeychainKey(account string) (keyBackend, error) {
+	if err := keychainAuthenticate(fmt.Sprintf("unlock the otp store key %s", account)); err != nil {
+		return nil, err
+	}
+	key, err := opensymmetrickey("KEYCHAIN", "otp keychain aes-256-gcm", symmetricSecret{
+		load: func() ([]byte, error) {
+			out, err := security(nil, "find-generic-password", "-s", keychainService, "-a", account, "-w")
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+				return nil, errNotFound
+			} else if err != nil {
+				return nil, err
+			}
+			return hex.DecodeString(strings.TrimSpace(string(out)))
+		},
+		store: func(secret []byte) error {
+			return addKeychainItem(account, secret)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Keychain item %s of service %s: %w", account, keychainService, err)
+	}
+	return key, nil
+}
+
+// keychainAuthenticate fails unless the user authenticates with Touch ID or
+// the login password.
+func keychainAuthenticate(reason string) error {
+	cmd := exec.Command("osascript", "-l", "JavaScript", "-e", keychainAuthScript, reason)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Touch ID authentication failed: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// addKeychainItem makes the item through the interactive mode of security,
+// which reads the command from stdin, so the secret never shows in the
+// arguments of a process.
+func addKeychainItem(account string, secret []byte) error {
+	cmd := fmt.Sprintf("add-generic-password -s %s -a %s -l %s -T \"\" -w %s\n",
+		strconv.Quote(keychainService), strconv.Quote(account), strconv.Quote("otp store key"), hex.EncodeToString(secret))
+	if _, err := security([]byte(cmd), "-i"); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "store key added to the Keychain as %s\n", account)
+	return nil
+}
+
+func security(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("security", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// keychainStoreLocation names where keychain stores are kept, for messages.
+const keychainStoreLocation = "Keychain"
+
+// keychainStoreService is the service of the Keychain items of keychain
+// stores.
+const keychainStoreService = "otp-store"
+
+// readKeychainStore reads the item of a keychain store, failing with
+// errNotFound when there is none.
+func readKeychainStore(name string) ([]byte, error) {
+	out, err := security(nil, "find-generic-password", "-s", keychainStoreService, "-a", name, "-w")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+// writeKeychainStore adds or updates the item through the interactive mode of
+// security, like addKeychainItem.
+func writeKeychainStore(name string, data []byte) error {
+	cmd := fmt.Sprintf("add-generic-password -U -s %s -a %s -l %s -w %s\n",
+		strconv.Quote(keychainStoreService), strconv.Quote(name), strconv.Quote("otp store "+name), base64.StdEncoding.EncodeToString(data))
+	_, err := security([]byte(cmd), "-i")
+	return err
+}
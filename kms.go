@@ -0,0 +1,183 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	keyBackends["aws-kms"] = newkmskey
+}
+
+// kmsKeyID is the AWS KMS key given by --kms-key-id.
+var kmsKeyID string
+
+// kmsKey encrypts every secret with its own data key, which is generated and
+// wrapped by an AWS KMS key, so IAM policies decide who can decrypt the
+// store, and CloudTrail logs every decryption. The label is bound to the
+// data key as the encryption context.
+//
+// Credentials and region come from the usual AWS environment variables, as
+// with a S3 store, unless the key is given by its ARN. AWS_ENDPOINT_URL_KMS
+// points to another endpoint.
+type kmsKey struct {
+	id       kmsKeyName
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// kmsKeyName is the public key of a kmsKey: the ID, alias or ARN of the KMS
+// key.
+type kmsKeyName string
+
+func (n kmsKeyName) Equal(o crypto.PublicKey) bool {
+	return n == o
+}
+
+func (n kmsKeyName) fingerprint() string {
+	return string(n)
+}
+
+func (kmsKeyName) kind() string {
+	return "AWS-KMS"
+}
+
+func newkmskey(string) (keyBackend, error) {
+	if kmsKeyID == "" {
+		return nil, errors.New("--kms-key-id is missing")
+	}
+	// arn:aws:kms:REGION:ACCOUNT:key/ID
+	var region string
+	if fields := strings.Split(kmsKeyID, ":"); len(fields) > 3 && fields[0] == "arn" {
+		region = fields[3]
+	}
+	creds, err := awsCredentialsFromEnv(region)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use AWS KMS: %w", err)
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_KMS")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", creds.region)
+	}
+	return &kmsKey{
+		id:       kmsKeyName(kmsKeyID),
+		endpoint: endpoint,
+		creds:    creds,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// call sends a request to the KMS JSON API.
+func (k *kmsKey) call(action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	k.creds.sign(req, body, "kms", time.Now().UTC())
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("AWS KMS %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(msg, &kmsErr) == nil && kmsErr.Type != "" {
+			return fmt.Errorf("AWS KMS %s: %s: %s", action, kmsErr.Type, kmsErr.Message)
+		}
+		return fmt.Errorf("AWS KMS %s: %s: %s", action, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func kmsContext(label []byte) map[string]string {
+	return map[string]string{"otp-label": base64.StdEncoding.EncodeToString(label)}
+}
+
+func (k *kmsKey) public() crypto.PublicKey {
+	return k.id
+}
+
+func (k *kmsKey) material() ([]byte, error) {
+	return nil, errors.New("AWS KMS keys do not reveal any secret")
+}
+
+// encrypted returns the length of the wrapped data key, the wrapped data key,
+// and the secret encrypted under the data key.
+func (k *kmsKey) encrypted(in, label []byte) ([]byte, error) {
+	var resp struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}
+	err := k.call("GenerateDataKey", map[string]any{
+		"KeyId":             string(k.id),
+		"KeySpec":           "AES_256",
+		"EncryptionContext": kmsContext(label),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealGCM(resp.Plaintext, in, label)
+	wipe(resp.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	out := binary.AppendUvarint(nil, uint64(len(resp.CiphertextBlob)))
+	out = append(out, resp.CiphertextBlob...)
+	return append(out, sealed...), nil
+}
+
+func (k *kmsKey) decrypted(in, label []byte) ([]byte, error) {
+	n, size := binary.Uvarint(in)
+	if size <= 0 || uint64(len(in)-size) < n {
+		return nil, errors.New("invalid wrapped data key")
+	}
+	blob, sealed := in[size:size+int(n)], in[size+int(n):]
+	var resp struct {
+		Plaintext []byte
+	}
+	err := k.call("Decrypt", map[string]any{
+		"KeyId":             string(k.id),
+		"CiphertextBlob":    blob,
+		"EncryptionContext": kmsContext(label),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(resp.Plaintext)
+	return openGCM(resp.Plaintext, sealed, label)
+}
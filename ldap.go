@@ -0,0 +1,238 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ldapAuth checks passwords by binding to an LDAP directory as the user,
+// whose DN is made from userDN by replacing %s with the escaped user name.
+// ldap:// URLs are upgraded with StartTLS before the password is sent.
+type ldapAuth struct {
+	addr    string
+	useTLS  bool
+	userDN  string
+	tlsConf *tls.Config
+}
+
+func newLDAPAuth(rawURL, userDN, cafn string) (*ldapAuth, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("--ldap-url: %s", err)
+	}
+	a := &ldapAuth{userDN: userDN, tlsConf: &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}}
+	switch u.Scheme {
+	case "ldaps":
+		a.useTLS, a.addr = true, hostPortDefault(u.Host, "636")
+	case "ldap":
+		a.addr = hostPortDefault(u.Host, "389")
+	default:
+		return nil, errors.New("--ldap-url must be an ldap:// or ldaps:// URL")
+	}
+	if strings.Count(userDN, "%s") != 1 {
+		return nil, errors.New("--ldap-user-dn must have one %s for the user name, as in uid=%s,ou=people,dc=example,dc=com")
+	}
+	if cafn != "" {
+		pemdata, err := os.ReadFile(cafn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemdata) {
+			return nil, fmt.Errorf("no certificates found in %s", cafn)
+		}
+		a.tlsConf.RootCAs = pool
+	}
+	return a, nil
+}
+
+func hostPortDefault(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// errLDAPInvalidCredentials is the result of binds with a wrong password or
+// an unknown user.
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+// check binds as the user with the password.
+func (a *ldapAuth) check(user, password string) error {
+	if user == "" || password == "" {
+		// Binds without a password are unauthenticated binds, which
+		// succeed.
+		return errLDAPInvalidCredentials
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if a.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", a.addr, a.tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", a.addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if !a.useTLS {
+		// ExtendedRequest of StartTLS.
+		req := berTLV(0x77, berTLV(0x80, []byte("1.3.6.1.4.1.1466.20037")))
+		if _, err := conn.Write(ldapMessage(1, req)); err != nil {
+			return err
+		}
+		if code, msg, err := ldapResult(bufio.NewReader(conn), 0x78); err != nil {
+			return err
+		} else if code != 0 {
+			return fmt.Errorf("StartTLS refused: %d %s", code, msg)
+		}
+		tlsConn := tls.Client(conn, a.tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+	dn := strings.Replace(a.userDN, "%s", ldapEscapeDN(user), 1)
+	req := berTLV(0x60, append(append(berTLV(0x02, []byte{3}), berTLV(0x04, []byte(dn))...), berTLV(0x80, []byte(password))...))
+	if _, err := conn.Write(ldapMessage(2, req)); err != nil {
+		return err
+	}
+	code, msg, err := ldapResult(bufio.NewReader(conn), 0x61)
+	if err != nil {
+		return err
+	}
+	// UnbindRequest.
+	conn.Write(ldapMessage(3, berTLV(0x42, nil)))
+	switch code {
+	case 0:
+		return nil
+	case 49:
+		return errLDAPInvalidCredentials
+	}
+	return fmt.Errorf("LDAP bind failed: %d %s", code, msg)
+}
+
+// ldapEscapeDN escapes the attribute value as RFC 4514 asks.
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case strings.IndexByte(`\,+"<>;=`, ch) >= 0,
+			ch == ' ' && (i == 0 || i == len(s)-1),
+			ch == '#' && i == 0:
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+func ldapMessage(id byte, op []byte) []byte {
+	return berTLV(0x30, append(berTLV(0x02, []byte{id}), op...))
+}
+
+// berTLV encodes a BER element with a definite length.
+func berTLV(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	default:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+// berRead reads a BER element with a definite length.
+func berRead(r io.Reader) (tag byte, content []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1])
+	if n >= 0x80 {
+		size := n & 0x7f
+		if size == 0 || size > 3 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, b := range buf {
+			n = n<<8 | int(b)
+		}
+	}
+	content = make([]byte, n)
+	_, err = io.ReadFull(r, content)
+	return hdr[0], content, err
+}
+
+// ldapResult reads the LDAPResult of the response with the given tag.
+func ldapResult(r io.Reader, tag byte) (code int, msg string, err error) {
+	t, msgContent, err := berRead(r)
+	if err != nil {
+		return 0, "", err
+	}
+	if t != 0x30 {
+		return 0, "", errors.New("invalid LDAP message")
+	}
+	body := bytes.NewReader(msgContent)
+	if _, _, err := berRead(body); err != nil { // messageID
+		return 0, "", err
+	}
+	t, op, err := berRead(body)
+	if err != nil {
+		return 0, "", err
+	}
+	if t != tag {
+		return 0, "", fmt.Errorf("unexpected LDAP response %#x", t)
+	}
+	fields := bytes.NewReader(op)
+	_, resultCode, err := berRead(fields)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, b := range resultCode {
+		code = code<<8 | int(b)
+	}
+	if _, _, err := berRead(fields); err != nil { // matchedDN
+		return code, "", nil
+	}
+	_, diagnostic, _ := berRead(fields)
+	return code, string(diagnostic), nil
+}
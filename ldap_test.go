@@ -0,0 +1,130 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBERTLV(t *testing.T) {
+	tests := []struct {
+		tag     byte
+		content []byte
+		want    string
+	}{
+		{0x02, []byte{3}, "020103"},
+		{0x04, nil, "0400"},
+		{0x04, bytes.Repeat([]byte{0xaa}, 0x7f), "047f" + strings.Repeat("aa", 0x7f)},
+		{0x04, bytes.Repeat([]byte{0xaa}, 0x80), "048180" + strings.Repeat("aa", 0x80)},
+		{0x04, bytes.Repeat([]byte{0xaa}, 0x100), "04820100" + strings.Repeat("aa", 0x100)},
+	}
+	for _, tt := range tests {
+		got := berTLV(tt.tag, tt.content)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("berTLV(%#x, %d bytes) = %x, want %s", tt.tag, len(tt.content), got, tt.want)
+		}
+		tag, content, err := berRead(bytes.NewReader(got))
+		if err != nil || tag != tt.tag || !bytes.Equal(content, tt.content) {
+			t.Errorf("berRead(%x) = %#x, %x, %v; want the element back", got, tag, content, err)
+		}
+	}
+}
+
+func TestLDAPMessage(t *testing.T) {
+	// The simple BindRequest of RFC 4511, as sent by check.
+	req := berTLV(0x60, append(append(berTLV(0x02, []byte{3}), berTLV(0x04, []byte("uid=alice,dc=example"))...), berTLV(0x80, []byte("secret"))...))
+	got := hex.EncodeToString(ldapMessage(2, req))
+	want := "3026020102" + "6021" + "020103" + "0414" + hex.EncodeToString([]byte("uid=alice,dc=example")) + "8006" + hex.EncodeToString([]byte("secret"))
+	if got != want {
+		t.Errorf("ldapMessage() = %s, want %s", got, want)
+	}
+}
+
+func TestBERReadErrors(t *testing.T) {
+	tests := []struct {
+		name, in string
+	}{
+		{"empty", ""},
+		{"no length", "04"},
+		{"indefinite length", "0480"},
+		{"length too long", "048400000001"},
+		{"truncated length", "0482"},
+		{"truncated content", "040401"},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.in)
+		if _, _, err := berRead(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: berRead(%s) did not fail", tt.name, tt.in)
+		}
+	}
+}
+
+func TestLDAPResult(t *testing.T) {
+	bindResponse := func(code byte, diagnostic string) []byte {
+		op := append(append(berTLV(0x0a, []byte{code}), berTLV(0x04, nil)...), berTLV(0x04, []byte(diagnostic))...)
+		return ldapMessage(2, berTLV(0x61, op))
+	}
+	tests := []struct {
+		name     string
+		in       []byte
+		tag      byte
+		wantCode int
+		wantMsg  string
+		wantErr  string
+	}{
+		{"success", bindResponse(0, ""), 0x61, 0, "", ""},
+		{"invalid credentials", bindResponse(49, "bad password"), 0x61, 49, "bad password", ""},
+		{"no diagnostic", ldapMessage(2, berTLV(0x61, berTLV(0x0a, []byte{0}))), 0x61, 0, "", ""},
+		{"other response", bindResponse(0, ""), 0x78, 0, "", "unexpected LDAP response"},
+		{"not a message", berTLV(0x04, []byte("x")), 0x61, 0, "", "invalid LDAP message"},
+		{"truncated", bindResponse(0, "")[:6], 0x61, 0, "", "EOF"},
+		{"no operation", berTLV(0x30, berTLV(0x02, []byte{2})), 0x61, 0, "", "EOF"},
+	}
+	for _, tt := range tests {
+		code, msg, err := ldapResult(bytes.NewReader(tt.in), tt.tag)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: ldapResult() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || code != tt.wantCode || msg != tt.wantMsg {
+			t.Errorf("%s: ldapResult() = %d, %q, %v; want %d, %q", tt.name, code, msg, err, tt.wantCode, tt.wantMsg)
+		}
+	}
+}
+
+func TestLDAPEscapeDN(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"alice", "alice"},
+		{"Sue, Grabbit and Runn", `Sue\, Grabbit and Runn`},
+		{"a+b=c", `a\+b\=c`},
+		{`"quoted"<>;\`, `\"quoted\"\<\>\;\\`},
+		{" padded ", `\ padded\ `},
+		{"#hash#", `\#hash#`},
+		{"nul\x00", `nul\00`},
+		{"*)(uid=*", "*)(uid\\=*"},
+	}
+	for _, tt := range tests {
+		if got := ldapEscapeDN(tt.in); got != tt.want {
+			t.Errorf("ldapEscapeDN(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
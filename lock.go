@@ -0,0 +1,82 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// errLocked is returned by tryLock when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// lockdb takes the advisory lock that serializes the commands that modify
+// the database, waiting up to busyTimeout for other processes to release
+// it. The lock is held until the returned function is called. In read-only
+// mode, the lock is refused. Network stores rely on their own transactions
+// instead.
+func lockdb(c *cli.Context) (unlock func(), err error) {
+	if c.GlobalBool("read-only") {
+		return nil, errors.New("cannot modify the store in read-only mode")
+	}
+	path := storePath(c)
+	if path == "" {
+		return func() {}, nil
+	}
+	fn := path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(fn), 0o700); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(busyTimeout)
+	for {
+		err = tryLock(fd)
+		if !errors.Is(err, errLocked) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if errors.Is(err, errLocked) {
+		fd.Close()
+		pid, _ := os.ReadFile(fn)
+		if pid := strings.TrimSpace(string(pid)); pid != "" {
+			return nil, fmt.Errorf("store is locked by PID %s", pid)
+		}
+		return nil, errors.New("store is locked by another process")
+	} else if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("cannot lock store: %w", err)
+	}
+
+	if err := fd.Truncate(0); err == nil {
+		fd.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return func() {
+		fd.Truncate(0)
+		unlockFile(fd)
+		fd.Close()
+	}, nil
+}
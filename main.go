@@ -13,18 +13,43 @@
 // limitations under the License.
 
 // Command otp manages one-time passwords tokens, protecting them with a local
-// private key (usually $HOME/.ssh/id_rsa) and storing its information in a
-// encrypted db (usually at $HOME/.ssh/auth.db).
+// RSA, Ed25519 or ECDSA private key (usually $HOME/.ssh/id_rsa) and storing its
+// information in a encrypted db (usually at $HOME/.ssh/auth.db).
+//
+// Defaults for the global flags can be set in $HOME/.config/otp/config.toml
+// (%APPDATA%\otp\config.toml on Windows), either at the top level or grouped
+// in named profiles:
+//
+//	private-key = "~/.ssh/id_rsa"
+//
+//	[profiles.work]
+//	db = "~/.ssh/auth-work.db"
+//	private-key = "~/.ssh/id_rsa-work"
+//
+// Tables named after a command set the defaults of its flags:
+//
+//	[http]
+//	addr = "127.0.0.1"
+//	port = 8080
+//
+// The output-format and clipboard-timeout settings, at the top level or in a
+// profile, are the defaults of list --format and tray --clear.
+//
+// Flags and environment variables take precedence over the configuration.
 package main // import "cirello.io/otp"
 
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
-	"database/sql"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -32,49 +57,222 @@ import (
 	"image/png"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	otp "github.com/pquerna/otp/totp"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 	_ "modernc.org/sqlite"
 	"rsc.io/qr"
 )
 
-var homeDir string
+var homeDir, configDir string
 
 func init() {
 	log.SetPrefix("")
 	log.SetFlags(0)
 
-	usr, err := user.Current()
+	var err error
+	homeDir, err = os.UserHomeDir()
 	if err != nil {
 		log.Fatal(err)
 	}
-	homeDir = usr.HomeDir
+	configDir = filepath.Join(homeDir, ".config", "otp")
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		configDir = filepath.Join(dir, "otp")
+	}
+	if runtime.GOOS == "windows" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		configDir = filepath.Join(dir, "otp")
+	}
+}
+
+// defaultDB returns the default location of the database. On Windows,
+// ~/.ssh belongs to OpenSSH, so the database is kept in %APPDATA% instead.
+func defaultDB() string {
+	legacy := filepath.Join(homeDir, ".ssh", "auth.db")
+	if runtime.GOOS == "windows" {
+		return movedDefault(filepath.Join(configDir, "auth.db"), legacy)
+	}
+	return legacy
+}
+
+// defaultConfig returns the default location of the configuration file.
+func defaultConfig() string {
+	fn := filepath.Join(configDir, "config.toml")
+	if runtime.GOOS == "windows" {
+		return movedDefault(fn, filepath.Join(homeDir, ".config", "otp", "config.toml"))
+	}
+	return fn
+}
+
+// movedDefault returns fn, the default location of a file on Windows,
+// unless only legacy, where older versions of otp kept it, exists. Then
+// legacy is still used, so that the store of existing users is not taken
+// for an empty one.
+func movedDefault(fn, legacy string) string {
+	if _, err := os.Stat(fn); !errors.Is(err, os.ErrNotExist) {
+		return fn
+	}
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return fn
 }
 
 func main() {
+	hardenProcess()
 	app := cli.NewApp()
 	app.Name = "OTP client"
 	app.Usage = "command interface"
 	app.Version = "1.0.0"
+	if version != "" {
+		app.Version = version
+	}
+	app.EnableBashCompletion = true
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "db",
-			Value:  filepath.Join(homeDir, ".ssh", "auth.db"),
+			Value:  defaultDB(),
+			Usage:  "SQLite database, dir:path for a store with one file per key, sealed:path for a store file encrypted as a whole, keychain:name for a store sealed whole in the keychain of the system, git:path for a directory store with history, pass:prefix or gopass:prefix for the otpauth:// lines of a password store under prefix (default: otp), bw:folder for the TOTP fields of a Bitwarden vault, a postgres:// or mysql:// DSN, a s3://bucket/prefix, or :memory: for a store that is never written to disk",
 			EnvVar: "OTP_DB",
 		},
 		cli.StringFlag{
 			Name:   "private-key",
 			Value:  filepath.Join(homeDir, ".ssh", "id_rsa"),
+			Usage:  "private key file, the pkcs11: URI of a RSA or EC key in a PKCS#11 token, or yubikey:SLOT for the key in a YubiKey PIV slot, such as yubikey:9d",
 			EnvVar: "OTP_PRIVKEY",
 		},
+		cli.StringFlag{
+			Name:   "encryption",
+			Value:  defaultKeyBackend,
+			Usage:  "how the keys are encrypted: private-key for a SSH or PEM private key, age for the age identities file given by --private-key, gpg for the OpenPGP key whose user ID is given by --private-key, ssh-agent for the RSA or Ed25519 agent key of the public key file or fingerprint given by --private-key (ECDSA and sk keys, such as those of Secretive, cannot be used), fido2 for a FIDO2 security key whose credential file is given by --private-key, keychain on macOS for the Keychain item whose account is given by --private-key, unlocked with Touch ID, dpapi on Windows for the DPAPI protected key file given by --private-key, secret-service on Linux and BSD desktops for the Secret Service secret whose account is given by --private-key, aws-kms for data keys wrapped by the AWS KMS key given by --kms-key-id, passphrase for a passphrase run through Argon2id, with no key file at all, or plugin:NAME for the key of --private-key as handled by the otp-plugin-NAME executable in the PATH",
+			EnvVar: "OTP_ENCRYPTION",
+		},
+		cli.StringFlag{
+			Name:   "kms-key-id",
+			Usage:  "ID, alias or ARN of the AWS KMS key of --encryption aws-kms",
+			EnvVar: "OTP_KMS_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "pq-key",
+			Usage:  "ML-KEM-768 key file, made when missing, to encrypt new keys with post-quantum hybrid encryption on top of --encryption",
+			EnvVar: "OTP_PQ_KEY",
+		},
+		cli.StringFlag{
+			Name:   "entry-keys",
+			Usage:  "comma-separated private keys that add --key may encrypt keys with, as ENCRYPTION=KEY such as private-key=yubikey:9d, or just KEY for --encryption; the keys of the store can only name these",
+			EnvVar: "OTP_ENTRY_KEYS",
+		},
+		cli.StringFlag{
+			Name:   "agent-socket",
+			Value:  defaultKeyAgentSocket(),
+			Usage:  "socket of otp agent, which is asked for the private key when running; empty to never ask",
+			EnvVar: "OTP_AGENT_SOCK",
+		},
+		cli.StringFlag{
+			Name:   "duress-db",
+			Usage:  "decoy store, opened instead of --db when the passphrase typed is the one of --duress-key",
+			EnvVar: "OTP_DURESS_DB",
+		},
+		cli.StringFlag{
+			Name:   "duress-key",
+			Usage:  "private key of --duress-db, protected by the duress passphrase; unused with --encryption passphrase",
+			EnvVar: "OTP_DURESS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "passphrase-file",
+			Usage:  "file with the passphrase of the private key (default: $OTP_KEY_PASSPHRASE, or ask on the terminal)",
+			EnvVar: "OTP_PASSPHRASE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "pinentry",
+			Usage:  "pinentry program to ask for passphrases and confirmations (default: the terminal, or pinentry when there is no terminal)",
+			EnvVar: "OTP_PINENTRY",
+		},
+		cli.BoolFlag{
+			Name:   "read-only",
+			Usage:  "refuse any command that modifies the database",
+			EnvVar: "OTP_READ_ONLY",
+		},
+		cli.BoolFlag{
+			Name:   "encrypt-names",
+			Usage:  "encrypt the account and issuer of the keys written to the store; init encrypts the existing ones",
+			EnvVar: "OTP_ENCRYPT_NAMES",
+		},
+		cli.StringFlag{
+			Name:   "backup-dir",
+			Usage:  "directory of the automatic backups taken before destructive operations (default: otp-backups next to the database)",
+			EnvVar: "OTP_BACKUP_DIR",
+		},
+		cli.IntFlag{
+			Name:   "backup-keep",
+			Value:  10,
+			Usage:  "number of automatic backups to keep, 0 disables them",
+			EnvVar: "OTP_BACKUP_KEEP",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Value:  defaultConfig(),
+			Usage:  "configuration file; its [hooks] table runs shell commands on post-add, post-rm, pre-get and post-sync, given OTP_HOOK, OTP_STORE, OTP_ISSUER and OTP_ACCOUNT, OTP_FILTER, or OTP_SYNC_TARGET, OTP_SYNC_RECEIVED and OTP_SYNC_SENT; a failing pre-get hook stops otp get",
+			EnvVar: "OTP_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "use the database and private key of the named profile",
+			EnvVar: "OTP_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "remote",
+			Usage:  "https URL of an otp http server to get, list, add and rm keys through, instead of the local database and private key; http only for localhost, or unix:PATH for the --socket of a server on this host",
+			EnvVar: "OTP_REMOTE",
+		},
+		cli.StringFlag{
+			Name:   "remote-token",
+			Usage:  "token of --remote, as given to its --auth-token; prefer the environment variable, as command lines are visible to other users",
+			EnvVar: "OTP_REMOTE_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "remote-ca",
+			Usage:  "CA certificates file to verify --remote with, instead of the system ones",
+			EnvVar: "OTP_REMOTE_CA",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := applyConfig(c); err != nil {
+			return err
+		}
+		if cmd := c.Args().First(); c.String("remote") != "" && cmd != "" && !remoteCommands[cmd] {
+			return fmt.Errorf("%s does not work with --remote", cmd)
+		}
+		passphraseFile = expandHome(c.String("passphrase-file"))
+		keyBackendName = c.String("encryption")
+		kmsKeyID = c.String("kms-key-id")
+		pqKeyFile = expandHome(c.String("pq-key"))
+		pinentryProgram = c.String("pinentry")
+		keyAgentSocket = expandHome(c.String("agent-socket"))
+		if _, ok := keyBackendOpener(keyBackendName); !ok {
+			return fmt.Errorf("unknown encryption %q", keyBackendName)
+		}
+		entryKeys = parseEntryKeys(c.String("entry-keys"))
+		duressDB = expandHome(c.String("duress-db"))
+		passphraseStore = func() (store, error) {
+			return openstore(cli.NewContext(c.App, nil, c), false)
+		}
+		return unlockDuress(c)
 	}
 	app.Commands = []cli.Command{
 		initdb(),
@@ -83,10 +281,49 @@ func main() {
 		list(),
 		genqr(),
 		rm(),
+		fsck(),
+		backup(),
+		restore(),
+		importBundle(),
+		gitlog(),
+		checkout(),
+		syncstore(),
+		servesync(),
+		pair(),
+		rekey(),
+		passwd(),
+		keyagent(),
+		grant(),
+		revoke(),
+		listRecipients(),
+		compact(),
 		servehttp(),
+		grpcServer(),
+		grpcClientCommand(),
+		tokens(),
+		mcp(),
+		shareLink(),
+		decoy(),
+		keyShares(),
+		completion(),
+		shell(),
+		execCode(),
+		awsCommand(),
+		credentialHelper(),
+		askpass(),
+		tray(),
+		dbusService(),
+		service(),
+		selfUpdate(),
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	args := os.Args
+	if strings.TrimSuffix(filepath.Base(args[0]), ".exe") == "otp-askpass" {
+		args = append([]string{args[0], "askpass"}, args[1:]...)
+	}
+	err := serviceMain(args, app.Run)
+	closePrivkeys()
+	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
 }
@@ -95,26 +332,108 @@ func initdb() cli.Command {
 	return cli.Command{
 		Name:  "init",
 		Usage: "initialize the OTP database",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "delete all keys and rebuild the database from scratch",
+			},
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "do not ask for confirmation",
+			},
+		},
 		Action: func(c *cli.Context) error {
-			db, err := sql.Open("sqlite", c.GlobalString("db"))
+			unlock, err := lockdb(c)
 			if err != nil {
 				return err
 			}
-			defer db.Close()
+			defer unlock()
+
+			fn, err := sqlitePath(c)
+			if err != nil {
+				fn := storeName(c)
+				if c.Bool("force") {
+					return fmt.Errorf("--force is not supported by store %s", fn)
+				}
+				if err := initstore(c); err != nil {
+					return err
+				}
+				s, err := openstore(c, true)
+				if err != nil {
+					return err
+				}
+				defer s.Close()
+				if err := encryptStoreNames(c, basestore(s)); err != nil {
+					return err
+				}
+				if err := upgradeSecrets(c, basestore(s)); err != nil {
+					return err
+				}
+				if err := upgradeTags(c, basestore(s)); err != nil {
+					return err
+				}
+				entries, err := s.List()
+				if err != nil {
+					return err
+				}
+				log.Printf("store %s initialized: %d keys", fn, len(entries))
+				return nil
+			}
 
-			queries := []string{
-				"CREATE TABLE IF NOT EXISTS `otps` (`id` INTEGER PRIMARY KEY, `account` char, `issuer` char, `password` blob);",
-				"CREATE UNIQUE INDEX `otps_account_issuer` ON `otps`(`account`, `issuer`);",
+			db, err := sqlopen(fn)
+			if err != nil {
+				return err
 			}
+			defer db.Close()
 
-			for _, q := range queries {
-				_, err = db.Exec(q)
-				if err != nil {
+			version, err := schemaVersion(db)
+			if err != nil {
+				return err
+			}
+			if version > 0 && c.Bool("force") {
+				if !c.Bool("yes") {
+					confirmed, err := confirm(fmt.Sprintf("all keys in %s will be deleted. continue?", fn))
+					if err != nil {
+						return err
+					}
+					if !confirmed {
+						return errors.New("aborted")
+					}
+				}
+				if err := autobackup(c, newsqlitestore(db)); err != nil {
 					return err
 				}
+				if err := dropSchema(db); err != nil {
+					return err
+				}
+				version = 0
+			}
+			if err := migrate(db); err != nil {
+				return err
+			}
+			if err := encryptStoreNames(c, newsqlitestore(db)); err != nil {
+				return err
+			}
+			if err := upgradeSecrets(c, newsqlitestore(db)); err != nil {
+				return err
+			}
+			if err := upgradeTags(c, newsqlitestore(db)); err != nil {
+				return err
 			}
 
-			log.Println("database initialized")
+			var count int
+			if err := db.QueryRow("SELECT COUNT(*) FROM `otps`;").Scan(&count); err != nil {
+				return err
+			}
+			switch {
+			case version == len(migrations):
+				log.Printf("database %s already initialized: schema version %d, %d keys", fn, version, count)
+				return nil
+			case version > 0:
+				log.Printf("database %s upgraded from schema version %d to %d: %d keys", fn, version, len(migrations), count)
+				return nil
+			}
+			log.Printf("database %s initialized", fn)
 			return nil
 		},
 	}
@@ -125,8 +444,44 @@ func add() cli.Command {
 		Name:      "add",
 		Usage:     "a new OTP key",
 		ArgsUsage: "`secret` `issuer` `account-name`",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "initialize the store without asking, if needed",
+			},
+			cli.StringFlag{
+				Name:  "key",
+				Usage: "encrypt the key with this private key instead of --private-key, such as yubikey:9d for a high-value key; it is recorded with the key",
+			},
+			cli.StringFlag{
+				Name:  "key-encryption",
+				Usage: "how the key given by --key encrypts (default: --encryption)",
+			},
+		},
 		Action: func(c *cli.Context) error {
-			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if rc, err := remote(c); err != nil {
+				return err
+			} else if rc != nil {
+				if c.String("key") != "" {
+					return errors.New("--key does not work with --remote")
+				}
+				if err := rc.add(apiEntry{Secret: c.Args().Get(0), Issuer: c.Args().Get(1), Account: c.Args().Get(2)}); err != nil {
+					return err
+				}
+				runPostHook(c, "post-add", "OTP_ISSUER="+c.Args().Get(1), "OTP_ACCOUNT="+c.Args().Get(2))
+				return nil
+			}
+			keyfile, backend := c.GlobalString("private-key"), keyBackendName
+			if c.String("key") != "" {
+				keyfile = entryKeyPath(expandHome(c.String("key")))
+				if c.String("key-encryption") != "" {
+					backend = c.String("key-encryption")
+				}
+				if !entryKeys[entryKeyID(backend, keyfile)] {
+					return fmt.Errorf("--key %s must be one of --entry-keys, so the key can be read back; add %s to it", keyfile, entryKeyID(backend, keyfile))
+				}
+			}
+			priv, err := privkeywith(backend, keyfile)
 			if err != nil {
 				return err
 			}
@@ -149,131 +504,732 @@ func add() cli.Command {
 				return err
 			}
 
-			db, err := sql.Open("sqlite", c.GlobalString("db"))
+			unlock, err := lockdb(c)
 			if err != nil {
 				return err
 			}
-			defer db.Close()
+			defer unlock()
 
-			_, err = db.Exec("REPLACE INTO `otps` (`issuer`, `account`, `password`) VALUES (?, ?, ?);", issuer, account, enckey)
-			return err
+			s, err := autoinit(c, c.Bool("yes"))
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+
+			if c.String("key") != "" {
+				enckey = withEntryKey(backend, keyfile, []byte(secretkey), account, issuer, priv.public(), enckey)
+			} else {
+				enckey = tagged([]byte(secretkey), account, issuer, priv.public(), enckey)
+			}
+			if err := s.Put(entry{Account: account, Issuer: issuer, Password: enckey}); err != nil {
+				return err
+			}
+			runPostHook(c, "post-add", "OTP_ISSUER="+issuer, "OTP_ACCOUNT="+account)
+			return nil
 		},
 	}
 }
 
 func get() cli.Command {
 	return cli.Command{
-		Name:  "get",
-		Usage: "generate OTP",
+		Name:         "get",
+		Usage:        "generate OTP",
+		ArgsUsage:    "[`filter`]",
+		BashComplete: completeFilter,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "tmux",
+				Usage: "print ISSUER:CODE (12s) on one line, for tmux and other status lines; the codes are cached until they change",
+			},
+			cli.BoolFlag{
+				Name:  "waybar",
+				Usage: "print the JSON of waybar custom modules, with the expiring class in the last seconds of the codes; they are cached like with --tmux",
+			},
+			cli.BoolFlag{
+				Name:  "copy",
+				Usage: "copy the code of the only key matching the filter to the clipboard, and clear it after --clear unless something else was copied",
+			},
+			cli.DurationFlag{
+				Name:  "clear",
+				Value: 30 * time.Second,
+				Usage: "how long until the code copied by --copy is cleared from the clipboard; 0 leaves it there",
+			},
+			cli.BoolFlag{
+				Name:  "type",
+				Usage: "type the code of the only key matching the filter into the focused window, after --type-delay",
+			},
+			cli.DurationFlag{
+				Name:  "type-delay",
+				Value: 2 * time.Second,
+				Usage: "how long to wait before typing, to focus the window the code goes to",
+			},
+		},
 		Action: func(c *cli.Context) error {
-			filter := c.Args().First()
-			if filter == "" {
-				return load(c, os.Stdout)
-			}
-			var buf bytes.Buffer
-			if err := load(c, &buf); err != nil {
+			if err := runHook(c, "pre-get", "OTP_FILTER="+c.Args().First()); err != nil {
 				return err
 			}
-			scanner := bufio.NewScanner(&buf)
-			for scanner.Scan() {
-				line := scanner.Text()
-				if strings.Contains(line, filter) {
-					fmt.Println(scanner.Text())
+			outputs := 0
+			for _, name := range []string{"tmux", "waybar", "copy", "type"} {
+				if c.Bool(name) {
+					outputs++
 				}
 			}
-			return scanner.Err()
+			switch {
+			case outputs > 1:
+				return errors.New("only one of --tmux, --waybar, --copy and --type can be given")
+			case c.Bool("tmux"):
+				return printTmux(c, os.Stdout, c.Args().First())
+			case c.Bool("waybar"):
+				return printWaybar(c, os.Stdout, c.Args().First())
+			case c.Bool("copy"):
+				return copyCode(c, c.Args().First(), c.Duration("clear"))
+			case c.Bool("type"):
+				code, err := codeFor(c, c.Args().First())
+				if err != nil {
+					return err
+				}
+				time.Sleep(c.Duration("type-delay"))
+				return typeText(code.Code)
+			}
+			return printCodes(c, c.Args().First())
 		},
 	}
 }
 
+// printCodes prints the current codes of the keys whose line matches the
+// filter.
+func printCodes(c *cli.Context, filter string) error {
+	if filter == "" {
+		return load(c, os.Stdout)
+	}
+	var buf bytes.Buffer
+	err := load(c, &buf)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, filter) {
+			fmt.Println(scanner.Text())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// copyCode copies the code of the key matching the filter to the clipboard,
+// and waits to clear it after clear, unless something else was copied in
+// the meantime.
+func copyCode(c *cli.Context, filter string, clear time.Duration) error {
+	code, err := codeFor(c, filter)
+	if err != nil {
+		return err
+	}
+	if err := writeClipboard(code.Code); err != nil {
+		return fmt.Errorf("cannot copy the code: %w", err)
+	}
+	if clear <= 0 {
+		log.Printf("code of %s/%s copied", code.Issuer, code.Account)
+		return nil
+	}
+	log.Printf("code of %s/%s copied; the clipboard is cleared in %s", code.Issuer, code.Account, clear)
+	time.Sleep(clear)
+	if current, err := readClipboard(); err == nil && current == code.Code {
+		return writeClipboard("")
+	}
+	return nil
+}
+
 func servehttp() cli.Command {
 	return cli.Command{
 		Name:  "http",
 		Usage: "serve OTP in a HTTP interface",
+		Description: `The address and port can also be set in the [http] table of the
+   configuration file. With --socket, otp listens on a Unix socket instead,
+   so its permissions decide who is served; a socket passed by systemd
+   socket activation is used over both.
+
+   The web page counts down to the next codes and fetches them from
+   /api/codes; tapping a code copies it, and phones can install the page as
+   an app. A JSON API is also served under /api/entries, which lists
+   the entries, serves their codes at /api/entries/ISSUER/ACCOUNT/code, and
+   manages them with POST, PUT and DELETE once some authentication is
+   configured. GET /ISSUER/ACCOUNT returns just the current code of an
+   entry, for scripts, and, with --serve-qr, /ISSUER/ACCOUNT/qr.png its
+   provisioning QR code.
+
+   With --login-passphrase-hash, the web interface asks for the master
+   passphrase plus a code of --login-totp-secret or a security key enrolled
+   at /login/enroll, and logs out the sessions idle for --session-idle.
+   Security keys are bound to --webauthn-origin, the URL the browser opens.
+
+   With --template-dir, the web page is rendered with the index.html of the
+   directory, as a Go html/template. It is given .Codes, each with .Account,
+   .Issuer, .Code, .ExpiresIn and .Owner, and .ExpiresIn, .Error, .Query,
+   .Login and .QR; the functions matches and qrURL tell whether a code matches the
+   query and link to its QR code. Its static directory is served under
+   /static/.
+
+   /share/ serves the single-use links of otp share, without authentication,
+   unless the store is read-only.
+
+   /stream pushes the codes of the entries given as ?entry=ISSUER/ACCOUNT as
+   server-sent events, at every new time step, with a countdown in between.
+
+   /healthz tells whether the store can be read, without authentication, and
+   /metrics serves metrics in the Prometheus text format.
+
+   With --api-tokens, the tokens of otp token create are accepted as
+   Authorization: Bearer too; read tokens only for GET requests.
+
+   With --users, each user logs in with basic authentication and sees only
+   the entries of their namespace, stored with issuers prefixed by their
+   name, as in alice/GitHub, plus those shared with them, read-only, whose
+   codes are served with ?owner=USER. The users file looks like:
+
+      {"users": {"alice": {"password": "BCRYPT-HASH", "admin": true}},
+       "shares": [{"user": "bob", "owner": "alice",
+                   "issuer": "GitHub", "account": "team"}]}
+
+   Admins manage the shares at /api/shares, which are written back to it,
+   and alone read /metrics.
+   Users without a password log in with the LDAP directory of --ldap-url
+   instead, or in the browser with the OpenID Connect provider of
+   --oidc-issuer; they need not be listed unless they are admins. The users
+   of the provider are named by --oidc-user-claim and the host name of the
+   provider, as 1234@accounts.example.com, apart from all others.
+
+   Every client address is limited to --rate-limit requests per second, and
+   locked out for --lockout after --lockout-failures failed authentications.
+
+   On Windows, --install-service installs otp http, with the other flags
+   given, as the service --service-name, started with the system; it logs
+   to the Application event log. The key must open without a prompt, as
+   with --encryption dpapi, and the service must log on as the user it
+   serves, which is set in services.msc. --uninstall-service removes it.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "addr",
+				Usage:  "address to listen on (default: all interfaces)",
+				EnvVar: "OTP_HTTP_ADDR",
+			},
+			cli.IntFlag{
+				Name:   "port",
+				Value:  9999,
+				Usage:  "port to listen on",
+				EnvVar: "OTP_HTTP_PORT",
+			},
+			cli.StringFlag{
+				Name:   "socket",
+				Usage:  "Unix socket to listen on instead of --addr and --port",
+				EnvVar: "OTP_HTTP_SOCKET",
+			},
+			cli.StringFlag{
+				Name:   "socket-mode",
+				Value:  "0600",
+				Usage:  "permissions of --socket, in octal",
+				EnvVar: "OTP_HTTP_SOCKET_MODE",
+			},
+			cli.StringFlag{
+				Name:   "tls-cert",
+				Usage:  "certificate file, to serve over HTTPS",
+				EnvVar: "OTP_HTTP_TLS_CERT",
+			},
+			cli.StringFlag{
+				Name:   "tls-key",
+				Usage:  "private key file of --tls-cert",
+				EnvVar: "OTP_HTTP_TLS_KEY",
+			},
+			cli.StringFlag{
+				Name:   "auth-token",
+				Usage:  "token the clients must send as Authorization: Bearer; prefer the environment variable, as command lines are visible to other users",
+				EnvVar: "OTP_HTTP_AUTH_TOKEN",
+			},
+			cli.StringFlag{
+				Name:   "basic-auth",
+				Usage:  "user:hash of the basic authentication clients may use instead, with a bcrypt hash as made by htpasswd -nbB",
+				EnvVar: "OTP_HTTP_BASIC_AUTH",
+			},
+			cli.BoolFlag{
+				Name:   "api-tokens",
+				Usage:  "also accept the API tokens of otp token create",
+				EnvVar: "OTP_HTTP_API_TOKENS",
+			},
+			cli.StringFlag{
+				Name:   "template-dir",
+				Usage:  "directory with an index.html template to render the web page with instead of the built-in one, and a static directory served under /static/",
+				EnvVar: "OTP_HTTP_TEMPLATE_DIR",
+			},
+			cli.StringFlag{
+				Name:   "users",
+				Usage:  "JSON file of the users, each with their own entries, who log in with basic authentication; replaces --auth-token and --basic-auth",
+				EnvVar: "OTP_HTTP_USERS",
+			},
+			cli.StringFlag{
+				Name:   "ldap-url",
+				Usage:  "ldaps:// or ldap:// URL of the LDAP directory that checks the passwords of the --users without one; ldap:// is upgraded with StartTLS",
+				EnvVar: "OTP_HTTP_LDAP_URL",
+			},
+			cli.StringFlag{
+				Name:   "ldap-user-dn",
+				Usage:  "DN the users bind to the LDAP directory as, with %s for the user name, as in uid=%s,ou=people,dc=example,dc=com",
+				EnvVar: "OTP_HTTP_LDAP_USER_DN",
+			},
+			cli.StringFlag{
+				Name:   "ldap-ca",
+				Usage:  "CA certificates file to verify the LDAP directory with, instead of the system ones",
+				EnvVar: "OTP_HTTP_LDAP_CA",
+			},
+			cli.StringFlag{
+				Name:   "oidc-issuer",
+				Usage:  "issuer URL of the OpenID Connect provider the --users log in with in the browser",
+				EnvVar: "OTP_HTTP_OIDC_ISSUER",
+			},
+			cli.StringFlag{
+				Name:   "oidc-client-id",
+				Usage:  "client ID of otp at the OpenID Connect provider",
+				EnvVar: "OTP_HTTP_OIDC_CLIENT_ID",
+			},
+			cli.StringFlag{
+				Name:   "oidc-client-secret",
+				Usage:  "client secret of otp at the OpenID Connect provider; prefer the environment variable, as command lines are visible to other users",
+				EnvVar: "OTP_HTTP_OIDC_CLIENT_SECRET",
+			},
+			cli.StringFlag{
+				Name:   "oidc-redirect-url",
+				Usage:  "redirect URL registered at the OpenID Connect provider (default: /login/oidc/callback of the host the browser asked)",
+				EnvVar: "OTP_HTTP_OIDC_REDIRECT_URL",
+			},
+			cli.StringFlag{
+				Name:   "oidc-user-claim",
+				Value:  "sub",
+				Usage:  "claim of the ID token that names the user, as CLAIM@HOST with the host name of --oidc-issuer; email is only taken when the provider verified it",
+				EnvVar: "OTP_HTTP_OIDC_USER_CLAIM",
+			},
+			cli.StringFlag{
+				Name:   "tls-client-ca",
+				Usage:  "CA certificates file; only the clients with a certificate issued by one of them are served",
+				EnvVar: "OTP_HTTP_TLS_CLIENT_CA",
+			},
+			cli.StringFlag{
+				Name:   "login-passphrase-hash",
+				Usage:  "bcrypt hash of the master passphrase, as made by htpasswd -nbB; enables the login page",
+				EnvVar: "OTP_HTTP_LOGIN_PASSPHRASE_HASH",
+			},
+			cli.StringFlag{
+				Name:   "login-totp-secret",
+				Usage:  "base32 secret of the TOTP dedicated to the login, asked along with the passphrase",
+				EnvVar: "OTP_HTTP_LOGIN_TOTP_SECRET",
+			},
+			cli.StringFlag{
+				Name:   "webauthn-credentials",
+				Value:  filepath.Join(configDir, "webauthn.json"),
+				Usage:  "file of the security keys enrolled for the login",
+				EnvVar: "OTP_HTTP_WEBAUTHN_CREDENTIALS",
+			},
+			cli.BoolFlag{
+				Name:  "webauthn-enroll",
+				Usage: "let logged in users enroll security keys at /login/enroll; until one is, the passphrase alone logs in unless --login-totp-secret is set",
+			},
+			cli.StringFlag{
+				Name:   "webauthn-origin",
+				Usage:  "URL the browser opens the web interface at, such as https://otp.example.com; needed for security keys",
+				EnvVar: "OTP_HTTP_WEBAUTHN_ORIGIN",
+			},
+			cli.StringFlag{
+				Name:   "webauthn-rp-id",
+				Usage:  "relying party ID the security keys are enrolled for (default: the host name of --webauthn-origin)",
+				EnvVar: "OTP_HTTP_WEBAUTHN_RP_ID",
+			},
+			cli.BoolFlag{
+				Name:   "read-only",
+				Usage:  "only serve codes: the API routes that modify the store are not served",
+				EnvVar: "OTP_HTTP_READ_ONLY",
+			},
+			cli.BoolFlag{
+				Name:   "serve-qr",
+				Usage:  "serve the provisioning QR codes, which hold the secrets, at /ISSUER/ACCOUNT/qr.png; needs authentication, and read API tokens are refused",
+				EnvVar: "OTP_HTTP_SERVE_QR",
+			},
+			cli.StringFlag{
+				Name:   "cors-origins",
+				Usage:  "comma separated origins whose pages may call the JSON API, such as https://example.com; the API refuses the other origins, all but otp http itself by default",
+				EnvVar: "OTP_HTTP_CORS_ORIGINS",
+			},
+			cli.StringFlag{
+				Name:   "cors-methods",
+				Value:  "GET",
+				Usage:  "comma separated methods those origins may use",
+				EnvVar: "OTP_HTTP_CORS_METHODS",
+			},
+			cli.DurationFlag{
+				Name:   "shutdown-timeout",
+				Value:  10 * time.Second,
+				Usage:  "how long to wait for the requests in flight on SIGINT or SIGTERM",
+				EnvVar: "OTP_HTTP_SHUTDOWN_TIMEOUT",
+			},
+			cli.StringFlag{
+				Name:   "access-log",
+				Usage:  "file to log every request to, as JSON lines with the client, who it authenticated as, and which entries it was served; - for the standard error",
+				EnvVar: "OTP_HTTP_ACCESS_LOG",
+			},
+			cli.Float64Flag{
+				Name:   "rate-limit",
+				Value:  10,
+				Usage:  "requests per second each client address may make; 0 disables the limit",
+				EnvVar: "OTP_HTTP_RATE_LIMIT",
+			},
+			cli.IntFlag{
+				Name:   "rate-burst",
+				Value:  30,
+				Usage:  "requests each client address may make at once, beyond --rate-limit",
+				EnvVar: "OTP_HTTP_RATE_BURST",
+			},
+			cli.IntFlag{
+				Name:   "lockout-failures",
+				Value:  5,
+				Usage:  "failed authentications after which a client address is locked out; 0 disables the lockout",
+				EnvVar: "OTP_HTTP_LOCKOUT_FAILURES",
+			},
+			cli.DurationFlag{
+				Name:   "lockout",
+				Value:  15 * time.Minute,
+				Usage:  "how long client addresses are locked out, and the window in which their failures are counted",
+				EnvVar: "OTP_HTTP_LOCKOUT",
+			},
+			cli.DurationFlag{
+				Name:   "session-idle",
+				Value:  15 * time.Minute,
+				Usage:  "log out the sessions idle for this long",
+				EnvVar: "OTP_HTTP_SESSION_IDLE",
+			},
+			cli.BoolFlag{
+				Name:  "install-service",
+				Usage: "install otp http, with the other flags given, as a Windows service",
+			},
+			cli.BoolFlag{
+				Name:  "uninstall-service",
+				Usage: "remove the Windows service",
+			},
+			cli.StringFlag{
+				Name:  "service-name",
+				Value: "otp",
+				Usage: "name of the Windows service",
+			},
+		},
+		Before: applyCommandConfig,
 		Action: func(c *cli.Context) error {
-			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				fmt.Fprintln(w, "<html><body><pre>")
-				load(c, w)
-				fmt.Fprintln(w, "</pre></body></html>")
-			})
-			http.ListenAndServe(":9999", nil)
-			return nil
+			switch {
+			case c.Bool("install-service"):
+				return installService(c)
+			case c.Bool("uninstall-service"):
+				return uninstallService(c.String("service-name"))
+			}
+			if c.Bool("read-only") {
+				// The store is also opened read-only, where supported.
+				if err := c.GlobalSet("read-only", "true"); err != nil {
+					return err
+				}
+			}
+			if err := checkServing(c); err != nil {
+				return err
+			}
+
+			tmpl, staticDir := webTemplate, ""
+			if dir := expandHome(c.String("template-dir")); dir != "" {
+				t, err := loadWebTemplate(dir)
+				if err != nil {
+					return err
+				}
+				tmpl = t
+				if fi, err := os.Stat(filepath.Join(dir, "static")); err == nil && fi.IsDir() {
+					staticDir = filepath.Join(dir, "static")
+				}
+			}
+			authenticated := c.String("users") != "" || c.String("auth-token") != "" || c.String("basic-auth") != "" || c.Bool("api-tokens") || c.String("login-passphrase-hash") != "" || c.String("tls-client-ca") != ""
+			if !authenticated && !c.Bool("read-only") {
+				log.Println("warning: no authentication is configured, so the API routes that modify the store are not served; use --auth-token, --basic-auth, --api-tokens, --users, --login-passphrase-hash or --tls-client-ca")
+			}
+			if c.Bool("serve-qr") && !authenticated {
+				return errors.New("--serve-qr needs authentication, as the QR codes hold the secrets")
+			}
+			registerWebUI(http.DefaultServeMux, c, tmpl, c.String("login-passphrase-hash") != "" || c.String("oidc-issuer") != "", c.Bool("serve-qr"))
+			registerAPI(http.DefaultServeMux, c, c.Bool("read-only") || !authenticated, c.Bool("serve-qr"))
+			registerStream(http.DefaultServeMux, c)
+			var users *httpUsers
+			if fn := expandHome(c.String("users")); fn != "" {
+				if c.String("auth-token") != "" || c.String("basic-auth") != "" || c.String("login-passphrase-hash") != "" || c.Bool("api-tokens") {
+					return errors.New("--users does not work with --auth-token, --basic-auth, --api-tokens or --login-passphrase-hash")
+				}
+				var ldap *ldapAuth
+				if u := c.String("ldap-url"); u != "" {
+					a, err := newLDAPAuth(u, c.String("ldap-user-dn"), expandHome(c.String("ldap-ca")))
+					if err != nil {
+						return err
+					}
+					ldap = a
+				}
+				var oidc *oidcLogin
+				if issuer := c.String("oidc-issuer"); issuer != "" {
+					l, err := newOIDCLogin(issuer, c.String("oidc-client-id"), c.String("oidc-client-secret"), c.String("oidc-redirect-url"), c.String("oidc-user-claim"), c.Duration("session-idle"))
+					if err != nil {
+						return err
+					}
+					oidc = l
+				}
+				loaded, err := loadHTTPUsers(fn, ldap, oidc)
+				if err != nil {
+					return err
+				}
+				users = loaded
+				registerShares(http.DefaultServeMux, c, users)
+			} else if c.String("ldap-url") != "" || c.String("oidc-issuer") != "" {
+				return errors.New("--ldap-url and --oidc-issuer need --users")
+			}
+			metrics := newHTTPMetrics()
+			registerMetrics(http.DefaultServeMux, c, metrics)
+			var handler http.Handler = http.DefaultServeMux
+			if staticDir != "" {
+				handler = webStatic(handler, staticDir)
+			}
+			if hash := c.String("login-passphrase-hash"); hash != "" {
+				login, err := newWebLogin(hash, c.String("login-totp-secret"), expandHome(c.String("webauthn-credentials")), c.Bool("webauthn-enroll"), c.Duration("session-idle"), c.String("webauthn-origin"), c.String("webauthn-rp-id"))
+				if err != nil {
+					return err
+				}
+				handler = login.handler(handler)
+			} else if c.String("login-totp-secret") != "" || c.Bool("webauthn-enroll") {
+				return errors.New("the login needs --login-passphrase-hash")
+			}
+			if users != nil {
+				handler = users.handler(handler)
+			} else {
+				var apiTokens func(string) (apiToken, error)
+				if c.Bool("api-tokens") {
+					if _, err := sqlitePath(c); err != nil {
+						return fmt.Errorf("--api-tokens: %w", err)
+					}
+					apiTokens = func(bearer string) (apiToken, error) { return checkAPIToken(c, bearer) }
+				}
+				authed, err := httpAuth(handler, c.String("auth-token"), c.String("basic-auth"), apiTokens)
+				if err != nil {
+					return err
+				}
+				handler = authed
+			}
+			if _, err := sqlitePath(c); err == nil && !c.Bool("read-only") {
+				handler = shareLinkHandler(handler, c)
+			}
+			handler, err := httpCORS(handler, c.String("cors-origins"), c.String("cors-methods"))
+			if err != nil {
+				return err
+			}
+			// The limiter is in front of /healthz too, which opens the store.
+			handler = metrics.handler(handler, c)
+			handler = httpLimit(handler, c.Float64("rate-limit"), c.Int("rate-burst"), c.Int("lockout-failures"), c.Duration("lockout"))
+			if fn := c.String("access-log"); fn != "" {
+				logged, out, err := accessLog(handler, expandHome(fn))
+				if err != nil {
+					return err
+				}
+				defer out.Close()
+				handler = logged
+			}
+			addr := net.JoinHostPort(c.String("addr"), strconv.Itoa(c.Int("port")))
+			certfn, keyfn := expandHome(c.String("tls-cert")), expandHome(c.String("tls-key"))
+			switch {
+			case (certfn == "") != (keyfn == ""):
+				return errors.New("--tls-cert and --tls-key go together")
+			case certfn == "" && c.String("tls-client-ca") != "":
+				return errors.New("--tls-client-ca needs --tls-cert and --tls-key")
+			}
+			mode, err := strconv.ParseUint(c.String("socket-mode"), 8, 32)
+			if err != nil || mode > 0o777 {
+				return fmt.Errorf("invalid --socket-mode %q", c.String("socket-mode"))
+			}
+			socket := expandHome(c.String("socket"))
+			l, err := listenHTTP(addr, socket, os.FileMode(mode))
+			if err != nil {
+				return err
+			}
+			if socket != "" && l.Addr().Network() == "unix" {
+				defer os.Remove(socket)
+			}
+			timeout := c.Duration("shutdown-timeout")
+			if certfn == "" {
+				srv := &http.Server{Handler: handler}
+				log.Println("serving on", l.Addr())
+				return serveUntilSignal(srv, func() error { return srv.Serve(l) }, timeout)
+			}
+			srv := &http.Server{Handler: handler, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+			if fn := expandHome(c.String("tls-client-ca")); fn != "" {
+				pemdata, err := os.ReadFile(fn)
+				if err != nil {
+					return fmt.Errorf("cannot read client CA file: %s", err)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pemdata) {
+					return fmt.Errorf("no certificates found in %s", fn)
+				}
+				srv.TLSConfig.ClientCAs = pool
+				srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			log.Println("serving on", l.Addr(), "over HTTPS")
+			return serveUntilSignal(srv, func() error { return srv.ServeTLS(l, certfn, keyfn) }, timeout)
 		},
 	}
 }
 
 func load(c *cli.Context, w io.Writer) error {
-	priv, err := privkeyfile(c.GlobalString("private-key"))
+	codes, failed, err := loadCodes(c)
 	if err != nil {
 		return err
 	}
 
-	db, err := sql.Open("sqlite", c.GlobalString("db"))
-	if err != nil {
-		return err
+	tabw := tabwriter.NewWriter(w, 8, 8, 2, ' ', 0)
+	defer tabw.Flush()
+	fmt.Fprintln(tabw, "account\tissuer\texpiration\tcode")
+	for _, code := range codes {
+		line := fmt.Sprintf("%s\t%s\t%vs\t%s", code.Account, code.Issuer, code.ExpiresIn, code.Code)
+		fmt.Fprintln(tabw, line)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d keys could not be decrypted", failed, len(codes)+failed)
 	}
-	defer db.Close()
+	return nil
+}
+
+// loadCodes returns the current codes of the entries, logging the entries
+// that could not be decrypted and counting them in failed.
+func loadCodes(c *cli.Context) (codes []apiCode, failed int, err error) {
+	codes, failedCodes, err := loadEntryCodes(c)
+	return codes, len(failedCodes), err
+}
 
-	rows, err := db.Query("SELECT `account`, `issuer`, `password` FROM `otps` ORDER BY `account` ASC, `issuer` ASC;")
+// loadEntryCodes returns the current codes of the entries, and the entries
+// that could not be decrypted, named but without codes, which are logged.
+func loadEntryCodes(c *cli.Context) (codes, failed []apiCode, err error) {
+	if rc, err := remote(c); err != nil || rc != nil {
+		if err != nil {
+			return nil, nil, err
+		}
+		codes, err := rc.codes()
+		return codes, nil, err
+	}
+	priv, err := privkeyfile(c.GlobalString("private-key"))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer rows.Close()
 
-	tabw := tabwriter.NewWriter(w, 8, 8, 2, ' ', 0)
-	defer tabw.Flush()
-	fmt.Fprintln(tabw, "account\tissuer\texpiration\tcode")
+	s, err := openstore(c, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
 
-	for rows.Next() {
-		var (
-			account, issuer string
-			pw              []byte
-		)
-		rows.Scan(&account, &issuer, &pw)
+	entries, err := s.List()
+	if err != nil {
+		return nil, nil, err
+	}
 
-		decrypted, err := priv.decrypted(pw, cryptlabel(account, issuer))
-		if err != nil {
-			return err
+	codes = make([]apiCode, 0, len(entries))
+	for _, e := range entries {
+		decrypted, err := priv.secret(e)
+		if errors.Is(err, errNotShared) {
+			// Keys of other members of a shared store.
+			continue
+		} else if err != nil {
+			log.Println(secretError(priv, e, err))
+			decryptionErrors.Add(1)
+			failed = append(failed, apiCode{Account: e.Account, Issuer: e.Issuer})
+			continue
 		}
 
-		key := strings.ToUpper(strings.ReplaceAll(string(decrypted), " ", ""))
-		token, err := otp.GenerateCode(key, time.Now())
+		token, err := currentCode(decrypted)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-
-		line := fmt.Sprintf("%s\t%s\t%vs\t%s", account, issuer, (30 - time.Now().Unix()%30), token)
-		fmt.Fprintln(tabw, line)
+		codes = append(codes, apiCode{Account: e.Account, Issuer: e.Issuer, Code: token, ExpiresIn: 30 - time.Now().Unix()%30})
 	}
+	return codes, failed, nil
+}
 
-	return nil
+// currentCode returns the code of the secret for the current time step, and
+// wipes the secret.
+func currentCode(secret []byte) (string, error) {
+	key := strings.ToUpper(strings.ReplaceAll(string(secret), " ", ""))
+	wipe(secret)
+	return otp.GenerateCode(key, time.Now())
 }
 
 func list() cli.Command {
 	return cli.Command{
-		Name:  "list",
-		Usage: "list all keys",
+		Name:   "list",
+		Usage:  "list all keys",
+		Before: applyCommandConfig,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "keys",
+				Usage: "show the fingerprint of the private key each key was encrypted with",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Value: "text",
+				Usage: "text, or alfred for the script filter JSON of Alfred and Raycast, with the current codes",
+			},
+		},
 		Action: func(c *cli.Context) error {
-			db, err := sql.Open("sqlite", c.GlobalString("db"))
+			switch c.String("format") {
+			case "text":
+			case "alfred":
+				return printAlfred(c, os.Stdout)
+			default:
+				return fmt.Errorf("unknown format %q", c.String("format"))
+			}
+			if rc, err := remote(c); err != nil {
+				return err
+			} else if rc != nil {
+				if c.Bool("keys") {
+					return errors.New("--keys does not work with --remote")
+				}
+				entries, err := rc.entries()
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+				defer w.Flush()
+				fmt.Fprintln(w, "account\tissuer")
+				for _, e := range entries {
+					fmt.Fprintf(w, "%s\t%s\n", e.Account, e.Issuer)
+				}
+				return nil
+			}
+
+			s, err := openstore(c, false)
 			if err != nil {
 				return err
 			}
-			defer db.Close()
+			defer s.Close()
 
-			rows, err := db.Query("SELECT account, issuer FROM `otps` ORDER BY account ASC, issuer ASC;")
+			entries, err := s.List()
 			if err != nil {
 				return err
 			}
-			defer rows.Close()
 
 			w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
 			defer w.Flush()
+			if c.Bool("keys") {
+				fmt.Fprintln(w, "account\tissuer\tencrypted with")
+				for _, e := range entries {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", e.Account, e.Issuer, keyFingerprint(e))
+				}
+				return nil
+			}
 			fmt.Fprintln(w, "account\tissuer")
 
-			for rows.Next() {
-				var account, issuer string
-				rows.Scan(&account, &issuer)
-				fmt.Fprintln(w, fmt.Sprintf("%s\t%s", account, issuer))
+			for _, e := range entries {
+				fmt.Fprintln(w, fmt.Sprintf("%s\t%s", e.Account, e.Issuer))
 			}
 
 			return nil
@@ -291,33 +1247,30 @@ func genqr() cli.Command {
 				return err
 			}
 
-			db, err := sql.Open("sqlite", c.GlobalString("db"))
+			s, err := openstore(c, false)
 			if err != nil {
 				return err
 			}
-			defer db.Close()
+			defer s.Close()
 
-			rows, err := db.Query("SELECT `account`, `issuer`, `password` FROM `otps` ORDER BY `account` ASC, `issuer` ASC;")
+			entries, err := s.List()
 			if err != nil {
 				return err
 			}
-			defer rows.Close()
 
 			w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
 			defer w.Flush()
 			fmt.Fprintln(w, "account\tissuer\tfile")
 
-			for rows.Next() {
-				var account, issuer string
-				var pw []byte
-				rows.Scan(&account, &issuer, &pw)
-
-				decrypted, err := priv.decrypted(pw, cryptlabel(account, issuer))
+			for _, e := range entries {
+				account, issuer := e.Account, e.Issuer
+				decrypted, err := priv.secret(e)
 				if err != nil {
-					return err
+					return secretError(priv, e, err)
 				}
 
 				qrfn, err := generateQR(issuer, account, string(decrypted))
+				wipe(decrypted)
 				if err != nil {
 					line := fmt.Sprintf("%s\t%s\t%s", account, issuer, err)
 					fmt.Fprintln(w, line)
@@ -334,9 +1287,10 @@ func genqr() cli.Command {
 
 func rm() cli.Command {
 	return cli.Command{
-		Name:      "rm",
-		Usage:     "delete a OTP key",
-		ArgsUsage: "`issuer` `account-name`",
+		Name:         "rm",
+		Usage:        "delete a OTP key",
+		ArgsUsage:    "`issuer` `account-name`",
+		BashComplete: completeEntries,
 		Action: func(c *cli.Context) error {
 			issuer := c.Args().Get(0)
 			account := c.Args().Get(1)
@@ -348,60 +1302,439 @@ func rm() cli.Command {
 				return errors.New("account name is missing")
 			}
 
-			db, err := sql.Open("sqlite", c.GlobalString("db"))
+			if rc, err := remote(c); err != nil {
+				return err
+			} else if rc != nil {
+				if err := rc.remove(issuer, account); err != nil {
+					return err
+				}
+				runPostHook(c, "post-rm", "OTP_ISSUER="+issuer, "OTP_ACCOUNT="+account)
+				return nil
+			}
+
+			unlock, err := lockdb(c)
 			if err != nil {
 				return err
 			}
-			defer db.Close()
+			defer unlock()
 
-			_, err = db.Exec("DELETE FROM `otps` WHERE `issuer` = ? AND `account` = ?;", issuer, account)
-			return err
+			s, err := openstore(c, true)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+
+			if _, err := s.Get(account, issuer); errors.Is(err, errNotFound) {
+				return fmt.Errorf("%s/%s: %w", issuer, account, err)
+			} else if err != nil {
+				return err
+			}
+
+			if err := autobackup(c, s); err != nil {
+				return err
+			}
+
+			if err := s.Delete(account, issuer); err != nil {
+				return err
+			}
+			runPostHook(c, "post-rm", "OTP_ISSUER="+issuer, "OTP_ACCOUNT="+account)
+			return nil
 		},
 	}
 }
 
+// privkey is the key that protects the store, as loaded by the key backend
+// selected with --encryption.
 type privkey struct {
-	*rsa.PrivateKey
+	keyBackend
+}
+
+// keyBackend encrypts and decrypts the secrets of the store.
+type keyBackend interface {
+	// public returns the key secrets are encrypted to, which tells the
+	// recipients of shared secrets apart.
+	public() crypto.PublicKey
+	encrypted(in, label []byte) ([]byte, error)
+	decrypted(in, label []byte) ([]byte, error)
+	// material returns secret bytes, from which the keys that do not
+	// depend on the store are derived. Backends that cannot reveal any
+	// secret fail.
+	material() ([]byte, error)
+}
+
+// defaultKeyBackend is the --encryption value of the key backend that reads
+// SSH and PEM private key files.
+const defaultKeyBackend = "private-key"
+
+// keyBackends maps the --encryption values to the functions that load the
+// key named by --private-key.
+var keyBackends = map[string]func(fn string) (keyBackend, error){
+	defaultKeyBackend: readKeyFile,
 }
 
+// keyBackendName is the --encryption value.
+var keyBackendName = defaultKeyBackend
+
+// privkeys caches the keys read by privkeyfile, so passphrases are asked
+// once per run.
+var privkeys = make(map[string]*privkey)
+
 func privkeyfile(fn string) (*privkey, error) {
+	return privkeywith(keyBackendName, fn)
+}
+
+// privkeywith reads the private key with the given key backend, which may
+// differ from --encryption for the keys added with add --key.
+func privkeywith(backend, fn string) (*privkey, error) {
+	id := fn
+	if backend != keyBackendName {
+		id = backend + ":" + fn
+	}
+	if priv, ok := privkeys[id]; ok {
+		return priv, nil
+	}
+	open, ok := keyBackendOpener(backend)
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption %q", backend)
+	}
+	if keyAgentSocket != "" && backend == keyBackendName {
+		if key, err := openKeyAgentKey(fn); err == nil {
+			privkeys[id] = &privkey{key}
+			return privkeys[id], nil
+		}
+	}
+	key, err := open(fn)
+	if err != nil {
+		return nil, err
+	}
+	opened := key
+	if pqKeyFile != "" {
+		dk, err := readPQKey(pqKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = &hybridKey{keyBackend: key, dk: dk}
+	}
+	privkeys[id] = &privkey{key}
+	if v, ok := opened.(verifiedKey); ok {
+		if err := v.verify(privkeys[id]); err != nil {
+			closePrivkey(id)
+			return nil, err
+		}
+	}
+	return privkeys[id], nil
+}
+
+// verifiedKey is implemented by the key backends that cannot tell a wrong key
+// by themselves, such as passphrase keys, as any passphrase makes a key. The
+// key is cached while verify checks it against the store, so the stores that
+// need the key to open find it.
+type verifiedKey interface {
+	verify(priv *privkey) error
+}
+
+// closableKey is implemented by the key backends that hold on to resources,
+// such as the sessions of PKCS#11 tokens, which are released once otp is
+// done with the key.
+type closableKey interface {
+	close() error
+}
+
+// closePrivkeys releases the keys read by privkeywith.
+func closePrivkeys() {
+	for id := range privkeys {
+		closePrivkey(id)
+	}
+}
+
+// closePrivkey releases the key read by privkeywith, which is then read
+// again the next time it is needed.
+func closePrivkey(id string) {
+	priv, ok := privkeys[id]
+	if !ok {
+		return
+	}
+	key := priv.keyBackend
+	if h, ok := key.(*hybridKey); ok {
+		key = h.keyBackend
+	}
+	if k, ok := key.(closableKey); ok {
+		if err := k.close(); err != nil {
+			log.Printf("cannot close private key %s: %v", id, err)
+		}
+	}
+	delete(privkeys, id)
+}
+
+// signerKey is a RSA, Ed25519 or ECDSA private key. Secrets are encrypted to
+// RSA keys with the envelope of encryptRSA, and to Ed25519 and ECDSA keys
+// with the ECIES envelope of encryptECDH.
+type signerKey struct {
+	crypto.Signer
+}
+
+func newsignerkey(key any) (signerKey, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return signerKey{key}, nil
+	case ed25519.PrivateKey:
+		return signerKey{key}, nil
+	case *ed25519.PrivateKey:
+		return signerKey{*key}, nil
+	case *ecdsa.PrivateKey:
+		if _, err := key.ECDH(); err != nil {
+			return signerKey{}, err
+		}
+		return signerKey{key}, nil
+	}
+	return signerKey{}, errors.New("only RSA, Ed25519 and ECDSA keys are supported")
+}
+
+func (k signerKey) public() crypto.PublicKey {
+	return k.Public()
+}
+
+func (k signerKey) material() ([]byte, error) {
+	switch key := k.Signer.(type) {
+	case *rsa.PrivateKey:
+		return x509.MarshalPKCS1PrivateKey(key), nil
+	case ed25519.PrivateKey:
+		return key.Seed(), nil
+	case *ecdsa.PrivateKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return ecdhKey.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported private key %T", k.Signer)
+}
+
+// readKeyFile reads the private key file of the default key backend, or
+// opens the PKCS#11 token named by a pkcs11: URI, or the YubiKey PIV slot
+// named by yubikey:SLOT.
+func readKeyFile(fn string) (keyBackend, error) {
+	switch {
+	case strings.HasPrefix(fn, "pkcs11:"):
+		return openPKCS11Key(fn)
+	case strings.HasPrefix(fn, "yubikey:"):
+		return openYubiKey(fn)
+	}
 	pemdata, err := os.ReadFile(fn)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read key file: %s", err)
 	}
+	defer wipe(pemdata)
+	// Key files edited on Windows may carry a BOM and CRLF line endings.
+	pemdata = bytes.TrimPrefix(pemdata, []byte("\xef\xbb\xbf"))
+	pemdata = bytes.ReplaceAll(pemdata, []byte("\r\n"), []byte("\n"))
+	defer wipe(pemdata)
 
 	block, _ := pem.Decode(pemdata)
 	if block == nil {
 		return nil, errors.New("key data is not PEM encoded")
 	}
+	defer wipe(block.Bytes)
 
-	if got, want := block.Type, "RSA PRIVATE KEY"; got != want {
-		return nil, fmt.Errorf("mismatched key type. got: %q want: %q", got, want)
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		der := block.Bytes
+		// Legacy PEM encryption, as written by openssl and ssh-keygen -m PEM.
+		if x509.IsEncryptedPEMBlock(block) {
+			var passphrase []byte
+			passphrase, err = readPassphrase(fmt.Sprintf("passphrase for %s: ", fn))
+			if err != nil {
+				return nil, err
+			}
+			defer wipe(passphrase)
+			der, err = x509.DecryptPEMBlock(block, passphrase)
+			if errors.Is(err, x509.IncorrectPasswordError) {
+				return nil, fmt.Errorf("%w for %s", errWrongPassphrase, fn)
+			} else if err != nil {
+				return nil, fmt.Errorf("cannot decrypt private key: %s", err)
+			}
+		}
+		key, err = x509.ParsePKCS1PrivateKey(der)
+		wipe(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = parsePKCS8(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		var passphrase, der []byte
+		passphrase, err = readPassphrase(fmt.Sprintf("passphrase for %s: ", fn))
+		if err != nil {
+			return nil, err
+		}
+		defer wipe(passphrase)
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+		if err == nil {
+			key, err = parsePKCS8(der)
+			wipe(der)
+		}
+		if errors.Is(err, errWrongPassphrase) || errors.Is(err, errNotPKCS8) {
+			return nil, fmt.Errorf("%w for %s", errWrongPassphrase, fn)
+		}
+	case "OPENSSH PRIVATE KEY":
+		key, err = parseOpenSSHKey(fn, pemdata)
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("%w for %s", errWrongPassphrase, fn)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", block.Type)
+	}
+	var priv signerKey
+	if err == nil {
+		priv, err = newsignerkey(key)
 	}
-
-	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, fmt.Errorf("invalid private key: %s", err)
 	}
+	return priv, nil
+}
+
+// errNotPKCS8 is returned by parsePKCS8 for data that is not a PKCS#8 key.
+var errNotPKCS8 = errors.New("not a PKCS#8 key")
+
+func parsePKCS8(der []byte) (any, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errNotPKCS8, err)
+	}
+	return key, nil
+}
+
+// parseOpenSSHKey parses the keys written by ssh-keygen, asking for the
+// passphrase if the key is protected by one.
+func parseOpenSSHKey(fn string, pemdata []byte) (any, error) {
+	key, err := ssh.ParseRawPrivateKey(pemdata)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		var passphrase []byte
+		passphrase, err = readPassphrase(fmt.Sprintf("passphrase for %s: ", fn))
+		if err != nil {
+			return nil, err
+		}
+		defer wipe(passphrase)
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemdata, passphrase)
+	}
+	return key, err
+}
+
+// passphraseFile is the file given by --passphrase-file.
+var passphraseFile string
+
+// readPassphrase returns the passphrase of the private key: the content of
+// --passphrase-file, or $OTP_KEY_PASSPHRASE, or else what the user types on
+// the terminal, without echo. Once the duress store is unlocked, its
+// passphrase is returned without asking again.
+func readPassphrase(prompt string) ([]byte, error) {
+	if duressPassphrase != nil {
+		return bytes.Clone(duressPassphrase), nil
+	}
+	passphrase, err := askPassphrase(prompt)
+	if err == nil && duressDB != "" {
+		lastPassphrase = bytes.Clone(passphrase)
+		mlock(lastPassphrase)
+	}
+	return passphrase, err
+}
+
+func askPassphrase(prompt string) ([]byte, error) {
+	if passphraseFile != "" {
+		passphrase, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read passphrase file: %s", err)
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	}
+	if passphrase, ok := os.LookupEnv("OTP_KEY_PASSPHRASE"); ok {
+		return []byte(passphrase), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if program, ok := usePinentry(term.IsTerminal(fd)); ok {
+		return pinentryPassphrase(program, strings.TrimSuffix(prompt, ": "), false)
+	}
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("key is protected by a passphrase; set OTP_KEY_PASSPHRASE or --passphrase-file, or run otp on a terminal or with pinentry")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(fd)
+}
 
-	return &privkey{PrivateKey: priv}, nil
+func (k signerKey) encrypted(in, label []byte) ([]byte, error) {
+	return encryptTo(k.Public(), in, label)
 }
 
-func (p privkey) encrypted(in, label []byte) ([]byte, error) {
-	return rsa.EncryptOAEP(sha256.New(), rand.Reader, &p.PublicKey, in, label)
+func (k signerKey) decrypted(in, label []byte) ([]byte, error) {
+	switch key := k.Signer.(type) {
+	case *rsa.PrivateKey:
+		return decryptRSA(key.Size(), in, label, func(in []byte) ([]byte, error) {
+			return rsa.DecryptOAEP(sha256.New(), rand.Reader, key, in, label)
+		})
+	}
+	key, err := ecdhPrivateKey(k.Signer)
+	if err != nil {
+		return nil, err
+	}
+	return decryptECDH(key, in, label)
 }
 
-func (p privkey) decrypted(in, label []byte) ([]byte, error) {
-	return rsa.DecryptOAEP(sha256.New(), rand.Reader, p.PrivateKey, in, label)
+// encryptTo encrypts in to the public key of a signerKey.
+func encryptTo(pub crypto.PublicKey, in, label []byte) ([]byte, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return encryptRSA(pub, in, label)
+	}
+	key, err := ecdhPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return encryptECDH(key, in, label)
 }
 
 func cryptlabel(account, issuer string) []byte {
 	return []byte(fmt.Sprint(account, issuer))
 }
 
+// withLabel prefixes the data with the label, for the encryption schemes
+// that do not take additional data.
+func withLabel(in, label []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(label)))
+	out = append(out, label...)
+	return append(out, in...)
+}
+
+// withoutLabel reverses withLabel, failing if the data was prefixed with
+// another label.
+func withoutLabel(plain, label []byte) ([]byte, error) {
+	n, size := binary.Uvarint(plain)
+	if size <= 0 || uint64(len(plain)-size) < n || !bytes.Equal(plain[size:size+int(n)], label) {
+		return nil, errors.New("ciphertext does not belong to this entry")
+	}
+	return plain[size+int(n):], nil
+}
+
+// provisioningQR encodes the otpauth:// URI of the key. The issuer and the
+// account are escaped, so neither can add parameters to the URI or end the
+// label early.
+func provisioningQR(issuer, account, password string) (*qr.Code, error) {
+	label := otpauthEscape(issuer) + ":" + otpauthEscape(account)
+	query := url.Values{"secret": {password}, "issuer": {issuer}}
+	otpauth := "otpauth://totp/" + label + "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+	return qr.Encode(otpauth, qr.H)
+}
+
+// otpauthEscape escapes a part of the label of an otpauth:// URI, spaces as
+// %20 as the authenticator apps expect.
+func otpauthEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
 func generateQR(issuer, account, password string) (string, error) {
-	otpauth := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s", issuer, account, password, issuer)
-	code, err := qr.Encode(otpauth, qr.H)
+	code, err := provisioningQR(issuer, account, password)
 	if err != nil {
 		return "", err
 	}
@@ -411,7 +1744,7 @@ func generateQR(issuer, account, password string) (string, error) {
 		panic(err)
 	}
 
-	fn := fmt.Sprintf("otp-qr-%s-%s.png", issuer, account)
+	fn := fmt.Sprintf("otp-qr-%s-%s.png", safeFilename(issuer), safeFilename(account))
 	out, err := os.Create(fn)
 	if err != nil {
 		return "", err
@@ -424,3 +1757,14 @@ func generateQR(issuer, account, password string) (string, error) {
 
 	return fn, nil
 }
+
+// safeFilename replaces the characters that are not allowed in file names on
+// any of the supported platforms.
+func safeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
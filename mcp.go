@@ -0,0 +1,226 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/urfave/cli"
+)
+
+// mcpProtocolVersions are the revisions of the Model Context Protocol otp
+// mcp speaks; the last is offered to clients asking for another.
+var mcpProtocolVersions = []string{"2024-11-05", "2025-03-26", "2025-06-18"}
+
+// mcpRequest is a JSON-RPC 2.0 request, or a notification without ID.
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+// mcpTools are the tools of otp mcp, as listed to clients.
+var mcpTools = []map[string]any{
+	{
+		"name":        "list_accounts",
+		"description": "List the issuers and account names of the OTP keys, optionally only those containing the query. No codes are returned.",
+		"inputSchema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"query": map[string]any{"type": "string", "description": "text the issuer or the account name contains"},
+			},
+		},
+	},
+	{
+		"name":        "get_code",
+		"description": "Get the current OTP code of an account. The user is asked to confirm every call, and may refuse.",
+		"inputSchema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"issuer":  map[string]any{"type": "string"},
+				"account": map[string]any{"type": "string"},
+			},
+			"required": []string{"issuer", "account"},
+		},
+	},
+}
+
+func mcp() cli.Command {
+	return cli.Command{
+		Name:  "mcp",
+		Usage: "serve the keys to AI assistants as a Model Context Protocol server on stdin and stdout",
+		Description: `The tools are list_accounts, which lists the issuers and account names,
+   and get_code, which returns the current code of an account once the user
+   confirms the call with pinentry: --pinentry, or the pinentry found in the
+   PATH, as stdin and stdout carry the protocol. Without pinentry, get_code
+   fails.`,
+		Action: func(c *cli.Context) error {
+			return serveMCP(c, os.Stdin, os.Stdout)
+		},
+	}
+}
+
+// serveMCP answers the requests read from r, one JSON-RPC message per line,
+// until r is closed.
+func serveMCP(c *cli.Context, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	enc := json.NewEncoder(w)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var req mcpRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			if err := enc.Encode(mcpResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &mcpError{rpcParseError, "invalid JSON-RPC message"}}); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.ID == nil {
+			// Notifications, such as notifications/initialized, are
+			// not answered.
+			continue
+		}
+		result, rpcErr := mcpCall(c, req)
+		if err := enc.Encode(mcpResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: rpcErr}); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func mcpCall(c *cli.Context, req mcpRequest) (any, *mcpError) {
+	if req.JSONRPC != "2.0" {
+		return nil, &mcpError{rpcInvalidRequest, "not a JSON-RPC 2.0 request"}
+	}
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(req.Params, &params)
+		version := mcpProtocolVersions[len(mcpProtocolVersions)-1]
+		if slices.Contains(mcpProtocolVersions, params.ProtocolVersion) {
+			version = params.ProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "otp", "version": c.App.Version},
+		}, nil
+	case "ping":
+		return map[string]any{}, nil
+	case "tools/list":
+		return map[string]any{"tools": mcpTools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string            `json:"name"`
+			Arguments map[string]string `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &mcpError{rpcInvalidParams, "invalid arguments: " + err.Error()}
+		}
+		text, err := mcpTool(c, params.Name, params.Arguments)
+		if errors.Is(err, errUnknownTool) {
+			return nil, &mcpError{rpcInvalidParams, err.Error()}
+		}
+		if err != nil {
+			return map[string]any{"content": []map[string]string{{"type": "text", "text": err.Error()}}, "isError": true}, nil
+		}
+		return map[string]any{"content": []map[string]string{{"type": "text", "text": text}}}, nil
+	}
+	return nil, &mcpError{rpcMethodNotFound, "unknown method " + req.Method}
+}
+
+var errUnknownTool = errors.New("unknown tool")
+
+// mcpTool runs the tool and returns its text. Errors are reported to the
+// client as the result of the tool.
+func mcpTool(c *cli.Context, name string, args map[string]string) (string, error) {
+	switch name {
+	case "list_accounts":
+		entries, err := listEntries(c)
+		if err != nil {
+			return "", err
+		}
+		out := make([]apiEntry, 0, len(entries))
+		for _, e := range entries {
+			if matches(args["query"], apiCode{Issuer: e.Issuer, Account: e.Account}) {
+				out = append(out, e)
+			}
+		}
+		data, err := json.Marshal(out)
+		return string(data), err
+	case "get_code":
+		issuer, account := args["issuer"], args["account"]
+		switch {
+		case issuer == "":
+			return "", errors.New("issuer is missing")
+		case account == "":
+			return "", errors.New("account is missing")
+		}
+		if ok, err := entryExists(c, issuer, account); err != nil {
+			return "", err
+		} else if !ok {
+			return "", fmt.Errorf("%s/%s: %w", issuer, account, errNotFound)
+		}
+		program, ok := usePinentry(false)
+		if !ok {
+			return "", errors.New("cannot ask the user to confirm: install pinentry or set --pinentry")
+		}
+		allowed, err := pinentryConfirm(program, fmt.Sprintf("An AI assistant asks for the OTP code of %s/%s. Allow?", issuer, account))
+		if err != nil {
+			return "", fmt.Errorf("cannot ask the user to confirm: %w", err)
+		}
+		if !allowed {
+			return "", errors.New("the user refused to share the code")
+		}
+		code, err := entryCode(c, issuer, account)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (valid for %ds more)", code.Code, code.ExpiresIn), nil
+	}
+	return "", fmt.Errorf("%w %q", errUnknownTool, name)
+}
@@ -0,0 +1,22 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// wipe zeroes a buffer that held a secret, once it is no longer needed. Go
+// may have copied the secret elsewhere, such as into strings, so wiping only
+// narrows how long a secret stays in memory.
+func wipe(b []byte) {
+	clear(b)
+}
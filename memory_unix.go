@@ -0,0 +1,32 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix && !linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// hardenProcess keeps secrets out of crash dumps: no core files are written.
+func hardenProcess() {
+	unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{})
+}
+
+// mlock keeps the pages of the buffer out of swap, as far as RLIMIT_MEMLOCK
+// allows.
+func mlock(b []byte) {
+	if len(b) > 0 {
+		unix.Mlock(b)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/urfave/cli"
+)
+
+// decryptionErrors counts the entries that could not be decrypted, for the
+// metrics of otp http.
+var decryptionErrors atomic.Int64
+
+// httpMetrics counts the requests by method and status, for /metrics.
+type httpMetrics struct {
+	mu       sync.Mutex
+	requests map[[2]string]int64
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{requests: make(map[[2]string]int64)}
+}
+
+// handler counts the requests served by next, and serves /healthz without
+// authentication, so load balancers and service managers can probe it. The
+// errors of the store are only logged, as anyone may probe it.
+func (m *httpMetrics) handler(next http.Handler, c *cli.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := countEntries(c); err != nil {
+			log.Println("health check:", err)
+			http.Error(w, "the store is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/", next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		default:
+			// Keep the label values bounded.
+			method = "other"
+		}
+		m.mu.Lock()
+		m.requests[[2]string{method, strconv.Itoa(rec.status)}]++
+		m.mu.Unlock()
+	})
+}
+
+// registerMetrics adds /metrics, in the Prometheus text format. The metrics
+// are of the whole store, so with --users only admins are served them.
+func registerMetrics(mux *http.ServeMux, c *cli.Context, m *httpMetrics) {
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		if t := tenantOf(r); t != nil && !t.admin {
+			http.Error(w, "only admins read the metrics", http.StatusForbidden)
+			return
+		}
+		entries, err := countEntries(c)
+		if err != nil {
+			log.Println("metrics:", err)
+			http.Error(w, "the store is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		m.mu.Lock()
+		keys := make([][2]string, 0, len(m.requests))
+		for k := range m.requests {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+		})
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintln(w, "# HELP otp_http_requests_total HTTP requests by method and status.")
+		fmt.Fprintln(w, "# TYPE otp_http_requests_total counter")
+		var failures int64
+		for _, k := range keys {
+			fmt.Fprintf(w, "otp_http_requests_total{method=%q,code=%q} %d\n", k[0], k[1], m.requests[k])
+			if k[1] == strconv.Itoa(http.StatusUnauthorized) {
+				failures += m.requests[k]
+			}
+		}
+		m.mu.Unlock()
+		fmt.Fprintln(w, "# HELP otp_http_auth_failures_total HTTP requests refused for failed authentication.")
+		fmt.Fprintln(w, "# TYPE otp_http_auth_failures_total counter")
+		fmt.Fprintf(w, "otp_http_auth_failures_total %d\n", failures)
+		fmt.Fprintln(w, "# HELP otp_decryption_errors_total Entries that could not be decrypted.")
+		fmt.Fprintln(w, "# TYPE otp_decryption_errors_total counter")
+		fmt.Fprintf(w, "otp_decryption_errors_total %d\n", decryptionErrors.Load())
+		fmt.Fprintln(w, "# HELP otp_entries Entries in the store.")
+		fmt.Fprintln(w, "# TYPE otp_entries gauge")
+		fmt.Fprintf(w, "otp_entries %d\n", entries)
+	})
+}
+
+// countEntries counts the entries of the store, without decrypting them.
+func countEntries(c *cli.Context) (int, error) {
+	httpMu.Lock()
+	defer httpMu.Unlock()
+	s, err := openstore(c, false)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	entries, err := s.List()
+	return len(entries), err
+}
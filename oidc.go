@@ -0,0 +1,458 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcCookie  = "otp_oidc"
+	oidcPending = 10 * time.Minute
+)
+
+// oidcLogin logs users in with the authorization code flow of an OpenID
+// Connect provider, with PKCE. The ID token is verified with the keys the
+// provider publishes, and the user is named by one of its claims, scoped by
+// the provider: the user sub of https://accounts.example.com is named
+// sub@accounts.example.com, so the users of the provider never take the names
+// of the users with a password or of the LDAP directory.
+type oidcLogin struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	userClaim    string
+	idle         time.Duration
+	hc           *http.Client
+	// scope is the suffix of the names of the users, @ and the host name of
+	// the issuer.
+	scope string
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	mu sync.Mutex
+	// keys are the signing keys of the provider by key ID, refreshed at
+	// most once a minute when a token names an unknown one.
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	pending     map[string]oidcAttempt
+	sessions    map[string]*oidcSession
+}
+
+// oidcAttempt is a login sent to the provider, by state.
+type oidcAttempt struct {
+	nonce    string
+	verifier string
+	started  time.Time
+}
+
+type oidcSession struct {
+	user string
+	seen time.Time
+}
+
+func newOIDCLogin(issuer, clientID, clientSecret, redirectURL, userClaim string, idle time.Duration) (*oidcLogin, error) {
+	if clientID == "" {
+		return nil, errors.New("--oidc-issuer needs --oidc-client-id")
+	}
+	if idle <= 0 {
+		return nil, errors.New("--session-idle must be positive")
+	}
+	u, err := url.Parse(issuer)
+	if err != nil || u.Hostname() == "" {
+		return nil, errors.New("--oidc-issuer must be a URL")
+	}
+	l := &oidcLogin{
+		scope:        "@" + u.Hostname(),
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		userClaim:    userClaim,
+		idle:         idle,
+		hc:           &http.Client{Timeout: 30 * time.Second},
+		pending:      make(map[string]oidcAttempt),
+		sessions:     make(map[string]*oidcSession),
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := l.getJSON(l.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("cannot discover the OIDC provider: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != l.issuer {
+		return nil, fmt.Errorf("the OIDC provider calls itself %q, not %q", discovery.Issuer, issuer)
+	}
+	l.authURL, l.tokenURL, l.jwksURL = discovery.AuthorizationEndpoint, discovery.TokenEndpoint, discovery.JWKSURI
+	if l.authURL == "" || l.tokenURL == "" || l.jwksURL == "" {
+		return nil, errors.New("the OIDC provider does not publish its endpoints")
+	}
+	return l, nil
+}
+
+func (l *oidcLogin) getJSON(u string, v any) error {
+	resp, err := l.hc.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// redirect returns the URL the provider sends users back to.
+func (l *oidcLogin) redirect(r *http.Request) string {
+	if l.redirectURL != "" {
+		return l.redirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/login/oidc/callback"
+}
+
+// start sends the user to the provider.
+func (l *oidcLogin) start(w http.ResponseWriter, r *http.Request) {
+	state := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	attempt := oidcAttempt{
+		nonce:    base64.RawURLEncoding.EncodeToString(randomBytes(32)),
+		verifier: base64.RawURLEncoding.EncodeToString(randomBytes(32)),
+		started:  time.Now(),
+	}
+	l.mu.Lock()
+	for s, a := range l.pending {
+		if time.Since(a.started) > oidcPending {
+			delete(l.pending, s)
+		}
+	}
+	l.pending[state] = attempt
+	l.mu.Unlock()
+	challenge := sha256.Sum256([]byte(attempt.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {l.clientID},
+		"redirect_uri":          {l.redirect(r)},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {attempt.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	// The provider sends the user back with a cross-site navigation, which
+	// carries Lax cookies only.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcPending.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	sep := "?"
+	if strings.Contains(l.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, l.authURL+sep+q.Encode(), http.StatusSeeOther)
+}
+
+// callback takes the user back from the provider and logs them in.
+func (l *oidcLogin) callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login refused by the provider: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	state := q.Get("state")
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "login expired or started elsewhere; try again", http.StatusBadRequest)
+		return
+	}
+	l.mu.Lock()
+	attempt, ok := l.pending[state]
+	delete(l.pending, state)
+	l.mu.Unlock()
+	if !ok || time.Since(attempt.started) > oidcPending {
+		http.Error(w, "login expired; try again", http.StatusBadRequest)
+		return
+	}
+	user, err := l.exchange(r, q.Get("code"), attempt)
+	if err != nil {
+		log.Println("OIDC login failed:", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	id := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	l.mu.Lock()
+	l.sessions[id] = &oidcSession{user: user, seen: time.Now()}
+	l.mu.Unlock()
+	audit(r).authenticated("oidc:" + user)
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/login/oidc", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// exchange redeems the code for an ID token and returns the user it names.
+func (l *oidcLogin) exchange(r *http.Request, code string, attempt oidcAttempt) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {l.redirect(r)},
+		"client_id":     {l.clientID},
+		"code_verifier": {attempt.verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, l.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if l.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(l.clientID), url.QueryEscape(l.clientSecret))
+	}
+	resp, err := l.hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s", resp.Status, tok.Error)
+	}
+	claims, err := l.verify(tok.IDToken, attempt.nonce)
+	if err != nil {
+		return "", err
+	}
+	return l.userOf(claims)
+}
+
+// userOf names the user of the verified claims. Email addresses only name
+// users once the provider verified them, as some let users set any.
+func (l *oidcLogin) userOf(claims map[string]any) (string, error) {
+	user, _ := claims[l.userClaim].(string)
+	if user == "" || strings.ContainsAny(user, "/:") {
+		return "", fmt.Errorf("the ID token has no usable %s claim: %q", l.userClaim, user)
+	}
+	if l.userClaim == "email" && claims["email_verified"] != true {
+		return "", fmt.Errorf("the provider did not verify the email address %q", user)
+	}
+	return user + l.scope, nil
+}
+
+// verify checks the signature and the claims of the ID token.
+func (l *oidcLogin) verify(raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := l.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("invalid ID token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ID token key %q", header.Kid)
+	}
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	iss, _ := claims["iss"].(string)
+	exp, _ := claims["exp"].(float64)
+	gotNonce, _ := claims["nonce"].(string)
+	switch {
+	case strings.TrimSuffix(iss, "/") != l.issuer:
+		return nil, fmt.Errorf("ID token issued by %q", iss)
+	case !audienceHas(claims["aud"], l.clientID):
+		return nil, errors.New("ID token issued to another client")
+	case time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)):
+		return nil, errors.New("ID token expired")
+	case gotNonce != nonce:
+		return nil, errors.New("ID token of another login")
+	}
+	return claims, nil
+}
+
+func audienceHas(aud any, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed ID token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed ID token")
+	}
+	return nil
+}
+
+// key returns the signing key of the provider with the ID.
+func (l *oidcLogin) key(kid string) (crypto.PublicKey, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if k, ok := l.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(l.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown ID token key %q", kid)
+	}
+	l.keysFetched = time.Now()
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := l.getJSON(l.jwksURL, &jwks); err != nil {
+		return nil, fmt.Errorf("cannot fetch the keys of the OIDC provider: %w", err)
+	}
+	l.keys = make(map[string]crypto.PublicKey)
+	b64 := func(s string) *big.Int {
+		data, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(data)
+	}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA" && k.N != "" && k.E != "":
+			l.keys[k.Kid] = &rsa.PublicKey{N: b64(k.N), E: int(b64(k.E).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			l.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: b64(k.X), Y: b64(k.Y)}
+		}
+	}
+	if k, ok := l.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown ID token key %q", kid)
+}
+
+// user returns the user of the live session of the request, and keeps it
+// alive.
+func (l *oidcLogin) user(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		return "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for id, sess := range l.sessions {
+		if now.Sub(sess.seen) > l.idle {
+			delete(l.sessions, id)
+		}
+	}
+	sess, ok := l.sessions[cookie.Value]
+	if !ok {
+		return "", false
+	}
+	sess.seen = now
+	return sess.user, true
+}
+
+func (l *oidcLogin) logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(loginCookie); err == nil {
+		l.mu.Lock()
+		delete(l.sessions, cookie.Value)
+		l.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
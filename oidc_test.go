@@ -0,0 +1,158 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT signs the claims as a JWT with the key, RS256 or ES256.
+func signJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &oidcLogin{
+		issuer:      "https://accounts.example.com",
+		clientID:    "otp",
+		scope:       "@accounts.example.com",
+		userClaim:   "sub",
+		keys:        map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey},
+		keysFetched: time.Now(),
+	}
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   "https://accounts.example.com",
+			"aud":   "otp",
+			"sub":   "1234",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "n0nce",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	good := signJWT(t, rsaKey, "RS256", "rsa", claims(nil))
+	parts := strings.Split(good, ".")
+	forged, _ := json.Marshal(claims(func(c map[string]any) { c["sub"] = "admin" }))
+	swapped := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`))
+
+	tests := []struct {
+		name, token, wantErr string
+	}{
+		{"rs256", good, ""},
+		{"es256", signJWT(t, ecKey, "ES256", "ec", claims(nil)), ""},
+		{"audience list", signJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["aud"] = []any{"other", "otp"} })), ""},
+		{"tampered claims", swapped, "invalid ID token signature"},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("signature")), "invalid ID token signature"},
+		{"other key", signJWT(t, otherKey, "RS256", "rsa", claims(nil)), "invalid ID token signature"},
+		{"alg none", noneHeader + "." + parts[1] + ".", "unsupported ID token algorithm"},
+		{"alg mismatch", signJWT(t, ecKey, "RS256", "ec", claims(nil)), "unsupported ID token algorithm"},
+		{"unknown key", signJWT(t, rsaKey, "RS256", "other", claims(nil)), "unknown ID token key"},
+		{"other issuer", signJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["iss"] = "https://evil.example" })), "issued by"},
+		{"other client", signJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["aud"] = "other" })), "another client"},
+		{"expired", signJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), "expired"},
+		{"no expiry", signJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { delete(c, "exp") })), "expired"},
+		{"other nonce", signJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["nonce"] = "other" })), "another login"},
+		{"two parts", parts[0] + "." + parts[1], "malformed"},
+		{"bad base64", parts[0] + "." + parts[1] + ".!!", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := l.verify(tt.token, "n0nce")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verify() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["sub"] != "1234" {
+				t.Errorf("verify() sub = %v, want 1234", got["sub"])
+			}
+		})
+	}
+}
+
+func TestOIDCUserOf(t *testing.T) {
+	tests := []struct {
+		claim   string
+		claims  map[string]any
+		want    string
+		wantErr bool
+	}{
+		{"sub", map[string]any{"sub": "1234"}, "1234@accounts.example.com", false},
+		{"sub", map[string]any{"preferred_username": "alice"}, "", true},
+		{"sub", map[string]any{"sub": "a/b"}, "", true},
+		{"sub", map[string]any{"sub": 1234}, "", true},
+		{"email", map[string]any{"email": "alice@example.com", "email_verified": true}, "alice@example.com@accounts.example.com", false},
+		{"email", map[string]any{"email": "alice@example.com", "email_verified": false}, "", true},
+		{"email", map[string]any{"email": "alice@example.com", "email_verified": "true"}, "", true},
+		{"email", map[string]any{"email": "alice@example.com"}, "", true},
+	}
+	for _, tt := range tests {
+		l := &oidcLogin{userClaim: tt.claim, scope: "@accounts.example.com"}
+		got, err := l.userOf(tt.claims)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("userOf(%v) with claim %s = %q, %v; want %q", tt.claims, tt.claim, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"rsc.io/qr"
+)
+
+// pairingTTL is how long a pairing token can be used.
+const pairingTTL = 10 * time.Minute
+
+// pairingParam is the fragment parameter of the pairing URL that holds the
+// token.
+const pairingParam = "pair"
+
+type pairingResponse struct {
+	Token string `json:"token"`
+}
+
+type enrollRequest struct {
+	Token  string `json:"token"`
+	Device string `json:"device"`
+	Key    []byte `json:"key"`
+}
+
+func pair() cli.Command {
+	return cli.Command{
+		Name:      "pair",
+		Usage:     "enroll another device in a sync server",
+		ArgsUsage: "`server-url` | --accept `pairing-url`",
+		Description: `On a device already enrolled in the sync server, "otp pair URL" shows a QR
+   code with the server address and a one-time pairing token, valid for 10
+   minutes. On the new device, "otp pair --accept PAIRING-URL", with the URL
+   read from the QR code, enrolls the device so it can run otp sync.
+
+   The private key is not transferred; it must be copied to the new device
+   separately.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "accept",
+				Usage: "enroll this device with the pairing URL shown by the other device",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			path := storePath(c)
+			if path == "" {
+				return fmt.Errorf("store %s is already shared and cannot be synced", storeName(c))
+			}
+			statefn := path + ".sync"
+
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			state, err := loadSyncState(statefn)
+			if err != nil {
+				return err
+			}
+
+			if pairing := c.String("accept"); pairing != "" {
+				server, err := acceptPairing(pairing, state)
+				if err != nil {
+					return err
+				}
+				if err := writeJSONFile(statefn, state); err != nil {
+					return err
+				}
+				log.Printf("device %s enrolled; run otp sync %s", state.Device, server)
+				return nil
+			}
+
+			server := c.Args().First()
+			if server == "" {
+				return errors.New("server is missing")
+			}
+			remote, err := newhttpremote(server, state)
+			if err != nil {
+				return err
+			}
+			if err := writeJSONFile(statefn, state); err != nil {
+				return err
+			}
+			data, err := remote.do(http.MethodPost, "/v1/pairing", nil, nil)
+			if err != nil {
+				return err
+			}
+			var resp pairingResponse
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return err
+			}
+			u := *remote.base
+			u.Fragment = pairingParam + "=" + resp.Token
+			if err := printQR(os.Stdout, u.String()); err != nil {
+				return err
+			}
+			fmt.Println(u.String())
+			return nil
+		},
+	}
+}
+
+// acceptPairing enrolls the device with the pairing URL, and returns the
+// address of the server.
+func acceptPairing(pairing string, state *syncState) (string, error) {
+	u, err := url.Parse(pairing)
+	if err != nil {
+		return "", err
+	}
+	token, ok := strings.CutPrefix(u.Fragment, pairingParam+"=")
+	if !ok || u.Host == "" {
+		return "", errors.New("invalid pairing URL")
+	}
+	u.Fragment = ""
+	key, err := deviceKey(state)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(enrollRequest{
+		Token:  token,
+		Device: state.Device,
+		Key:    key.Public().(ed25519.PublicKey),
+	})
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(u.JoinPath("/v1/enroll").String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("sync server: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return u.String(), nil
+}
+
+// newPairing returns a new one-time pairing token.
+func (srv *syncServer) newPairing() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.pairings == nil {
+		srv.pairings = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for t, expiry := range srv.pairings {
+		if now.After(expiry) {
+			delete(srv.pairings, t)
+		}
+	}
+	srv.pairings[token] = now.Add(pairingTTL)
+	return token, nil
+}
+
+// enroll adds the device of a pairing to the devices file.
+func (srv *syncServer) enroll(w http.ResponseWriter, body []byte) {
+	var req enrollRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if !validDevice.MatchString(req.Device) || len(req.Key) != ed25519.PublicKeySize {
+		http.Error(w, "invalid device", http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	expiry, ok := srv.pairings[req.Token]
+	delete(srv.pairings, req.Token)
+	if !ok || time.Now().After(expiry) {
+		http.Error(w, "invalid or expired pairing token", http.StatusUnauthorized)
+		return
+	}
+	devices, err := srv.loadDevices()
+	if err != nil {
+		log.Println("cannot load devices:", err)
+		http.Error(w, "cannot load devices", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := devices[req.Device]; ok {
+		http.Error(w, "device already enrolled", http.StatusConflict)
+		return
+	}
+	fd, err := os.OpenFile(srv.devices, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err == nil {
+		_, err = fmt.Fprintln(fd, req.Device, base64.StdEncoding.EncodeToString(req.Key))
+		err = errors.Join(err, fd.Close())
+	}
+	if err != nil {
+		log.Println("cannot enroll device:", err)
+		http.Error(w, "cannot enroll device", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("device %s enrolled", req.Device)
+}
+
+// printQR draws the QR code of the text with block characters, two modules
+// per line. Light modules are drawn, so the code reads well on the usual
+// dark terminal background.
+func printQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return err
+	}
+	const quiet = 2
+	light := func(x, y int) bool {
+		return x < 0 || y < 0 || x >= code.Size || y >= code.Size || !code.Black(x, y)
+	}
+	var buf strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	_, err = io.WriteString(w, buf.String())
+	return err
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+func init() {
+	keyBackends["passphrase"] = newpassphrasekey
+}
+
+// Argon2id parameters of the passphrase keys, as recommended by RFC 9106.
+const (
+	passphraseVersion = 1
+	argon2Time        = 3
+	argon2Memory      = 64 * 1024
+	argon2Threads     = 4
+	argon2SaltSize    = 16
+)
+
+// passphraseKey encrypts the secrets with AES-256-GCM, under a key derived
+// from a passphrase with Argon2id, so no key file is needed at all. Every
+// secret carries the salt it was encrypted with: the version, the salt, and
+// then the nonce and the ciphertext.
+//
+// As deriving a key is slow on purpose, the keys are kept for the whole run,
+// and new secrets reuse the salt of the secrets already decrypted.
+type passphraseKey struct {
+	passphrase []byte
+	// salt is the salt of the new secrets.
+	salt []byte
+	keys map[string][]byte
+}
+
+// passphraseKeyID is the public key of every passphraseKey.
+type passphraseKeyID struct{}
+
+func (passphraseKeyID) Equal(o crypto.PublicKey) bool {
+	_, ok := o.(passphraseKeyID)
+	return ok
+}
+
+func (passphraseKeyID) fingerprint() string {
+	return "-"
+}
+
+func (passphraseKeyID) kind() string {
+	return "PASSPHRASE"
+}
+
+// passphraseStore opens, read-only, the store the passphrase is checked
+// against. It is set once the global flags are known.
+var passphraseStore func() (store, error)
+
+func newpassphrasekey(string) (keyBackend, error) {
+	passphrase, err := readPassphrase("passphrase of the store: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	mlock(passphrase)
+	return &passphraseKey{passphrase: passphrase, keys: make(map[string][]byte)}, nil
+}
+
+// verify checks the passphrase against the secrets of the store, which all
+// act as verifiers, until one is decrypted; it fails with errWrongPassphrase
+// when none is. Secrets encrypted with other keys are left out. When the
+// store has no secret yet, the passphrase is asked again instead, so a typo
+// cannot encrypt the first secrets under an unknown key.
+func (k *passphraseKey) verify(priv *privkey) error {
+	if passphraseStore == nil {
+		return nil
+	}
+	var entries []entry
+	s, err := passphraseStore()
+	if err == nil {
+		entries, err = (&namesStore{base: basestore(s), priv: priv}).List()
+		s.Close()
+	}
+	switch {
+	case errors.Is(err, errWrongPassphrase):
+		return err
+	case err != nil && !errors.Is(err, errNotInitialized):
+		return fmt.Errorf("cannot check the passphrase: %w", err)
+	}
+	wrong := false
+	for _, e := range entries {
+		if _, _, _, ok := cutEntryKey(e.Password); ok {
+			continue
+		}
+		secret, err := priv.legacySecret(e)
+		if err == nil {
+			wipe(secret)
+			return nil
+		}
+		wrong = wrong || errors.Is(err, errWrongPassphrase)
+	}
+	if wrong {
+		return errWrongPassphrase
+	}
+	again, err := readPassphrase("passphrase of the store again: ")
+	if err != nil {
+		return err
+	}
+	defer wipe(again)
+	if !bytes.Equal(k.passphrase, again) {
+		return errors.New("passphrases do not match")
+	}
+	return nil
+}
+
+// readNewPassphrase reads the new passphrase from the file, or else asks it
+// twice on the terminal or with pinentry.
+func readNewPassphrase(fn string) ([]byte, error) {
+	if fn != "" {
+		passphrase, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read passphrase file: %s", err)
+		}
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, errors.New("empty passphrase")
+		}
+		return passphrase, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if program, ok := usePinentry(term.IsTerminal(fd)); ok {
+		passphrase, err := pinentryPassphrase(program, "new passphrase of the store", true)
+		if err == nil && len(passphrase) == 0 {
+			err = errors.New("empty passphrase")
+		}
+		return passphrase, err
+	}
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("set --new-passphrase-file, or run otp on a terminal or with pinentry")
+	}
+	fmt.Fprint(os.Stderr, "New passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(os.Stderr, "New passphrase again: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !bytes.Equal(passphrase, again):
+		return nil, errors.New("passphrases do not match")
+	case len(passphrase) == 0:
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+func (k *passphraseKey) key(salt []byte) []byte {
+	key, ok := k.keys[string(salt)]
+	if !ok {
+		key = argon2.IDKey(k.passphrase, salt, argon2Time, argon2Memory, argon2Threads, 32)
+		mlock(key)
+		k.keys[string(salt)] = key
+	}
+	if k.salt == nil {
+		k.salt = salt
+	}
+	return key
+}
+
+func (k *passphraseKey) public() crypto.PublicKey {
+	return passphraseKeyID{}
+}
+
+func (k *passphraseKey) material() ([]byte, error) {
+	return nil, errors.New("passphrase keys cannot encrypt names")
+}
+
+func (k *passphraseKey) encrypted(in, label []byte) ([]byte, error) {
+	salt := k.salt
+	if salt == nil {
+		salt = randomBytes(argon2SaltSize)
+	}
+	sealed, err := sealGCM(k.key(salt), in, label)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{passphraseVersion}, salt...)
+	return append(out, sealed...), nil
+}
+
+func (k *passphraseKey) decrypted(in, label []byte) ([]byte, error) {
+	if len(in) < 1+argon2SaltSize || in[0] != passphraseVersion {
+		return nil, errors.New("not encrypted with a passphrase")
+	}
+	salt := bytes.Clone(in[1 : 1+argon2SaltSize])
+	plain, err := openGCM(k.key(salt), in[1+argon2SaltSize:], label)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plain, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pinentryProgram is the pinentry given by --pinentry.
+var pinentryProgram string
+
+// usePinentry returns the pinentry that asks for passphrases: the one given
+// by --pinentry, or else, when there is no terminal to ask on, the pinentry
+// found in the PATH.
+func usePinentry(terminal bool) (string, bool) {
+	if pinentryProgram != "" {
+		return pinentryProgram, true
+	}
+	if terminal {
+		return "", false
+	}
+	program, err := exec.LookPath("pinentry")
+	return program, err == nil
+}
+
+// pinentry talks the Assuan protocol to a pinentry program, as gpg-agent
+// does, so prompts work in graphical sessions and without a terminal.
+type pinentry struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+func startPinentry(program string) (*pinentry, error) {
+	cmd := exec.Command(program)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot run pinentry: %w", err)
+	}
+	p := &pinentry{cmd: cmd, in: in, out: bufio.NewReader(out)}
+	if _, err := p.response(); err != nil {
+		p.close()
+		return nil, err
+	}
+	// Curses pinentries need the terminal, which gpg users export as
+	// GPG_TTY. Older pinentries may not know some options.
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		p.call("OPTION ttyname=" + tty)
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		p.call("OPTION ttytype=" + term)
+	}
+	p.call("SETTITLE otp")
+	return p, nil
+}
+
+func (p *pinentry) close() {
+	p.in.Close()
+	p.cmd.Wait()
+}
+
+// call sends a command and returns the data of the response.
+func (p *pinentry) call(command string) (string, error) {
+	if _, err := fmt.Fprintln(p.in, command); err != nil {
+		return "", fmt.Errorf("pinentry: %w", err)
+	}
+	return p.response()
+}
+
+func (p *pinentry) response() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := p.out.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("pinentry: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "D "):
+			value, err := url.PathUnescape(line[2:])
+			if err != nil {
+				return "", fmt.Errorf("pinentry: invalid data: %w", err)
+			}
+			data.WriteString(value)
+		case strings.HasPrefix(line, "ERR "):
+			// ERR code message, where the message of a canceled
+			// prompt is "Operation cancelled".
+			_, msg, _ := strings.Cut(line[4:], " ")
+			return "", pinentryError(msg)
+		}
+	}
+}
+
+// pinentryError is an error response of pinentry.
+type pinentryError string
+
+func (e pinentryError) Error() string {
+	return "pinentry: " + string(e)
+}
+
+// assuanEscape escapes the characters that cannot be sent as is in the
+// arguments of Assuan commands.
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// pinentryPassphrase asks a passphrase. When repeat is set, the passphrase
+// is asked twice, and must match.
+func pinentryPassphrase(program, description string, repeat bool) ([]byte, error) {
+	p, err := startPinentry(program)
+	if err != nil {
+		return nil, err
+	}
+	defer p.close()
+	if _, err := p.call("SETDESC " + assuanEscape(description)); err != nil {
+		return nil, err
+	}
+	if _, err := p.call("SETPROMPT Passphrase:"); err != nil {
+		return nil, err
+	}
+	if repeat {
+		if _, err := p.call("SETREPEAT"); err != nil {
+			return nil, err
+		}
+		p.call("SETREPEATERROR passphrases do not match")
+	}
+	passphrase, err := p.call("GETPIN")
+	if err != nil {
+		return nil, err
+	}
+	return []byte(passphrase), nil
+}
+
+// pinentryConfirm asks a yes/no question.
+func pinentryConfirm(program, question string) (bool, error) {
+	p, err := startPinentry(program)
+	if err != nil {
+		return false, err
+	}
+	defer p.close()
+	if _, err := p.call("SETDESC " + assuanEscape(question)); err != nil {
+		return false, err
+	}
+	p.call("SETOK Yes")
+	p.call("SETCANCEL No")
+	_, err = p.call("CONFIRM")
+	if errors.As(err, new(pinentryError)) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,452 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Key is a RSA or EC private key kept in a PKCS#11 token, such as a
+// HSM or a smartcard, which decrypts the secrets itself. Secrets are
+// encrypted as with a key file, with the envelopes of encryptRSA or
+// encryptECDH, so a key moved from a file into a token keeps decrypting the
+// store. Encrypted names are the exception: they are blinded with a secret
+// the token computes, as its key cannot be read.
+type pkcs11Key struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	handle  pkcs11.ObjectHandle
+	label   string
+	// pub is a *rsa.PublicKey or an *ecdsa.PublicKey.
+	pub crypto.PublicKey
+	// ecdhPub is the ECDH counterpart of pub for EC keys.
+	ecdhPub *ecdh.PublicKey
+	// pin is kept for the keys that require the PIN for every use, as
+	// with the PIN policy "always" of YubiKeys.
+	pin string
+}
+
+// pkcs11TouchDelay is how long an operation runs before the user is told
+// that the token may be waiting to be touched.
+const pkcs11TouchDelay = time.Second
+
+// pkcs11URI holds the attributes of a RFC 7512 pkcs11: URI.
+type pkcs11URI struct {
+	path  map[string]string
+	query url.Values
+}
+
+func parsePKCS11URI(uri string) (*pkcs11URI, error) {
+	rest, ok := strings.CutPrefix(uri, "pkcs11:")
+	if !ok {
+		return nil, errors.New("not a pkcs11: URI")
+	}
+	path, rawQuery, _ := strings.Cut(rest, "?")
+	u := &pkcs11URI{path: make(map[string]string)}
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pkcs11: URI attribute %q", attr)
+		}
+		v, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkcs11: URI attribute %q: %s", attr, err)
+		}
+		u.path[k] = v
+	}
+	query, err := url.ParseQuery(strings.ReplaceAll(rawQuery, ";", "&"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkcs11: URI query: %s", err)
+	}
+	u.query = query
+	return u, nil
+}
+
+// openPKCS11Key logs into the token named by the pkcs11: URI and finds the
+// RSA private key in it. The module comes from module-path, or else
+// $OTP_PKCS11_MODULE. The PIN comes from pin-value or pin-source, or else it
+// is asked like the passphrases of key files.
+func openPKCS11Key(uri string) (keyBackend, error) {
+	u, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	module := u.query.Get("module-path")
+	if module == "" {
+		module = os.Getenv("OTP_PKCS11_MODULE")
+	}
+	if module == "" {
+		return nil, errors.New("PKCS#11 module is missing; set module-path in the URI or $OTP_PKCS11_MODULE")
+	}
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("cannot load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("cannot initialize PKCS#11 module: %w", err)
+	}
+	key, err := loginPKCS11(ctx, u)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return key, nil
+}
+
+func loginPKCS11(ctx *pkcs11.Ctx, u *pkcs11URI) (_ *pkcs11Key, err error) {
+	slot, label, err := findPKCS11Slot(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open PKCS#11 session: %w", err)
+	}
+	loggedIn := false
+	defer func() {
+		if err != nil {
+			if loggedIn {
+				ctx.Logout(session)
+			}
+			ctx.CloseSession(session)
+		}
+	}()
+	pin := u.query.Get("pin-value")
+	if source := u.query.Get("pin-source"); pin == "" && source != "" {
+		data, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read PIN: %s", err)
+		}
+		pin = string(bytes.TrimRight(data, "\r\n"))
+	}
+	if pin == "" {
+		value, err := readPassphrase(fmt.Sprintf("PIN for token %s: ", label))
+		if err != nil {
+			return nil, err
+		}
+		pin = string(value)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return nil, fmt.Errorf("cannot log into token %s: %w", label, err)
+	}
+	loggedIn = true
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if object, ok := u.path["object"]; ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, object))
+	}
+	if id, ok := u.path["id"]; ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)))
+	}
+	handle, err := findPKCS11Object(ctx, session, template)
+	if errors.Is(err, errNoPKCS11Object) {
+		return nil, fmt.Errorf("no private key found in token %s", label)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w in token %s; set object or id in the URI", err, label)
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key from token %s: %w", label, err)
+	}
+	key := &pkcs11Key{ctx: ctx, session: session, handle: handle, label: label}
+	switch keyType := bytesToUint(attrs[0].Value); keyType {
+	case pkcs11.CKK_RSA:
+		key.pub, err = pkcs11RSAPublicKey(ctx, session, handle)
+	case pkcs11.CKK_EC:
+		key.pub, key.ecdhPub, err = pkcs11ECPublicKey(ctx, session, attrs[1].Value)
+	default:
+		return nil, fmt.Errorf("unsupported key type %#x in token %s; only RSA and EC keys are supported", keyType, label)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read public key from token %s: %w", label, err)
+	}
+
+	always, err := ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ALWAYS_AUTHENTICATE, nil),
+	})
+	if err == nil && len(always[0].Value) == 1 && always[0].Value[0] != 0 {
+		key.pin = pin
+	}
+	return key, nil
+}
+
+// errNoPKCS11Object is returned by findPKCS11Object when no object matches.
+var errNoPKCS11Object = errors.New("no key found")
+
+func findPKCS11Object(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+	handles, _, err := ctx.FindObjects(session, 2)
+	ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, err
+	}
+	switch len(handles) {
+	case 0:
+		return 0, errNoPKCS11Object
+	case 1:
+		return handles[0], nil
+	}
+	return 0, errors.New("several keys found")
+}
+
+// bytesToUint decodes the CK_ULONG attributes, which are in native byte order.
+func bytesToUint(b []byte) uint {
+	var n uint
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint(b[i])
+	}
+	return n
+}
+
+func pkcs11RSAPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
+	attrs, err := ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid public exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(attrs[0].Value), E: int(e.Int64())}, nil
+}
+
+// pkcs11ECPublicKey reads the public key object that has the same ID as the
+// private key, as the point of EC keys is only kept there.
+func pkcs11ECPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, id []byte) (*ecdsa.PublicKey, *ecdh.PublicKey, error) {
+	handle, err := findPKCS11Object(ctx, session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("public key object: %w", err)
+	}
+	attrs, err := ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// The point is supposed to be wrapped in an OCTET STRING, but some
+	// tokens return it bare.
+	point := attrs[1].Value
+	var wrapped []byte
+	if rest, err := asn1.Unmarshal(point, &wrapped); err == nil && len(rest) == 0 {
+		point = wrapped
+	}
+	spki, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1},
+			Parameters: asn1.RawValue{FullBytes: attrs[0].Value},
+		},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, nil, err
+	}
+	ecpub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected public key %T", pub)
+	}
+	ecdhPub, err := ecpub.ECDH()
+	return ecpub, ecdhPub, err
+}
+
+// findPKCS11Slot returns the slot of the token that matches the URI, and the
+// label of the token.
+func findPKCS11Slot(ctx *pkcs11.Ctx, u *pkcs11URI) (uint, string, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot list PKCS#11 slots: %w", err)
+	}
+	var found []uint
+	var labels []string
+	for _, slot := range slots {
+		if id, ok := u.path["slot-id"]; ok && id != strconv.FormatUint(uint64(slot), 10) {
+			continue
+		}
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		label := strings.TrimRight(info.Label, " \x00")
+		if token, ok := u.path["token"]; ok && token != label {
+			continue
+		}
+		if serial, ok := u.path["serial"]; ok && serial != strings.TrimRight(info.SerialNumber, " \x00") {
+			continue
+		}
+		found = append(found, slot)
+		labels = append(labels, label)
+	}
+	switch len(found) {
+	case 0:
+		return 0, "", errors.New("no PKCS#11 token matches the URI")
+	case 1:
+		return found[0], labels[0], nil
+	}
+	return 0, "", fmt.Errorf("several PKCS#11 tokens match the URI: %s; set token or serial in the URI", strings.Join(labels, ", "))
+}
+
+func (k *pkcs11Key) public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *pkcs11Key) encrypted(in, label []byte) ([]byte, error) {
+	return encryptTo(k.pub, in, label)
+}
+
+func (k *pkcs11Key) decrypted(in, label []byte) ([]byte, error) {
+	if k.ecdhPub != nil {
+		return decryptECDH(pkcs11ECDH{k}, in, label)
+	}
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, label)
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+	return decryptRSA(k.pub.(*rsa.PublicKey).Size(), in, label, func(in []byte) ([]byte, error) {
+		return k.do(func() error {
+			return k.ctx.DecryptInit(k.session, mech, k.handle)
+		}, func() ([]byte, error) {
+			return k.ctx.Decrypt(k.session, in)
+		})
+	})
+}
+
+// close logs out of the token, closes the session and unloads the module.
+func (k *pkcs11Key) close() error {
+	k.ctx.Logout(k.session)
+	err := k.ctx.CloseSession(k.session)
+	k.ctx.Finalize()
+	k.ctx.Destroy()
+	return err
+}
+
+// material is, for RSA keys, the signature of a fixed message, which is the
+// same every time with PKCS #1 v1.5 padding, and for EC keys the ECDH of the
+// key with itself.
+func (k *pkcs11Key) material() ([]byte, error) {
+	if k.ecdhPub != nil {
+		return pkcs11ECDH{k}.ECDH(k.ecdhPub)
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil)}
+	return k.do(func() error {
+		return k.ctx.SignInit(k.session, mech, k.handle)
+	}, func() ([]byte, error) {
+		return k.ctx.Sign(k.session, []byte("otp encrypted names"))
+	})
+}
+
+// do runs an operation of the key, once init has started it. Keys that
+// require the PIN for every use are logged into again in between. As tokens
+// with a touch policy wait to be touched, the user is told so if the
+// operation takes long.
+func (k *pkcs11Key) do(init func() error, op func() ([]byte, error)) ([]byte, error) {
+	if err := init(); err != nil {
+		return nil, err
+	}
+	if k.pin != "" {
+		if err := k.ctx.Login(k.session, pkcs11.CKU_CONTEXT_SPECIFIC, k.pin); err != nil {
+			return nil, fmt.Errorf("cannot log into token %s: %w", k.label, err)
+		}
+	}
+	timer := time.AfterFunc(pkcs11TouchDelay, func() {
+		fmt.Fprintf(os.Stderr, "waiting for token %s; touch it if it blinks\n", k.label)
+	})
+	defer timer.Stop()
+	return op()
+}
+
+// pkcs11ECDH computes the ECDH of a pkcs11Key with CKM_ECDH1_DERIVE, into a
+// session object that is read and destroyed.
+type pkcs11ECDH struct {
+	*pkcs11Key
+}
+
+func (k pkcs11ECDH) Curve() ecdh.Curve {
+	return k.ecdhPub.Curve()
+}
+
+func (k pkcs11ECDH) PublicKey() *ecdh.PublicKey {
+	return k.ecdhPub
+}
+
+func (k pkcs11ECDH) ECDH(remote *ecdh.PublicKey) ([]byte, error) {
+	params := pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, remote.Bytes())
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, params)}
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+	var shared pkcs11.ObjectHandle
+	_, err := k.do(func() error { return nil }, func() ([]byte, error) {
+		var err error
+		shared, err = k.ctx.DeriveKey(k.session, mech, k.handle, template)
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer k.ctx.DestroyObject(k.session, shared)
+	attrs, err := k.ctx.GetAttributeValue(k.session, shared, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs[0].Value, nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !cgo
+
+package main
+
+import "errors"
+
+// openPKCS11Key fails, as PKCS#11 modules are loaded through cgo.
+func openPKCS11Key(string) (keyBackend, error) {
+	return nil, errors.New("PKCS#11 tokens are not supported by this build of otp, which was built without cgo")
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// keyPluginPrefix marks the --encryption values of the key backends
+// implemented by plugins: --encryption plugin:NAME runs otp-plugin-NAME,
+// found in the PATH.
+//
+// The plugin speaks the protocol of otp agent on its stdin and stdout: each
+// request is a line of JSON, answered by a line of JSON, with the binary
+// fields base64 encoded.
+//
+//	{"op":"hello","key":"--private-key"} -> {"kind":"HSM","fingerprint":"..."}
+//	{"op":"encrypt","in":"..."}          -> {"out":"..."}
+//	{"op":"decrypt","in":"..."}          -> {"out":"..."}
+//	{"op":"material"}                    -> {"out":"..."}
+//
+// Any request may be answered with {"error":"..."}, as material is by the
+// plugins that cannot reveal any secret. The plugin runs until its stdin is
+// closed, and inherits the standard error, so it can ask for PINs on the
+// terminal or with pinentry.
+const keyPluginPrefix = "plugin:"
+
+// keyBackendOpener returns the function that loads the keys of the key
+// backend.
+func keyBackendOpener(name string) (func(fn string) (keyBackend, error), bool) {
+	if open, ok := keyBackends[name]; ok {
+		return open, true
+	}
+	plugin, ok := strings.CutPrefix(name, keyPluginPrefix)
+	if !ok || plugin == "" || strings.ContainsAny(plugin, `/\`) {
+		return nil, false
+	}
+	return func(fn string) (keyBackend, error) {
+		return openKeyPlugin(plugin, fn)
+	}, true
+}
+
+// pluginKey is a key whose encryption is done by a plugin.
+type pluginKey struct {
+	name string
+	pub  pluginPublic
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// pluginPublic is the public key of a pluginKey, as described by the plugin.
+type pluginPublic struct {
+	plugin, fpr string
+}
+
+func (p pluginPublic) Equal(o crypto.PublicKey) bool {
+	return p == o
+}
+
+func (p pluginPublic) fingerprint() string {
+	return p.fpr
+}
+
+func (p pluginPublic) kind() string {
+	return strings.ToUpper(p.plugin)
+}
+
+func openKeyPlugin(name, fn string) (keyBackend, error) {
+	program, err := exec.LookPath("otp-plugin-" + name)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s is not installed: %w", name, err)
+	}
+	cmd := exec.Command(program)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start plugin %s: %w", name, err)
+	}
+	k := &pluginKey{name: name, cmd: cmd, in: in, out: bufio.NewReader(out)}
+	resp, err := k.call(keyAgentRequest{Op: "hello", Key: fn})
+	if err != nil {
+		k.close()
+		return nil, err
+	}
+	if resp.Fingerprint == "" {
+		k.close()
+		return nil, fmt.Errorf("plugin %s did not tell the fingerprint of %s", name, fn)
+	}
+	kind := resp.Kind
+	if kind == "" {
+		kind = name
+	}
+	k.pub = pluginPublic{plugin: kind, fpr: resp.Fingerprint}
+	return k, nil
+}
+
+func (k *pluginKey) call(req keyAgentRequest) (keyAgentResponse, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	data, err := json.Marshal(req)
+	if err != nil {
+		return keyAgentResponse{}, err
+	}
+	if _, err := k.in.Write(append(data, '\n')); err != nil {
+		return keyAgentResponse{}, fmt.Errorf("plugin %s exited: %w", k.name, err)
+	}
+	line, err := k.out.ReadBytes('\n')
+	if err != nil {
+		return keyAgentResponse{}, fmt.Errorf("plugin %s exited without answering %s", k.name, req.Op)
+	}
+	var resp keyAgentResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return keyAgentResponse{}, fmt.Errorf("plugin %s answered %s with invalid JSON: %w", k.name, req.Op, err)
+	}
+	if resp.Error != "" {
+		return keyAgentResponse{}, fmt.Errorf("plugin %s: %s", k.name, resp.Error)
+	}
+	return resp, nil
+}
+
+// close closes the stdin of the plugin, which tells it to exit, and waits
+// for it.
+func (k *pluginKey) close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.in.Close()
+	if err := k.cmd.Wait(); err != nil {
+		return fmt.Errorf("plugin %s: %w", k.name, err)
+	}
+	return nil
+}
+
+func (k *pluginKey) public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *pluginKey) material() ([]byte, error) {
+	resp, err := k.call(keyAgentRequest{Op: "material"})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Out) == 0 {
+		return nil, errors.New("plugin " + k.name + " revealed no secret")
+	}
+	return resp.Out, nil
+}
+
+// encrypted binds the label to the data, as gpgKey does, so plugins only
+// deal with opaque bytes.
+func (k *pluginKey) encrypted(in, label []byte) ([]byte, error) {
+	resp, err := k.call(keyAgentRequest{Op: "encrypt", In: withLabel(in, label)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Out, nil
+}
+
+func (k *pluginKey) decrypted(in, label []byte) ([]byte, error) {
+	resp, err := k.call(keyAgentRequest{Op: "decrypt", In: in})
+	if err != nil {
+		return nil, err
+	}
+	return withoutLabel(resp.Out, label)
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// pqKeyFile is the ML-KEM key file given by --pq-key.
+var pqKeyFile string
+
+// hybridMagic prefixes the secrets encrypted with hybridKey.
+const hybridMagic = "OTPPQ1\n"
+
+// pqKeyPEMType is the PEM block type of the ML-KEM key file, which holds the
+// 64-byte seed of the key.
+const pqKeyPEMType = "OTP ML-KEM-768 SEED"
+
+// hybridKey encrypts the secrets both with its key backend, such as X25519
+// for Ed25519 keys, and with ML-KEM-768, so secrets recorded today stay
+// safe from a quantum computer breaking the classical key tomorrow. The
+// AES-256-GCM key of the secret is derived from both shared secrets. The
+// ML-KEM key is kept in its own file, as deriving it from the private key
+// would make it no stronger than the private key.
+//
+// Secrets encrypted before --pq-key was set, and secrets shared with other
+// keys, stay classical; rekey with the same key encrypts them again.
+type hybridKey struct {
+	keyBackend
+	dk *mlkem.DecapsulationKey768
+}
+
+// readPQKey reads the ML-KEM key file, and makes it when it does not exist
+// yet.
+func readPQKey(fn string) (*mlkem.DecapsulationKey768, error) {
+	data, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		dk, err := mlkem.GenerateKey768()
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: pqKeyPEMType, Bytes: dk.Bytes()})
+		if err := os.WriteFile(fn, data, 0o600); err != nil {
+			return nil, fmt.Errorf("cannot write ML-KEM key file: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "ML-KEM key written to %s; keep it along with the private key\n", fn)
+		return dk, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read ML-KEM key file: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pqKeyPEMType {
+		return nil, fmt.Errorf("%s is not a ML-KEM key file", fn)
+	}
+	dk, err := mlkem.NewDecapsulationKey768(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ML-KEM key file %s: %s", fn, err)
+	}
+	return dk, nil
+}
+
+// errNeedPQKey is returned when decrypting a hybrid secret without --pq-key.
+var errNeedPQKey = errors.New("key is encrypted with post-quantum hybrid encryption; set --pq-key")
+
+// decrypted tells apart the hybrid secrets that the key cannot decrypt
+// without the ML-KEM key.
+func (p privkey) decrypted(in, label []byte) ([]byte, error) {
+	if !isHybrid(p.keyBackend) && bytes.HasPrefix(in, []byte(hybridMagic)) {
+		return nil, errNeedPQKey
+	}
+	return p.keyBackend.decrypted(in, label)
+}
+
+// isHybrid tells whether the key decrypts hybrid secrets, either itself or
+// through otp agent.
+func isHybrid(key keyBackend) bool {
+	switch key := key.(type) {
+	case *hybridKey:
+		return true
+	case *keyAgentClient:
+		return key.hybrid
+	}
+	return false
+}
+
+func hybridAEADKey(pqSecret, classicalSecret, pqCiphertext []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	secret := append(bytes.Clone(pqSecret), classicalSecret...)
+	defer wipe(secret)
+	kdf := hkdf.New(sha256.New, secret, pqCiphertext, []byte("otp hybrid ml-kem-768 aes-256-gcm"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encrypted returns the ML-KEM ciphertext, the length of the classical
+// ciphertext, the classical ciphertext, and the secret encrypted under the
+// combined key.
+func (k *hybridKey) encrypted(in, label []byte) ([]byte, error) {
+	classicalSecret := make([]byte, 32)
+	if _, err := rand.Read(classicalSecret); err != nil {
+		return nil, err
+	}
+	defer wipe(classicalSecret)
+	classical, err := k.keyBackend.encrypted(classicalSecret, label)
+	if err != nil {
+		return nil, err
+	}
+	pqSecret, pqCiphertext := k.dk.EncapsulationKey().Encapsulate()
+	defer wipe(pqSecret)
+	key, err := hybridAEADKey(pqSecret, classicalSecret, pqCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	sealed, err := sealGCM(key, in, label)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(hybridMagic), pqCiphertext...)
+	out = binary.AppendUvarint(out, uint64(len(classical)))
+	out = append(out, classical...)
+	return append(out, sealed...), nil
+}
+
+func (k *hybridKey) decrypted(in, label []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(in, []byte(hybridMagic))
+	if !ok {
+		return k.keyBackend.decrypted(in, label)
+	}
+	if len(rest) < mlkem.CiphertextSize768 {
+		return nil, errors.New("truncated hybrid ciphertext")
+	}
+	pqCiphertext, rest := rest[:mlkem.CiphertextSize768], rest[mlkem.CiphertextSize768:]
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || uint64(len(rest)-size) < n {
+		return nil, errors.New("truncated hybrid ciphertext")
+	}
+	classical, sealed := rest[size:size+int(n)], rest[size+int(n):]
+	classicalSecret, err := k.keyBackend.decrypted(classical, label)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(classicalSecret)
+	pqSecret, err := k.dk.Decapsulate(pqCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(pqSecret)
+	key, err := hybridAEADKey(pqSecret, classicalSecret, pqCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return openGCM(key, sealed, label)
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPQKey(t *testing.T) *mlkem.DecapsulationKey768 {
+	t.Helper()
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dk
+}
+
+func TestHybridKey(t *testing.T) {
+	classical := testSignerKey(t, testEd25519Key(t))
+	dk := testPQKey(t)
+	key := &hybridKey{keyBackend: classical, dk: dk}
+	t.Run("other ML-KEM key", func(t *testing.T) {
+		testEnvelope(t, key, &hybridKey{keyBackend: classical, dk: testPQKey(t)})
+	})
+	t.Run("other classical key", func(t *testing.T) {
+		testEnvelope(t, key, &hybridKey{keyBackend: testSignerKey(t, testEd25519Key(t)), dk: dk})
+	})
+
+	label := cryptlabel("alice", "GitHub")
+	secret := []byte("JBSWY3DPEHPK3PXP")
+	ct, err := key.encrypted(secret, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (privkey{classical}).decrypted(ct, label); !errors.Is(err, errNeedPQKey) {
+		t.Errorf("decrypted without the ML-KEM key: %v, want errNeedPQKey", err)
+	}
+
+	// Secrets encrypted before --pq-key was set stay readable.
+	old, err := classical.encrypted(secret, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := key.decrypted(old, label)
+	if err != nil {
+		t.Fatalf("decrypted(classical ciphertext): %v", err)
+	}
+	if !bytes.Equal(pt, secret) {
+		t.Errorf("decrypted(classical ciphertext) = %q, want %q", pt, secret)
+	}
+}
+
+func TestReadPQKey(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "pq.pem")
+	made, err := readPQKey(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := readPQKey(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(made.Bytes(), read.Bytes()) {
+		t.Error("readPQKey read another key than the one it made")
+	}
+
+	if err := os.WriteFile(fn, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPQKey(fn); err == nil {
+		t.Error("readPQKey accepted a file that is not a ML-KEM key file")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The messages of otp.proto are encoded and decoded by hand: the service is
+// small, and its messages only have strings, integers and booleans.
+
+// protoMessage is a decoded message: the last value of every string and
+// varint field, and all the values of the repeated fields.
+type protoMessage struct {
+	strings  map[int]string
+	varints  map[int]uint64
+	repeated map[int][][]byte
+}
+
+func (m protoMessage) str(field int) string {
+	return m.strings[field]
+}
+
+func (m protoMessage) bool(field int) bool {
+	return m.varints[field] != 0
+}
+
+func (m protoMessage) int64(field int) int64 {
+	return int64(m.varints[field])
+}
+
+// decodeProto decodes the message, skipping the fixed-size fields, which
+// otp.proto does not use.
+func decodeProto(b []byte) (protoMessage, error) {
+	m := protoMessage{
+		strings:  make(map[int]string),
+		varints:  make(map[int]uint64),
+		repeated: make(map[int][][]byte),
+	}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return m, errors.New("invalid protobuf field")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return m, errors.New("invalid protobuf varint")
+			}
+			m.varints[field] = v
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return m, errors.New("truncated protobuf message")
+			}
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return m, errors.New("truncated protobuf message")
+			}
+			data := b[n : n+int(size)]
+			m.strings[field] = string(data)
+			m.repeated[field] = append(m.repeated[field], data)
+			b = b[n+int(size):]
+		case 5:
+			if len(b) < 4 {
+				return m, errors.New("truncated protobuf message")
+			}
+			b = b[4:]
+		default:
+			return m, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+	}
+	return m, nil
+}
+
+// protoAppendString appends the string field, left out when empty as
+// proto3 does.
+func protoAppendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return protoAppendBytes(b, field, []byte(s))
+}
+
+// protoAppendBytes appends the bytes field, even when empty, which is how
+// the embedded messages are appended.
+func protoAppendBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoAppendVarint appends the integer field, left out when zero.
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoAppendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return protoAppendVarint(b, field, 1)
+}
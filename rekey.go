@@ -0,0 +1,223 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/urfave/cli"
+)
+
+// rekeyer is implemented by the stores that are encrypted as a whole with
+// the private key, and must be sealed again with the new one.
+type rekeyer interface {
+	Rekey(*privkey) error
+}
+
+func rekey() cli.Command {
+	return cli.Command{
+		Name:  "rekey",
+		Usage: "re-encrypt all keys with a new private key",
+		Description: `Every key is decrypted with the current private key and encrypted with the
+   new one, all in a single transaction, after an automatic backup. Names
+   encrypted with --encrypt-names are encrypted again too.
+
+   Backups and sync logs made before the rotation stay encrypted with the
+   old private key.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "new-key",
+				Usage: "private key to encrypt the keys with",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run, n",
+				Usage: "check that every key can be re-encrypted, without changing the store",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.String("new-key") == "" {
+				return errors.New("--new-key is missing")
+			}
+			oldKey, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+			newKey, err := privkeyfile(expandHome(c.String("new-key")))
+			if err != nil {
+				return err
+			}
+			count, err := rekeyStore(c, oldKey, newKey, c.Bool("dry-run"))
+			if err != nil {
+				return err
+			}
+			if c.Bool("dry-run") {
+				log.Printf("%d keys can be re-encrypted with %s", count, c.String("new-key"))
+				return nil
+			}
+			log.Printf("%d keys re-encrypted; use --private-key %s from now on", count, c.String("new-key"))
+			return nil
+		},
+	}
+}
+
+func passwd() cli.Command {
+	return cli.Command{
+		Name:  "passwd",
+		Usage: "change the passphrase of a store encrypted with --encryption passphrase",
+		Description: `Every key is decrypted with the current passphrase and encrypted with the
+   new one, as rekey does. The new passphrase is asked twice on the terminal
+   or with pinentry, unless --new-passphrase-file is given.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "new-passphrase-file",
+				Usage: "file with the new passphrase",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if keyBackendName != "passphrase" {
+				return errors.New("passwd only changes the passphrase of --encryption passphrase; use rekey to change keys")
+			}
+			oldKey, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+			passphrase, err := readNewPassphrase(expandHome(c.String("new-passphrase-file")))
+			if err != nil {
+				return err
+			}
+			newKey := &privkey{&passphraseKey{passphrase: passphrase, keys: make(map[string][]byte)}}
+			count, err := rekeyStore(c, oldKey, newKey, false)
+			if err != nil {
+				return err
+			}
+			log.Printf("%d keys re-encrypted with the new passphrase", count)
+			return nil
+		},
+	}
+}
+
+// rekeyStore re-encrypts the whole store from oldKey to newKey, after an
+// automatic backup, and returns how many keys it re-encrypted. A dry run only
+// checks that every key can be re-encrypted.
+func rekeyStore(c *cli.Context, oldKey, newKey *privkey, dryRun bool) (int, error) {
+	unlock, err := lockdb(c)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	s, err := openstore(c, true)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	if !dryRun {
+		if err := autobackup(c, s); err != nil {
+			return 0, err
+		}
+	}
+
+	errDryRun := errors.New("dry run")
+	var count int
+	err = basestore(s).Tx(func(tx store) error {
+		var err error
+		count, err = rekeyEntries(tx, oldKey, newKey)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		return count, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if r, ok := basestore(s).(rekeyer); ok {
+		if err := r.Rekey(newKey); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// rekeyEntries re-encrypts the entries of the store, which must not be
+// wrapped by a namesStore, so entries keep their form.
+func rekeyEntries(s store, oldKey, newKey *privkey) (int, error) {
+	raw, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	oldNames := &namesStore{base: s, priv: oldKey}
+	newNames := &namesStore{base: s, priv: newKey}
+	for _, e := range raw {
+		plain, err := oldNames.unseal(e)
+		if err != nil {
+			return 0, err
+		}
+		// The keys added with add --key keep their own private key.
+		if _, _, _, ok := cutEntryKey(plain.Password); ok {
+			if err := rekeyNames(s, e, plain, newNames); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		secret, err := oldKey.legacySecret(plain)
+		if err != nil {
+			return 0, fmt.Errorf("cannot decrypt key for account %q of issuer %q: %w", plain.Account, plain.Issuer, err)
+		}
+		recipients, err := oldKey.recipients(plain)
+		if err != nil {
+			return 0, err
+		}
+		for i, r := range recipients {
+			if sameKey(r, oldKey.public()) {
+				recipients[i] = newKey.public()
+			}
+		}
+		password, err := newKey.encryptShared(secret, cryptlabel(plain.Account, plain.Issuer), recipients)
+		if err != nil {
+			wipe(secret)
+			return 0, err
+		}
+		plain.Password = tagged(secret, plain.Account, plain.Issuer, newKey.public(), password)
+		wipe(secret)
+		if err := rekeyNames(s, e, plain, newNames); err != nil {
+			return 0, err
+		}
+	}
+	return len(raw), nil
+}
+
+// rekeyNames writes the entry back, with its names encrypted with the new key
+// if they were encrypted with the old one.
+func rekeyNames(s store, e, plain entry, newNames *namesStore) error {
+	blinded := e.Issuer == encryptedNamesIssuer && bytes.HasPrefix(e.Password, []byte(encryptedNamesMagic))
+	if !blinded {
+		return s.Put(plain)
+	}
+	// The name under which the entry is kept depends on the key.
+	if err := s.Delete(e.Account, e.Issuer); err != nil {
+		return err
+	}
+	newNames.encrypt = true
+	return newNames.Put(plain)
+}
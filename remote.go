@@ -0,0 +1,174 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// remoteCommands are the commands that, with --remote, call the JSON API of
+// otp http instead of opening the store.
+var remoteCommands = map[string]bool{
+	"get":  true,
+	"list": true,
+	"add":  true,
+	"rm":   true,
+	"help": true,
+	"h":    true,
+}
+
+// remoteClient calls the JSON API of the otp http server given by --remote.
+type remoteClient struct {
+	base  *url.URL
+	token string
+	hc    *http.Client
+}
+
+// remote returns the client of --remote, or nil when the store is local.
+func remote(c *cli.Context) (*remoteClient, error) {
+	addr := c.GlobalString("remote")
+	if addr == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(strings.TrimSuffix(addr, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("--remote: %s", err)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	switch {
+	case base.Scheme == "unix" && base.Path != "":
+		socket := base.Path
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		base = &url.URL{Scheme: "http", Host: "otp"}
+	case base.Scheme == "http" && base.Host != "":
+		// The token and the secrets would cross the network in the clear.
+		if !isLoopbackHost(base.Hostname()) {
+			return nil, errors.New("--remote must be an https URL, unless it is on this host: http://localhost or a unix: socket")
+		}
+	case base.Scheme != "https" || base.Host == "":
+		return nil, errors.New("--remote must be an https URL, or http://localhost or a unix: socket")
+	}
+	if fn := expandHome(c.GlobalString("remote-ca")); fn != "" {
+		pemdata, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemdata) {
+			return nil, fmt.Errorf("no certificates found in %s", fn)
+		}
+		tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	}
+	return &remoteClient{
+		base:  base,
+		token: c.GlobalString("remote-token"),
+		hc:    &http.Client{Transport: tr, Timeout: time.Minute},
+	}, nil
+}
+
+// isLoopbackHost tells whether the host name is localhost or a loopback
+// address.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// do sends in, if any, as JSON and decodes the response into out, if any.
+func (rc *remoteClient) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, rc.base.String()+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if rc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rc.token)
+	}
+	resp, err := rc.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s: %s", rc.base.Host, apiErr.Error)
+		}
+		return fmt.Errorf("%s: %s", rc.base.Host, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (rc *remoteClient) codes() ([]apiCode, error) {
+	var out webCodes
+	if err := rc.do(http.MethodGet, "/api/codes", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Codes, nil
+}
+
+func (rc *remoteClient) entries() ([]apiEntry, error) {
+	var out []apiEntry
+	err := rc.do(http.MethodGet, "/api/entries", nil, &out)
+	return out, err
+}
+
+func (rc *remoteClient) add(e apiEntry) error {
+	return rc.do(http.MethodPost, "/api/entries", e, nil)
+}
+
+func (rc *remoteClient) remove(issuer, account string) error {
+	return rc.do(http.MethodDelete, entryURL(issuer, account), nil, nil)
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func init() {
+	keyBackends["secret-service"] = openSecretServiceKey
+}
+
+// openSecretServiceKey looks up the random secret kept by the Secret Service
+// of the desktop, such as GNOME Keyring or KWallet, which unlocks it with the
+// desktop session, and stores a new one when it does not exist yet. The
+// secrets are encrypted with AES-256-GCM under a key derived from it. The
+// secret is looked up by the attributes service=otp and
+// account=--private-key.
+//
+// The secret goes through secret-tool, which comes with libsecret.
+func openSecretServiceKey(account string) (keyBackend, error) {
+	key, err := opensymmetrickey("SECRET-SERVICE", "otp secret-service aes-256-gcm", symmetricSecret{
+		load: func() ([]byte, error) {
+			out, err := secretTool(nil, "lookup", "service", "otp", "account", account)
+			if errors.Is(err, errNoSecretServiceItem) {
+				return nil, errNotFound
+			} else if err != nil {
+				return nil, err
+			}
+			return hex.DecodeString(string(bytes.TrimSpace(out)))
+		},
+		store: func(secret []byte) error {
+			// secret-tool reads the secret from stdin, so it never shows
+			// in the arguments of a process.
+			_, err := secretTool([]byte(hex.EncodeToString(secret)), "store", "--label=otp store key", "service", "otp", "account", account)
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "store key added to the Secret Service as %s\n", account)
+			}
+			return err
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("secret %s of service otp: %w", account, err)
+	}
+	return key, nil
+}
+
+// errNoSecretServiceItem is returned by secretTool when lookup finds nothing.
+var errNoSecretServiceItem = errors.New("no such secret")
+
+func secretTool(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return nil, errors.New("secret-tool not found; install the libsecret tools")
+	case errors.As(err, &exitErr) && args[0] == "lookup" && stderr.Len() == 0:
+		// lookup fails silently when nothing matches.
+		return nil, errNoSecretServiceItem
+	case err != nil:
+		return nil, fmt.Errorf("secret-tool: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// keychainStoreLocation names where keychain stores are kept, for messages.
+const keychainStoreLocation = "Secret Service"
+
+// readKeychainStore reads the item of a keychain store, failing with
+// errNotFound when there is none.
+func readKeychainStore(name string) ([]byte, error) {
+	out, err := secretTool(nil, "lookup", "service", "otp-store", "store", name)
+	if errors.Is(err, errNoSecretServiceItem) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(out)))
+}
+
+func writeKeychainStore(name string, data []byte) error {
+	_, err := secretTool([]byte(base64.StdEncoding.EncodeToString(data)), "store", "--label=otp store "+name, "service", "otp-store", "store", name)
+	return err
+}
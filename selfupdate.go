@@ -0,0 +1,338 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// releaseKey is the SSH public key the release binaries are signed with,
+// set when building the releases with -ldflags "-X 'main.releaseKey=...'".
+var releaseKey string
+
+// version is the release otp was built from, such as v1.2.0, set when
+// building the releases with -ldflags "-X 'main.version=...'". Other builds
+// cannot tell whether a release is newer, so they only install the one given
+// by --version.
+var version string
+
+// releaseNamespace is the namespace of the release signatures, as made by
+// ssh-keygen -Y sign -n file.
+const releaseNamespace = "file"
+
+// maxReleaseSize bounds the downloads of otp self-update.
+const maxReleaseSize = 256 << 20
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func selfUpdate() cli.Command {
+	return cli.Command{
+		Name:  "self-update",
+		Usage: "replace otp with its latest release",
+		Description: `The binary of the release for this system, otp-GOOS-GOARCH, is downloaded
+   with its SSH signature, otp-GOOS-GOARCH.sig, which must be made with
+   ssh-keygen -Y sign -n file by the release key: the one otp was built
+   with, or --key. The running binary is then replaced at once, so it is
+   either the old or the new one. Binaries installed by a package manager
+   should be updated by it instead. Binaries not built from a release are
+   only updated to the release given by --version.`,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "check",
+				Usage: "only tell whether a newer release is available",
+			},
+			cli.StringFlag{
+				Name:  "version",
+				Usage: "install this release, such as v1.2.0, even if it is older (default: the latest)",
+			},
+			cli.StringFlag{
+				Name:   "key",
+				Usage:  "SSH public key, or file holding it, the releases are signed with (default: the one otp was built with)",
+				EnvVar: "OTP_RELEASE_KEY",
+			},
+			cli.StringFlag{
+				Name:   "releases",
+				Value:  "https://api.github.com/repos/cirello-io/otp/releases",
+				Usage:  "GitHub API URL of the releases, for mirrors",
+				EnvVar: "OTP_RELEASES_URL",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if version == "" && c.String("version") == "" {
+				return errors.New("this otp was not built from a release, so it cannot tell whether one is newer: give the release to install with --version")
+			}
+			client := &http.Client{Timeout: 5 * time.Minute}
+			url := strings.TrimSuffix(c.String("releases"), "/") + "/latest"
+			if v := c.String("version"); v != "" {
+				url = strings.TrimSuffix(c.String("releases"), "/") + "/tags/" + v
+			}
+			var rel githubRelease
+			data, err := download(client, url, 1<<20)
+			if err != nil {
+				return fmt.Errorf("cannot find the release: %w", err)
+			}
+			if err := json.Unmarshal(data, &rel); err != nil {
+				return fmt.Errorf("cannot read the release: %w", err)
+			}
+			running := version
+			if running == "" {
+				running = "an unreleased version"
+			}
+			if c.String("version") == "" && compareVersions(rel.TagName, running) <= 0 {
+				log.Printf("otp %s is up to date", running)
+				return nil
+			}
+			if c.Bool("check") {
+				fmt.Printf("otp %s is available; this is otp %s\n", rel.TagName, running)
+				return nil
+			}
+
+			key, err := parseReleaseKey(c.String("key"))
+			if err != nil {
+				return err
+			}
+			name := "otp-" + runtime.GOOS + "-" + runtime.GOARCH
+			if runtime.GOOS == "windows" {
+				name += ".exe"
+			}
+			var binURL, sigURL string
+			for _, a := range rel.Assets {
+				switch a.Name {
+				case name:
+					binURL = a.URL
+				case name + ".sig":
+					sigURL = a.URL
+				}
+			}
+			switch {
+			case binURL == "":
+				return fmt.Errorf("release %s has no binary for %s/%s", rel.TagName, runtime.GOOS, runtime.GOARCH)
+			case sigURL == "":
+				return fmt.Errorf("release %s has no signature for %s", rel.TagName, name)
+			}
+			bin, err := download(client, binURL, maxReleaseSize)
+			if err != nil {
+				return fmt.Errorf("cannot download %s: %w", name, err)
+			}
+			sig, err := download(client, sigURL, 1<<16)
+			if err != nil {
+				return fmt.Errorf("cannot download the signature of %s: %w", name, err)
+			}
+			if err := verifySSHSignature(key, releaseNamespace, bin, sig); err != nil {
+				return fmt.Errorf("%s of release %s is not signed by the release key: %w", name, rel.TagName, err)
+			}
+
+			exe, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			if exe, err = filepath.EvalSymlinks(exe); err != nil {
+				return err
+			}
+			if err := replaceExecutable(exe, bin); err != nil {
+				return fmt.Errorf("cannot replace %s: %w", exe, err)
+			}
+			log.Printf("%s updated from %s to %s", exe, running, rel.TagName)
+			return nil
+		},
+	}
+}
+
+func download(client *http.Client, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json, application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+// compareVersions compares the versions, such as v1.2.0 and 1.10.3, number
+// by number.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseReleaseKey(s string) (ssh.PublicKey, error) {
+	if s == "" {
+		s = releaseKey
+	}
+	if s == "" {
+		return nil, errors.New("this otp was built without a release key to verify the update with: give it with --key")
+	}
+	data := []byte(s)
+	if !strings.HasPrefix(s, "ssh-") && !strings.HasPrefix(s, "ecdsa-") {
+		var err error
+		if data, err = os.ReadFile(expandHome(s)); err != nil {
+			return nil, fmt.Errorf("cannot read release key: %w", err)
+		}
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid release key: %w", err)
+	}
+	return key, nil
+}
+
+// verifySSHSignature verifies an armored signature of ssh-keygen -Y sign,
+// as described in PROTOCOL.sshsig of OpenSSH.
+func verifySSHSignature(key ssh.PublicKey, namespace string, data, armored []byte) error {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return errors.New("not an SSH signature")
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte("SSHSIG"))
+	if !ok {
+		return errors.New("not an SSH signature")
+	}
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	switch {
+	case sig.Version != 1:
+		return fmt.Errorf("unsupported SSH signature version %d", sig.Version)
+	case !bytes.Equal(sig.PublicKey, key.Marshal()):
+		if other, err := ssh.ParsePublicKey(sig.PublicKey); err == nil {
+			return fmt.Errorf("signed by another key, %s", ssh.FingerprintSHA256(other))
+		}
+		return errors.New("signed by another key")
+	case sig.Namespace != namespace:
+		return fmt.Errorf("signed for namespace %q instead of %q", sig.Namespace, namespace)
+	}
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported hash algorithm %q", sig.HashAlgorithm)
+	}
+	h.Write(data)
+	var s ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &s); err != nil {
+		return fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+	return key.Verify(signed, &s)
+}
+
+// replaceExecutable writes the new binary next to exe and renames it over
+// exe. Windows does not let running binaries be replaced, but lets them be
+// renamed, so there the old binary is moved aside first.
+func replaceExecutable(exe string, bin []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(exe), ".otp-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bin); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(f.Name(), exe)
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The key, file and signatures made by OpenSSH with:
+//
+//	ssh-keygen -t ed25519 -C release -f k
+//	ssh-keygen -Y sign -n file -f k bin
+const (
+	testReleaseKey  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKYetpuYhfn6r8ZAfD9gxVC5JgOXqhA8YyUgxjPhXAp4 release"
+	testReleaseFile = "otp release binary\n"
+	testReleaseSig  = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgph62m5iF+fqvxkB8P2DFULkmA5
+eqEDxjJSDGM+FcCngAAAAEZmlsZQAAAAAAAAAGc2hhNTEyAAAAUwAAAAtzc2gtZWQyNTUx
+OQAAAEBnfmTv5d1GIshX15H/5Vl0BPNPwSEThzUcru22hLHsk/vy+m5+WTzWrftTz/jjEm
+Y4HdlNusc9CDcMU/71S5AG
+-----END SSH SIGNATURE-----
+`
+	// The same file signed with -n git.
+	testReleaseGitSig = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgph62m5iF+fqvxkB8P2DFULkmA5
+eqEDxjJSDGM+FcCngAAAADZ2l0AAAAAAAAAAZzaGE1MTIAAABTAAAAC3NzaC1lZDI1NTE5
+AAAAQCqB0a34tE0OrjAdIGIbz9dAzwOUVN6yrBwpyRPznQ17TLCqOB/7qiIVbIq7Br1sIY
+Q/uHY7JncfLZ1xqbx9TgU=
+-----END SSH SIGNATURE-----
+`
+)
+
+// signSSH signs the data as ssh-keygen -Y sign does, with SHA-256.
+func signSSH(t *testing.T, signer ssh.Signer, namespace string, data []byte) []byte {
+	t.Helper()
+	h := sha256.Sum256(data)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{namespace, "", "sha256", h[:]})...)
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{1, signer.PublicKey().Marshal(), namespace, "", "sha256", ssh.Marshal(sig)})...)
+	return pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob})
+}
+
+func TestVerifySSHSignature(t *testing.T) {
+	key, err := parseReleaseKey(testReleaseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(testReleaseFile)
+	sig := []byte(testReleaseSig)
+	block, _ := pem.Decode(sig)
+	// Flip a bit of the signature itself, at the end of the blob.
+	block.Bytes[len(block.Bytes)-1] ^= 1
+	tamperedSig := pem.EncodeToMemory(block)
+
+	tests := []struct {
+		name      string
+		key       ssh.PublicKey
+		data, sig []byte
+		wantErr   string
+	}{
+		{"ssh-keygen", key, data, sig, ""},
+		{"round trip", signer.PublicKey(), data, signSSH(t, signer, "file", data), ""},
+		{"tampered file", key, []byte("otp release binarY\n"), sig, "did not verify"},
+		{"truncated file", key, data[:len(data)-1], sig, "did not verify"},
+		{"tampered signature", key, data, tamperedSig, "did not verify"},
+		{"other key", signer.PublicKey(), data, sig, "signed by another key, SHA256:"},
+		{"other namespace", key, data, []byte(testReleaseGitSig), `namespace "git"`},
+		{"round trip other namespace", signer.PublicKey(), data, signSSH(t, signer, "git", data), `namespace "git"`},
+		{"not armored", key, data, []byte("signature"), "not an SSH signature"},
+		{"other armor", key, data, pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: []byte("SSHSIG")}), "invalid SSH signature"},
+		{"other magic", key, data, bytes.Replace(sig, []byte("U1NIU0lH"), []byte("U1NIU0lI"), 1), "not an SSH signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySSHSignature(tt.key, releaseNamespace, tt.data, tt.sig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifySSHSignature() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.0", "1.2.0", 0},
+		{"v1.2", "v1.2.0", 0},
+		{"v1.10.0", "v1.9.3", 1},
+		{"v1.2.0", "v1.2.1", -1},
+		{"v2", "v1.99.99", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// checkServing fails now, not on every request, if the key or the store
+// cannot be opened; this also asks the passphrases before serving.
+func checkServing(c *cli.Context) error {
+	if _, err := privkeyfile(c.GlobalString("private-key")); err != nil {
+		return err
+	}
+	s, err := openstore(c, false)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// listenHTTP returns the listener passed by systemd socket activation, if
+// any, or else listens on the Unix socket, if set, or on the TCP address.
+// The Unix socket is only accessible to the user, unless mode says
+// otherwise, so the file permissions decide who is served.
+func listenHTTP(addr, socket string, mode os.FileMode) (net.Listener, error) {
+	if l, ok, err := systemdListener(); ok || err != nil {
+		return l, err
+	}
+	if socket == "" {
+		return net.Listen("tcp", addr)
+	}
+	os.Remove(socket)
+	if err := os.MkdirAll(filepath.Dir(socket), 0o700); err != nil {
+		return nil, err
+	}
+	// The socket must not be accessible before its mode is set.
+	old := umask(0o777)
+	l, err := net.Listen("unix", socket)
+	umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListener returns the first socket passed by systemd, as described
+// in sd_listen_fds(3).
+func systemdListener() (net.Listener, bool, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		return nil, true, fmt.Errorf("systemd passed %d sockets; only one is supported", n)
+	}
+	const sdListenFDsStart = 3
+	f := os.NewFile(sdListenFDsStart, "systemd socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, true, fmt.Errorf("cannot use the socket passed by systemd: %w", err)
+	}
+	return l, true, nil
+}
+
+// serviceStop is closed when the service manager of the system asks otp to
+// stop; it is nil, and so never closed, unless otp runs as a service.
+var serviceStop chan struct{}
+
+// serveUntilSignal runs serve, one of the Serve methods of srv, until
+// SIGINT or SIGTERM, or until the service manager asks to stop. Then the
+// server stops accepting connections and waits up to timeout for the
+// requests in flight before closing them. The context of the requests is
+// canceled on shutdown, so long-lived ones, such as the code streams, end
+// right away. The handlers still running when the connections are closed
+// are waited for up to timeout again.
+func serveUntilSignal(srv *http.Server, serve func() error, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var inflight sync.WaitGroup
+	next := srv.Handler
+	if next == nil {
+		next = http.DefaultServeMux
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight.Add(1)
+		defer inflight.Done()
+		next.ServeHTTP(w, r)
+	})
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.BaseContext = func(net.Listener) context.Context { return base }
+	srv.RegisterOnShutdown(cancel)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	case <-serviceStop:
+	}
+	stop()
+	log.Printf("shutting down; waiting up to %s for the requests in flight", timeout)
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(sctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		srv.Close()
+		// Closing the connections does not stop their handlers, which may
+		// be writing to the store.
+		done := make(chan struct{})
+		go func() {
+			inflight.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			log.Printf("handlers still running after another %s are abandoned", timeout)
+		}
+		return fmt.Errorf("requests still in flight after %s were interrupted", timeout)
+	} else if err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Print("server stopped")
+	return nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// serviceKinds are the long-running modes otp service installs, with the
+// command each runs.
+var serviceKinds = map[string]struct {
+	command     string
+	description string
+	// network tells whether the mode serves or reaches other hosts; the
+	// others only use Unix sockets.
+	network bool
+}{
+	"http":  {"http", "OTP codes web interface", true},
+	"agent": {"agent", "OTP private key agent", false},
+	"sync":  {"serve-sync", "OTP sync server", true},
+}
+
+func service() cli.Command {
+	kindFlag := cli.StringFlag{
+		Name:  "kind",
+		Usage: "http for otp http, agent for otp agent, or sync for otp serve-sync",
+	}
+	formatFlag := cli.StringFlag{
+		Name:  "format",
+		Value: defaultServiceFormat(),
+		Usage: "systemd for a systemd user unit, or launchd for a launchd agent",
+	}
+	return cli.Command{
+		Name:  "service",
+		Usage: "run otp http, otp agent or otp serve-sync as a service of the user",
+		Description: `The service runs with the --db, --private-key, --encryption and --config
+   in effect, made absolute, and the arguments given after --, such as
+   otp service install --kind http -- --addr 127.0.0.1:8080.
+
+   systemd units are sandboxed: the file system is read-only but for the
+   store, the configuration directory, the runtime directory and the
+   --read-write paths, and devices are hidden unless the key needs them.
+   On Windows, use otp http --install-service instead.
+
+   Services cannot ask passphrases on a terminal: otp agent asks them with
+   pinentry, and still exits after its --ttl, which can be given after --.`,
+		Subcommands: []cli.Command{
+			{
+				Name:      "install",
+				Usage:     "write the unit or plist of the service, and print how to start it",
+				ArgsUsage: "[-- `arguments`]",
+				Flags: []cli.Flag{
+					kindFlag,
+					formatFlag,
+					cli.BoolFlag{
+						Name:  "print",
+						Usage: "print the unit or plist instead of writing it",
+					},
+					cli.StringSliceFlag{
+						Name:  "read-write",
+						Usage: "other path the service writes to, such as the --data of otp serve-sync; can be repeated",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					kind, format, err := serviceOptions(c)
+					if err != nil {
+						return err
+					}
+					args, err := serviceArgs(c, kind)
+					if err != nil {
+						return err
+					}
+					var unit string
+					if format == "systemd" {
+						unit = systemdUnit(c, kind, args)
+					} else {
+						unit = launchdPlist(kind, args)
+					}
+					if c.Bool("print") {
+						fmt.Print(unit)
+						return nil
+					}
+					fn := serviceFile(kind, format)
+					if err := os.MkdirAll(filepath.Dir(fn), 0o755); err != nil {
+						return err
+					}
+					if err := writeFileAtomic(fn, []byte(unit), 0o644); err != nil {
+						return err
+					}
+					log.Printf("%s written; start it with:", fn)
+					if format == "systemd" {
+						fmt.Printf("systemctl --user daemon-reload && systemctl --user enable --now otp-%s.service\n", kind)
+					} else {
+						fmt.Printf("launchctl bootstrap gui/%d %s\n", os.Getuid(), fn)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "uninstall",
+				Usage: "remove the unit or plist of the service, once stopped",
+				Flags: []cli.Flag{kindFlag, formatFlag},
+				Action: func(c *cli.Context) error {
+					kind, format, err := serviceOptions(c)
+					if err != nil {
+						return err
+					}
+					fn := serviceFile(kind, format)
+					if err := os.Remove(fn); errors.Is(err, os.ErrNotExist) {
+						return fmt.Errorf("service %s is not installed", kind)
+					} else if err != nil {
+						return err
+					}
+					if format == "systemd" {
+						log.Printf("%s removed; stop the service first with: systemctl --user disable --now otp-%s.service", fn, kind)
+					} else {
+						log.Printf("%s removed; stop the service first with: launchctl bootout gui/%d/io.cirello.otp.%s", fn, os.Getuid(), kind)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func defaultServiceFormat() string {
+	if runtime.GOOS == "darwin" {
+		return "launchd"
+	}
+	return "systemd"
+}
+
+func serviceOptions(c *cli.Context) (kind, format string, err error) {
+	kind, format = c.String("kind"), c.String("format")
+	if _, ok := serviceKinds[kind]; !ok {
+		return "", "", fmt.Errorf("unknown kind %q: use http, agent or sync", kind)
+	}
+	switch {
+	case format != "systemd" && format != "launchd":
+		return "", "", fmt.Errorf("unknown format %q: use systemd or launchd", format)
+	case runtime.GOOS == "windows":
+		return "", "", errors.New("services are installed with otp http --install-service on Windows")
+	}
+	return kind, format, nil
+}
+
+// serviceArgs returns the command line of the service.
+func serviceArgs(c *cli.Context, kind string) ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return nil, err
+	}
+	args := []string{
+		exe,
+		"--db", absPath(c.GlobalString("db")),
+		"--private-key", absPath(c.GlobalString("private-key")),
+		"--encryption", c.GlobalString("encryption"),
+		"--config", absPath(c.GlobalString("config")),
+		serviceKinds[kind].command,
+	}
+	return append(args, c.Args()...), nil
+}
+
+func serviceFile(kind, format string) string {
+	if format == "launchd" {
+		return filepath.Join(homeDir, "Library", "LaunchAgents", "io.cirello.otp."+kind+".plist")
+	}
+	dir := filepath.Join(homeDir, ".config")
+	if d := os.Getenv("XDG_CONFIG_HOME"); d != "" {
+		dir = d
+	}
+	return filepath.Join(dir, "systemd", "user", "otp-"+kind+".service")
+}
+
+// absPath makes the file names absolute, leaving the URIs and the other
+// schemes alone.
+func absPath(fn string) string {
+	fn = expandHome(fn)
+	if fn == "" || filepath.VolumeName(fn) == "" && strings.Contains(fn, ":") {
+		return fn
+	}
+	if abs, err := filepath.Abs(fn); err == nil {
+		return abs
+	}
+	return fn
+}
+
+// systemdUnit returns a user unit running args in a sandbox that leaves
+// writable only what otp writes to.
+func systemdUnit(c *cli.Context, kind string, args []string) string {
+	writable := []string{"%t", systemdEscape(configDir)}
+	if fn := storePath(c); fn != "" {
+		fn = absPath(fn)
+		if st, err := os.Stat(fn); err != nil || !st.IsDir() {
+			fn = filepath.Dir(fn)
+		}
+		writable = append(writable, systemdEscape(fn))
+	}
+	if c.GlobalString("encryption") == "gpg" {
+		writable = append(writable, systemdEscape(filepath.Join(homeDir, ".gnupg")))
+	}
+	for _, fn := range c.StringSlice("read-write") {
+		writable = append(writable, systemdEscape(absPath(fn)))
+	}
+	slices.Sort(writable)
+	writable = slices.Compact(writable)
+	for i, fn := range writable {
+		// Paths that do not exist are skipped, instead of failing the
+		// service.
+		writable[i] = "-" + fn
+	}
+	cmd := make([]string, len(args))
+	for i, arg := range args {
+		cmd[i] = systemdEscape(arg)
+	}
+	families := "AF_UNIX AF_INET AF_INET6"
+	if !serviceKinds[kind].network {
+		families = "AF_UNIX"
+	}
+	privkey, encryption := c.GlobalString("private-key"), c.GlobalString("encryption")
+	// Keys in tokens and security keys are reached through /dev.
+	devices := strings.HasPrefix(privkey, "pkcs11:") || strings.HasPrefix(privkey, "yubikey:") || encryption == "fido2"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=%s\nDocumentation=https://github.com/cirello-io/otp\n\n", serviceKinds[kind].description)
+	fmt.Fprintf(&b, "[Service]\nExecStart=%s\n", strings.Join(cmd, " "))
+	b.WriteString("Restart=on-failure\nUMask=0077\n")
+	b.WriteString("NoNewPrivileges=yes\nProtectSystem=strict\nProtectHome=read-only\n")
+	fmt.Fprintf(&b, "ReadWritePaths=%s\n", strings.Join(writable, " "))
+	b.WriteString("PrivateTmp=yes\n")
+	if !devices {
+		b.WriteString("PrivateDevices=yes\n")
+	}
+	b.WriteString("ProtectKernelTunables=yes\nProtectKernelModules=yes\nProtectControlGroups=yes\n")
+	fmt.Fprintf(&b, "RestrictAddressFamilies=%s\n", families)
+	b.WriteString("RestrictNamespaces=yes\nRestrictRealtime=yes\nRestrictSUIDSGID=yes\nLockPersonality=yes\nMemoryDenyWriteExecute=yes\n")
+	b.WriteString("SystemCallArchitectures=native\nSystemCallFilter=@system-service\nSystemCallFilter=~@privileged\nSystemCallErrorNumber=EPERM\n")
+	b.WriteString("\n[Install]\nWantedBy=default.target\n")
+	return b.String()
+}
+
+// systemdEscape quotes s for the command lines and path lists of units.
+func systemdEscape(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// launchdPlist returns a launchd agent running args, restarted when it
+// fails, which logs to ~/Library/Logs.
+func launchdPlist(kind string, args []string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>io.cirello.otp.%s</string>\n", kind)
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range args {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", xmlEscape(arg))
+	}
+	b.WriteString("\t</array>\n")
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	b.WriteString("\t<key>ThrottleInterval</key>\n\t<integer>10</integer>\n")
+	b.WriteString("\t<key>Umask</key>\n\t<integer>63</integer>\n")
+	b.WriteString("\t<key>ProcessType</key>\n\t<string>Background</string>\n")
+	logfn := xmlEscape(filepath.Join(homeDir, "Library", "Logs", "otp-"+kind+".log"))
+	fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t<string>%s</string>\n", logfn)
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", logfn)
+	b.WriteString("</dict>\n</plist>\n")
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
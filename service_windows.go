@@ -0,0 +1,208 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceMain runs the application, under the service control manager when
+// it started otp: the log goes to the event log, and stop requests shut the
+// server down as SIGTERM would.
+func serviceMain(args []string, run func([]string) error) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return run(args)
+	}
+	name := serviceName(args)
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	log.SetFlags(0)
+	log.SetOutput(eventLogWriter{elog})
+	serviceStop = make(chan struct{})
+	return svc.Run(name, &windowsService{args: args, run: run, elog: elog})
+}
+
+// serviceName returns the value of --service-name in args, as the service
+// control manager does not tell.
+func serviceName(args []string) string {
+	for i, arg := range args {
+		arg = strings.TrimLeft(arg, "-")
+		if v, ok := strings.CutPrefix(arg, "service-name="); ok {
+			return v
+		}
+		if arg == "service-name" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return "otp"
+}
+
+type windowsService struct {
+	args []string
+	run  func([]string) error
+	elog *eventlog.Log
+}
+
+func (s *windowsService) Execute(_ []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.run(s.args)
+	}()
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	stopping := false
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				s.elog.Error(1, err.Error())
+				return false, 1
+			}
+			return false, 0
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				if !stopping {
+					stopping = true
+					status <- svc.Status{State: svc.StopPending}
+					close(serviceStop)
+				}
+			}
+		}
+	}
+}
+
+// eventLogWriter writes the log lines as informational events.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.elog.Info(1, strings.TrimSpace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// installService installs the running command as a service. The store, key,
+// encryption and configuration are given explicitly, in place of those of
+// the command line, as the service does not share the home directory of the
+// user installing it unless it logs on as them.
+func installService(c *cli.Context) error {
+	name := c.String("service-name")
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"--db", absPath(c.GlobalString("db")),
+		"--private-key", absPath(c.GlobalString("private-key")),
+		"--encryption", c.GlobalString("encryption"),
+		"--config", absPath(c.GlobalString("config")),
+	}
+	named := false
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		flag := strings.TrimLeft(arg, "-")
+		name, _, valued := strings.Cut(flag, "=")
+		switch {
+		case flag == "install-service", flag == "install-service=true":
+			continue
+		case arg != flag && (name == "db" || name == "private-key" || name == "encryption" || name == "config"):
+			if !valued {
+				// The value is the next argument.
+				i++
+			}
+			continue
+		case flag == "service-name", strings.HasPrefix(flag, "service-name="):
+			named = true
+		}
+		args = append(args, arg)
+	}
+	if !named {
+		// serviceMain finds the name of the service in its arguments.
+		args = append(args, "--service-name", name)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("cannot connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "OTP web interface (" + name + ")",
+		Description: "Serves the OTP codes of otp http.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("cannot create service %s: %w", name, err)
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("cannot register the event log source: %w", err)
+	}
+	log.Printf("service %s installed; start it with: sc start %s", name, name)
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("cannot connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	if st, err := s.Control(svc.Stop); err == nil {
+		for deadline := time.Now().Add(30 * time.Second); st.State != svc.Stopped && time.Now().Before(deadline); {
+			time.Sleep(300 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("cannot remove service %s: %w", name, err)
+	}
+	if err := eventlog.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove the event log source: %w", err)
+	}
+	log.Printf("service %s removed", name)
+	return nil
+}
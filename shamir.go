@@ -0,0 +1,311 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"rsc.io/qr"
+)
+
+// shareMagic starts every share written by key split.
+const shareMagic = "OTPSHARE1"
+
+// shareChecksumSize is the size of the checksum appended to the secret before
+// it is split, so that recover notices wrong or mismatched shares.
+const shareChecksumSize = 8
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func keyShares() cli.Command {
+	return cli.Command{
+		Name:  "key",
+		Usage: "back up the private key as Shamir shares",
+		Subcommands: []cli.Command{
+			{
+				Name:  "split",
+				Usage: "split the private key file into shares, any threshold of which recover it",
+				Description: `The private key file is split with Shamir's secret sharing, and each share
+   is printed on a line of its own, to be handed to a different person or
+   kept in a different place. With --qr, every share is written to a PNG
+   file too. Fewer shares than the threshold tell nothing about the key.
+
+   Only keys kept in files can be split; keys in tokens, agents or OS
+   keychains cannot.`,
+				Flags: []cli.Flag{
+					cli.IntFlag{
+						Name:  "n",
+						Value: 5,
+						Usage: "number of shares",
+					},
+					cli.IntFlag{
+						Name:  "t",
+						Value: 3,
+						Usage: "number of shares needed to recover the key",
+					},
+					cli.StringFlag{
+						Name:  "key",
+						Usage: "key file to split, such as the --pq-key file (default: --private-key)",
+					},
+					cli.BoolFlag{
+						Name:  "qr",
+						Usage: "write every share to a PNG file with its QR code",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					n, t := c.Int("n"), c.Int("t")
+					switch {
+					case t < 2:
+						return errors.New("-t must be at least 2")
+					case n < t:
+						return errors.New("-n must be at least -t")
+					case n > 255:
+						return errors.New("-n must be at most 255")
+					}
+					fn := expandHome(c.String("key"))
+					if fn == "" {
+						if keyBackendName != "private-key" && keyBackendName != "age" {
+							return fmt.Errorf("the key of --encryption %s is not kept in a file; use --key to split another file", keyBackendName)
+						}
+						fn = c.GlobalString("private-key")
+						if strings.HasPrefix(fn, "pkcs11:") || strings.HasPrefix(fn, "yubikey:") {
+							return errors.New("keys kept in a token cannot be split")
+						}
+					}
+					data, err := os.ReadFile(fn)
+					if err != nil {
+						return fmt.Errorf("cannot read key file: %s", err)
+					}
+					defer wipe(data)
+					sum := sha256.Sum256(data)
+					secret := append(bytes.Clone(data), sum[:shareChecksumSize]...)
+					defer wipe(secret)
+					shares, err := shamirSplit(secret, n, t)
+					if err != nil {
+						return err
+					}
+					id := strings.ToUpper(hex.EncodeToString(randomBytes(4)))
+					for i, y := range shares {
+						share := fmt.Sprintf("%s-%s-%d-%d-%s", shareMagic, id, t, i+1, shareEncoding.EncodeToString(y))
+						fmt.Println(share)
+						if !c.Bool("qr") {
+							continue
+						}
+						code, err := qr.Encode(share, qr.M)
+						if err != nil {
+							return fmt.Errorf("cannot make QR code of share %d: %s", i+1, err)
+						}
+						qrfn := fmt.Sprintf("otp-share-%s-%d.png", id, i+1)
+						if err := os.WriteFile(qrfn, code.PNG(), 0o600); err != nil {
+							return err
+						}
+						log.Printf("share %d written to %s", i+1, qrfn)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "recover",
+				Usage:     "reassemble the private key file from its shares",
+				ArgsUsage: "[`share`...]",
+				Description: `The shares are read from the arguments, or else one per line from the
+   standard input. The key is written to --out, which must not exist yet.`,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "out",
+						Usage: "file to write the key to (default: --private-key)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					out := expandHome(c.String("out"))
+					if out == "" {
+						out = c.GlobalString("private-key")
+					}
+					if _, err := os.Stat(out); err == nil {
+						return fmt.Errorf("%s already exists", out)
+					}
+					lines := []string(c.Args())
+					if len(lines) == 0 {
+						for {
+							line, err := stdin.ReadString('\n')
+							if line = strings.TrimSpace(line); line != "" {
+								lines = append(lines, line)
+							}
+							if err != nil {
+								break
+							}
+						}
+					}
+					data, err := recoverShares(lines)
+					if err != nil {
+						return err
+					}
+					defer wipe(data)
+					f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+					if err != nil {
+						return err
+					}
+					if _, err := f.Write(data); err != nil {
+						f.Close()
+						return err
+					}
+					if err := f.Close(); err != nil {
+						return err
+					}
+					log.Println("key recovered to", out)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// recoverShares parses the shares and combines them back into the key.
+func recoverShares(lines []string) ([]byte, error) {
+	var (
+		id        string
+		threshold int
+		xs        []byte
+		ys        [][]byte
+	)
+	for _, line := range lines {
+		parts := strings.Split(line, "-")
+		if len(parts) != 5 || parts[0] != shareMagic {
+			return nil, fmt.Errorf("invalid share %q", line)
+		}
+		t, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid share %q", line)
+		}
+		x, err := strconv.ParseUint(parts[3], 10, 8)
+		if err != nil || x == 0 {
+			return nil, fmt.Errorf("invalid share %q", line)
+		}
+		y, err := shareEncoding.DecodeString(parts[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid share %q: %s", line, err)
+		}
+		switch {
+		case id == "":
+			id, threshold = parts[1], t
+		case parts[1] != id:
+			return nil, errors.New("shares belong to different keys")
+		case len(y) != len(ys[0]):
+			return nil, fmt.Errorf("share %d is corrupted", x)
+		}
+		if bytes.IndexByte(xs, byte(x)) >= 0 {
+			continue
+		}
+		xs = append(xs, byte(x))
+		ys = append(ys, y)
+	}
+	switch {
+	case len(xs) == 0:
+		return nil, errors.New("shares are missing")
+	case len(xs) < threshold:
+		return nil, fmt.Errorf("%d shares are needed, only %d given", threshold, len(xs))
+	}
+	secret := shamirCombine(xs, ys)
+	if len(secret) < shareChecksumSize {
+		return nil, errors.New("shares are corrupted")
+	}
+	data, checksum := secret[:len(secret)-shareChecksumSize], secret[len(secret)-shareChecksumSize:]
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:shareChecksumSize], checksum) {
+		wipe(secret)
+		return nil, errors.New("shares do not recover the key: some are corrupted")
+	}
+	return data, nil
+}
+
+// shamirSplit splits the secret into n shares, any t of which recover it.
+// Every byte of the secret is the constant term of a random polynomial of
+// degree t-1 over GF(2^8), and share i holds the polynomials evaluated at
+// x = i+1.
+func shamirSplit(secret []byte, n, t int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coeffs := make([]byte, t)
+	defer wipe(coeffs)
+	for j, b := range secret {
+		coeffs[0] = b
+		copy(coeffs[1:], randomBytes(t-1))
+		for i := range shares {
+			shares[i][j] = gfEval(coeffs, byte(i+1))
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from the shares with Lagrange
+// interpolation at x = 0.
+func shamirCombine(xs []byte, ys [][]byte) []byte {
+	secret := make([]byte, len(ys[0]))
+	for i, xi := range xs {
+		// basis is the Lagrange basis polynomial of xi evaluated at 0.
+		basis := byte(1)
+		for j, xj := range xs {
+			if i != j {
+				basis = gfMul(basis, gfMul(xj, gfInv(xi^xj)))
+			}
+		}
+		for k, y := range ys[i] {
+			secret[k] ^= gfMul(y, basis)
+		}
+	}
+	return secret
+}
+
+// gfEval evaluates the polynomial at x with Horner's method.
+func gfEval(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, in constant time.
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse, a^254.
+func gfInv(a byte) byte {
+	r := a
+	for range 6 {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return gfMul(r, r)
+}
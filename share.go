@@ -0,0 +1,528 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// sharedSecretMagic prefixes the secrets encrypted to several public keys.
+const sharedSecretMagic = "OTPSHARED1\n"
+
+// sharedSecret is a secret encrypted with a random AES-256-GCM data key,
+// which is in turn encrypted to the public key of every recipient.
+type sharedSecret struct {
+	Recipients []sharedRecipient `json:"recipients"`
+	Nonce      []byte            `json:"nonce"`
+	Ciphertext []byte            `json:"ciphertext"`
+}
+
+type sharedRecipient struct {
+	// Key is the PKIX encoding of the public key of the recipient.
+	Key     []byte `json:"key"`
+	DataKey []byte `json:"data_key"`
+}
+
+// errNotShared is returned when decrypting a shared secret whose recipients
+// do not include the private key.
+var errNotShared = errors.New("secret is not shared with this private key")
+
+func isShared(password []byte) bool {
+	return bytes.HasPrefix(password, []byte(sharedSecretMagic))
+}
+
+func parseShared(password []byte) (*sharedSecret, error) {
+	var shared sharedSecret
+	if err := json.Unmarshal(password[len(sharedSecretMagic):], &shared); err != nil {
+		return nil, fmt.Errorf("invalid shared secret: %w", err)
+	}
+	return &shared, nil
+}
+
+// warnUntagged warns, once per run, about the entries written before
+// integrity tags existed, or before they covered the private key recorded by
+// add --key.
+var warnUntagged sync.Once
+
+// secret decrypts the secret of the entry, whether it is encrypted to the
+// private key only or shared with other keys, and checks its integrity tag.
+// Entries written before integrity tags existed are still decrypted, with a
+// warning, until init adds their tag.
+func (p privkey) secret(e entry) ([]byte, error) {
+	if _, ok := cutTag(e.Password); !ok || unboundEntryKey(e.Password) {
+		warnUntagged.Do(func() {
+			log.Print("warning: some keys have no integrity tag; run init to add it")
+		})
+	}
+	return p.legacySecret(e)
+}
+
+// secretError explains why the secret of the entry could not be decrypted,
+// naming the entry, the private key used and the likely causes.
+func secretError(p *privkey, e entry, err error) error {
+	name := fmt.Sprintf("key for account %q of issuer %q", e.Account, e.Issuer)
+	if _, fn, _, ok := cutEntryKey(e.Password); ok {
+		return fmt.Errorf("cannot decrypt %s with its own private key %s: %w", name, fn, err)
+	}
+	switch {
+	case errors.Is(err, errNeedPQKey), errors.Is(err, errNotShared):
+		return fmt.Errorf("%s: %w", name, err)
+	case errors.Is(err, errTampered):
+		return fmt.Errorf("%s: %w; restore it from a backup", name, err)
+	}
+	own, recorded := fingerprint(p.public()), keyFingerprint(e)
+	var hint string
+	switch recorded {
+	case "-":
+		hint = "likely causes: a wrong --private-key, a rotated key the entry was not re-encrypted with, or a corrupted entry"
+	case own:
+		hint = "it was encrypted with this very key, so the entry is likely corrupted; restore it from a backup"
+	default:
+		hint = fmt.Sprintf("it was encrypted with key %s: use that key with --private-key or, if it was rotated, rekey the store from it to the current key", recorded)
+	}
+	return fmt.Errorf("cannot decrypt %s with private key %s (%v); %s", name, own, err, hint)
+}
+
+// decryptSecret decrypts the secret of an entry stripped of its tag.
+func (p privkey) decryptSecret(e entry) ([]byte, error) {
+	label := cryptlabel(e.Account, e.Issuer)
+	if !isShared(e.Password) {
+		return p.decrypted(e.Password, label)
+	}
+	shared, err := parseShared(e.Password)
+	if err != nil {
+		return nil, err
+	}
+	own, err := x509.MarshalPKIXPublicKey(p.public())
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range shared.Recipients {
+		if !bytes.Equal(r.Key, own) {
+			continue
+		}
+		dataKey, err := p.decrypted(r.DataKey, label)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newGCM(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, shared.Nonce, shared.Ciphertext, label)
+	}
+	return nil, errNotShared
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealGCM encrypts with AES-GCM under a random nonce, which is prepended to
+// the ciphertext.
+func sealGCM(key, in, label []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(in)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, in, label), nil
+}
+
+func openGCM(key, in, label []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(in) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, in[:aead.NonceSize()], in[aead.NonceSize():], label)
+}
+
+// encryptShared encrypts the secret to all the public keys. With a single
+// key, which must be the private key's own, the usual format is used.
+func (p privkey) encryptShared(secret, label []byte, recipients []crypto.PublicKey) ([]byte, error) {
+	if len(recipients) == 1 && sameKey(recipients[0], p.public()) {
+		return p.encrypted(secret, label)
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	shared := sharedSecret{Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(shared.Nonce); err != nil {
+		return nil, err
+	}
+	shared.Ciphertext = aead.Seal(nil, shared.Nonce, secret, label)
+	for _, pub := range recipients {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := encryptTo(pub, dataKey, label)
+		if err != nil {
+			return nil, err
+		}
+		shared.Recipients = append(shared.Recipients, sharedRecipient{Key: der, DataKey: wrapped})
+	}
+	data, err := json.Marshal(shared)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(sharedSecretMagic), data...), nil
+}
+
+// recipients returns the public keys the secret of the entry is encrypted
+// to.
+func (p privkey) recipients(e entry) ([]crypto.PublicKey, error) {
+	if backend, fn, rest, ok := cutEntryKey(e.Password); ok {
+		key, err := readEntryKey(backend, fn)
+		if err != nil {
+			return nil, err
+		}
+		e.Password = rest
+		return key.recipients(e)
+	}
+	t, _ := cutTag(e.Password)
+	password := t.inner
+	if !isShared(password) {
+		return []crypto.PublicKey{p.public()}, nil
+	}
+	shared, err := parseShared(password)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.PublicKey
+	for _, r := range shared.Recipients {
+		pub, err := x509.ParsePKIXPublicKey(r.Key)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPublicKey(pub); err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+// checkPublicKey fails for the public keys secrets cannot be encrypted to.
+func checkPublicKey(pub crypto.PublicKey) error {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return nil
+	}
+	if _, err := ecdhPublicKey(pub); err != nil {
+		return fmt.Errorf("%s; only RSA, Ed25519 and ECDSA keys are supported", err)
+	}
+	return nil
+}
+
+// describedKey is implemented by the public keys of the key backends that do
+// not use a plain public key, which cannot be shared with.
+type describedKey interface {
+	Equal(crypto.PublicKey) bool
+	fingerprint() string
+	kind() string
+}
+
+// sameKey reports whether both public keys are the same.
+func sameKey(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// pubkeyfile reads a RSA, Ed25519 or ECDSA public key, either in the OpenSSH
+// format of id_rsa.pub, id_ed25519.pub and id_ecdsa.pub files or PEM encoded.
+func pubkeyfile(fn string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %s", err)
+	}
+	var pub crypto.PublicKey
+	if block, _ := pem.Decode(data); block != nil {
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unsupported key type %q", block.Type)
+		}
+	} else {
+		var sshpub ssh.PublicKey
+		sshpub, _, _, _, err = ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, errors.New("key data is neither an OpenSSH public key nor PEM encoded")
+		}
+		if k, ok := sshpub.(ssh.CryptoPublicKey); ok {
+			pub = k.CryptoPublicKey()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+	return pub, checkPublicKey(pub)
+}
+
+// fingerprint returns the fingerprint of the public key, as shown by
+// ssh-keygen -l.
+func fingerprint(pub crypto.PublicKey) string {
+	if k, ok := pub.(describedKey); ok {
+		return k.fingerprint()
+	}
+	sshpub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return fmt.Sprintf("unsupported public key %T", pub)
+	}
+	return ssh.FingerprintSHA256(sshpub)
+}
+
+// keyDescription returns the size and kind of the public key, as shown by
+// ssh-keygen -l. The size is 0 when unknown.
+func keyDescription(pub crypto.PublicKey) (int, string) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return pub.N.BitLen(), "RSA"
+	case ed25519.PublicKey:
+		return 256, "ED25519"
+	case *ecdsa.PublicKey:
+		return pub.Curve.Params().BitSize, "ECDSA"
+	case describedKey:
+		return 0, pub.kind()
+	}
+	return 0, fmt.Sprintf("%T", pub)
+}
+
+// updateRecipients changes the keys the secret of an entry is shared with.
+func updateRecipients(c *cli.Context, update func(priv *privkey, recipients []crypto.PublicKey) ([]crypto.PublicKey, error)) error {
+	issuer := c.Args().Get(0)
+	account := c.Args().Get(1)
+	switch {
+	case issuer == "":
+		return errors.New("issuer is missing")
+	case account == "":
+		return errors.New("account name is missing")
+	}
+	priv, err := privkeyfile(c.GlobalString("private-key"))
+	if err != nil {
+		return err
+	}
+	if checkPublicKey(priv.public()) != nil {
+		return fmt.Errorf("keys encrypted with --encryption %s cannot be shared", keyBackendName)
+	}
+
+	unlock, err := lockdb(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := openstore(c, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var count int
+	err = s.Tx(func(tx store) error {
+		e, err := tx.Get(account, issuer)
+		if errors.Is(err, errNotFound) {
+			return fmt.Errorf("%s/%s: %w", issuer, account, err)
+		} else if err != nil {
+			return err
+		}
+		if _, fn, _, ok := cutEntryKey(e.Password); ok {
+			return fmt.Errorf("%s/%s is encrypted with its own private key %s and cannot be shared", issuer, account, fn)
+		}
+		secret, err := priv.secret(e)
+		if err != nil {
+			return err
+		}
+		defer wipe(secret)
+		recipients, err := priv.recipients(e)
+		if err != nil {
+			return err
+		}
+		recipients, err = update(priv, recipients)
+		if err != nil {
+			return err
+		}
+		e.Password, err = priv.encryptShared(secret, cryptlabel(account, issuer), recipients)
+		if err != nil {
+			return err
+		}
+		e.Password = tagged(secret, account, issuer, priv.public(), e.Password)
+		count = len(recipients)
+		return tx.Put(e)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s/%s is encrypted to %d keys", issuer, account, count)
+	return nil
+}
+
+func grant() cli.Command {
+	return cli.Command{
+		Name:         "grant",
+		Usage:        "share a OTP key with the owner of another private key",
+		ArgsUsage:    "`issuer` `account-name` `public-key-file`",
+		BashComplete: completeEntries,
+		Description: `The secret is encrypted with a random data key, which is encrypted to each
+   public key the entry is shared with, so every owner decrypts it with their
+   own private key. The public key is an OpenSSH id_rsa.pub, id_ed25519.pub or
+   id_ecdsa.pub file, or a PEM encoded RSA, Ed25519 or ECDSA public key.`,
+		Action: func(c *cli.Context) error {
+			fn := c.Args().Get(2)
+			if fn == "" {
+				return errors.New("public key is missing")
+			}
+			pub, err := pubkeyfile(expandHome(fn))
+			if err != nil {
+				return err
+			}
+			return updateRecipients(c, func(_ *privkey, recipients []crypto.PublicKey) ([]crypto.PublicKey, error) {
+				for _, r := range recipients {
+					if sameKey(r, pub) {
+						return nil, fmt.Errorf("already shared with %s", fingerprint(pub))
+					}
+				}
+				return append(recipients, pub), nil
+			})
+		},
+	}
+}
+
+func revoke() cli.Command {
+	return cli.Command{
+		Name:         "revoke",
+		Usage:        "stop sharing a OTP key with the owner of another private key",
+		ArgsUsage:    "`issuer` `account-name` `public-key-file-or-fingerprint`",
+		BashComplete: completeEntries,
+		Description: `The secret is encrypted again with a new data key for the remaining keys.
+   Former recipients may still know the secret itself, so consider resetting
+   it with the service too.`,
+		Action: func(c *cli.Context) error {
+			target := c.Args().Get(2)
+			if target == "" {
+				return errors.New("public key is missing")
+			}
+			if !strings.HasPrefix(target, "SHA256:") {
+				pub, err := pubkeyfile(expandHome(target))
+				if err != nil {
+					return err
+				}
+				target = fingerprint(pub)
+			}
+			return updateRecipients(c, func(priv *privkey, recipients []crypto.PublicKey) ([]crypto.PublicKey, error) {
+				if target == fingerprint(priv.public()) {
+					return nil, errors.New("cannot revoke the own private key; revoke it with the key of another recipient")
+				}
+				var kept []crypto.PublicKey
+				for _, r := range recipients {
+					if fingerprint(r) != target {
+						kept = append(kept, r)
+					}
+				}
+				if len(kept) == len(recipients) {
+					return nil, fmt.Errorf("not shared with %s", target)
+				}
+				return kept, nil
+			})
+		},
+	}
+}
+
+func listRecipients() cli.Command {
+	return cli.Command{
+		Name:         "recipients",
+		Usage:        "list the public keys a OTP key is shared with",
+		ArgsUsage:    "`issuer` `account-name`",
+		BashComplete: completeEntries,
+		Action: func(c *cli.Context) error {
+			issuer := c.Args().Get(0)
+			account := c.Args().Get(1)
+			switch {
+			case issuer == "":
+				return errors.New("issuer is missing")
+			case account == "":
+				return errors.New("account name is missing")
+			}
+			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+			s, err := openstore(c, false)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			e, err := s.Get(account, issuer)
+			if errors.Is(err, errNotFound) {
+				return fmt.Errorf("%s/%s: %w", issuer, account, err)
+			} else if err != nil {
+				return err
+			}
+			recipients, err := priv.recipients(e)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+			defer w.Flush()
+			fmt.Fprintln(w, "fingerprint\tbits\ttype")
+			for _, r := range recipients {
+				bits, kind := keyDescription(r)
+				size := "-"
+				if bits > 0 {
+					size = fmt.Sprint(bits)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", fingerprint(r), size, kind)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func shareLink() cli.Command {
+	return cli.Command{
+		Name:      "share",
+		Usage:     "create a single-use link of otp http that reveals one current code of a OTP key",
+		ArgsUsage: "`issuer` `account-name`",
+		Description: `The link is kept, hashed, in the database otp http serves, and expires
+   after --ttl or once opened. Whoever opens it sees one code, never the
+   secret. The base URL can also be set in the [share] table of the
+   configuration file.`,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "ttl",
+				Value: 5 * time.Minute,
+				Usage: "how long the link can be opened",
+			},
+			cli.StringFlag{
+				Name:   "url",
+				Usage:  "URL otp http is reached at, as in https://otp.example.com",
+				EnvVar: "OTP_SHARE_URL",
+			},
+		},
+		Before: applyCommandConfig,
+		Action: func(c *cli.Context) error {
+			issuer, account := c.Args().Get(0), c.Args().Get(1)
+			base := strings.TrimSuffix(c.String("url"), "/")
+			switch {
+			case issuer == "":
+				return errors.New("issuer is missing")
+			case account == "":
+				return errors.New("account name is missing")
+			case base == "":
+				return errors.New("--url of otp http is missing")
+			case c.Duration("ttl") <= 0:
+				return errors.New("--ttl must be positive")
+			}
+			if ok, err := entryExists(c, issuer, account); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("%s/%s: %w", issuer, account, errNotFound)
+			}
+
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			db, err := opensqlite(c, true, "share links")
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			now := time.Now()
+			if _, err := db.Exec("DELETE FROM `share_links` WHERE `expires` <= ?;", now.Unix()); err != nil {
+				return err
+			}
+			token := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+			expires := now.Add(c.Duration("ttl"))
+			_, err = db.Exec("INSERT INTO `share_links` (`hash`, `account`, `issuer`, `expires`) VALUES (?, ?, ?, ?);",
+				hashToken(token), account, issuer, expires.Unix())
+			if err != nil {
+				return err
+			}
+			fmt.Println(base + "/share/" + token)
+			fmt.Fprintln(os.Stderr, "expires at", expires.Format(time.DateTime))
+			return nil
+		},
+	}
+}
+
+// useShareLink deletes the share link and returns the entry it reveals, or
+// errNotFound if it was used or expired.
+func useShareLink(c *cli.Context, token string) (issuer, account string, err error) {
+	db, err := opensqlite(c, true, "share links")
+	if err != nil {
+		return "", "", err
+	}
+	defer db.Close()
+	var expires int64
+	// A single statement, so concurrent requests cannot both use the link.
+	err = db.QueryRow("DELETE FROM `share_links` WHERE `hash` = ? RETURNING `issuer`, `account`, `expires`;", hashToken(token)).Scan(&issuer, &account, &expires)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return "", "", errNotFound
+	case err != nil:
+		return "", "", err
+	case time.Now().Unix() >= expires:
+		return "", "", errNotFound
+	}
+	return issuer, account, nil
+}
+
+// shareLinkHandler serves the share links of otp share ahead of next, as
+// they are opened without authentication. Opening a link shows a button,
+// and only pressing it uses the link: link previews fetch with GET.
+func shareLinkHandler(next http.Handler, c *cli.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /share/{token}", func(w http.ResponseWriter, r *http.Request) {
+		renderShare(w, http.StatusOK, sharePage{})
+	})
+	mux.HandleFunc("POST /share/{token}", func(w http.ResponseWriter, r *http.Request) {
+		audit(r).authenticated("share-link")
+		issuer, account, err := useShareLink(c, r.PathValue("token"))
+		if errors.Is(err, errNotFound) {
+			renderShare(w, http.StatusNotFound, sharePage{Error: "This link expired or was already used."})
+			return
+		} else if err != nil {
+			log.Println(err)
+			renderShare(w, http.StatusInternalServerError, sharePage{Error: "The code cannot be revealed."})
+			return
+		}
+		httpMu.Lock()
+		code, err := entryCode(c, issuer, account)
+		httpMu.Unlock()
+		if err != nil {
+			renderShare(w, errorStatus(err), sharePage{Error: "The code cannot be revealed: " + err.Error()})
+			return
+		}
+		audit(r).servedCode(issuer, account)
+		renderShare(w, http.StatusOK, sharePage{Code: &code})
+	})
+	mux.Handle("/", next)
+	return mux
+}
+
+type sharePage struct {
+	Code  *apiCode
+	Error string
+}
+
+func renderShare(w http.ResponseWriter, status int, p sharePage) {
+	var buf bytes.Buffer
+	if err := shareTemplate.Execute(&buf, p); err != nil {
+		log.Println(err)
+		http.Error(w, "cannot render the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+var shareTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>otp</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 30em; margin: 2em auto; padding: 0 1em; text-align: center; }
+.code { font-family: ui-monospace, monospace; font-size: 2.5em; letter-spacing: 0.1em; }
+</style></head><body>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>
+{{else if .Code}}<p>{{.Code.Issuer}} / {{.Code.Account}}</p>
+<p class="code">{{.Code.Code}}</p>
+<p>Valid for {{.Code.ExpiresIn}} more seconds. This link cannot be opened again.</p>
+{{else}}<p>This link reveals one code, once.</p>
+<form method="post"><button type="submit">Reveal the code</button></form>
+{{end}}</body></html>
+`))
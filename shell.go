@@ -0,0 +1,203 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/urfave/cli"
+	"golang.org/x/term"
+)
+
+// shellCommands are the commands otp shell runs.
+var shellCommands = []string{"add", "get", "list"}
+
+func shell() cli.Command {
+	return cli.Command{
+		Name:  "shell",
+		Usage: "run get, add and list repeatedly with the private key unlocked once",
+		Description: `Each line is a command with its arguments, quoted like in the shell, and
+   the global flags of otp shell apply to all of them. Up and down walk the
+   history of the session, which is never written to disk; tab completes the
+   commands and the names of the store. exit or an EOF ends the session.`,
+		Action: func(c *cli.Context) error {
+			if _, err := privkeyfile(c.GlobalString("private-key")); err != nil {
+				return err
+			}
+			globals := os.Args[:len(os.Args)-c.NArg()-1]
+			run := func(line string) error {
+				args, err := splitWords(line)
+				if err != nil || len(args) == 0 {
+					return err
+				}
+				switch name := args[0]; {
+				case name == "exit" || name == "quit":
+					return io.EOF
+				case name == "help":
+					fmt.Println("commands:", strings.Join(shellCommands, ", "), "and exit")
+					return nil
+				case !isShellCommand(name):
+					return fmt.Errorf("%s does not work in otp shell", name)
+				}
+				return c.App.Run(append(append([]string{}, globals...), args...))
+			}
+
+			fd := int(os.Stdin.Fd())
+			if !term.IsTerminal(fd) {
+				scanner := bufio.NewScanner(os.Stdin)
+				for scanner.Scan() {
+					if err := run(scanner.Text()); errors.Is(err, io.EOF) {
+						return nil
+					} else if err != nil {
+						fmt.Fprintln(os.Stderr, "error:", err)
+					}
+				}
+				return scanner.Err()
+			}
+
+			t := term.NewTerminal(struct {
+				io.Reader
+				io.Writer
+			}{os.Stdin, os.Stdout}, "otp> ")
+			t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+				if key != '\t' {
+					return "", 0, false
+				}
+				return completeShellLine(c, line, pos)
+			}
+			for {
+				state, err := term.MakeRaw(fd)
+				if err != nil {
+					return err
+				}
+				line, err := t.ReadLine()
+				term.Restore(fd, state)
+				if errors.Is(err, io.EOF) {
+					fmt.Println()
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if err := run(line); errors.Is(err, io.EOF) {
+					return nil
+				} else if err != nil {
+					fmt.Fprintln(os.Stderr, "error:", err)
+				}
+			}
+		},
+	}
+}
+
+func isShellCommand(name string) bool {
+	for _, cmd := range shellCommands {
+		if cmd == name {
+			return true
+		}
+	}
+	return false
+}
+
+var shellEscaper = strings.NewReplacer(`\`, `\\`, " ", `\ `, "\t", "\\\t", `"`, `\"`, "'", `\'`)
+
+// completeShellLine completes the word before pos with the commands for the
+// first word, and the issuers and account names of the store for the others.
+// With several candidates, it completes their common prefix.
+func completeShellLine(c *cli.Context, line string, pos int) (string, int, bool) {
+	start := 0
+	for i := 0; i < pos; i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ' ', '\t':
+			start = i + 1
+		}
+	}
+	word := line[start:pos]
+	candidates := append(shellCommands[:0:0], shellCommands...)
+	if strings.TrimSpace(line[:start]) != "" {
+		candidates = candidates[:0]
+		for _, e := range completionEntries(c) {
+			candidates = append(candidates, e.Issuer, e.Account)
+		}
+	}
+	var prefix string
+	found := false
+	for _, cand := range candidates {
+		cand = shellEscaper.Replace(cand)
+		if !strings.HasPrefix(cand, word) {
+			continue
+		}
+		if !found {
+			prefix, found = cand, true
+			continue
+		}
+		for !strings.HasPrefix(cand, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	if !found || prefix == word {
+		return "", 0, false
+	}
+	return line[:start] + prefix + line[pos:], start + len(prefix), true
+}
+
+// splitWords splits a line into words like the shell does, with single and
+// double quotes and backslash escapes.
+func splitWords(line string) ([]string, error) {
+	var (
+		words           []string
+		word            strings.Builder
+		quote           rune
+		inWord, escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func init() {
+	keyBackends["ssh-agent"] = newagentkey
+}
+
+// agentChallenge is the data signed by the ssh-agent to derive the store key.
+const agentChallenge = "otp ssh-agent store key v1"
+
+// newagentkey is the key backend that encrypts the secrets with AES-256-GCM,
+// under a key derived from the signature the ssh-agent makes of
+// agentChallenge, so the private key itself never has to be on disk
+// unencrypted, or at all.
+//
+// The signature must be the same every time, which holds for RSA and Ed25519
+// keys only. ECDSA keys, such as the Secure Enclave keys of Secretive, sign
+// with a random nonce, and the signatures of FIDO sk keys carry a counter, so
+// no stable key can be derived from them and they are refused before the
+// agent is asked to sign. Hardware keys are used through the agent when they
+// are RSA or Ed25519 keys, such as those of a smartcard or a gpg-agent.
+//
+// The agent signs agentChallenge with the key named by --private-key: either
+// its SHA256 fingerprint, or a public key file, or a private key file next
+// to its .pub file.
+func newagentkey(name string) (keyBackend, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set; is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to ssh-agent: %s", err)
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+
+	want := name
+	if !strings.HasPrefix(name, "SHA256:") {
+		pub, err := agentPublicKeyFile(name)
+		if err != nil {
+			return nil, err
+		}
+		want = ssh.FingerprintSHA256(pub)
+	}
+	keys, err := client.List()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list ssh-agent keys: %s", err)
+	}
+	var pub ssh.PublicKey
+	for _, k := range keys {
+		if ssh.FingerprintSHA256(k) == want {
+			pub = k
+			break
+		}
+	}
+	if pub == nil {
+		return nil, fmt.Errorf("key %s is not loaded in ssh-agent; add it with ssh-add", want)
+	}
+
+	var flags agent.SignatureFlags
+	switch pub.Type() {
+	case ssh.KeyAlgoRSA:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoED25519:
+	default:
+		return nil, fmt.Errorf("key %s is a %s key, which does not sign deterministically; only RSA and Ed25519 agent keys can protect the store", want, pub.Type())
+	}
+	var sigs [2][]byte
+	for i := range sigs {
+		sig, err := client.SignWithFlags(pub, []byte(agentChallenge), flags)
+		if err != nil {
+			return nil, fmt.Errorf("ssh-agent cannot sign with key %s: %s", want, err)
+		}
+		sigs[i] = sig.Blob
+	}
+	if !bytes.Equal(sigs[0], sigs[1]) {
+		return nil, fmt.Errorf("key %s (%s) does not sign deterministically; only RSA and Ed25519 keys can protect the store", want, pub.Type())
+	}
+	return newsymmetrickey("SSH-AGENT", want, sigs[0], "otp ssh-agent aes-256-gcm")
+}
+
+func agentPublicKeyFile(fn string) (ssh.PublicKey, error) {
+	if !strings.HasSuffix(fn, ".pub") {
+		fn += ".pub"
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read public key file: %s", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %s", fn, err)
+	}
+	return pub, nil
+}
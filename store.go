@@ -0,0 +1,371 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// entry is an OTP key as kept in the store. The secret is encrypted with the
+// private key, using cryptlabel(Account, Issuer) as label.
+type entry struct {
+	Account  string `json:"account"`
+	Issuer   string `json:"issuer"`
+	Password []byte `json:"password"`
+}
+
+// store is where the entries are kept.
+type store interface {
+	// Get returns the entry of the given account and issuer, or
+	// errNotFound.
+	Get(account, issuer string) (entry, error)
+	// List returns all entries ordered by account and issuer.
+	List() ([]entry, error)
+	// Put adds the entry, replacing the one with the same account and
+	// issuer if it exists.
+	Put(entry) error
+	// Delete removes the entry of the given account and issuer.
+	Delete(account, issuer string) error
+	// Tx runs fn with a view of the store whose modifications are applied
+	// all together if fn succeeds, and discarded otherwise.
+	Tx(fn func(store) error) error
+	Close() error
+}
+
+// snapshotter is implemented by the stores that can copy themselves into a
+// local file or directory, for the automatic backups.
+type snapshotter interface {
+	Snapshot(dst string) error
+}
+
+var (
+	// errNotInitialized is returned when opening a store that does not
+	// exist.
+	errNotInitialized = errors.New("not initialized; run init first")
+
+	// errNotFound is returned by store.Get for missing entries.
+	errNotFound = errors.New("key not found")
+)
+
+// storeBackend is an implementation of store. The backend is selected by
+// the scheme that prefixes the --db value, as in dir:path or
+// postgres://host/db; values without a registered scheme name a SQLite
+// database.
+type storeBackend struct {
+	// Open opens an existing store, failing with errNotInitialized if it
+	// does not exist.
+	Open func(location string, opts storeOptions) (store, error)
+	// Init creates the store if it does not exist yet.
+	Init func(location string, opts storeOptions) error
+	// Path returns the local path of the store, used for the lock file and
+	// the automatic backups. Network stores return an empty string.
+	Path func(location string) string
+	// Redact hides the credentials in the location, for use in messages.
+	// It is optional.
+	Redact func(location string) string
+}
+
+// storeOptions are the global settings that affect how stores are opened.
+type storeOptions struct {
+	readOnly bool
+	// privateKey is the file of the private key, for the stores that are
+	// encrypted as a whole.
+	privateKey string
+}
+
+// defaultStoreScheme is the backend of --db values without a scheme.
+const defaultStoreScheme = "sqlite"
+
+var storeBackends = make(map[string]storeBackend)
+
+// registerStore makes the backend available under the scheme. It is meant
+// to be called from init functions.
+func registerStore(scheme string, backend storeBackend) {
+	if _, ok := storeBackends[scheme]; ok {
+		panic("store scheme registered twice: " + scheme)
+	}
+	storeBackends[scheme] = backend
+}
+
+// memoryStoreName is the --db value of the store kept in memory only.
+const memoryStoreName = ":memory:"
+
+// storeScheme returns the scheme of the --db value. Single letters are
+// Windows drive letters, not schemes.
+func storeScheme(fn string) string {
+	if fn == memoryStoreName {
+		return "memory"
+	}
+	if i := strings.Index(fn, ":"); i > 1 {
+		if _, ok := storeBackends[fn[:i]]; ok {
+			return fn[:i]
+		}
+	}
+	return defaultStoreScheme
+}
+
+func storeBackendFor(c *cli.Context) (storeBackend, string) {
+	fn := c.GlobalString("db")
+	return storeBackends[storeScheme(fn)], fn
+}
+
+// storeName returns the --db value with any credentials redacted.
+func storeName(c *cli.Context) string {
+	backend, fn := storeBackendFor(c)
+	if backend.Redact != nil {
+		return backend.Redact(fn)
+	}
+	return fn
+}
+
+// storePath returns the local path of the store named by --db, or an empty
+// string for network stores.
+func storePath(c *cli.Context) string {
+	backend, fn := storeBackendFor(c)
+	return backend.Path(fn)
+}
+
+// sqlitePath returns the SQLite database named by --db, for the commands that
+// work on the database file itself.
+func sqlitePath(c *cli.Context) (string, error) {
+	fn := c.GlobalString("db")
+	if storeScheme(fn) != "sqlite" {
+		return "", fmt.Errorf("%s is not a SQLite database", storeName(c))
+	}
+	return strings.TrimPrefix(fn, "sqlite:"), nil
+}
+
+// openstore opens the store named by --db. Unless the store is opened for
+// writing, which requires holding the lock from lockdb, it is opened
+// read-only.
+func openstore(c *cli.Context, write bool) (store, error) {
+	backend, fn := storeBackendFor(c)
+	keyfile := c.GlobalString("private-key")
+	s, err := backend.Open(fn, storeOptions{readOnly: !write, privateKey: keyfile})
+	if err != nil {
+		return nil, err
+	}
+	return &namesStore{base: s, keyfile: keyfile, encrypt: c.GlobalBool("encrypt-names")}, nil
+}
+
+// initstore creates the store named by --db, if it does not exist yet.
+func initstore(c *cli.Context) error {
+	backend, fn := storeBackendFor(c)
+	return backend.Init(fn, storeOptions{privateKey: c.GlobalString("private-key")})
+}
+
+// autoinit opens the store for writing, creating it first if it does not
+// exist yet. Unless assumeYes is set, the user is asked to confirm the
+// creation.
+func autoinit(c *cli.Context, assumeYes bool) (store, error) {
+	s, err := openstore(c, true)
+	if !errors.Is(err, errNotInitialized) {
+		return s, err
+	}
+	fn := storeName(c)
+	if !assumeYes {
+		confirmed, err := confirm(fmt.Sprintf("store %s is not initialized. initialize it?", fn))
+		if err != nil {
+			return nil, err
+		}
+		if !confirmed {
+			return nil, fmt.Errorf("store %s is %w", fn, errNotInitialized)
+		}
+	}
+	if err := initstore(c); err != nil {
+		return nil, err
+	}
+	log.Printf("store %s initialized", fn)
+	return openstore(c, true)
+}
+
+func sortEntries(entries []entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Account != entries[j].Account {
+			return entries[i].Account < entries[j].Account
+		}
+		return entries[i].Issuer < entries[j].Issuer
+	})
+}
+
+type entryKey struct {
+	account, issuer string
+}
+
+// memStore keeps the entries in memory.
+type memStore struct {
+	entries map[entryKey]entry
+}
+
+// processStore is the store named by --db :memory:. It lives as long as the
+// process, and nothing of it is written to disk.
+var processStore = newmemstore(nil)
+
+func init() {
+	registerStore("memory", storeBackend{
+		Open: func(string, storeOptions) (store, error) {
+			return nopCloser{processStore}, nil
+		},
+		Init: func(string, storeOptions) error { return nil },
+		Path: func(string) string { return "" },
+	})
+}
+
+// nopCloser keeps the store open when closed.
+type nopCloser struct {
+	store
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func newmemstore(entries []entry) *memStore {
+	s := &memStore{entries: make(map[entryKey]entry)}
+	for _, e := range entries {
+		s.entries[entryKey{e.Account, e.Issuer}] = e
+	}
+	return s
+}
+
+func (s *memStore) Get(account, issuer string) (entry, error) {
+	e, ok := s.entries[entryKey{account, issuer}]
+	if !ok {
+		return entry{}, errNotFound
+	}
+	return e, nil
+}
+
+func (s *memStore) List() ([]entry, error) {
+	entries := make([]entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (s *memStore) Put(e entry) error {
+	s.entries[entryKey{e.Account, e.Issuer}] = e
+	return nil
+}
+
+func (s *memStore) Delete(account, issuer string) error {
+	delete(s.entries, entryKey{account, issuer})
+	return nil
+}
+
+// Tx works on a copy of the entries, which replaces the original ones if fn
+// succeeds.
+func (s *memStore) Tx(fn func(store) error) error {
+	entries, _ := s.List()
+	tx := newmemstore(entries)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.entries = tx.entries
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// txlog provides transactions to stores without native ones. It records the
+// modifications made by the transaction, which are applied to the
+// underlying store only once the transaction succeeds. Callers must hold
+// the store lock, so the application does not interleave with other
+// writers.
+type txlog struct {
+	base    store
+	changes map[entryKey]*entry // nil for deletions
+	order   []entryKey
+}
+
+func runtxlog(base store, fn func(store) error) error {
+	tx := &txlog{base: base, changes: make(map[entryKey]*entry)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for _, k := range tx.order {
+		var err error
+		if e := tx.changes[k]; e != nil {
+			err = base.Put(*e)
+		} else {
+			err = base.Delete(k.account, k.issuer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *txlog) record(k entryKey, e *entry) {
+	if _, ok := tx.changes[k]; !ok {
+		tx.order = append(tx.order, k)
+	}
+	tx.changes[k] = e
+}
+
+func (tx *txlog) Get(account, issuer string) (entry, error) {
+	if e, ok := tx.changes[entryKey{account, issuer}]; ok {
+		if e == nil {
+			return entry{}, errNotFound
+		}
+		return *e, nil
+	}
+	return tx.base.Get(account, issuer)
+}
+
+func (tx *txlog) List() ([]entry, error) {
+	entries, err := tx.base.List()
+	if err != nil {
+		return nil, err
+	}
+	view := newmemstore(entries)
+	for k, e := range tx.changes {
+		if e == nil {
+			view.Delete(k.account, k.issuer)
+		} else {
+			view.Put(*e)
+		}
+	}
+	return view.List()
+}
+
+func (tx *txlog) Put(e entry) error {
+	tx.record(entryKey{e.Account, e.Issuer}, &e)
+	return nil
+}
+
+func (tx *txlog) Delete(account, issuer string) error {
+	tx.record(entryKey{account, issuer}, nil)
+	return nil
+}
+
+func (tx *txlog) Tx(fn func(store) error) error {
+	return fn(tx)
+}
+
+func (tx *txlog) Close() error {
+	return nil
+}
@@ -0,0 +1,343 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// bwStore keeps the keys in the TOTP field of the login items of a Bitwarden
+// vault, through the bw command, so the keys already there are used as they
+// are. The --db value is bw:FOLDER, where the optional folder is the one
+// searched and where new items are added. bw must be logged in and
+// unlocked, with BW_SESSION set.
+//
+// The vault is encrypted by Bitwarden, so the secrets are encrypted again to
+// the private key as they are read, and decrypted with it as they are
+// written. The other fields of the items are left untouched.
+type bwStore struct {
+	folder   string
+	folderID string
+	priv     *privkey
+}
+
+func init() {
+	registerStore("bw", storeBackend{
+		Open: func(fn string, opts storeOptions) (store, error) {
+			return openbwstore(passStorePrefix(fn), opts.privateKey)
+		},
+		Init: func(fn string, _ storeOptions) error {
+			folder := passStorePrefix(fn)
+			if folder == "" {
+				return nil
+			}
+			if _, err := bwFolderID(folder); !errors.Is(err, errNotInitialized) {
+				return err
+			}
+			_, err := bwRun(bwEncode(map[string]string{"name": folder}), "create", "folder")
+			return err
+		},
+		Path: func(string) string { return "" },
+	})
+}
+
+func openbwstore(folder, keyfn string) (*bwStore, error) {
+	if _, err := exec.LookPath("bw"); err != nil {
+		return nil, fmt.Errorf("cannot find bw: %w", err)
+	}
+	s := &bwStore{folder: folder}
+	if folder != "" {
+		id, err := bwFolderID(folder)
+		if err != nil {
+			return nil, err
+		}
+		s.folderID = id
+	}
+	priv, err := privkeyfile(keyfn)
+	if err != nil {
+		return nil, err
+	}
+	s.priv = priv
+	return s, nil
+}
+
+func bwRun(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("bw", append(args, "--nointeraction")...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("bw %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("bw %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// bwEncode encodes an item or folder as bw create and bw edit read them from
+// the standard input. They are not given as arguments, which any user can
+// read in the list of processes.
+func bwEncode(v any) []byte {
+	data, _ := json.Marshal(v)
+	defer wipe(data)
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(out, data)
+	return out
+}
+
+func bwFolderID(folder string) (string, error) {
+	out, err := bwRun(nil, "list", "folders", "--search", folder)
+	if err != nil {
+		return "", err
+	}
+	var folders []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(out, &folders); err != nil {
+		return "", fmt.Errorf("bw list folders: %w", err)
+	}
+	for _, f := range folders {
+		if f.Name == folder {
+			return f.ID, nil
+		}
+	}
+	return "", fmt.Errorf("bitwarden folder %s is %w", folder, errNotInitialized)
+}
+
+// bwItem is the part of a login item of the vault that otp reads.
+type bwItem struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Login *struct {
+		Username string `json:"username"`
+		TOTP     string `json:"totp"`
+	} `json:"login"`
+}
+
+// bwKey is a TOTP key found in the vault.
+type bwKey struct {
+	id                      string
+	account, issuer, secret string
+}
+
+// keys reads the TOTP keys of the items in the folder.
+func (s *bwStore) keys() ([]bwKey, error) {
+	args := []string{"list", "items"}
+	if s.folderID != "" {
+		args = append(args, "--folderid", s.folderID)
+	}
+	out, err := bwRun(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(out)
+	var items []bwItem
+	if err := json.Unmarshal(out, &items); err != nil {
+		return nil, fmt.Errorf("bw list items: %w", err)
+	}
+	var keys []bwKey
+	for _, item := range items {
+		if item.Login == nil || item.Login.TOTP == "" {
+			continue
+		}
+		keys = append(keys, parseBitwardenTOTP(item.ID, item.Name, item.Login.Username, item.Login.TOTP))
+	}
+	return keys, nil
+}
+
+// parseBitwardenTOTP reads the TOTP field of an item, which is either an
+// otpauth:// URI or the bare secret. The issuer and the account are taken
+// from the label of the URI, and else from the name and user name of the
+// item.
+func parseBitwardenTOTP(id, name, username, totp string) bwKey {
+	k := bwKey{id: id, issuer: name, account: username, secret: totp}
+	if u, err := url.Parse(totp); err == nil && u.Scheme == "otpauth" {
+		query := u.Query()
+		k.secret = query.Get("secret")
+		label := strings.TrimPrefix(u.Path, "/")
+		if issuer, account, ok := strings.Cut(label, ":"); ok {
+			k.issuer, k.account = strings.TrimSpace(issuer), strings.TrimSpace(account)
+		} else if label != "" {
+			k.account = label
+		}
+		if issuer := query.Get("issuer"); issuer != "" && !strings.Contains(label, ":") {
+			k.issuer = issuer
+		}
+	}
+	k.secret = strings.ToUpper(strings.ReplaceAll(k.secret, " ", ""))
+	if k.account == "" {
+		k.account = name
+	}
+	return k
+}
+
+// entry encrypts the key to the private key.
+func (s *bwStore) entry(k bwKey) (entry, error) {
+	secret := []byte(k.secret)
+	password, err := s.priv.encrypted(secret, cryptlabel(k.account, k.issuer))
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{Account: k.account, Issuer: k.issuer, Password: tagged(secret, k.account, k.issuer, s.priv.public(), password)}, nil
+}
+
+func (s *bwStore) find(account, issuer string) (bwKey, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return bwKey{}, err
+	}
+	for _, k := range keys {
+		if k.account == account && k.issuer == issuer {
+			return k, nil
+		}
+	}
+	return bwKey{}, errNotFound
+}
+
+func (s *bwStore) Get(account, issuer string) (entry, error) {
+	k, err := s.find(account, issuer)
+	if err != nil {
+		return entry{}, err
+	}
+	return s.entry(k)
+}
+
+func (s *bwStore) List() ([]entry, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entry, 0, len(keys))
+	for _, k := range keys {
+		e, err := s.entry(k)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// item reads the whole item, so it is edited without losing the fields otp
+// does not know about.
+func (s *bwStore) item(id string) (map[string]any, error) {
+	out, err := bwRun(nil, "get", "item", id)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(out)
+	var item map[string]any
+	if err := json.Unmarshal(out, &item); err != nil {
+		return nil, fmt.Errorf("bw get item: %w", err)
+	}
+	return item, nil
+}
+
+// Put replaces the TOTP field of the item of the key, or adds a new login
+// item named after the issuer.
+func (s *bwStore) Put(e entry) error {
+	secret, err := s.priv.secret(e)
+	if err != nil {
+		return err
+	}
+	defer wipe(secret)
+	uri := (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + e.Issuer + ":" + e.Account,
+		RawQuery: url.Values{"secret": {string(secret)}, "issuer": {e.Issuer}}.Encode(),
+	}).String()
+
+	k, err := s.find(e.Account, e.Issuer)
+	if errors.Is(err, errNotFound) {
+		item := map[string]any{
+			"type":  1,
+			"name":  e.Issuer,
+			"login": map[string]any{"username": e.Account, "totp": uri},
+		}
+		if s.folderID != "" {
+			item["folderId"] = s.folderID
+		}
+		data := bwEncode(item)
+		defer wipe(data)
+		_, err := bwRun(data, "create", "item")
+		return err
+	} else if err != nil {
+		return err
+	}
+	item, err := s.item(k.id)
+	if err != nil {
+		return err
+	}
+	login, _ := item["login"].(map[string]any)
+	if login == nil {
+		return fmt.Errorf("bitwarden item %s is not a login", k.id)
+	}
+	login["totp"] = uri
+	data := bwEncode(item)
+	defer wipe(data)
+	_, err = bwRun(data, "edit", "item", k.id)
+	return err
+}
+
+// Delete clears the TOTP field of the item of the key, and removes the whole
+// item if nothing else is left in it.
+func (s *bwStore) Delete(account, issuer string) error {
+	k, err := s.find(account, issuer)
+	if errors.Is(err, errNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	item, err := s.item(k.id)
+	if err != nil {
+		return err
+	}
+	login, _ := item["login"].(map[string]any)
+	if login == nil {
+		return fmt.Errorf("bitwarden item %s is not a login", k.id)
+	}
+	password, _ := login["password"].(string)
+	notes, _ := item["notes"].(string)
+	uris, _ := login["uris"].([]any)
+	if password == "" && notes == "" && len(uris) == 0 {
+		_, err := bwRun(nil, "delete", "item", k.id)
+		return err
+	}
+	login["totp"] = nil
+	_, err = bwRun(bwEncode(item), "edit", "item", k.id)
+	return err
+}
+
+// Tx applies the changes once fn succeeds. The vault has no transactions, so
+// they are applied one by one.
+func (s *bwStore) Tx(fn func(store) error) error {
+	return runtxlog(s, fn)
+}
+
+func (s *bwStore) Close() error {
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirStorePrefix marks a --db value as a file-per-entry store directory.
+const dirStorePrefix = "dir:"
+
+// dirEntryExt is the extension of the files holding the entries of a
+// dirStore.
+const dirEntryExt = ".otp"
+
+// dirStore keeps each entry in its own file, named <issuer>/<account>.otp
+// within the store directory, so file synchronization tools only ever
+// conflict on individual entries instead of on the whole store. The file
+// holds the encrypted secret.
+type dirStore struct {
+	dir string
+}
+
+func init() {
+	registerStore("dir", storeBackend{
+		Open: func(fn string, opts storeOptions) (store, error) {
+			return opendirstore(dirStorePath(fn))
+		},
+		Init: func(fn string, _ storeOptions) error {
+			return initdirstore(dirStorePath(fn))
+		},
+		Path: dirStorePath,
+	})
+}
+
+func dirStorePath(fn string) string {
+	return expandHome(strings.TrimPrefix(fn, dirStorePrefix))
+}
+
+func initdirstore(dir string) error {
+	return os.MkdirAll(dir, 0o700)
+}
+
+func opendirstore(dir string) (*dirStore, error) {
+	fi, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("store %s is %w", dir, errNotInitialized)
+	} else if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("store %s is not a directory", dir)
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func (s *dirStore) filename(account, issuer string) string {
+	return filepath.Join(s.dir, escapeFilename(issuer), escapeFilename(account)+dirEntryExt)
+}
+
+// escapeFilename percent-encodes the name so it is safe to use as a file
+// name. Colons, which Windows does not allow, and leading dots are encoded
+// too, to keep "." and ".." from escaping the store and to keep entries from
+// becoming hidden files.
+func escapeFilename(name string) string {
+	escaped := strings.ReplaceAll(url.PathEscape(name), ":", "%3A")
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+func (s *dirStore) Get(account, issuer string) (entry, error) {
+	pw, err := os.ReadFile(s.filename(account, issuer))
+	if errors.Is(err, os.ErrNotExist) {
+		return entry{}, errNotFound
+	} else if err != nil {
+		return entry{}, err
+	}
+	return entry{Account: account, Issuer: issuer, Password: pw}, nil
+}
+
+func (s *dirStore) List() ([]entry, error) {
+	var entries []entry
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != s.dir {
+			// Hidden files belong to version control and sync tools.
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || filepath.Ext(path) != dirEntryExt {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		escapedIssuer, escapedAccount, ok := strings.Cut(filepath.ToSlash(strings.TrimSuffix(rel, dirEntryExt)), "/")
+		if !ok || strings.Contains(escapedAccount, "/") {
+			return nil
+		}
+		issuer, err := url.PathUnescape(escapedIssuer)
+		if err != nil {
+			return fmt.Errorf("invalid entry %s: %w", rel, err)
+		}
+		account, err := url.PathUnescape(escapedAccount)
+		if err != nil {
+			return fmt.Errorf("invalid entry %s: %w", rel, err)
+		}
+		pw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{Account: account, Issuer: issuer, Password: pw})
+		return nil
+	})
+	sortEntries(entries)
+	return entries, err
+}
+
+func (s *dirStore) Put(e entry) error {
+	return writeFileAtomic(s.filename(e.Account, e.Issuer), e.Password, 0o600)
+}
+
+func (s *dirStore) Delete(account, issuer string) error {
+	fn := s.filename(account, issuer)
+	if err := os.Remove(fn); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Only succeeds when no other entries are left for the issuer.
+	os.Remove(filepath.Dir(fn))
+	return nil
+}
+
+func (s *dirStore) Tx(fn func(store) error) error {
+	return runtxlog(s, fn)
+}
+
+// Snapshot copies the entries into the destination directory.
+func (s *dirStore) Snapshot(dst string) error {
+	entries, err := s.List()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0o700); err != nil {
+		return err
+	}
+	snap := &dirStore{dir: dst}
+	for _, e := range entries {
+		if err := snap.Put(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dirStore) Close() error {
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// gitStorePrefix marks a --db value as a git-backed store.
+const gitStorePrefix = "git:"
+
+// gitStore is a dirStore kept in a git repository. Every modification is
+// committed, so the repository holds the full history of the store and can
+// be pushed and pulled to share it between devices.
+type gitStore struct {
+	*dirStore
+
+	// batch collects the changes made within Tx, which are committed
+	// together.
+	batching bool
+	batch    []string
+}
+
+func init() {
+	registerStore("git", storeBackend{
+		Open: func(fn string, opts storeOptions) (store, error) {
+			return opengitstore(gitStorePath(fn))
+		},
+		Init: func(fn string, _ storeOptions) error {
+			return initgitstore(gitStorePath(fn))
+		},
+		Path: gitStorePath,
+	})
+}
+
+func gitStorePath(fn string) string {
+	return expandHome(strings.TrimPrefix(fn, gitStorePrefix))
+}
+
+func initgitstore(dir string) error {
+	if err := initdirstore(dir); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return nil
+	}
+	_, err := git(dir, "init", "--quiet")
+	return err
+}
+
+func opengitstore(dir string) (*gitStore, error) {
+	ds, err := opendirstore(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("store %s is not a git repository: %w", dir, errNotInitialized)
+	}
+	return &gitStore{dirStore: ds}, nil
+}
+
+// git runs the git command in the store directory.
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+func (s *gitStore) Put(e entry) error {
+	change := "add"
+	if _, err := os.Stat(s.filename(e.Account, e.Issuer)); err == nil {
+		change = "update"
+	}
+	if err := s.dirStore.Put(e); err != nil {
+		return err
+	}
+	return s.commit(fmt.Sprintf("%s %s/%s", change, e.Issuer, e.Account))
+}
+
+func (s *gitStore) Delete(account, issuer string) error {
+	if _, err := os.Stat(s.filename(account, issuer)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err := s.dirStore.Delete(account, issuer); err != nil {
+		return err
+	}
+	return s.commit(fmt.Sprintf("rm %s/%s", issuer, account))
+}
+
+// Tx commits all changes of the transaction at once.
+func (s *gitStore) Tx(fn func(store) error) error {
+	s.batching = true
+	err := runtxlog(s, fn)
+	changes := s.batch
+	s.batching, s.batch = false, nil
+	switch len(changes) {
+	case 0:
+		return err
+	case 1:
+		return errors.Join(err, s.commit(changes[0]))
+	}
+	msg := fmt.Sprintf("update %d keys\n\n%s", len(changes), strings.Join(changes, "\n"))
+	return errors.Join(err, s.commit(msg))
+}
+
+func (s *gitStore) commit(msg string) error {
+	if s.batching {
+		s.batch = append(s.batch, msg)
+		return nil
+	}
+	if _, err := git(s.dir, "add", "--all", "."); err != nil {
+		return err
+	}
+	_, err := git(s.dir, "commit", "--quiet", "--allow-empty", "-m", msg)
+	return err
+}
+
+// gitStoreDir returns the directory of the git-backed store named by --db.
+func gitStoreDir(c *cli.Context) (string, error) {
+	fn := c.GlobalString("db")
+	if storeScheme(fn) != "git" {
+		return "", fmt.Errorf("%s is not a git-backed store", storeName(c))
+	}
+	return gitStorePath(fn), nil
+}
+
+func gitlog() cli.Command {
+	return cli.Command{
+		Name:            "log",
+		Usage:           "show the history of a git-backed store",
+		ArgsUsage:       "[`git-log-arguments`]",
+		SkipFlagParsing: true,
+		Action: func(c *cli.Context) error {
+			dir, err := gitStoreDir(c)
+			if err != nil {
+				return err
+			}
+			cmd := exec.Command("git", append([]string{"-C", dir, "log"}, c.Args()...)...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			return cmd.Run()
+		},
+	}
+}
+
+func checkout() cli.Command {
+	return cli.Command{
+		Name:      "checkout",
+		Usage:     "roll a git-backed store back to an earlier revision",
+		ArgsUsage: "`revision`",
+		Description: `The keys are restored as they were at the revision, and the rollback is
+   committed on top of the history, so it can be undone too.`,
+		Action: func(c *cli.Context) error {
+			rev := c.Args().First()
+			if rev == "" {
+				return errors.New("revision is missing")
+			}
+			dir, err := gitStoreDir(c)
+			if err != nil {
+				return err
+			}
+			if _, err := git(dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}"); err != nil {
+				return fmt.Errorf("unknown revision %s", rev)
+			}
+
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			s, err := openstore(c, true)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			if err := autobackup(c, s); err != nil {
+				return err
+			}
+
+			if _, err := git(dir, "rm", "--quiet", "-r", "--ignore-unmatch", "."); err != nil {
+				return err
+			}
+			if _, err := git(dir, "checkout", rev, "--", "."); err != nil {
+				return err
+			}
+			gs := basestore(s).(*gitStore)
+			if err := gs.commit("checkout " + rev); err != nil {
+				return err
+			}
+			log.Printf("store %s rolled back to %s", dir, rev)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// keychainStoreMagic prefixes the sealed entries kept in the keychain.
+const keychainStoreMagic = "OTPKEYCHAIN1\n"
+
+// keychainStore keeps all entries in a single item of the keychain of the
+// platform, sealed as a whole with the private key like a sealed store: the
+// macOS Keychain, the Windows Credential Manager, or the Secret Service of
+// the desktop elsewhere. So the store follows the backups, synchronization
+// and locking of the keychain, for stores small enough to fit an item. The
+// --db value is keychain:NAME, where the optional name tells several stores
+// apart.
+type keychainStore struct {
+	name string
+	priv *privkey
+	*memStore
+}
+
+func init() {
+	registerStore("keychain", storeBackend{
+		Open: func(fn string, opts storeOptions) (store, error) {
+			return openkeychainstore(keychainStoreName(fn), opts.privateKey)
+		},
+		Init: func(fn string, opts storeOptions) error {
+			name := keychainStoreName(fn)
+			if _, err := readKeychainStore(name); !errors.Is(err, errNotFound) {
+				return err
+			}
+			priv, err := privkeyfile(opts.privateKey)
+			if err != nil {
+				return err
+			}
+			s := &keychainStore{name: name, priv: priv, memStore: newmemstore(nil)}
+			return s.save()
+		},
+		Path: func(string) string { return "" },
+	})
+}
+
+func keychainStoreName(fn string) string {
+	_, name, _ := strings.Cut(fn, ":")
+	if name == "" {
+		return "default"
+	}
+	return name
+}
+
+func openkeychainstore(name, keyfn string) (*keychainStore, error) {
+	sealed, err := readKeychainStore(name)
+	if errors.Is(err, errNotFound) {
+		return nil, fmt.Errorf("store %s in the %s is %w", name, keychainStoreLocation, errNotInitialized)
+	} else if err != nil {
+		return nil, err
+	}
+	priv, err := privkeyfile(keyfn)
+	if err != nil {
+		return nil, err
+	}
+	data, err := priv.unseal(keychainStoreMagic, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open store %s: %w", name, err)
+	}
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid store %s: %w", name, err)
+	}
+	return &keychainStore{name: name, priv: priv, memStore: newmemstore(entries)}, nil
+}
+
+func (s *keychainStore) save() error {
+	entries, _ := s.memStore.List()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.priv.seal(keychainStoreMagic, data)
+	if err != nil {
+		return err
+	}
+	return writeKeychainStore(s.name, sealed)
+}
+
+func (s *keychainStore) Put(e entry) error {
+	return s.Tx(func(tx store) error {
+		return tx.Put(e)
+	})
+}
+
+func (s *keychainStore) Delete(account, issuer string) error {
+	return s.Tx(func(tx store) error {
+		return tx.Delete(account, issuer)
+	})
+}
+
+// Tx rewrites the keychain item once fn succeeds. The in-memory entries are
+// left untouched if the item cannot be written.
+func (s *keychainStore) Tx(fn func(store) error) error {
+	old := s.memStore.entries
+	if err := s.memStore.Tx(fn); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.memStore.entries = old
+		return err
+	}
+	return nil
+}
+
+// Rekey seals the store again with the new private key.
+func (s *keychainStore) Rekey(priv *privkey) error {
+	old := s.priv
+	s.priv = priv
+	if err := s.save(); err != nil {
+		s.priv = old
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/urfave/cli"
+)
+
+// encryptedNamesMagic prefixes the entries whose account and issuer are
+// encrypted.
+const encryptedNamesMagic = "OTPNAMES1\n"
+
+// encryptedNamesIssuer is the issuer under which the entries with encrypted
+// names are kept.
+const encryptedNamesIssuer = "otp-encrypted"
+
+// wrappedStore is implemented by the stores that add a layer on top of
+// another store.
+type wrappedStore interface {
+	Unwrap() store
+}
+
+// basestore returns the store at the bottom of the layers, which is the one
+// that can be backed up and checked.
+func basestore(s store) store {
+	for {
+		w, ok := s.(wrappedStore)
+		if !ok {
+			return s
+		}
+		s = w.Unwrap()
+	}
+}
+
+// namesStore hides the accounts and issuers from the underlying store. Each
+// entry is kept under an HMAC of its account and issuer, keyed with the
+// private key, so entries can still be looked up and replaced, and the real
+// names are sealed together with the secret.
+//
+// Entries are only written this way when encrypt is set, but entries with
+// encrypted names are always read back, so stores can hold both kinds.
+type namesStore struct {
+	base    store
+	keyfile string
+	encrypt bool
+	priv    *privkey
+}
+
+func (s *namesStore) Unwrap() store {
+	return s.base
+}
+
+func (s *namesStore) privkey() (*privkey, error) {
+	if s.priv != nil {
+		return s.priv, nil
+	}
+	priv, err := privkeyfile(s.keyfile)
+	if err != nil {
+		return nil, err
+	}
+	s.priv = priv
+	return priv, nil
+}
+
+// nameBlinder is implemented by the key backends that blind names without
+// revealing their material, such as the client of otp agent.
+type nameBlinder interface {
+	blind(name []byte) ([]byte, error)
+}
+
+// blindName returns the HMAC of the name, keyed with a key derived from the
+// material of the key.
+func blindName(key keyBackend, name []byte) ([]byte, error) {
+	if b, ok := key.(nameBlinder); ok {
+		return b.blind(name)
+	}
+	material, err := key.material()
+	if err != nil {
+		return nil, err
+	}
+	return hmacsha256(hmacsha256(material, "otp encrypted names"), string(name)), nil
+}
+
+// blind returns the name under which the entry is kept when its names are
+// encrypted.
+func (s *namesStore) blind(account, issuer string) (string, error) {
+	priv, err := s.privkey()
+	if err != nil {
+		return "", err
+	}
+	blinded, err := blindName(priv.keyBackend, fmt.Appendf(nil, "%d:%s%s", len(account), account, issuer))
+	if err != nil {
+		return "", fmt.Errorf("cannot encrypt names: %w", err)
+	}
+	return hex.EncodeToString(blinded), nil
+}
+
+func (s *namesStore) seal(e entry) (entry, error) {
+	blinded, err := s.blind(e.Account, e.Issuer)
+	if err != nil {
+		return entry{}, err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return entry{}, err
+	}
+	sealed, err := s.priv.seal(encryptedNamesMagic, data)
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{Account: blinded, Issuer: encryptedNamesIssuer, Password: sealed}, nil
+}
+
+func (s *namesStore) unseal(e entry) (entry, error) {
+	if e.Issuer != encryptedNamesIssuer || !bytes.HasPrefix(e.Password, []byte(encryptedNamesMagic)) {
+		return e, nil
+	}
+	priv, err := s.privkey()
+	if err != nil {
+		return entry{}, err
+	}
+	data, err := priv.unseal(encryptedNamesMagic, e.Password)
+	if err != nil {
+		return entry{}, fmt.Errorf("cannot decrypt names of entry %s: %w", e.Account, err)
+	}
+	var plain entry
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return entry{}, fmt.Errorf("invalid entry %s: %w", e.Account, err)
+	}
+	return plain, nil
+}
+
+// hasEncryptedNames reports whether entries may be kept under encrypted
+// names, so that names are only blinded, which needs the private key, when
+// an entry could be found that way.
+func (s *namesStore) hasEncryptedNames() (bool, error) {
+	if s.encrypt {
+		return true, nil
+	}
+	entries, err := s.base.List()
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Issuer == encryptedNamesIssuer && bytes.HasPrefix(e.Password, []byte(encryptedNamesMagic)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get looks the entry up by its plain names and by its encrypted ones, in
+// the order that matches encrypt.
+func (s *namesStore) Get(account, issuer string) (entry, error) {
+	if !s.encrypt {
+		e, err := s.base.Get(account, issuer)
+		if !errors.Is(err, errNotFound) {
+			return e, err
+		}
+		if ok, listErr := s.hasEncryptedNames(); listErr != nil {
+			return entry{}, listErr
+		} else if !ok {
+			return entry{}, err
+		}
+	}
+	blinded, err := s.blind(account, issuer)
+	if err != nil {
+		return entry{}, err
+	}
+	e, err := s.base.Get(blinded, encryptedNamesIssuer)
+	if err == nil {
+		return s.unseal(e)
+	} else if !errors.Is(err, errNotFound) || !s.encrypt {
+		return entry{}, err
+	}
+	return s.base.Get(account, issuer)
+}
+
+func (s *namesStore) List() ([]entry, error) {
+	entries, err := s.base.List()
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if entries[i], err = s.unseal(e); err != nil {
+			return nil, err
+		}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (s *namesStore) Put(e entry) error {
+	if !s.encrypt {
+		return s.base.Put(e)
+	}
+	sealed, err := s.seal(e)
+	if err != nil {
+		return err
+	}
+	return s.base.Put(sealed)
+}
+
+// Delete removes the entry whether its names are encrypted or not.
+func (s *namesStore) Delete(account, issuer string) error {
+	ok, err := s.hasEncryptedNames()
+	if err != nil {
+		return err
+	}
+	if ok {
+		blinded, err := s.blind(account, issuer)
+		if err != nil {
+			return err
+		}
+		if err := s.base.Delete(blinded, encryptedNamesIssuer); err != nil {
+			return err
+		}
+	}
+	return s.base.Delete(account, issuer)
+}
+
+func (s *namesStore) Tx(fn func(store) error) error {
+	return s.base.Tx(func(tx store) error {
+		return fn(&namesStore{base: tx, keyfile: s.keyfile, encrypt: s.encrypt, priv: s.priv})
+	})
+}
+
+func (s *namesStore) Close() error {
+	return s.base.Close()
+}
+
+// encryptNames rewrites the entries that still have plain names, so their
+// names are encrypted too.
+func (s *namesStore) encryptNames() (int, error) {
+	var converted int
+	err := s.Tx(func(tx store) error {
+		converted = 0
+		names := tx.(*namesStore)
+		entries, err := names.base.List()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Issuer == encryptedNamesIssuer && bytes.HasPrefix(e.Password, []byte(encryptedNamesMagic)) {
+				continue
+			}
+			if err := names.Put(e); err != nil {
+				return err
+			}
+			if err := names.base.Delete(e.Account, e.Issuer); err != nil {
+				return err
+			}
+			converted++
+		}
+		return nil
+	})
+	return converted, err
+}
+
+// encryptStoreNames encrypts the names of the entries that still have plain
+// names, when --encrypt-names is set.
+func encryptStoreNames(c *cli.Context, s store) error {
+	if !c.GlobalBool("encrypt-names") {
+		return nil
+	}
+	names := &namesStore{base: s, keyfile: c.GlobalString("private-key"), encrypt: true}
+	n, err := names.encryptNames()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("encrypted the names of %d keys", n)
+	}
+	return nil
+}
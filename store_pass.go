@@ -0,0 +1,368 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// passStore keeps the entries as otpauth:// lines of the entries of a pass
+// or gopass password store, as pass-otp does, so the keys already there are
+// used as they are. The --db value is pass:PREFIX or gopass:PREFIX, where the
+// prefix is the folder of the password store that is searched and where new
+// keys are added, as PREFIX/issuer/account. It defaults to otp, so the rest of
+// the password store is never decrypted.
+//
+// The password store is encrypted with its own GnuPG keys, so the secrets are
+// encrypted again to the private key as they are read, and decrypted with it
+// as they are written. Other lines of the entries are left untouched.
+type passStore struct {
+	program string
+	prefix  string
+	priv    *privkey
+	// index maps the issuers and accounts to the names of their entries
+	// once keys has read them, so a key is found by decrypting its entry
+	// only.
+	index map[[2]string]string
+}
+
+func init() {
+	for _, program := range []string{"pass", "gopass"} {
+		registerStore(program, storeBackend{
+			Open: func(fn string, opts storeOptions) (store, error) {
+				return openpassstore(program, passStorePrefix(fn), opts.privateKey)
+			},
+			Init: func(fn string, _ storeOptions) error {
+				if program == "pass" {
+					if _, err := os.Stat(filepath.Join(passStoreDir(), ".gpg-id")); err != nil {
+						return errors.New("the password store is not initialized; run pass init first")
+					}
+				}
+				return nil
+			},
+			Path: func(fn string) string {
+				if program == "pass" {
+					return passStoreDir()
+				}
+				return ""
+			},
+		})
+	}
+}
+
+func passStorePrefix(fn string) string {
+	_, prefix, _ := strings.Cut(fn, ":")
+	if prefix = strings.Trim(prefix, "/"); prefix == "" {
+		return "otp"
+	}
+	return prefix
+}
+
+// passStoreDir is the directory of the password store of pass.
+func passStoreDir() string {
+	if dir := os.Getenv("PASSWORD_STORE_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(homeDir, ".password-store")
+}
+
+func openpassstore(program, prefix, keyfn string) (*passStore, error) {
+	if program == "pass" {
+		if _, err := os.Stat(passStoreDir()); errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("password store %s is %w", passStoreDir(), errNotInitialized)
+		}
+	}
+	if _, err := exec.LookPath(program); err != nil {
+		return nil, fmt.Errorf("cannot find %s: %w", program, err)
+	}
+	priv, err := privkeyfile(keyfn)
+	if err != nil {
+		return nil, err
+	}
+	return &passStore{program: program, prefix: prefix, priv: priv}, nil
+}
+
+func (s *passStore) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(s.program, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s %s: %s", s.program, args[0], msg)
+		}
+		return nil, fmt.Errorf("%s %s: %w", s.program, args[0], err)
+	}
+	return out, nil
+}
+
+// names lists the entries of the password store under the prefix.
+func (s *passStore) names() ([]string, error) {
+	var names []string
+	if s.program == "gopass" {
+		out, err := s.run(nil, "ls", "--flat", s.prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Split(string(out), "\n") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	root := passStoreDir()
+	err := filepath.WalkDir(filepath.Join(root, s.prefix), func(fn string, d fs.DirEntry, err error) error {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case d.IsDir() && strings.HasPrefix(d.Name(), ".") && fn != root:
+			return filepath.SkipDir
+		case d.IsDir() || filepath.Ext(fn) != ".gpg":
+			return nil
+		}
+		rel, err := filepath.Rel(root, fn)
+		if err != nil {
+			return err
+		}
+		names = append(names, strings.TrimSuffix(filepath.ToSlash(rel), ".gpg"))
+		return nil
+	})
+	return names, err
+}
+
+func (s *passStore) show(name string) ([]byte, error) {
+	if s.program == "gopass" {
+		return s.run(nil, "show", "-f", name)
+	}
+	return s.run(nil, "show", name)
+}
+
+// passKey is an otpauth:// line found in the password store.
+type passKey struct {
+	name                    string
+	content                 []byte
+	account, issuer, secret string
+}
+
+// keys reads the TOTP keys of the password store, and indexes them.
+func (s *passStore) keys() ([]passKey, error) {
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+	var keys []passKey
+	s.index = make(map[[2]string]string)
+	for _, name := range names {
+		content, err := s.show(name)
+		if err != nil {
+			return nil, err
+		}
+		k, ok := parsePassOTP(name, content)
+		if !ok {
+			wipe(content)
+			continue
+		}
+		s.index[[2]string{k.issuer, k.account}] = name
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// parsePassOTP finds the otpauth://totp line of the entry. The issuer and
+// the account are taken from the label, and else from the name of the
+// entry.
+func parsePassOTP(name string, content []byte) (passKey, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		u, err := url.Parse(strings.TrimSpace(scanner.Text()))
+		if err != nil || u.Scheme != "otpauth" || u.Host != "totp" {
+			continue
+		}
+		query := u.Query()
+		k := passKey{name: name, content: content, secret: query.Get("secret")}
+		if k.secret == "" {
+			continue
+		}
+		label := strings.TrimPrefix(u.Path, "/")
+		if issuer, account, ok := strings.Cut(label, ":"); ok {
+			k.issuer, k.account = strings.TrimSpace(issuer), strings.TrimSpace(account)
+		} else {
+			k.account = label
+		}
+		if k.issuer == "" {
+			k.issuer = query.Get("issuer")
+		}
+		if k.issuer == "" {
+			k.issuer = path.Base(path.Dir(name))
+		}
+		if k.account == "" {
+			k.account = path.Base(name)
+		}
+		return k, true
+	}
+	return passKey{}, false
+}
+
+// entry encrypts the key to the private key.
+func (s *passStore) entry(k passKey) (entry, error) {
+	secret := []byte(k.secret)
+	password, err := s.priv.encrypted(secret, cryptlabel(k.account, k.issuer))
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{Account: k.account, Issuer: k.issuer, Password: tagged(secret, k.account, k.issuer, s.priv.public(), password)}, nil
+}
+
+// find reads the key from the entry the index names, and reads the whole
+// password store again only when there is no index yet or the entry changed.
+func (s *passStore) find(account, issuer string) (passKey, error) {
+	if name, ok := s.index[[2]string{issuer, account}]; ok {
+		content, err := s.show(name)
+		if err == nil {
+			k, ok := parsePassOTP(name, content)
+			if ok && k.account == account && k.issuer == issuer {
+				return k, nil
+			}
+			wipe(content)
+		}
+	}
+	keys, err := s.keys()
+	if err != nil {
+		return passKey{}, err
+	}
+	var found passKey
+	err = errNotFound
+	for _, k := range keys {
+		if err != nil && k.account == account && k.issuer == issuer {
+			found, err = k, nil
+			continue
+		}
+		wipe(k.content)
+	}
+	return found, err
+}
+
+func (s *passStore) Get(account, issuer string) (entry, error) {
+	k, err := s.find(account, issuer)
+	if err != nil {
+		return entry{}, err
+	}
+	return s.entry(k)
+}
+
+func (s *passStore) List() ([]entry, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entry, 0, len(keys))
+	for _, k := range keys {
+		e, err := s.entry(k)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// Put replaces the otpauth:// line of the entry of the key, or adds a new
+// entry to the password store.
+func (s *passStore) Put(e entry) error {
+	secret, err := s.priv.secret(e)
+	if err != nil {
+		return err
+	}
+	defer wipe(secret)
+	uri := (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + e.Issuer + ":" + e.Account,
+		RawQuery: url.Values{"secret": {string(secret)}, "issuer": {e.Issuer}}.Encode(),
+	}).String()
+
+	k, err := s.find(e.Account, e.Issuer)
+	switch {
+	case errors.Is(err, errNotFound):
+		k.name = path.Join(s.prefix, safeFilename(e.Issuer), safeFilename(e.Account))
+		k.content = []byte(uri + "\n")
+	case err != nil:
+		return err
+	default:
+		lines := strings.SplitAfter(string(k.content), "\n")
+		for i, line := range lines {
+			if strings.HasPrefix(strings.TrimSpace(line), "otpauth://totp") {
+				lines[i] = uri + "\n"
+				break
+			}
+		}
+		k.content = []byte(strings.Join(lines, ""))
+	}
+	_, err = s.run(k.content, "insert", "-m", "-f", k.name)
+	wipe(k.content)
+	if err == nil && s.index != nil {
+		s.index[[2]string{e.Issuer, e.Account}] = k.name
+	}
+	return err
+}
+
+// Delete removes the otpauth:// line of the key, and the whole entry of the
+// password store if nothing else is left in it.
+func (s *passStore) Delete(account, issuer string) error {
+	k, err := s.find(account, issuer)
+	if errors.Is(err, errNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var rest []string
+	for _, line := range strings.SplitAfter(string(k.content), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "otpauth://totp") {
+			rest = append(rest, line)
+		}
+	}
+	delete(s.index, [2]string{issuer, account})
+	if strings.TrimSpace(strings.Join(rest, "")) == "" {
+		_, err := s.run(nil, "rm", "-f", k.name)
+		return err
+	}
+	_, err = s.run([]byte(strings.Join(rest, "")), "insert", "-m", "-f", k.name)
+	return err
+}
+
+// Tx applies the changes once fn succeeds. The password store has no
+// transactions, so they are applied one by one.
+func (s *passStore) Tx(fn func(store) error) error {
+	return runtxlog(s, fn)
+}
+
+func (s *passStore) Close() error {
+	return nil
+}
@@ -0,0 +1,352 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// s3StoreObject is the name of the object that holds the store, within the
+// configured prefix.
+const s3StoreObject = "otp-store.json"
+
+// s3MaxAttempts bounds how many times a modification is retried when another
+// device changes the store concurrently.
+const s3MaxAttempts = 5
+
+// errS3Conflict is returned when a conditional write loses the race against
+// another writer.
+var errS3Conflict = errors.New("store was modified concurrently")
+
+// s3Store keeps all entries in a single object of an S3-compatible bucket.
+// Modifications are read-modify-write cycles made safe by conditional
+// writes on the object's ETag, so several devices can share the store
+// without a server of their own.
+//
+// The store is named s3://bucket/prefix. Credentials and region come from
+// the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+// AWS_REGION environment variables. Other S3-compatible services are used
+// by adding ?endpoint=https://host to the store name.
+type s3Store struct {
+	bucket   string
+	key      string
+	endpoint string
+	awsCredentials
+
+	client *http.Client
+}
+
+// awsCredentials are the credentials and region of the requests to AWS.
+type awsCredentials struct {
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// awsCredentialsFromEnv reads the usual AWS environment variables. The
+// region, when not empty, takes precedence over AWS_REGION.
+func awsCredentialsFromEnv(region string) (awsCredentials, error) {
+	c := awsCredentials{
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_REGION")
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return awsCredentials{}, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+// s3Document is the content of the store object.
+type s3Document struct {
+	Entries []entry `json:"entries"`
+}
+
+func news3store(fn string) (*s3Store, error) {
+	u, err := url.Parse(fn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("store %s has no bucket", fn)
+	}
+	creds, err := awsCredentialsFromEnv(u.Query().Get("region"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot use a S3 store: %w", err)
+	}
+	return &s3Store{
+		bucket:         u.Host,
+		key:            path.Join(strings.TrimPrefix(u.Path, "/"), s3StoreObject),
+		endpoint:       u.Query().Get("endpoint"),
+		awsCredentials: creds,
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func init() {
+	registerStore("s3", storeBackend{
+		Open: func(fn string, opts storeOptions) (store, error) {
+			return opens3store(fn)
+		},
+		Init: func(fn string, _ storeOptions) error {
+			return inits3store(fn)
+		},
+		Path: func(string) string { return "" },
+	})
+}
+
+func inits3store(fn string) error {
+	s, err := news3store(fn)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.load()
+	if !errors.Is(err, errNotInitialized) {
+		return err
+	}
+	err = s.save(&s3Document{}, "")
+	if errors.Is(err, errS3Conflict) {
+		// Another device created the store meanwhile.
+		return nil
+	}
+	return err
+}
+
+func opens3store(fn string) (*s3Store, error) {
+	s, err := news3store(fn)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *s3Store) Get(account, issuer string) (entry, error) {
+	doc, _, err := s.load()
+	if err != nil {
+		return entry{}, err
+	}
+	return newmemstore(doc.Entries).Get(account, issuer)
+}
+
+func (s *s3Store) List() ([]entry, error) {
+	doc, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return doc.Entries, nil
+}
+
+func (s *s3Store) Put(e entry) error {
+	return s.Tx(func(tx store) error {
+		return tx.Put(e)
+	})
+}
+
+func (s *s3Store) Delete(account, issuer string) error {
+	return s.Tx(func(tx store) error {
+		return tx.Delete(account, issuer)
+	})
+}
+
+// Tx runs fn against the latest version of the store, and starts over if
+// another writer got there first. Therefore fn may run more than once.
+func (s *s3Store) Tx(fn func(store) error) error {
+	for attempt := 0; attempt < s3MaxAttempts; attempt++ {
+		doc, etag, err := s.load()
+		if err != nil {
+			return err
+		}
+		tx := newmemstore(doc.Entries)
+		if err := fn(tx); err != nil {
+			return err
+		}
+		doc.Entries, _ = tx.List()
+		err = s.save(doc, etag)
+		if !errors.Is(err, errS3Conflict) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+	return fmt.Errorf("cannot update store: %w", errS3Conflict)
+}
+
+func (s *s3Store) Close() error {
+	return nil
+}
+
+func (s *s3Store) load() (*s3Document, string, error) {
+	resp, err := s.do(http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", fmt.Errorf("store s3://%s/%s is %w", s.bucket, s.key, errNotInitialized)
+	default:
+		return nil, "", s3error(resp)
+	}
+	doc := &s3Document{}
+	if err := json.NewDecoder(resp.Body).Decode(doc); err != nil {
+		return nil, "", fmt.Errorf("invalid store object: %w", err)
+	}
+	sortEntries(doc.Entries)
+	return doc, resp.Header.Get("ETag"), nil
+}
+
+// save writes the store object if it still has the given ETag, or, when the
+// ETag is empty, if it does not exist yet.
+func (s *s3Store) save(doc *s3Document, etag string) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+	resp, err := s.do(http.MethodPut, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return errS3Conflict
+	}
+	return s3error(resp)
+}
+
+// do sends a request for the store object, signed with AWS Signature
+// Version 4.
+func (s *s3Store) do(method string, body []byte, header http.Header) (*http.Response, error) {
+	var u *url.URL
+	if s.endpoint != "" {
+		base, err := url.Parse(s.endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+		}
+		u = base.JoinPath(s.bucket, s.key)
+	} else {
+		u = &url.URL{
+			Scheme: "https",
+			Host:   fmt.Sprintf("%s.s3.%s.amazonaws.com", s.bucket, s.region),
+			Path:   "/" + s.key,
+		}
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body, "s3", time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign signs the request for the service with AWS Signature Version 4.
+func (c awsCredentials) sign(req *http.Request, body []byte, service string, now time.Time) {
+	amzdate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256hex(body)
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, c.region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		sha256hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacsha256([]byte("AWS4"+c.secretKey), date)
+	key = hmacsha256(key, c.region)
+	key = hmacsha256(key, service)
+	key = hmacsha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacsha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+func sha256hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacsha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3error(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("S3 request failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
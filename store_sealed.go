@@ -0,0 +1,149 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sealedStorePrefix marks a --db value as a sealed store file.
+const sealedStorePrefix = "sealed:"
+
+// sealedStoreMagic prefixes the files of sealed stores.
+const sealedStoreMagic = "OTPSEALED1\n"
+
+// sealedStore keeps all entries in a single file encrypted as a whole with
+// the private key, so whoever copies the file learns neither the accounts
+// and issuers nor how many entries there are.
+type sealedStore struct {
+	fn   string
+	priv *privkey
+	*memStore
+}
+
+func init() {
+	registerStore("sealed", storeBackend{
+		Open: func(fn string, opts storeOptions) (store, error) {
+			return opensealedstore(sealedStorePath(fn), opts.privateKey)
+		},
+		Init: func(fn string, opts storeOptions) error {
+			return initsealedstore(sealedStorePath(fn), opts.privateKey)
+		},
+		Path: sealedStorePath,
+	})
+}
+
+func sealedStorePath(fn string) string {
+	return expandHome(strings.TrimPrefix(fn, sealedStorePrefix))
+}
+
+func initsealedstore(fn, keyfn string) error {
+	if _, err := os.Stat(fn); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	priv, err := privkeyfile(keyfn)
+	if err != nil {
+		return err
+	}
+	s := &sealedStore{fn: fn, priv: priv, memStore: newmemstore(nil)}
+	return s.save()
+}
+
+func opensealedstore(fn, keyfn string) (*sealedStore, error) {
+	sealed, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("store %s is %w", fn, errNotInitialized)
+	} else if err != nil {
+		return nil, err
+	}
+	priv, err := privkeyfile(keyfn)
+	if err != nil {
+		return nil, err
+	}
+	data, err := priv.unseal(sealedStoreMagic, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open store %s: %w", fn, err)
+	}
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid store %s: %w", fn, err)
+	}
+	return &sealedStore{fn: fn, priv: priv, memStore: newmemstore(entries)}, nil
+}
+
+func (s *sealedStore) save() error {
+	entries, _ := s.memStore.List()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.priv.seal(sealedStoreMagic, data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.fn, sealed, 0o600)
+}
+
+func (s *sealedStore) Put(e entry) error {
+	return s.Tx(func(tx store) error {
+		return tx.Put(e)
+	})
+}
+
+func (s *sealedStore) Delete(account, issuer string) error {
+	return s.Tx(func(tx store) error {
+		return tx.Delete(account, issuer)
+	})
+}
+
+// Tx rewrites the store file once fn succeeds. The in-memory entries are
+// left untouched if the file cannot be written.
+func (s *sealedStore) Tx(fn func(store) error) error {
+	old := s.memStore.entries
+	if err := s.memStore.Tx(fn); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.memStore.entries = old
+		return err
+	}
+	return nil
+}
+
+// Snapshot copies the store file, which stays sealed.
+func (s *sealedStore) Snapshot(dst string) error {
+	sealed, err := os.ReadFile(s.fn)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, sealed, 0o600)
+}
+
+// Rekey seals the store again with the new private key.
+func (s *sealedStore) Rekey(priv *privkey) error {
+	old := s.priv
+	s.priv = priv
+	if err := s.save(); err != nil {
+		s.priv = old
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// sqlDialect holds the statements that differ between the SQL databases.
+type sqlDialect struct {
+	driver string
+	// dsn converts the --db value into the DSN understood by the driver.
+	dsn         func(string) string
+	schema      []string
+	initialized string
+	get         string
+	list        string
+	put         string
+	delete      string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	// The SQLite schema is managed by the migrations in db.go.
+	"sqlite": {
+		get:    "SELECT `account`, `issuer`, `password` FROM `otps` WHERE `issuer` = ? AND `account` = ?;",
+		list:   "SELECT `account`, `issuer`, `password` FROM `otps` ORDER BY `account` ASC, `issuer` ASC;",
+		put:    "REPLACE INTO `otps` (`issuer`, `account`, `password`) VALUES (?, ?, ?);",
+		delete: "DELETE FROM `otps` WHERE `issuer` = ? AND `account` = ?;",
+	},
+	"postgres": {
+		driver: "postgres",
+		dsn:    func(fn string) string { return fn },
+		schema: []string{
+			`CREATE TABLE IF NOT EXISTS otps (id SERIAL PRIMARY KEY, account VARCHAR(255) NOT NULL, issuer VARCHAR(255) NOT NULL, password BYTEA NOT NULL);`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS otps_account_issuer ON otps(account, issuer);`,
+		},
+		initialized: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'otps';`,
+		get:         `SELECT account, issuer, password FROM otps WHERE issuer = $1 AND account = $2;`,
+		list:        `SELECT account, issuer, password FROM otps ORDER BY account ASC, issuer ASC;`,
+		put:         `INSERT INTO otps (issuer, account, password) VALUES ($1, $2, $3) ON CONFLICT (account, issuer) DO UPDATE SET password = EXCLUDED.password;`,
+		delete:      `DELETE FROM otps WHERE issuer = $1 AND account = $2;`,
+	},
+	"mysql": {
+		driver: "mysql",
+		dsn:    func(fn string) string { return strings.TrimPrefix(fn, "mysql://") },
+		schema: []string{
+			"CREATE TABLE IF NOT EXISTS `otps` (`id` INTEGER AUTO_INCREMENT PRIMARY KEY, `account` VARCHAR(255) NOT NULL, `issuer` VARCHAR(255) NOT NULL, `password` BLOB NOT NULL, UNIQUE KEY `otps_account_issuer` (`account`, `issuer`));",
+		},
+		initialized: "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'otps';",
+		get:         "SELECT `account`, `issuer`, `password` FROM `otps` WHERE `issuer` = ? AND `account` = ?;",
+		list:        "SELECT `account`, `issuer`, `password` FROM `otps` ORDER BY `account` ASC, `issuer` ASC;",
+		put:         "REPLACE INTO `otps` (`issuer`, `account`, `password`) VALUES (?, ?, ?);",
+		delete:      "DELETE FROM `otps` WHERE `issuer` = ? AND `account` = ?;",
+	},
+}
+
+// sqlStore keeps the entries in a PostgreSQL or MySQL database, so a team can
+// share a store. The server only ever sees the encrypted secrets.
+type sqlStore struct {
+	db *sql.DB
+	// q is db, or the transaction within Tx.
+	q       querier
+	dialect sqlDialect
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func init() {
+	for _, scheme := range []string{"postgres", "postgresql", "mysql"} {
+		kind := scheme
+		if kind == "postgresql" {
+			kind = "postgres"
+		}
+		registerStore(scheme, storeBackend{
+			Open: func(fn string, opts storeOptions) (store, error) {
+				return opensqlstore(kind, fn)
+			},
+			Init: func(fn string, _ storeOptions) error {
+				return initsqlstore(kind, fn)
+			},
+			Path: func(string) string {
+				// Network stores are neither locked nor backed
+				// up locally.
+				return ""
+			},
+			Redact: redactDSN,
+		})
+	}
+}
+
+// redactDSN hides the password of a PostgreSQL or MySQL store name.
+func redactDSN(fn string) string {
+	if dsn, ok := strings.CutPrefix(fn, "mysql://"); ok {
+		if at := strings.LastIndex(dsn, "@"); at >= 0 {
+			if colon := strings.Index(dsn[:at], ":"); colon >= 0 {
+				return "mysql://" + dsn[:colon] + ":xxxxx" + dsn[at:]
+			}
+		}
+		return fn
+	}
+	if u, err := url.Parse(fn); err == nil {
+		return u.Redacted()
+	}
+	return fn
+}
+
+func initsqlstore(kind, fn string) error {
+	dialect := sqlDialects[kind]
+	db, err := sql.Open(dialect.driver, dialect.dsn(fn))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, q := range dialect.schema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func opensqlstore(kind, fn string) (*sqlStore, error) {
+	dialect := sqlDialects[kind]
+	db, err := sql.Open(dialect.driver, dialect.dsn(fn))
+	if err != nil {
+		return nil, err
+	}
+	var tables int
+	if err := db.QueryRow(dialect.initialized).Scan(&tables); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open store: %w", err)
+	}
+	if tables == 0 {
+		db.Close()
+		return nil, fmt.Errorf("store %s is %w", kind, errNotInitialized)
+	}
+	return &sqlStore{db: db, q: db, dialect: dialect}, nil
+}
+
+func (s *sqlStore) Get(account, issuer string) (entry, error) {
+	var e entry
+	err := s.q.QueryRow(s.dialect.get, issuer, account).Scan(&e.Account, &e.Issuer, &e.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry{}, errNotFound
+	}
+	return e, err
+}
+
+func (s *sqlStore) List() ([]entry, error) {
+	rows, err := s.q.Query(s.dialect.list)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.Account, &e.Issuer, &e.Password); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlStore) Put(e entry) error {
+	_, err := s.q.Exec(s.dialect.put, e.Issuer, e.Account, e.Password)
+	return err
+}
+
+func (s *sqlStore) Delete(account, issuer string) error {
+	_, err := s.q.Exec(s.dialect.delete, issuer, account)
+	return err
+}
+
+func (s *sqlStore) Tx(fn func(store) error) error {
+	if _, ok := s.q.(*sql.Tx); ok {
+		return fn(s)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqlStore{db: s.db, q: tx, dialect: s.dialect}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Close() error {
+	if _, ok := s.q.(*sql.Tx); ok {
+		return nil
+	}
+	return s.db.Close()
+}
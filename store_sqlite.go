@@ -0,0 +1,65 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+func init() {
+	registerStore("sqlite", storeBackend{
+		Open: func(fn string, opts storeOptions) (store, error) {
+			open := opendb
+			if opts.readOnly {
+				open = openreadonly
+			}
+			db, err := open(strings.TrimPrefix(fn, "sqlite:"))
+			if err != nil {
+				return nil, err
+			}
+			return newsqlitestore(db), nil
+		},
+		Init: func(fn string, _ storeOptions) error {
+			db, err := sqlopen(strings.TrimPrefix(fn, "sqlite:"))
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return migrate(db)
+		},
+		Path: func(fn string) string {
+			return strings.TrimPrefix(fn, "sqlite:")
+		},
+	})
+}
+
+// sqliteStore keeps the entries in a SQLite database.
+type sqliteStore struct {
+	*sqlStore
+}
+
+func newsqlitestore(db *sql.DB) *sqliteStore {
+	return &sqliteStore{&sqlStore{db: db, q: db, dialect: sqlDialects["sqlite"]}}
+}
+
+func (s *sqliteStore) Snapshot(dst string) error {
+	return snapshot(s.db, dst)
+}
+
+// IntegrityCheck runs SQLite's own consistency checks.
+func (s *sqliteStore) IntegrityCheck() ([]string, error) {
+	return integrityCheck(s.db)
+}
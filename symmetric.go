@@ -0,0 +1,110 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// symmetricKey encrypts the secrets with AES-256-GCM, under a key derived
+// from a secret the key backend gets from elsewhere: an item of the Keychain
+// or of the Secret Service, a DPAPI blob, the hmac-secret of a security key,
+// or the signature of an ssh-agent.
+type symmetricKey struct {
+	pub symmetricPublic
+	// secret is the secret the key is derived from.
+	secret []byte
+	key    []byte
+}
+
+// symmetricPublic is the public key of a symmetricKey: the kind of its key
+// backend and a fingerprint that tells its secret apart.
+type symmetricPublic struct {
+	kindName, fpr string
+}
+
+func (p symmetricPublic) Equal(o crypto.PublicKey) bool {
+	return p == o
+}
+
+func (p symmetricPublic) fingerprint() string {
+	return p.fpr
+}
+
+func (p symmetricPublic) kind() string {
+	return p.kindName
+}
+
+// newsymmetrickey derives the key from the secret, with info naming the key
+// backend so different backends never derive the same key.
+func newsymmetrickey(kind, fpr string, secret []byte, info string) (*symmetricKey, error) {
+	key := make([]byte, 32)
+	mlock(key)
+	kdf := hkdf.New(sha256.New, secret, nil, []byte(info))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return &symmetricKey{pub: symmetricPublic{kindName: kind, fpr: fpr}, secret: secret, key: key}, nil
+}
+
+// symmetricSecret is where a key backend keeps the random secret of its
+// symmetricKey.
+type symmetricSecret struct {
+	// load returns the secret, or errNotFound when there is none yet.
+	load func() ([]byte, error)
+	// store keeps a new secret.
+	store func(secret []byte) error
+}
+
+// opensymmetrickey loads the secret, and makes and stores a new one when
+// there is none yet. The fingerprint is the SHA-256 of the secret.
+func opensymmetrickey(kind, info string, s symmetricSecret) (*symmetricKey, error) {
+	secret, err := s.load()
+	if errors.Is(err, errNotFound) {
+		secret = randomBytes(32)
+		err = s.store(secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("not an otp %s secret", kind)
+	}
+	sum := sha256.Sum256(secret)
+	return newsymmetrickey(kind, "SHA256:"+base64.RawStdEncoding.EncodeToString(sum[:]), secret, info)
+}
+
+func (k *symmetricKey) public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *symmetricKey) material() ([]byte, error) {
+	return k.secret, nil
+}
+
+func (k *symmetricKey) encrypted(in, label []byte) ([]byte, error) {
+	return sealGCM(k.key, in, label)
+}
+
+func (k *symmetricKey) decrypted(in, label []byte) ([]byte, error) {
+	return openGCM(k.key, in, label)
+}
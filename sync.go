@@ -0,0 +1,465 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// syncOpMagic prefixes the sealed operations of the sync logs.
+const syncOpMagic = "OTPSYNC1\n"
+
+// syncLogExt is the extension of the operation logs in the sync directory.
+const syncLogExt = ".oplog"
+
+// syncOp is an entry of an operation log. Password is nil for deletions.
+type syncOp struct {
+	Time     int64  `json:"time"`
+	Device   string `json:"device"`
+	Account  string `json:"account"`
+	Issuer   string `json:"issuer"`
+	Password []byte `json:"password,omitempty"`
+}
+
+// syncVersion identifies the operation that last changed an entry.
+type syncVersion struct {
+	Time   int64  `json:"time"`
+	Device string `json:"device"`
+}
+
+func (v syncVersion) newer(o syncVersion) bool {
+	if v.Time != o.Time {
+		return v.Time > o.Time
+	}
+	return v.Device > o.Device
+}
+
+// syncState is what a device remembers between syncs. It is kept next to the
+// store, in <store>.sync.
+type syncState struct {
+	Device string `json:"device"`
+	// Key is the Ed25519 seed with which the device authenticates to sync
+	// servers.
+	Key []byte `json:"key,omitempty"`
+	// Offsets are how far the log of each device was read.
+	Offsets map[string]int64 `json:"offsets"`
+	// Entries are the version and the checksum of the encrypted secret
+	// of every entry as of the last sync, keyed by issuer and account.
+	Entries map[string]syncEntry `json:"entries"`
+}
+
+type syncEntry struct {
+	Version syncVersion `json:"version"`
+	Sum     string      `json:"sum,omitempty"`
+}
+
+func syncKey(account, issuer string) string {
+	return issuer + "/" + account
+}
+
+func passwordSum(pw []byte) string {
+	if pw == nil {
+		return ""
+	}
+	return sha256hex(pw)
+}
+
+func syncstore() cli.Command {
+	return cli.Command{
+		Name:      "sync",
+		Usage:     "merge the changes of other devices through a shared directory or a sync server",
+		ArgsUsage: "`directory-or-url`",
+		Description: `Each device appends the changes made to its store since the previous sync
+   to its own operation log in the directory, which is meant to be shared
+   with a file synchronization tool or a network drive, and replays the
+   changes found in the logs of the other devices. The operations are
+   sealed with the private key, which all devices must share.
+
+   When an entry was changed both locally and by another device since the
+   last sync, the latest change wins; local changes count as made at the
+   time of the sync. With --interactive, the user chooses instead.
+
+   Instead of a directory, the logs can be kept by a server started with
+   "otp serve-sync", given as an http:// or https:// URL. The server only
+   ever sees sealed operations, and devices authenticate with their own
+   key, which is created on the first sync. --show-device prints the line to
+   add to the devices file of the server.`,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "interactive, i",
+				Usage: "ask which change to keep when an entry was changed on both sides",
+			},
+			cli.BoolFlag{
+				Name:  "show-device",
+				Usage: "print the identity of this device for the devices file of a sync server, and exit",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			path := storePath(c)
+			if path == "" {
+				return fmt.Errorf("store %s is already shared and cannot be synced", storeName(c))
+			}
+			statefn := path + ".sync"
+			if c.Bool("show-device") {
+				return showDevice(c, statefn)
+			}
+			target := c.Args().First()
+			if target == "" {
+				return errors.New("directory or server is missing")
+			}
+			priv, err := privkeyfile(c.GlobalString("private-key"))
+			if err != nil {
+				return err
+			}
+
+			unlock, err := lockdb(c)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			s, err := openstore(c, true)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+
+			state, err := loadSyncState(statefn)
+			if err != nil {
+				return err
+			}
+			var remote syncRemote = dirRemote(target)
+			if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+				remote, err = newhttpremote(target, state)
+				if err != nil {
+					return err
+				}
+			}
+			sy := &syncer{
+				remote:      remote,
+				priv:        priv,
+				state:       state,
+				interactive: c.Bool("interactive"),
+			}
+			ops, err := sy.readLogs()
+			if err != nil {
+				return err
+			}
+			if len(ops) > 0 {
+				if err := autobackup(c, s); err != nil {
+					return err
+				}
+			}
+			var applied, published int
+			err = s.Tx(func(tx store) error {
+				var err error
+				applied, published, err = sy.merge(tx, ops)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if err := writeJSONFile(statefn, state); err != nil {
+				return err
+			}
+			log.Printf("sync: %d changes received, %d changes sent", applied, published)
+			runPostHook(c, "post-sync", "OTP_SYNC_TARGET="+target, "OTP_SYNC_RECEIVED="+strconv.Itoa(applied), "OTP_SYNC_SENT="+strconv.Itoa(published))
+			return nil
+		},
+	}
+}
+
+type syncer struct {
+	remote      syncRemote
+	priv        *privkey
+	state       *syncState
+	interactive bool
+}
+
+func loadSyncState(fn string) (*syncState, error) {
+	state := &syncState{
+		Offsets: make(map[string]int64),
+		Entries: make(map[string]syncEntry),
+	}
+	data, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		device := make([]byte, 8)
+		if _, err := rand.Read(device); err != nil {
+			return nil, err
+		}
+		state.Device = hex.EncodeToString(device)
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid sync state %s: %w", fn, err)
+	}
+	return state, nil
+}
+
+func writeJSONFile(fn string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, data, 0o600)
+}
+
+// readLogs returns the operations of the other devices that were not read
+// yet, in the order they were made.
+func (sy *syncer) readLogs() ([]syncOp, error) {
+	devices, err := sy.remote.devices()
+	if err != nil {
+		return nil, err
+	}
+	var ops []syncOp
+	for _, device := range devices {
+		offset, known := sy.state.Offsets[device]
+		if device == sy.state.Device {
+			if !known {
+				// Logs written before the offset of the own log
+				// was tracked.
+				data, err := sy.remote.read(device, 0)
+				if err != nil {
+					return nil, err
+				}
+				sy.state.Offsets[device] = int64(len(data))
+			}
+			continue
+		}
+		data, err := sy.remote.read(device, offset)
+		if err != nil {
+			return nil, err
+		}
+		// The last line may still be being written.
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			op, err := sy.openOp(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid operation in the log of device %s: %w", device, err)
+			}
+			ops = append(ops, op)
+		}
+		sy.state.Offsets[device] = offset + int64(len(data))
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		return syncVersion{ops[j].Time, ops[j].Device}.newer(syncVersion{ops[i].Time, ops[i].Device})
+	})
+	return ops, nil
+}
+
+func (sy *syncer) openOp(line []byte) (syncOp, error) {
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return syncOp{}, err
+	}
+	data, err := sy.priv.unseal(syncOpMagic, sealed)
+	if err != nil {
+		return syncOp{}, err
+	}
+	var op syncOp
+	err = json.Unmarshal(data, &op)
+	return op, err
+}
+
+// merge applies the operations of the other devices to the store, and
+// publishes the local changes made since the previous sync. It returns how
+// many operations were applied and published.
+func (sy *syncer) merge(s store, remote []syncOp) (applied, published int, err error) {
+	entries, err := s.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	local := make(map[string]*entry)
+	for k, known := range sy.state.Entries {
+		if known.Sum != "" {
+			// Deleted since the previous sync, unless listed below.
+			local[k] = nil
+		}
+	}
+	for _, e := range entries {
+		k := syncKey(e.Account, e.Issuer)
+		if sy.state.Entries[k].Sum == passwordSum(e.Password) {
+			delete(local, k)
+			continue
+		}
+		local[k] = &e
+	}
+
+	for _, op := range remote {
+		k := syncKey(op.Account, op.Issuer)
+		version := syncVersion{op.Time, op.Device}
+		if !version.newer(sy.state.Entries[k].Version) {
+			continue
+		}
+		if change, conflict := local[k]; conflict {
+			keepLocal := true
+			if sy.interactive {
+				keepLocal, err = sy.askKeepLocal(op, change)
+				if err != nil {
+					return applied, published, err
+				}
+			}
+			if keepLocal {
+				continue
+			}
+			delete(local, k)
+		}
+		if op.Password == nil {
+			err = s.Delete(op.Account, op.Issuer)
+		} else {
+			err = s.Put(entry{Account: op.Account, Issuer: op.Issuer, Password: op.Password})
+		}
+		if err != nil {
+			return applied, published, err
+		}
+		sy.state.Entries[k] = syncEntry{Version: version, Sum: passwordSum(op.Password)}
+		applied++
+	}
+
+	var ops []syncOp
+	now := time.Now().UnixNano()
+	for k, e := range local {
+		op := syncOp{Time: now, Device: sy.state.Device}
+		if e == nil {
+			op.Issuer, op.Account, _ = strings.Cut(k, "/")
+		} else {
+			op.Account, op.Issuer, op.Password = e.Account, e.Issuer, e.Password
+		}
+		ops = append(ops, op)
+		sy.state.Entries[k] = syncEntry{Version: syncVersion{op.Time, op.Device}, Sum: passwordSum(op.Password)}
+	}
+	return applied, len(ops), sy.appendLog(ops)
+}
+
+func (sy *syncer) askKeepLocal(op syncOp, change *entry) (bool, error) {
+	local, remote := "changed", "changed"
+	if change == nil {
+		local = "deleted"
+	}
+	if op.Password == nil {
+		remote = "deleted"
+	}
+	when := time.Unix(0, op.Time).Format(time.RFC3339)
+	keepRemote, err := confirm(fmt.Sprintf("%s/%s was %s here and %s by device %s at %s. take the change of the other device?",
+		op.Issuer, op.Account, local, remote, op.Device, when))
+	return !keepRemote, err
+}
+
+func (sy *syncer) appendLog(ops []syncOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, op := range ops {
+		data, err := json.Marshal(op)
+		if err != nil {
+			return err
+		}
+		sealed, err := sy.priv.seal(syncOpMagic, data)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(base64.StdEncoding.EncodeToString(sealed))
+		buf.WriteByte('\n')
+	}
+	if err := sy.remote.append(sy.state.Device, sy.state.Offsets[sy.state.Device], buf.Bytes()); err != nil {
+		return err
+	}
+	sy.state.Offsets[sy.state.Device] += int64(buf.Len())
+	return nil
+}
+
+// syncRemote is where the operation logs of the devices are kept.
+type syncRemote interface {
+	// devices lists the devices that have a log.
+	devices() ([]string, error)
+	// read returns the log of the device from the offset on.
+	read(device string, offset int64) ([]byte, error)
+	// append adds the data to the log of the device, which must be
+	// offset bytes long.
+	append(device string, offset int64, data []byte) error
+}
+
+// errSyncLogChanged is returned when appending to a log that does not have
+// the expected length.
+var errSyncLogChanged = errors.New("operation log changed unexpectedly")
+
+// dirRemote keeps the operation logs in a directory, as <device>.oplog.
+type dirRemote string
+
+func (dir dirRemote) devices() ([]string, error) {
+	logs, err := filepath.Glob(filepath.Join(string(dir), "*"+syncLogExt))
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]string, len(logs))
+	for i, fn := range logs {
+		devices[i] = strings.TrimSuffix(filepath.Base(fn), syncLogExt)
+	}
+	return devices, nil
+}
+
+func (dir dirRemote) read(device string, offset int64) ([]byte, error) {
+	fd, err := os.Open(filepath.Join(string(dir), device+syncLogExt))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(fd)
+}
+
+func (dir dirRemote) append(device string, offset int64, data []byte) error {
+	if err := os.MkdirAll(string(dir), 0o700); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(filepath.Join(string(dir), device+syncLogExt), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := fd.Stat()
+	if err == nil && fi.Size() != offset {
+		err = fmt.Errorf("%w: %d bytes long instead of %d", errSyncLogChanged, fi.Size(), offset)
+	}
+	if err == nil {
+		_, err = fd.Write(data)
+	}
+	return errors.Join(err, fd.Close())
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testDevice is a store that syncs through a shared directory.
+type testDevice struct {
+	t  *testing.T
+	s  *memStore
+	sy *syncer
+}
+
+func newTestDevice(t *testing.T, name string, dir dirRemote, priv *privkey) *testDevice {
+	return &testDevice{
+		t: t,
+		s: newmemstore(nil),
+		sy: &syncer{
+			remote: dir,
+			priv:   priv,
+			state: &syncState{
+				Device:  name,
+				Offsets: make(map[string]int64),
+				Entries: make(map[string]syncEntry),
+			},
+		},
+	}
+}
+
+// sync does what otp sync does, and returns how many operations were
+// applied and published.
+func (d *testDevice) sync() (applied, published int) {
+	d.t.Helper()
+	ops, err := d.sy.readLogs()
+	if err != nil {
+		d.t.Fatalf("%s: readLogs: %v", d.sy.state.Device, err)
+	}
+	err = d.s.Tx(func(tx store) error {
+		var err error
+		applied, published, err = d.sy.merge(tx, ops)
+		return err
+	})
+	if err != nil {
+		d.t.Fatalf("%s: merge: %v", d.sy.state.Device, err)
+	}
+	return applied, published
+}
+
+func (d *testDevice) put(account, issuer, password string) {
+	d.s.Put(entry{Account: account, Issuer: issuer, Password: []byte(password)})
+}
+
+// entries returns the entries as issuer/account=password.
+func (d *testDevice) entries() []string {
+	entries, _ := d.s.List()
+	out := []string{}
+	for _, e := range entries {
+		out = append(out, syncKey(e.Account, e.Issuer)+"="+string(e.Password))
+	}
+	return out
+}
+
+func TestSyncMerge(t *testing.T) {
+	dir := dirRemote(t.TempDir())
+	priv := &privkey{testSignerKey(t, testEd25519Key(t))}
+	a := newTestDevice(t, "a", dir, priv)
+	b := newTestDevice(t, "b", dir, priv)
+
+	a.put("alice", "GitHub", "a1")
+	a.put("alice", "GitLab", "a1")
+	a.put("bob", "GitHub", "a1")
+	if applied, published := a.sync(); applied != 0 || published != 3 {
+		t.Fatalf("first sync of a: %d applied, %d published; want 0, 3", applied, published)
+	}
+	if applied, published := b.sync(); applied != 3 || published != 0 {
+		t.Fatalf("first sync of b: %d applied, %d published; want 3, 0", applied, published)
+	}
+	want := []string{"GitHub/alice=a1", "GitLab/alice=a1", "GitHub/bob=a1"}
+	if got := b.entries(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("b after the first sync = %q, want %q", got, want)
+	}
+
+	// Both devices diverge: a changes GitHub/alice and deletes
+	// GitLab/alice, which b changes; b deletes GitHub/bob and adds
+	// GitHub/carol.
+	a.put("alice", "GitHub", "a2")
+	a.s.Delete("alice", "GitLab")
+	b.put("alice", "GitLab", "b2")
+	b.s.Delete("bob", "GitHub")
+	b.put("carol", "GitHub", "b2")
+	a.sync()
+	b.sync()
+	a.sync()
+
+	// b synced last, so its change of GitLab/alice wins over the
+	// deletion by a.
+	want = []string{"GitHub/alice=a2", "GitLab/alice=b2", "GitHub/carol=b2"}
+	if got := a.entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("a after merging = %q, want %q", got, want)
+	}
+	if got := b.entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("b after merging = %q, want %q", got, want)
+	}
+
+	// Nothing left to exchange.
+	if applied, published := a.sync(); applied != 0 || published != 0 {
+		t.Errorf("idle sync of a: %d applied, %d published; want 0, 0", applied, published)
+	}
+	if applied, published := b.sync(); applied != 0 || published != 0 {
+		t.Errorf("idle sync of b: %d applied, %d published; want 0, 0", applied, published)
+	}
+
+	// Replaying logs that were already applied changes nothing.
+	for device := range a.sy.state.Offsets {
+		if device != "a" {
+			a.sy.state.Offsets[device] = 0
+		}
+	}
+	if applied, published := a.sync(); applied != 0 || published != 0 {
+		t.Errorf("replay on a: %d applied, %d published; want 0, 0", applied, published)
+	}
+	if got := a.entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("a after the replay = %q, want %q", got, want)
+	}
+
+	// A new device replays every log, and ends up with the same entries.
+	c := newTestDevice(t, "c", dir, priv)
+	c.sync()
+	if got := c.entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("new device = %q, want %q", got, want)
+	}
+}
+
+func TestSyncMergeOrder(t *testing.T) {
+	dir := dirRemote(t.TempDir())
+	priv := &privkey{testSignerKey(t, testEd25519Key(t))}
+	b := newTestDevice(t, "b", dir, priv)
+	c := newTestDevice(t, "c", dir, priv)
+
+	// The logs of b and c interleave in time; the entries end as the
+	// latest operation left them, whichever log holds it.
+	err := b.sy.appendLog([]syncOp{
+		{Time: 100, Device: "b", Account: "alice", Issuer: "GitHub", Password: []byte("b100")},
+		{Time: 300, Device: "b", Account: "alice", Issuer: "GitHub"},
+		{Time: 400, Device: "b", Account: "bob", Issuer: "GitHub", Password: []byte("b400")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.sy.appendLog([]syncOp{
+		{Time: 200, Device: "c", Account: "alice", Issuer: "GitHub", Password: []byte("c200")},
+		{Time: 400, Device: "c", Account: "bob", Issuer: "GitHub", Password: []byte("c400")},
+		{Time: 500, Device: "c", Account: "carol", Issuer: "GitHub", Password: []byte("c500")},
+		{Time: 100, Device: "c", Account: "carol", Issuer: "GitHub"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestDevice(t, "a", dir, priv)
+	ops, err := a.sy.readLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(ops); i++ {
+		prev := syncVersion{ops[i-1].Time, ops[i-1].Device}
+		if prev.newer(syncVersion{ops[i].Time, ops[i].Device}) {
+			t.Fatalf("operation %d (%d, %s) comes after a newer one", i, ops[i].Time, ops[i].Device)
+		}
+	}
+	for _, device := range []string{"b", "c"} {
+		a.sy.state.Offsets[device] = 0
+	}
+	if applied, _ := a.sync(); applied != len(ops) {
+		t.Errorf("%d operations applied, want %d", applied, len(ops))
+	}
+	// GitHub/alice was deleted last; GitHub/bob was changed by both at
+	// the same time, and the device ID breaks the tie.
+	want := []string{"GitHub/bob=c400", "GitHub/carol=c500"}
+	if got := a.entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
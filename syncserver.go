@@ -0,0 +1,382 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// syncAuthScheme is the scheme of the Authorization header of the requests
+// made to sync servers.
+const syncAuthScheme = "OTP-Ed25519"
+
+// syncClockSkew bounds how old or how far in the future the timestamp of a
+// signed request may be.
+const syncClockSkew = 5 * time.Minute
+
+// syncMaxAppend bounds the size of the operations appended at once.
+const syncMaxAppend = 16 << 20
+
+var validDevice = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// deviceKey returns the key with which the device authenticates to sync
+// servers, creating it if needed.
+func deviceKey(state *syncState) (ed25519.PrivateKey, error) {
+	if len(state.Key) == 0 {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		state.Key = seed
+	}
+	if len(state.Key) != ed25519.SeedSize {
+		return nil, errors.New("invalid device key in sync state")
+	}
+	return ed25519.NewKeyFromSeed(state.Key), nil
+}
+
+// showDevice prints the line of the device for the devices file of a sync
+// server.
+func showDevice(c *cli.Context, statefn string) error {
+	unlock, err := lockdb(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := loadSyncState(statefn)
+	if err != nil {
+		return err
+	}
+	key, err := deviceKey(state)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(statefn, state); err != nil {
+		return err
+	}
+	fmt.Println(state.Device, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	return nil
+}
+
+// syncSigningString is what devices sign to authenticate a request.
+func syncSigningString(method, uri, timestamp string, body []byte) []byte {
+	return []byte(strings.Join([]string{method, uri, timestamp, sha256hex(body)}, "\n"))
+}
+
+// httpRemote keeps the operation logs in a sync server.
+type httpRemote struct {
+	base   *url.URL
+	device string
+	key    ed25519.PrivateKey
+	client *http.Client
+}
+
+func newhttpremote(server string, state *syncState) (*httpRemote, error) {
+	base, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deviceKey(state)
+	if err != nil {
+		return nil, err
+	}
+	return &httpRemote{
+		base:   base,
+		device: state.Device,
+		key:    key,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (r *httpRemote) do(method, path string, query url.Values, body []byte) ([]byte, error) {
+	u := r.base.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := ed25519.Sign(r.key, syncSigningString(method, req.URL.RequestURI(), timestamp, body))
+	req.Header.Set("Authorization", fmt.Sprintf("%s device=%s, timestamp=%s, signature=%s",
+		syncAuthScheme, r.device, timestamp, base64.StdEncoding.EncodeToString(sig)))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return data, nil
+	case http.StatusConflict:
+		return nil, fmt.Errorf("%w: %s", errSyncLogChanged, bytes.TrimSpace(data))
+	}
+	return nil, fmt.Errorf("sync server: %s: %s", resp.Status, bytes.TrimSpace(data))
+}
+
+func (r *httpRemote) devices() ([]string, error) {
+	data, err := r.do(http.MethodGet, "/v1/logs", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var devices []string
+	err = json.Unmarshal(data, &devices)
+	return devices, err
+}
+
+func (r *httpRemote) read(device string, offset int64) ([]byte, error) {
+	return r.do(http.MethodGet, "/v1/logs/"+device, url.Values{"offset": {strconv.FormatInt(offset, 10)}}, nil)
+}
+
+func (r *httpRemote) append(device string, offset int64, data []byte) error {
+	_, err := r.do(http.MethodPost, "/v1/logs/"+device, url.Values{"offset": {strconv.FormatInt(offset, 10)}}, data)
+	return err
+}
+
+func servesync() cli.Command {
+	return cli.Command{
+		Name:  "serve-sync",
+		Usage: "serve the operation logs of otp sync to other devices",
+		Description: `The server keeps the sealed operation logs of the devices, as a shared
+   directory would, without ever holding the private key. Only the devices
+   listed in the devices file are served; each line holds the identity of a
+   device, as printed by "otp sync --show-device". The file is read again on
+   every request, so devices can be added while the server runs.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "listen",
+				Value: ":8443",
+				Usage: "address to listen on",
+			},
+			cli.StringFlag{
+				Name:  "data",
+				Usage: "directory of the operation logs",
+			},
+			cli.StringFlag{
+				Name:  "devices",
+				Usage: "file with the devices allowed to sync",
+			},
+			cli.StringFlag{
+				Name:  "tls-cert",
+				Usage: "certificate file, to serve HTTPS",
+			},
+			cli.StringFlag{
+				Name:  "tls-key",
+				Usage: "private key file of the certificate",
+			},
+			cli.DurationFlag{
+				Name:  "shutdown-timeout",
+				Value: 10 * time.Second,
+				Usage: "how long to wait for the requests in flight on SIGINT or SIGTERM",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			switch {
+			case c.String("data") == "":
+				return errors.New("--data is missing")
+			case c.String("devices") == "":
+				return errors.New("--devices is missing")
+			}
+			srv := &syncServer{
+				logs:    dirRemote(c.String("data")),
+				devices: c.String("devices"),
+			}
+			if _, err := srv.loadDevices(); err != nil {
+				return err
+			}
+			log.Printf("serving sync on %s", c.String("listen"))
+			hs := &http.Server{Addr: c.String("listen"), Handler: srv}
+			serve := hs.ListenAndServe
+			if c.String("tls-cert") != "" {
+				serve = func() error { return hs.ListenAndServeTLS(c.String("tls-cert"), c.String("tls-key")) }
+			}
+			return serveUntilSignal(hs, serve, c.Duration("shutdown-timeout"))
+		},
+	}
+}
+
+type syncServer struct {
+	logs    dirRemote
+	devices string
+	// mu serializes the appends, so the offsets are checked and moved
+	// atomically, and the changes to the devices file and the pairings.
+	mu       sync.Mutex
+	pairings map[string]time.Time
+}
+
+// loadDevices reads the devices file, which lists the identity and public
+// key of each device, one per line.
+func (srv *syncServer) loadDevices() (map[string]ed25519.PublicKey, error) {
+	fd, err := os.Open(srv.devices)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	devices := make(map[string]ed25519.PublicKey)
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !validDevice.MatchString(fields[0]) {
+			return nil, fmt.Errorf("%s:%d: invalid device", srv.devices, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid device key", srv.devices, n)
+		}
+		devices[fields[0]] = key
+	}
+	return devices, scanner.Err()
+}
+
+// authenticate returns the device that signed the request.
+func (srv *syncServer) authenticate(r *http.Request, body []byte) (string, error) {
+	params, ok := strings.CutPrefix(r.Header.Get("Authorization"), syncAuthScheme+" ")
+	if !ok {
+		return "", errors.New("missing authorization")
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[k] = v
+	}
+	devices, err := srv.loadDevices()
+	if err != nil {
+		log.Println("cannot load devices:", err)
+		return "", errors.New("cannot load devices")
+	}
+	key, ok := devices[fields["device"]]
+	if !ok {
+		return "", errors.New("unknown device")
+	}
+	timestamp, err := strconv.ParseInt(fields["timestamp"], 10, 64)
+	if err != nil {
+		return "", errors.New("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > syncClockSkew || skew < -syncClockSkew {
+		return "", errors.New("timestamp out of range; check the clock of the device")
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields["signature"])
+	if err != nil || !ed25519.Verify(key, syncSigningString(r.Method, r.URL.RequestURI(), fields["timestamp"], body), sig) {
+		return "", errors.New("invalid signature")
+	}
+	return fields["device"], nil
+}
+
+func (srv *syncServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, syncMaxAppend))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if r.URL.Path == "/v1/enroll" && r.Method == http.MethodPost {
+		// New devices authenticate with a pairing token instead.
+		srv.enroll(w, body)
+		return
+	}
+	caller, err := srv.authenticate(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == "/v1/pairing" && r.Method == http.MethodPost {
+		token, err := srv.newPairing()
+		if err != nil {
+			log.Println("cannot create pairing token:", err)
+			http.Error(w, "cannot create pairing token", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("device %s started a pairing", caller)
+		json.NewEncoder(w).Encode(pairingResponse{Token: token})
+		return
+	}
+
+	if r.URL.Path == "/v1/logs" && r.Method == http.MethodGet {
+		devices, err := srv.logs.devices()
+		if err != nil {
+			log.Println("cannot list logs:", err)
+			http.Error(w, "cannot list logs", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(devices)
+		return
+	}
+
+	device, ok := strings.CutPrefix(r.URL.Path, "/v1/logs/")
+	if !ok || !validDevice.MatchString(device) {
+		http.NotFound(w, r)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		data, err := srv.logs.read(device, offset)
+		if err != nil {
+			log.Println("cannot read log:", err)
+			http.Error(w, "cannot read log", http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	case http.MethodPost:
+		if device != caller {
+			http.Error(w, "devices may only append to their own log", http.StatusForbidden)
+			return
+		}
+		srv.mu.Lock()
+		err := srv.logs.append(device, offset, body)
+		srv.mu.Unlock()
+		if errors.Is(err, errSyncLogChanged) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println("cannot append to log:", err)
+			http.Error(w, "cannot append to log", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("device %s appended %d bytes", device, len(body))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/urfave/cli"
+)
+
+// entryTagMagic prefixes the secrets that carry an integrity tag and the
+// fingerprint of the key that encrypted them. Secrets tagged before the
+// fingerprint was recorded start with entryTagV1Magic.
+const (
+	entryTagMagic   = "OTPTAG2\n"
+	entryTagV1Magic = "OTPTAG1\n"
+)
+
+// errTampered tells that the tag does not match the name of the entry. It
+// does not tell about a secret replaced along with its tag: the secrets are
+// encrypted to the public key, so anyone who can write to the store can make
+// an entry of their own.
+var errTampered = errors.New("integrity tag does not match: the entry was renamed or swapped")
+
+// entryTagged is a tagged secret taken apart.
+type entryTagged struct {
+	tag, inner []byte
+	// fingerprint is the fingerprint of the key that encrypted the secret,
+	// nil when it was not recorded.
+	fingerprint []byte
+}
+
+// entryTag binds the account, the issuer, the fingerprint of the key, the
+// private key recorded by add --key and the encrypted secret together, so
+// entries cannot be swapped or renamed by someone who can write to the
+// store. The tag is keyed with the secret itself, so anyone who can decrypt
+// the entry can check it, whatever the key backend and however many
+// recipients the secret is shared with. As it takes no private key, whoever
+// can write to the store can still replace the secret and its tag with
+// their own.
+func entryTag(secret []byte, account, issuer string, fingerprint, ref, password []byte) []byte {
+	mac := hmac.New(sha256.New, hmacsha256(secret, "otp entry tag"))
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(account)))
+	buf = append(buf, account...)
+	buf = binary.AppendUvarint(buf, uint64(len(issuer)))
+	buf = append(buf, issuer...)
+	if fingerprint != nil {
+		buf = binary.AppendUvarint(buf, uint64(len(fingerprint)))
+		buf = append(buf, fingerprint...)
+	}
+	buf = append(buf, ref...)
+	mac.Write(buf)
+	mac.Write(password)
+	return mac.Sum(nil)
+}
+
+// tagged prefixes the secret encrypted by the key with the fingerprint of
+// the key and the integrity tag.
+func tagged(secret []byte, account, issuer string, key crypto.PublicKey, password []byte) []byte {
+	return taggedRef(secret, account, issuer, key, nil, password)
+}
+
+// taggedRef is tagged with the tag also covering the private key recorded by
+// withEntryKey.
+func taggedRef(secret []byte, account, issuer string, key crypto.PublicKey, ref, password []byte) []byte {
+	fp := []byte(fingerprint(key))
+	out := []byte(entryTagMagic)
+	out = binary.AppendUvarint(out, uint64(len(fp)))
+	out = append(out, fp...)
+	out = append(out, entryTag(secret, account, issuer, fp, ref, password)...)
+	return append(out, password...)
+}
+
+// cutTag takes a tagged secret apart, leaving out the private key recorded
+// by add --key.
+func cutTag(password []byte) (entryTagged, bool) {
+	_, _, password, _ = cutEntryKey(password)
+	if rest, ok := bytes.CutPrefix(password, []byte(entryTagV1Magic)); ok && len(rest) >= sha256.Size {
+		return entryTagged{tag: rest[:sha256.Size], inner: rest[sha256.Size:]}, true
+	}
+	rest, ok := bytes.CutPrefix(password, []byte(entryTagMagic))
+	if !ok {
+		return entryTagged{inner: password}, false
+	}
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || uint64(len(rest)-size) < n+sha256.Size {
+		return entryTagged{inner: password}, false
+	}
+	fp := rest[size : size+int(n)]
+	rest = rest[size+int(n):]
+	return entryTagged{tag: rest[:sha256.Size], inner: rest[sha256.Size:], fingerprint: fp}, true
+}
+
+// keyFingerprint returns the fingerprint of the key that encrypted the
+// secret of the entry, or "-" when it was not recorded.
+func keyFingerprint(e entry) string {
+	t, _ := cutTag(e.Password)
+	if t.fingerprint == nil {
+		return "-"
+	}
+	return string(t.fingerprint)
+}
+
+// legacySecret decrypts the secret of the entry like secret does, but also
+// accepts the entries written before integrity tags existed.
+func (p privkey) legacySecret(e entry) ([]byte, error) {
+	if backend, fn, rest, ok := cutEntryKey(e.Password); ok {
+		key, err := readEntryKey(backend, fn)
+		if err != nil {
+			return nil, err
+		}
+		ref := entryKeyRef(e.Password)
+		e.Password = rest
+		return key.taggedSecret(e, ref)
+	}
+	return p.taggedSecret(e, nil)
+}
+
+// taggedSecret decrypts the secret of the entry and checks its tag, which
+// covers the private key recorded by withEntryKey when ref is set.
+func (p privkey) taggedSecret(e entry, ref []byte) ([]byte, error) {
+	t, ok := cutTag(e.Password)
+	e.Password = t.inner
+	secret, err := p.decryptSecret(e)
+	if err != nil || !ok {
+		return secret, err
+	}
+	if !hmac.Equal(t.tag, entryTag(secret, e.Account, e.Issuer, t.fingerprint, ref, t.inner)) {
+		wipe(secret)
+		return nil, errTampered
+	}
+	return secret, nil
+}
+
+// upgradeTags adds the integrity tag to the entries written before tags
+// existed. The private key is only read when the store may have any.
+func upgradeTags(c *cli.Context, s store) error {
+	entries, err := s.List()
+	if err != nil {
+		return err
+	}
+	maybe := false
+	for _, e := range entries {
+		blinded := e.Issuer == encryptedNamesIssuer && bytes.HasPrefix(e.Password, []byte(encryptedNamesMagic))
+		_, ok := cutTag(e.Password)
+		maybe = maybe || blinded || !ok || unboundEntryKey(e.Password)
+	}
+	if !maybe {
+		return nil
+	}
+	priv, err := privkeyfile(c.GlobalString("private-key"))
+	if err != nil {
+		return err
+	}
+	untagged := 0
+	names := &namesStore{base: s, priv: priv}
+	for _, e := range entries {
+		plain, err := names.unseal(e)
+		if err != nil {
+			return err
+		}
+		if _, ok := cutTag(plain.Password); !ok || unboundEntryKey(plain.Password) {
+			untagged++
+		}
+	}
+	if untagged == 0 {
+		return nil
+	}
+	if err := autobackup(c, s); err != nil {
+		return err
+	}
+	err = s.Tx(func(tx store) error {
+		raw, err := tx.List()
+		if err != nil {
+			return err
+		}
+		names := &namesStore{base: tx, priv: priv}
+		for _, e := range raw {
+			plain, err := names.unseal(e)
+			if err != nil {
+				return err
+			}
+			if _, ok := cutTag(plain.Password); ok && !unboundEntryKey(plain.Password) {
+				continue
+			}
+			secret, err := priv.legacySecret(plain)
+			if err != nil {
+				return fmt.Errorf("cannot decrypt key for account %q of issuer %q: %w", plain.Account, plain.Issuer, err)
+			}
+			if backend, fn, rest, ok := cutEntryKey(plain.Password); ok {
+				key, err := readEntryKey(backend, fn)
+				if err != nil {
+					wipe(secret)
+					return err
+				}
+				t, _ := cutTag(rest)
+				plain.Password = withEntryKey(backend, fn, secret, plain.Account, plain.Issuer, key.public(), t.inner)
+			} else {
+				plain.Password = tagged(secret, plain.Account, plain.Issuer, priv.public(), plain.Password)
+			}
+			wipe(secret)
+			names.encrypt = e.Issuer == encryptedNamesIssuer && bytes.HasPrefix(e.Password, []byte(encryptedNamesMagic))
+			if err := names.Put(plain); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Join(errors.New("cannot add integrity tags"), err)
+	}
+	log.Printf("added integrity tags to %d keys", untagged)
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// tmuxCache keeps the codes of otp get --tmux and --waybar until their time
+// step ends, so status lines refreshed every few seconds decrypt the keys
+// once per step.
+type tmuxCache struct {
+	Step  int64     `json:"step"`
+	Codes []apiCode `json:"codes"`
+}
+
+// tmuxCachePath returns the cache of the codes matching the filter. It goes
+// in the runtime directory where there is one, which is private to the
+// user and not kept across reboots.
+func tmuxCachePath(c *cli.Context, filter string) string {
+	sum := sha256.Sum256([]byte(storeName(c) + "\x00" + c.GlobalString("private-key") + "\x00" + filter))
+	name := "tmux-" + hex.EncodeToString(sum[:8]) + ".json"
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "otp-"+name)
+	}
+	return filepath.Join(configDir, name)
+}
+
+// cachedCodes returns the codes matching the filter, from the cache while
+// their time step lasts, and how many seconds they have left.
+func cachedCodes(c *cli.Context, filter string) ([]apiCode, int64, error) {
+	now := time.Now()
+	step := now.Unix() / 30
+	fn := tmuxCachePath(c, filter)
+	var cache tmuxCache
+	if data, err := os.ReadFile(fn); err != nil || json.Unmarshal(data, &cache) != nil || cache.Step != step {
+		codes, _, err := loadCodes(c)
+		if err != nil {
+			return nil, 0, err
+		}
+		cache = tmuxCache{Step: step}
+		for _, code := range codes {
+			if matches(filter, code) {
+				cache.Codes = append(cache.Codes, apiCode{Issuer: code.Issuer, Account: code.Account, Code: code.Code})
+			}
+		}
+		if data, err := json.Marshal(cache); err == nil {
+			// A cache that cannot be written only costs speed.
+			writeFileAtomic(fn, data, 0o600)
+		}
+	}
+	return cache.Codes, 30 - now.Unix()%30, nil
+}
+
+// printTmux prints the codes matching the filter as ISSUER:CODE (12s), on
+// one line, for status lines.
+func printTmux(c *cli.Context, w io.Writer, filter string) error {
+	codes, left, err := cachedCodes(c, filter)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, statusText(codes, left))
+	return err
+}
+
+func statusText(codes []apiCode, left int64) string {
+	out := make([]string, 0, len(codes))
+	for _, code := range codes {
+		out = append(out, fmt.Sprintf("%s:%s (%ds)", code.Issuer, code.Code, left))
+	}
+	return strings.Join(out, " ")
+}
+
+// waybarExpiring is how many seconds before the codes change the waybar
+// output has the expiring class.
+const waybarExpiring = 5
+
+// printWaybar prints the codes matching the filter as the JSON of the custom
+// modules of waybar, whose class is expiring in the last seconds of the
+// codes, or error when they cannot be read.
+func printWaybar(c *cli.Context, w io.Writer, filter string) error {
+	type module struct {
+		Text       string `json:"text"`
+		Tooltip    string `json:"tooltip"`
+		Class      string `json:"class"`
+		Percentage int64  `json:"percentage"`
+	}
+	codes, left, err := cachedCodes(c, filter)
+	if err != nil {
+		// The bar shows the output, not the exit status.
+		return json.NewEncoder(w).Encode(module{Text: "otp: error", Tooltip: err.Error(), Class: "error"})
+	}
+	lines := make([]string, 0, len(codes))
+	for _, code := range codes {
+		lines = append(lines, fmt.Sprintf("%s %s: %s", code.Issuer, code.Account, code.Code))
+	}
+	class := "ok"
+	if left <= waybarExpiring {
+		class = "expiring"
+	}
+	return json.NewEncoder(w).Encode(module{
+		Text:       statusText(codes, left),
+		Tooltip:    strings.Join(lines, "\n"),
+		Class:      class,
+		Percentage: left * 100 / 30,
+	})
+}
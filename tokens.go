@@ -0,0 +1,238 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// API token scopes: read tokens list entries and get codes, write tokens
+// also add and delete entries.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// apiToken is a token of otp token create, as found by checkAPIToken.
+type apiToken struct {
+	id    int64
+	scope string
+}
+
+// tokenPrefix marks the API tokens, so they are easy to tell apart in
+// scripts and to find by secret scanners.
+const tokenPrefix = "otp_"
+
+// hashToken returns the hash API tokens are stored by. Tokens are random,
+// so a fast hash is enough.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// checkAPIToken finds the unexpired API token in the database, or fails
+// with errNotFound.
+func checkAPIToken(c *cli.Context, token string) (apiToken, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return apiToken{}, errNotFound
+	}
+	fn, err := sqlitePath(c)
+	if err != nil {
+		return apiToken{}, err
+	}
+	db, err := openreadonly(fn)
+	if err != nil {
+		return apiToken{}, err
+	}
+	defer db.Close()
+	var t apiToken
+	var expires int64
+	err = db.QueryRow("SELECT `id`, `scope`, `expires` FROM `api_tokens` WHERE `hash` = ?;", hashToken(token)).Scan(&t.id, &t.scope, &expires)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return apiToken{}, errNotFound
+	case err != nil:
+		return apiToken{}, err
+	case expires != 0 && time.Now().Unix() >= expires:
+		return apiToken{}, errNotFound
+	}
+	return t, nil
+}
+
+// parseExpiry parses durations as time.ParseDuration does, plus days, as in
+// 30d.
+func parseExpiry(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid expiry %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid expiry %q", s)
+	}
+	return d, nil
+}
+
+// opensqlite opens the database to manage what, such as its API tokens,
+// which only SQLite databases keep.
+func opensqlite(c *cli.Context, write bool, what string) (*sql.DB, error) {
+	fn, err := sqlitePath(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s are only kept in SQLite databases: %w", what, err)
+	}
+	if write {
+		return opendb(fn)
+	}
+	return openreadonly(fn)
+}
+
+func tokens() cli.Command {
+	return cli.Command{
+		Name:  "token",
+		Usage: "manage the API tokens of otp http and otp grpc-server --api-tokens",
+		Subcommands: []cli.Command{
+			{
+				Name:      "create",
+				Usage:     "create an API token and print it; only its hash is kept",
+				ArgsUsage: "[`name`]",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "scope",
+						Value: scopeRead,
+						Usage: "read to list entries and get codes, or write to also add and delete them",
+					},
+					cli.StringFlag{
+						Name:  "expires",
+						Usage: "lifetime of the token, such as 30d or 12h (default: it does not expire)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					scope := c.String("scope")
+					if scope != scopeRead && scope != scopeWrite {
+						return fmt.Errorf("unknown scope %q: use read or write", scope)
+					}
+					now := time.Now()
+					var expires int64
+					if s := c.String("expires"); s != "" {
+						d, err := parseExpiry(s)
+						if err != nil {
+							return err
+						}
+						expires = now.Add(d).Unix()
+					}
+					unlock, err := lockdb(c)
+					if err != nil {
+						return err
+					}
+					defer unlock()
+					db, err := opensqlite(c, true, "API tokens")
+					if err != nil {
+						return err
+					}
+					defer db.Close()
+					token := tokenPrefix + base64.RawURLEncoding.EncodeToString(randomBytes(32))
+					_, err = db.Exec("INSERT INTO `api_tokens` (`name`, `hash`, `scope`, `created`, `expires`) VALUES (?, ?, ?, ?, ?);",
+						c.Args().First(), hashToken(token), scope, now.Unix(), expires)
+					if err != nil {
+						return err
+					}
+					fmt.Println(token)
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "list the API tokens",
+				Action: func(c *cli.Context) error {
+					db, err := opensqlite(c, false, "API tokens")
+					if err != nil {
+						return err
+					}
+					defer db.Close()
+					rows, err := db.Query("SELECT `id`, `name`, `scope`, `created`, `expires` FROM `api_tokens` ORDER BY `id`;")
+					if err != nil {
+						return err
+					}
+					defer rows.Close()
+					w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+					defer w.Flush()
+					fmt.Fprintln(w, "id\tname\tscope\tcreated\texpires")
+					for rows.Next() {
+						var id, created, expires int64
+						var name sql.NullString
+						var scope string
+						if err := rows.Scan(&id, &name, &scope, &created, &expires); err != nil {
+							return err
+						}
+						expiry := "never"
+						if expires != 0 {
+							expiry = time.Unix(expires, 0).Format(time.DateTime)
+							if time.Now().Unix() >= expires {
+								expiry += " (expired)"
+							}
+						}
+						fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", id, name.String, scope, time.Unix(created, 0).Format(time.DateTime), expiry)
+					}
+					return rows.Err()
+				},
+			},
+			{
+				Name:      "revoke",
+				Usage:     "delete an API token",
+				ArgsUsage: "`id`",
+				Action: func(c *cli.Context) error {
+					id, err := strconv.ParseInt(c.Args().First(), 10, 64)
+					if err != nil {
+						return errors.New("id of the token is missing; see otp token list")
+					}
+					unlock, err := lockdb(c)
+					if err != nil {
+						return err
+					}
+					defer unlock()
+					db, err := opensqlite(c, true, "API tokens")
+					if err != nil {
+						return err
+					}
+					defer db.Close()
+					res, err := db.Exec("DELETE FROM `api_tokens` WHERE `id` = ?;", id)
+					if err != nil {
+						return err
+					}
+					if n, err := res.RowsAffected(); err != nil {
+						return err
+					} else if n == 0 {
+						return fmt.Errorf("token %d not found", id)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func tray() cli.Command {
+	return cli.Command{
+		Name:   "tray",
+		Usage:  "list the keys in the system tray or menu bar, and copy their codes on click",
+		Before: applyCommandConfig,
+		Description: `The clipboard is cleared after --clear, unless something else was copied
+   meanwhile. On Linux and the BSDs, the tray is a StatusNotifierItem, shown
+   by KDE, most other desktops, and GNOME with the AppIndicator extension;
+   the clipboard goes through wl-copy, xclip or xsel. On macOS, the menu is
+   made by osascript, and lists the keys there were when it started.`,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "clear",
+				Value: 30 * time.Second,
+				Usage: "how long until the code is cleared from the clipboard; 0 leaves it there",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if _, err := privkeyfile(c.GlobalString("private-key")); err != nil {
+				return err
+			}
+			return runTray(&trayApp{c: c, clear: c.Duration("clear")})
+		},
+	}
+}
+
+// trayItem is a key in the menu of the tray.
+type trayItem struct {
+	issuer, account string
+}
+
+func (i trayItem) label() string {
+	return i.issuer + " — " + i.account
+}
+
+// trayApp is what the menus of the platforms act on.
+type trayApp struct {
+	c     *cli.Context
+	clear time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// items lists the keys of the store.
+func (t *trayApp) items() ([]trayItem, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries, err := listEntries(t.c)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]trayItem, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, trayItem{issuer: e.Issuer, account: e.Account})
+	}
+	return items, nil
+}
+
+// copy puts the current code of the key in the clipboard, and clears it
+// after a while if it is still there. Errors are logged, as there is nobody
+// to return them to.
+func (t *trayApp) copy(item trayItem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	code, err := entryCode(t.c, item.issuer, item.account)
+	if err != nil {
+		log.Printf("cannot generate the code of %s: %v", item.label(), err)
+		return
+	}
+	if err := writeClipboard(code.Code); err != nil {
+		log.Printf("cannot copy the code of %s: %v", item.label(), err)
+		return
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	if t.clear <= 0 {
+		return
+	}
+	t.timer = time.AfterFunc(t.clear, func() {
+		if current, err := readClipboard(); err == nil && current == code.Code {
+			writeClipboard("")
+		}
+	})
+}
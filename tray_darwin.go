@@ -0,0 +1,99 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// trayScript makes the menu bar item with the labels given as arguments, and
+// prints the index of the one picked, through the Objective-C bridge of
+// JavaScript for Automation, as otp does not link Cocoa.
+const trayScript = `ObjC.import('Cocoa');
+function run(argv) {
+	const app = $.NSApplication.sharedApplication;
+	app.setActivationPolicy($.NSApplicationActivationPolicyAccessory);
+	const out = $.NSFileHandle.fileHandleWithStandardOutput;
+	ObjC.registerSubclass({
+		name: 'OTPTrayTarget',
+		methods: {
+			'pick:': {
+				types: ['void', ['id']],
+				implementation: function (sender) {
+					out.writeData($(sender.tag + '\n').dataUsingEncoding($.NSUTF8StringEncoding));
+				},
+			},
+			'quit:': {
+				types: ['void', ['id']],
+				implementation: function (sender) {
+					app.terminate(null);
+				},
+			},
+		},
+	});
+	const target = $.OTPTrayTarget.alloc.init;
+	const menu = $.NSMenu.alloc.init;
+	argv.forEach(function (label, i) {
+		const item = $.NSMenuItem.alloc.initWithTitleActionKeyEquivalent(label, 'pick:', '');
+		item.target = target;
+		item.tag = i;
+		menu.addItem(item);
+	});
+	if (argv.length === 0) {
+		const empty = $.NSMenuItem.alloc.initWithTitleActionKeyEquivalent('no keys', null, '');
+		empty.enabled = false;
+		menu.addItem(empty);
+	}
+	menu.addItem($.NSMenuItem.separatorItem);
+	const quit = $.NSMenuItem.alloc.initWithTitleActionKeyEquivalent('Quit', 'quit:', 'q');
+	quit.target = target;
+	menu.addItem(quit);
+	const status = $.NSStatusBar.systemStatusBar.statusItemWithLength($.NSVariableStatusItemLength);
+	status.button.title = 'otp';
+	status.menu = menu;
+	app.run;
+}`
+
+// runTray shows the menu of the keys in the menu bar. The menu is made once,
+// so otp tray is started again to see new keys.
+func runTray(t *trayApp) error {
+	items, err := t.items()
+	if err != nil {
+		return err
+	}
+	args := []string{"-l", "JavaScript", "-e", trayScript}
+	for _, item := range items {
+		args = append(args, item.label())
+	}
+	cmd := exec.Command("osascript", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		if i, err := strconv.Atoi(scanner.Text()); err == nil && i >= 0 && i < len(items) {
+			go t.copy(items[i])
+		}
+	}
+	return cmd.Wait()
+}
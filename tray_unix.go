@@ -0,0 +1,284 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	sniPath    dbusObjectPath = "/StatusNotifierItem"
+	menuPath   dbusObjectPath = "/MenuBar"
+	sniIface                  = "org.kde.StatusNotifierItem"
+	menuIface                 = "com.canonical.dbusmenu"
+	propsIface                = "org.freedesktop.DBus.Properties"
+)
+
+// runTray shows the keys as a StatusNotifierItem, whose menu is served with
+// the dbusmenu protocol and read again every time it opens.
+func runTray(t *trayApp) error {
+	conn, err := dialSessionBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	name := fmt.Sprintf("org.kde.StatusNotifierItem-%d-1", os.Getpid())
+	if err := conn.RequestName(name); err != nil {
+		return err
+	}
+
+	m := &trayMenu{app: t, conn: conn, quit: make(chan struct{})}
+	if err := m.reload(); err != nil {
+		return err
+	}
+	sniProps := map[string]dbusVariant{
+		"Category":   {"s", "ApplicationStatus"},
+		"Id":         {"s", "otp"},
+		"Title":      {"s", "otp"},
+		"Status":     {"s", "Active"},
+		"IconName":   {"s", "dialog-password"},
+		"Menu":       {"o", menuPath},
+		"ItemIsMenu": {"b", true},
+		"ToolTip":    {"(sa(iiay)ss)", []any{"", []any{}, "otp", "click a key to copy its code"}},
+	}
+	menuProps := map[string]dbusVariant{
+		"Version":       {"u", uint32(3)},
+		"TextDirection": {"s", "ltr"},
+		"Status":        {"s", "normal"},
+		"IconThemePath": {"as", []any{}},
+	}
+	exportProperties(conn, sniPath, sniIface, sniProps)
+	exportProperties(conn, menuPath, menuIface, menuProps)
+	for _, member := range []string{"Activate", "SecondaryActivate", "ContextMenu", "Scroll"} {
+		conn.Export(sniPath, sniIface, member, func(*dbusMessage) (string, []any, error) {
+			return "", nil, nil
+		})
+	}
+	m.export()
+
+	_, err = conn.Call("org.kde.StatusNotifierWatcher", "/StatusNotifierWatcher", "org.kde.StatusNotifierWatcher", "RegisterStatusNotifierItem", "s", name)
+	if err != nil {
+		return fmt.Errorf("cannot show the tray icon; does the desktop show StatusNotifierItems? %w", err)
+	}
+	lost := make(chan error, 1)
+	go func() { lost <- conn.Wait() }()
+	select {
+	case <-m.quit:
+		return nil
+	case err := <-lost:
+		return err
+	}
+}
+
+// exportProperties serves the properties of the interface at the path.
+func exportProperties(conn *dbusConn, path dbusObjectPath, iface string, props map[string]dbusVariant) {
+	conn.Export(path, propsIface, "Get", func(m *dbusMessage) (string, []any, error) {
+		if len(m.Body) != 2 || m.Body[0] != iface {
+			return "", nil, &dbusError{"org.freedesktop.DBus.Error.UnknownInterface", "unknown interface"}
+		}
+		name, _ := m.Body[1].(string)
+		v, ok := props[name]
+		if !ok {
+			return "", nil, &dbusError{"org.freedesktop.DBus.Error.UnknownProperty", "unknown property " + name}
+		}
+		return "v", []any{v}, nil
+	})
+	conn.Export(path, propsIface, "GetAll", func(m *dbusMessage) (string, []any, error) {
+		all := []any{}
+		if len(m.Body) == 1 && m.Body[0] == iface {
+			for k, v := range props {
+				all = append(all, []any{k, v})
+			}
+		}
+		return "a{sv}", []any{all}, nil
+	})
+}
+
+// trayMenu serves the menu of the keys. The ids of the keys are their index
+// plus one, as the root is 0, and the id after them quits.
+type trayMenu struct {
+	app      *trayApp
+	conn     *dbusConn
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	mu       sync.Mutex
+	items    []trayItem
+	revision uint32
+}
+
+// reload reads the keys again, telling whether they changed.
+func (m *trayMenu) reload() error {
+	items, err := m.app.items()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.revision > 0 && fmt.Sprint(items) == fmt.Sprint(m.items) {
+		return nil
+	}
+	m.items = items
+	m.revision++
+	return nil
+}
+
+func (m *trayMenu) quitID() int32 {
+	return int32(len(m.items) + 2)
+}
+
+// node is the layout of a menu item: its id, properties and children.
+func (m *trayMenu) node(id int32) []any {
+	props := []any{}
+	prop := func(k, sig string, v any) {
+		props = append(props, []any{k, dbusVariant{sig, v}})
+	}
+	children := []any{}
+	switch {
+	case id == 0:
+		prop("children-display", "s", "submenu")
+		for i := range m.items {
+			children = append(children, dbusVariant{"(ia{sv}av)", m.node(int32(i + 1))})
+		}
+		if len(m.items) == 0 {
+			children = append(children, dbusVariant{"(ia{sv}av)", []any{int32(-1), []any{
+				[]any{"label", dbusVariant{"s", "no keys"}},
+				[]any{"enabled", dbusVariant{"b", false}},
+			}, []any{}}})
+		}
+		children = append(children,
+			dbusVariant{"(ia{sv}av)", m.node(m.quitID() - 1)},
+			dbusVariant{"(ia{sv}av)", m.node(m.quitID())})
+	case int(id) <= len(m.items):
+		prop("label", "s", m.items[id-1].label())
+	case id == m.quitID()-1:
+		prop("type", "s", "separator")
+	case id == m.quitID():
+		prop("label", "s", "Quit")
+	}
+	return []any{id, props, children}
+}
+
+func (m *trayMenu) export() {
+	export := func(member string, h dbusHandler) {
+		m.conn.Export(menuPath, menuIface, member, h)
+	}
+	export("GetLayout", func(*dbusMessage) (string, []any, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return "u(ia{sv}av)", []any{m.revision, m.node(0)}, nil
+	})
+	export("GetGroupProperties", func(msg *dbusMessage) (string, []any, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		out := []any{}
+		ids, _ := msg.Body[0].([]any)
+		for _, id := range ids {
+			id, _ := id.(int32)
+			if id >= 0 && id <= m.quitID() {
+				node := m.node(id)
+				out = append(out, []any{id, node[1]})
+			}
+		}
+		return "a(ia{sv})", []any{out}, nil
+	})
+	export("GetProperty", func(msg *dbusMessage) (string, []any, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		id, _ := msg.Body[0].(int32)
+		name, _ := msg.Body[1].(string)
+		if id >= 0 && id <= m.quitID() {
+			for _, p := range m.node(id)[1].([]any) {
+				if p := p.([]any); p[0] == name {
+					return "v", []any{p[1]}, nil
+				}
+			}
+		}
+		return "", nil, fmt.Errorf("no property %s of item %d", name, id)
+	})
+	export("Event", func(msg *dbusMessage) (string, []any, error) {
+		id, _ := msg.Body[0].(int32)
+		event, _ := msg.Body[1].(string)
+		m.event(id, event)
+		return "", nil, nil
+	})
+	export("EventGroup", func(msg *dbusMessage) (string, []any, error) {
+		events, _ := msg.Body[0].([]any)
+		for _, e := range events {
+			e := e.([]any)
+			id, _ := e[0].(int32)
+			event, _ := e[1].(string)
+			m.event(id, event)
+		}
+		return "ai", []any{[]any{}}, nil
+	})
+	export("AboutToShow", func(msg *dbusMessage) (string, []any, error) {
+		id, _ := msg.Body[0].(int32)
+		return "b", []any{id == 0 && m.refresh()}, nil
+	})
+	export("AboutToShowGroup", func(msg *dbusMessage) (string, []any, error) {
+		ids, _ := msg.Body[0].([]any)
+		updated := []any{}
+		for _, id := range ids {
+			if id == int32(0) && m.refresh() {
+				updated = append(updated, int32(0))
+			}
+		}
+		return "aiai", []any{updated, []any{}}, nil
+	})
+}
+
+// refresh reads the keys as the menu opens, and announces the new layout
+// when they changed.
+func (m *trayMenu) refresh() bool {
+	m.mu.Lock()
+	before := m.revision
+	m.mu.Unlock()
+	if err := m.reload(); err != nil {
+		return false
+	}
+	m.mu.Lock()
+	revision := m.revision
+	m.mu.Unlock()
+	if revision == before {
+		return false
+	}
+	m.conn.Emit(menuPath, menuIface, "LayoutUpdated", "ui", revision, int32(0))
+	return true
+}
+
+func (m *trayMenu) event(id int32, event string) {
+	if event != "clicked" {
+		return
+	}
+	m.mu.Lock()
+	var item trayItem
+	found := id >= 1 && int(id) <= len(m.items)
+	if found {
+		item = m.items[id-1]
+	}
+	quit := id == m.quitID()
+	m.mu.Unlock()
+	switch {
+	case found:
+		m.app.copy(item)
+	case quit:
+		m.quitOnce.Do(func() { close(m.quit) })
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procRegisterClassEx     = user32.NewProc("RegisterClassExW")
+	procCreateWindowEx      = user32.NewProc("CreateWindowExW")
+	procDefWindowProc       = user32.NewProc("DefWindowProcW")
+	procGetMessage          = user32.NewProc("GetMessageW")
+	procTranslateMessage    = user32.NewProc("TranslateMessage")
+	procDispatchMessage     = user32.NewProc("DispatchMessageW")
+	procPostMessage         = user32.NewProc("PostMessageW")
+	procPostQuitMessage     = user32.NewProc("PostQuitMessage")
+	procLoadIcon            = user32.NewProc("LoadIconW")
+	procCreatePopupMenu     = user32.NewProc("CreatePopupMenu")
+	procAppendMenu          = user32.NewProc("AppendMenuW")
+	procTrackPopupMenu      = user32.NewProc("TrackPopupMenu")
+	procDestroyMenu         = user32.NewProc("DestroyMenu")
+	procGetCursorPos        = user32.NewProc("GetCursorPos")
+	procSetForegroundWindow = user32.NewProc("SetForegroundWindow")
+
+	shell32             = windows.NewLazySystemDLL("shell32.dll")
+	procShellNotifyIcon = shell32.NewProc("Shell_NotifyIconW")
+)
+
+const (
+	wmNull      = 0x0000
+	wmLButtonUp = 0x0202
+	wmRButtonUp = 0x0205
+	// wmTrayIcon is the message the tray icon sends on clicks.
+	wmTrayIcon = 0x8000 + 1
+
+	nifMessage = 0x1
+	nifIcon    = 0x2
+	nifTip     = 0x4
+	nimAdd     = 0x0
+	nimDelete  = 0x2
+
+	mfString    = 0x0
+	mfGrayed    = 0x1
+	mfSeparator = 0x800
+
+	tpmRightButton = 0x2
+	tpmNoNotify    = 0x80
+	tpmReturnCmd   = 0x100
+
+	idiApplication = 32512
+)
+
+// notifyIconData is the NOTIFYICONDATAW structure.
+type notifyIconData struct {
+	Size            uint32
+	Wnd             windows.HWND
+	ID              uint32
+	Flags           uint32
+	CallbackMessage uint32
+	Icon            windows.Handle
+	Tip             [128]uint16
+	State           uint32
+	StateMask       uint32
+	Info            [256]uint16
+	Version         uint32
+	InfoTitle       [64]uint16
+	InfoFlags       uint32
+	GUIDItem        windows.GUID
+	BalloonIcon     windows.Handle
+}
+
+// wndClassEx is the WNDCLASSEXW structure.
+type wndClassEx struct {
+	Size       uint32
+	Style      uint32
+	WndProc    uintptr
+	ClsExtra   int32
+	WndExtra   int32
+	Instance   windows.Handle
+	Icon       windows.Handle
+	Cursor     windows.Handle
+	Background windows.Handle
+	MenuName   *uint16
+	ClassName  *uint16
+	IconSm     windows.Handle
+}
+
+// winMsg is the MSG structure.
+type winMsg struct {
+	Wnd     windows.HWND
+	Message uint32
+	WParam  uintptr
+	LParam  uintptr
+	Time    uint32
+	Pt      struct{ X, Y int32 }
+	Private uint32
+}
+
+// runTray shows an icon in the notification area, whose menu lists the keys
+// as they are when it opens.
+func runTray(t *trayApp) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var instance windows.Handle
+	if err := windows.GetModuleHandleEx(0, nil, &instance); err != nil {
+		return err
+	}
+	className, _ := windows.UTF16PtrFromString("otpTray")
+	wndProc := windows.NewCallback(func(hwnd windows.HWND, message uint32, wParam, lParam uintptr) uintptr {
+		if message == wmTrayIcon && (lParam == wmLButtonUp || lParam == wmRButtonUp) {
+			showTrayMenu(t, hwnd)
+			return 0
+		}
+		r, _, _ := procDefWindowProc.Call(uintptr(hwnd), uintptr(message), wParam, lParam)
+		return r
+	})
+	wc := wndClassEx{WndProc: wndProc, Instance: instance, ClassName: className}
+	wc.Size = uint32(unsafe.Sizeof(wc))
+	if r, _, err := procRegisterClassEx.Call(uintptr(unsafe.Pointer(&wc))); r == 0 {
+		return fmt.Errorf("cannot register the window class: %w", err)
+	}
+	// The window is never shown; it receives the clicks on the icon and owns
+	// the menu.
+	hwnd, _, err := procCreateWindowEx.Call(0, uintptr(unsafe.Pointer(className)), uintptr(unsafe.Pointer(className)), 0, 0, 0, 0, 0, 0, 0, uintptr(instance), 0)
+	if hwnd == 0 {
+		return fmt.Errorf("cannot create the window: %w", err)
+	}
+	icon, _, _ := procLoadIcon.Call(0, idiApplication)
+	nid := notifyIconData{
+		Wnd:             windows.HWND(hwnd),
+		ID:              1,
+		Flags:           nifMessage | nifIcon | nifTip,
+		CallbackMessage: wmTrayIcon,
+		Icon:            windows.Handle(icon),
+	}
+	nid.Size = uint32(unsafe.Sizeof(nid))
+	tip, _ := windows.UTF16FromString("otp")
+	copy(nid.Tip[:], tip)
+	if r, _, err := procShellNotifyIcon.Call(nimAdd, uintptr(unsafe.Pointer(&nid))); r == 0 {
+		return fmt.Errorf("cannot add the tray icon: %w", err)
+	}
+	defer procShellNotifyIcon.Call(nimDelete, uintptr(unsafe.Pointer(&nid)))
+
+	var m winMsg
+	for {
+		r, _, err := procGetMessage.Call(uintptr(unsafe.Pointer(&m)), 0, 0, 0)
+		switch int32(r) {
+		case -1:
+			return err
+		case 0:
+			return nil
+		}
+		procTranslateMessage.Call(uintptr(unsafe.Pointer(&m)))
+		procDispatchMessage.Call(uintptr(unsafe.Pointer(&m)))
+	}
+}
+
+func showTrayMenu(t *trayApp, hwnd windows.HWND) {
+	items, err := t.items()
+	if err != nil {
+		log.Printf("cannot list the keys: %v", err)
+	}
+	menu, _, _ := procCreatePopupMenu.Call()
+	if menu == 0 {
+		return
+	}
+	defer procDestroyMenu.Call(menu)
+	appendItem := func(flags, id uintptr, label string) {
+		p, _ := windows.UTF16PtrFromString(label)
+		procAppendMenu.Call(menu, flags, id, uintptr(unsafe.Pointer(p)))
+	}
+	for i, item := range items {
+		appendItem(mfString, uintptr(i+1), item.label())
+	}
+	if len(items) == 0 {
+		appendItem(mfString|mfGrayed, 0, "no keys")
+	}
+	procAppendMenu.Call(menu, mfSeparator, 0, 0)
+	quitID := uintptr(len(items) + 1)
+	appendItem(mfString, quitID, "Quit")
+
+	var pt struct{ X, Y int32 }
+	procGetCursorPos.Call(uintptr(unsafe.Pointer(&pt)))
+	// The menu only closes when clicking elsewhere if its window is in the
+	// foreground.
+	procSetForegroundWindow.Call(uintptr(hwnd))
+	cmd, _, _ := procTrackPopupMenu.Call(menu, tpmReturnCmd|tpmNoNotify|tpmRightButton, uintptr(pt.X), uintptr(pt.Y), 0, uintptr(hwnd), 0)
+	procPostMessage.Call(uintptr(hwnd), wmNull, 0, 0)
+	switch {
+	case cmd == quitID:
+		procPostQuitMessage.Call(0)
+	case cmd >= 1 && int(cmd) <= len(items):
+		go t.copy(items[cmd-1])
+	}
+}
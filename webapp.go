@@ -0,0 +1,110 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"sync"
+)
+
+// webManifest makes the web page installable as an app.
+const webManifest = `{
+	"name": "otp",
+	"short_name": "otp",
+	"description": "One-time password codes",
+	"start_url": "/",
+	"scope": "/",
+	"display": "standalone",
+	"background_color": "#1e3a5f",
+	"theme_color": "#1e3a5f",
+	"icons": [
+		{"src": "/icon-192.png", "sizes": "192x192", "type": "image/png"},
+		{"src": "/icon-512.png", "sizes": "512x512", "type": "image/png", "purpose": "any maskable"}
+	]
+}
+`
+
+// webServiceWorker lets the app be installed. Codes are never cached: pages
+// are always fetched from the server, and an offline page says so when it
+// cannot be reached.
+const webServiceWorker = `self.addEventListener("install", () => self.skipWaiting());
+self.addEventListener("activate", e => e.waitUntil(self.clients.claim()));
+self.addEventListener("fetch", e => {
+	if (e.request.mode !== "navigate") {
+		return;
+	}
+	e.respondWith(fetch(e.request).catch(() => new Response(
+		"<!DOCTYPE html><meta name=viewport content='width=device-width, initial-scale=1'><title>otp</title><p>The otp server cannot be reached.</p>",
+		{headers: {"Content-Type": "text/html; charset=utf-8"}})));
+});
+`
+
+// registerPWA adds the manifest, the service worker and the icons of the
+// installable web app.
+func registerPWA(mux *http.ServeMux) {
+	mux.HandleFunc("GET /manifest.webmanifest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/manifest+json")
+		w.Write([]byte(webManifest))
+	})
+	mux.HandleFunc("GET /sw.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(webServiceWorker))
+	})
+	for _, size := range []int{192, 512} {
+		icon := sync.OnceValue(func() []byte { return webIcon(size) })
+		mux.HandleFunc(fmt.Sprintf("GET /icon-%d.png", size), func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Cache-Control", "max-age=86400")
+			w.Write(icon())
+		})
+	}
+}
+
+// webIcon draws the app icon: a countdown ring on a plain background, kept
+// within the safe zone of maskable icons.
+func webIcon(size int) []byte {
+	bg := color.RGBA{0x1e, 0x3a, 0x5f, 0xff}
+	fg := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	c := float64(size) / 2
+	outer, inner := float64(size)*0.3, float64(size)*0.22
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)+0.5-c, float64(y)+0.5-c
+			d := math.Hypot(dx, dy)
+			// Angle clockwise from 12 o'clock; the last sixth of the
+			// ring is left out, as a countdown in progress.
+			angle := math.Atan2(dx, -dy)
+			if angle < 0 {
+				angle += 2 * math.Pi
+			}
+			if d >= inner && d <= outer && angle <= 2*math.Pi*5/6 {
+				img.Set(x, y, fg)
+			} else {
+				img.Set(x, y, bg)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
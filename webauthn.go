@@ -0,0 +1,328 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// webauthnCredential is a security key enrolled for the login of otp http.
+type webauthnCredential struct {
+	ID        []byte `json:"id"`
+	PublicKey []byte `json:"public_key"` // PKIX
+	SignCount uint32 `json:"sign_count"`
+}
+
+func readWebAuthnCredentials(fn string) ([]webauthnCredential, error) {
+	data, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var creds []webauthnCredential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid security keys file %s: %w", fn, err)
+	}
+	return creds, nil
+}
+
+func writeWebAuthnCredentials(fn string, creds []webauthnCredential) error {
+	data, err := json.MarshalIndent(creds, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, data, 0o600)
+}
+
+// webauthnClientData is the part of clientDataJSON that is checked.
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func checkClientData(clientDataJSON []byte, typ string, challenge []byte, origin string) error {
+	var cd webauthnClientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return fmt.Errorf("invalid client data: %w", err)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	switch {
+	case cd.Type != typ:
+		return fmt.Errorf("client data is %q, not %q", cd.Type, typ)
+	case err != nil || !bytes.Equal(got, challenge):
+		return errors.New("challenge does not match")
+	case cd.Origin != origin:
+		return fmt.Errorf("origin %q does not match %q", cd.Origin, origin)
+	}
+	return nil
+}
+
+// webauthnAuthData is the parsed authenticator data.
+type webauthnAuthData struct {
+	signCount uint32
+	// credentialID and publicKey are only set by registrations.
+	credentialID []byte
+	publicKey    any
+}
+
+const (
+	webauthnUserPresent  = 0x01
+	webauthnAttestedData = 0x40
+)
+
+func parseAuthData(data []byte, rpID string) (webauthnAuthData, error) {
+	var ad webauthnAuthData
+	if len(data) < 37 {
+		return ad, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return ad, errors.New("authenticator data is for another site")
+	}
+	flags := data[32]
+	if flags&webauthnUserPresent == 0 {
+		return ad, errors.New("user presence was not verified")
+	}
+	ad.signCount = binary.BigEndian.Uint32(data[33:37])
+	if flags&webauthnAttestedData == 0 {
+		return ad, nil
+	}
+	rest := data[37:]
+	if len(rest) < 18 {
+		return ad, errors.New("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		return ad, errors.New("credential ID too short")
+	}
+	ad.credentialID = rest[:n]
+	cose, _, err := decodeCBOR(rest[n:])
+	if err != nil {
+		return ad, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	ad.publicKey, err = parseCOSEKey(cose)
+	return ad, err
+}
+
+// parseCOSEKey supports the ES256 and Ed25519 keys of security keys.
+func parseCOSEKey(v any) (any, error) {
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, errors.New("COSE key is not a map")
+	}
+	x, _ := m[int64(-2)].([]byte)
+	switch {
+	case m[int64(1)] == int64(2) && m[int64(3)] == int64(-7) && m[int64(-1)] == int64(1):
+		y, _ := m[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, errors.New("invalid P-256 key")
+		}
+		return pub, nil
+	case m[int64(1)] == int64(1) && m[int64(3)] == int64(-8) && m[int64(-1)] == int64(6):
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported security key algorithm; only ES256 and Ed25519 are supported")
+}
+
+// webauthnRegister checks the response to navigator.credentials.create, and
+// returns the new credential. Attestation is not checked: any security key
+// the user enrolls is trusted.
+func webauthnRegister(clientDataJSON, attestationObject, challenge []byte, origin, rpID string) (webauthnCredential, error) {
+	if err := checkClientData(clientDataJSON, "webauthn.create", challenge, origin); err != nil {
+		return webauthnCredential{}, err
+	}
+	obj, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return webauthnCredential{}, fmt.Errorf("invalid attestation: %w", err)
+	}
+	m, _ := obj.(map[any]any)
+	authData, _ := m["authData"].([]byte)
+	ad, err := parseAuthData(authData, rpID)
+	if err != nil {
+		return webauthnCredential{}, err
+	}
+	if ad.publicKey == nil {
+		return webauthnCredential{}, errors.New("no credential in the attestation")
+	}
+	pub, err := x509.MarshalPKIXPublicKey(ad.publicKey)
+	if err != nil {
+		return webauthnCredential{}, err
+	}
+	return webauthnCredential{ID: bytes.Clone(ad.credentialID), PublicKey: pub, SignCount: ad.signCount}, nil
+}
+
+// webauthnVerify checks the response to navigator.credentials.get against
+// the enrolled credential, whose sign count it updates.
+func webauthnVerify(cred *webauthnCredential, clientDataJSON, authData, signature, challenge []byte, origin, rpID string) error {
+	if err := checkClientData(clientDataJSON, "webauthn.get", challenge, origin); err != nil {
+		return err
+	}
+	ad, err := parseAuthData(authData, rpID)
+	if err != nil {
+		return err
+	}
+	pub, err := x509.ParsePKIXPublicKey(cred.PublicKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(authData), clientDataHash[:]...)
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, signed, signature) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key %T", pub)
+	}
+	// Security keys that count signatures never go back, unless cloned.
+	if ad.signCount != 0 || cred.SignCount != 0 {
+		if ad.signCount <= cred.SignCount {
+			return errors.New("signature counter went back: the security key may be cloned")
+		}
+		cred.SignCount = ad.signCount
+	}
+	return nil
+}
+
+// decodeCBOR decodes the subset of CBOR used by WebAuthn: integers, byte and
+// text strings, arrays, maps and simple values, all of definite length. It
+// returns the value and the number of bytes it took.
+func decodeCBOR(data []byte) (any, int, error) {
+	return decodeCBORDepth(data, 0)
+}
+
+func decodeCBORDepth(data []byte, depth int) (any, int, error) {
+	if depth > 16 {
+		return nil, 0, errors.New("CBOR nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, 0, errors.New("truncated CBOR")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	n := 1
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < 1+size {
+			return nil, 0, errors.New("truncated CBOR")
+		}
+		for _, b := range data[1 : 1+size] {
+			arg = arg<<8 | uint64(b)
+		}
+		n += size
+	default:
+		return nil, 0, errors.New("unsupported CBOR encoding")
+	}
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, 0, errors.New("CBOR integer too large")
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, 0, errors.New("CBOR integer too large")
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if uint64(len(data)-n) < arg {
+			return nil, 0, errors.New("truncated CBOR")
+		}
+		b := data[n : n+int(arg)]
+		if major == 3 {
+			return string(b), n + int(arg), nil
+		}
+		return b, n + int(arg), nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, errors.New("truncated CBOR")
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			v, size, err := decodeCBORDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, v)
+			n += size
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, errors.New("truncated CBOR")
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			k, size, err := decodeCBORDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errors.New("unsupported CBOR map key")
+			}
+			v, size, err := decodeCBORDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			m[k] = v
+		}
+		return m, n, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22, 23:
+			return nil, n, nil
+		}
+	}
+	return nil, 0, errors.New("unsupported CBOR type")
+}
@@ -0,0 +1,319 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// The examples of RFC 8949, appendix A, within the supported subset.
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"190100", int64(256)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62225c", "\"\\"},
+		{"80", []any{}},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a0", map[any]any{}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"826161a161626163", []any{"a", map[any]any{"b": "c"}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.in)
+		got, n, err := decodeCBOR(data)
+		if err != nil {
+			t.Errorf("decodeCBOR(%s): %v", tt.in, err)
+			continue
+		}
+		if n != len(data) {
+			t.Errorf("decodeCBOR(%s) took %d bytes, want %d", tt.in, n, len(data))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeCBOR(%s) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	tests := []struct {
+		name, in, wantErr string
+	}{
+		{"empty", "", "truncated"},
+		{"truncated argument", "1901", "truncated"},
+		{"truncated bytes", "440102", "truncated"},
+		{"truncated array", "830102", "truncated"},
+		{"huge array", "9bffffffffffffffff", "truncated"},
+		{"huge map", "bbffffffffffffffff", "truncated"},
+		{"huge integer", "1bffffffffffffffff", "too large"},
+		{"huge negative integer", "3bffffffffffffffff", "too large"},
+		{"indefinite bytes", "5f4101ff", "unsupported CBOR encoding"},
+		{"indefinite array", "9f01ff", "unsupported CBOR encoding"},
+		{"tag", "c11a514b67b0", "unsupported CBOR type"},
+		{"float", "f93c00", "unsupported CBOR type"},
+		{"array map key", "a18001", "unsupported CBOR map key"},
+		{"too deep", strings.Repeat("81", 20) + "00", "too deep"},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.in)
+		if _, _, err := decodeCBOR(data); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: decodeCBOR(%s) error = %v, want %q", tt.name, tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+// cborHead encodes the major type and argument of a CBOR item.
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	}
+	return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, len(s)), s...)
+}
+
+// testAuthenticator is a security key, with the COSE encoding of its public
+// key and a signer.
+type testAuthenticator struct {
+	id    []byte
+	cose  []byte
+	sign  func(msg []byte) []byte
+	count uint32
+}
+
+func newEd25519Authenticator(t *testing.T) *testAuthenticator {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {1: 1 (OKP), 3: -8 (EdDSA), -1: 6 (Ed25519), -2: x}
+	cose := append([]byte{0xa4, 0x01, 0x01, 0x03, 0x27, 0x20, 0x06, 0x21}, cborBytes(pub)...)
+	return &testAuthenticator{id: []byte("ed25519 credential"), cose: cose, sign: func(msg []byte) []byte {
+		return ed25519.Sign(priv, msg)
+	}}
+}
+
+func newP256Authenticator(t *testing.T) *testAuthenticator {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := priv.X.FillBytes(make([]byte, 32)), priv.Y.FillBytes(make([]byte, 32))
+	// {1: 2 (EC2), 3: -7 (ES256), -1: 1 (P-256), -2: x, -3: y}
+	cose := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21}
+	cose = append(cose, cborBytes(x)...)
+	cose = append(cose, 0x22)
+	cose = append(cose, cborBytes(y)...)
+	return &testAuthenticator{id: []byte("p256 credential"), cose: cose, sign: func(msg []byte) []byte {
+		digest := sha256.Sum256(msg)
+		sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}}
+}
+
+func (a *testAuthenticator) authData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.count)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.cose...)
+	}
+	return data
+}
+
+func clientData(typ string, challenge []byte, origin string) []byte {
+	data, _ := json.Marshal(webauthnClientData{Type: typ, Challenge: base64.RawURLEncoding.EncodeToString(challenge), Origin: origin})
+	return data
+}
+
+// attestation is the attestationObject of a registration, of format none.
+func (a *testAuthenticator) attestation(rpID string) []byte {
+	obj := []byte{0xa3}
+	obj = append(obj, cborText("fmt")...)
+	obj = append(obj, cborText("none")...)
+	obj = append(obj, cborText("attStmt")...)
+	obj = append(obj, 0xa0)
+	obj = append(obj, cborText("authData")...)
+	return append(obj, cborBytes(a.authData(rpID, webauthnUserPresent|webauthnAttestedData, true))...)
+}
+
+func TestWebAuthn(t *testing.T) {
+	const origin, rpID = "https://otp.example.com", "example.com"
+	challenge := []byte("0123456789abcdef")
+	for _, a := range []*testAuthenticator{newEd25519Authenticator(t), newP256Authenticator(t)} {
+		t.Run(string(a.id), func(t *testing.T) {
+			a.count = 1
+			create := clientData("webauthn.create", challenge, origin)
+			for name, err := range map[string]error{
+				"other challenge": errOf(webauthnRegister(create, a.attestation(rpID), []byte("other"), origin, rpID)),
+				"other origin":    errOf(webauthnRegister(create, a.attestation(rpID), challenge, "https://evil.example", rpID)),
+				"other rp ID":     errOf(webauthnRegister(create, a.attestation("evil.example"), challenge, origin, rpID)),
+				"get":             errOf(webauthnRegister(clientData("webauthn.get", challenge, origin), a.attestation(rpID), challenge, origin, rpID)),
+			} {
+				if err == nil {
+					t.Errorf("register with %s: no error", name)
+				}
+			}
+			cred, err := webauthnRegister(create, a.attestation(rpID), challenge, origin, rpID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(cred.ID, a.id) || cred.SignCount != 1 {
+				t.Fatalf("registered %q with count %d, want %q with count 1", cred.ID, cred.SignCount, a.id)
+			}
+
+			get := clientData("webauthn.get", challenge, origin)
+			sign := func(authData, clientData []byte) []byte {
+				hash := sha256.Sum256(clientData)
+				return a.sign(append(bytes.Clone(authData), hash[:]...))
+			}
+			a.count = 2
+			authData := a.authData(rpID, webauthnUserPresent, false)
+			sig := sign(authData, get)
+			tampered := bytes.Clone(authData)
+			tampered[len(tampered)-1] ^= 1
+			absent := a.authData(rpID, 0, false)
+			otherSite := a.authData("evil.example", webauthnUserPresent, false)
+			tests := []struct {
+				name                      string
+				clientData, authData, sig []byte
+				challenge                 []byte
+				wantErr                   string
+			}{
+				{"tampered authenticator data", get, tampered, sig, challenge, "invalid signature"},
+				{"tampered client data", append(bytes.Clone(get), ' '), authData, sig, challenge, "invalid signature"},
+				{"other origin", clientData("webauthn.get", challenge, origin+"/"), authData, sig, challenge, "origin"},
+				{"tampered signature", get, authData, sign(authData, create), challenge, "invalid signature"},
+				{"other challenge", get, authData, sig, []byte("other"), "challenge does not match"},
+				{"user absent", get, absent, sign(absent, get), challenge, "user presence"},
+				{"other site", get, otherSite, sign(otherSite, get), challenge, "another site"},
+				{"create", create, authData, sign(authData, create), challenge, "not \"webauthn.get\""},
+				{"truncated", get, authData[:36], sig, challenge, "too short"},
+			}
+			for _, tt := range tests {
+				c := cred
+				if err := webauthnVerify(&c, tt.clientData, tt.authData, tt.sig, tt.challenge, origin, rpID); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("%s: webauthnVerify() error = %v, want %q", tt.name, err, tt.wantErr)
+				}
+			}
+			if err := webauthnVerify(&cred, get, authData, sig, challenge, origin, rpID); err != nil {
+				t.Fatal(err)
+			}
+			if cred.SignCount != 2 {
+				t.Errorf("sign count = %d, want 2", cred.SignCount)
+			}
+			// Replaying the same signature counter is refused.
+			if err := webauthnVerify(&cred, get, authData, sig, challenge, origin, rpID); err == nil || !strings.Contains(err.Error(), "cloned") {
+				t.Errorf("replay: webauthnVerify() error = %v, want the counter to be refused", err)
+			}
+		})
+	}
+}
+
+func errOf(_ webauthnCredential, err error) error {
+	return err
+}
+
+func TestParseAuthDataErrors(t *testing.T) {
+	a := newEd25519Authenticator(t)
+	attested := a.authData("example.com", webauthnUserPresent|webauthnAttestedData, true)
+	unsupported := a.authData("example.com", webauthnUserPresent|webauthnAttestedData, false)
+	unsupported = append(unsupported, make([]byte, 16)...)
+	unsupported = binary.BigEndian.AppendUint16(unsupported, 1)
+	unsupported = append(unsupported, 'x', 0xa1, 0x01, 0x03) // {1: 3 (RSA)}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"no credential data", attested[:37], "attested credential data too short"},
+		{"truncated credential ID", attested[:37+18+2], "credential ID too short"},
+		{"truncated key", attested[:len(attested)-1], "invalid credential public key"},
+		{"unsupported key", unsupported, "unsupported security key algorithm"},
+	}
+	for _, tt := range tests {
+		if _, err := parseAuthData(tt.data, "example.com"); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: parseAuthData() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebAuthnOrigin(t *testing.T) {
+	tests := []struct {
+		origin, rpID         string
+		wantOrigin, wantRPID string
+	}{
+		{"https://otp.example.com", "", "https://otp.example.com", "otp.example.com"},
+		{"https://otp.example.com/", "example.com", "https://otp.example.com", "example.com"},
+		{"http://localhost:8080", "", "http://localhost:8080", "localhost"},
+		{"", "", "", ""},
+		{"otp.example.com", "", "", ""},
+		{"https://otp.example.com/otp", "", "", ""},
+		{"ftp://otp.example.com", "", "", ""},
+		{"https://otp.example.com", "evil.example", "", ""},
+		{"https://otp.example.com", "ample.com", "", ""},
+	}
+	for _, tt := range tests {
+		origin, rpID, err := webauthnOrigin(tt.origin, tt.rpID)
+		if (err != nil) != (tt.wantOrigin == "") || origin != tt.wantOrigin || rpID != tt.wantRPID {
+			t.Errorf("webauthnOrigin(%q, %q) = %q, %q, %v; want %q, %q", tt.origin, tt.rpID, origin, rpID, err, tt.wantOrigin, tt.wantRPID)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// webCodes are the codes shown by the web interface.
+type webCodes struct {
+	ExpiresIn int64     `json:"expires_in"`
+	Codes     []apiCode `json:"codes"`
+	Error     string    `json:"error,omitempty"`
+	// Query is the filter of the page, Login tells whether to show the
+	// logout button, and QR whether to link the QR codes.
+	Query string `json:"-"`
+	Login bool   `json:"-"`
+	QR    bool   `json:"-"`
+	// failed are the entries that could not be decrypted, until the codes
+	// are narrowed to those of a tenant.
+	failed []apiCode
+}
+
+// matches tells whether the account or the issuer contains the query,
+// ignoring case.
+func matches(query string, code apiCode) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	return strings.Contains(strings.ToLower(code.Account), query) || strings.Contains(strings.ToLower(code.Issuer), query)
+}
+
+func qrURL(code apiCode) string {
+	return "/" + url.PathEscape(code.Issuer) + "/" + url.PathEscape(code.Account) + "/qr.png"
+}
+
+func currentCodes(c *cli.Context) (webCodes, error) {
+	httpMu.Lock()
+	defer httpMu.Unlock()
+	codes, failed, err := loadEntryCodes(c)
+	if err != nil {
+		return webCodes{}, err
+	}
+	return webCodes{ExpiresIn: 30 - time.Now().Unix()%30, Codes: codes, failed: failed}, nil
+}
+
+// view narrows the codes to those the tenant sees, and tells about the
+// entries among them that could not be decrypted, so the users do not learn
+// about the entries of the others.
+func (in webCodes) view(t *tenant) (webCodes, error) {
+	out := in
+	out.Codes, out.failed = t.codes(in.Codes), nil
+	failed := len(t.codes(in.failed))
+	switch {
+	case failed > 0 && len(out.Codes) == 0:
+		// Most likely the wrong private key: an empty page would hide it.
+		return webCodes{}, apiStatus(http.StatusInternalServerError, fmt.Errorf("none of the %d keys could be decrypted", failed))
+	case failed > 0:
+		out.Error = fmt.Sprintf("%d of %d keys could not be decrypted", failed, len(out.Codes)+failed)
+	}
+	return out, nil
+}
+
+// webTemplateFuncs are the functions of the templates of the web page.
+var webTemplateFuncs = template.FuncMap{"matches": matches, "qrURL": qrURL}
+
+// loadWebTemplate parses the index.html of the directory, along with the
+// other *.html files it may include, in place of the built-in page.
+func loadWebTemplate(dir string) (*template.Template, error) {
+	if _, err := os.Stat(filepath.Join(dir, "index.html")); err != nil {
+		return nil, fmt.Errorf("--template-dir: %w", err)
+	}
+	t, err := template.New("index.html").Funcs(webTemplateFuncs).ParseGlob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, fmt.Errorf("--template-dir: %w", err)
+	}
+	return t, nil
+}
+
+// webStatic serves the files of dir under /static/, ahead of next: a route
+// of the mux would overlap the ones of the entries.
+func webStatic(next http.Handler, dir string) http.Handler {
+	files := http.StripPrefix("/static/", http.FileServer(http.Dir(dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.HasPrefix(r.URL.Path, "/static/") {
+			files.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registerWebUI adds the web page, which counts down to the next time step
+// and then fetches the new codes from /api/codes. Both take the filter ?q=,
+// which the page applies again as it is typed: the rows that do not match
+// are hidden, not left out. The page is rendered with tmpl.
+func registerWebUI(mux *http.ServeMux, c *cli.Context, tmpl *template.Template, login, qr bool) {
+	registerPWA(mux)
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		codes, err := currentCodes(c)
+		if err == nil {
+			codes, err = codes.view(tenantOf(r))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		codes.Query, codes.Login, codes.QR = r.FormValue("q"), login, qr
+		for _, code := range codes.Codes {
+			audit(r).servedCode(code.Issuer, code.Account)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, codes); err != nil {
+			log.Println(err)
+			http.Error(w, "cannot render the page", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		buf.WriteTo(w)
+	})
+	mux.HandleFunc("GET /api/codes", func(w http.ResponseWriter, r *http.Request) {
+		codes, err := currentCodes(c)
+		if err == nil {
+			codes, err = codes.view(tenantOf(r))
+		}
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		filtered := make([]apiCode, 0, len(codes.Codes))
+		for _, code := range codes.Codes {
+			if matches(r.FormValue("q"), code) {
+				filtered = append(filtered, code)
+				audit(r).servedCode(code.Issuer, code.Account)
+			}
+		}
+		codes.Codes = filtered
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, codes)
+	})
+}
+
+var webTemplate = template.Must(template.New("web").Funcs(webTemplateFuncs).Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1, viewport-fit=cover"><title>otp</title>
+<meta name="theme-color" content="#1e3a5f">
+<meta name="apple-mobile-web-app-capable" content="yes">
+<link rel="manifest" href="/manifest.webmanifest" crossorigin="use-credentials">
+<link rel="apple-touch-icon" href="/icon-192.png">
+<style>
+:root { color-scheme: light dark; --accent: #2f6fb3; --muted: #777; --card: #f4f6f8; }
+@media (prefers-color-scheme: dark) { :root { --accent: #6fa8e6; --muted: #999; --card: #1d2329; } }
+body { font-family: system-ui, sans-serif; margin: 0 auto; max-width: 40em; padding: 1em max(1em, env(safe-area-inset-right)) 2em max(1em, env(safe-area-inset-left)); }
+header { display: flex; gap: 0.5em; align-items: center; }
+#q { flex: 1; font-size: 1.1em; padding: 0.5em; border-radius: 0.5em; border: 1px solid var(--muted); }
+#codes { list-style: none; margin: 1em 0; padding: 0; }
+#codes li { display: flex; align-items: center; gap: 0.8em; background: var(--card); border-radius: 0.8em; padding: 0.7em 0.9em; margin-bottom: 0.6em; }
+#codes li[hidden] { display: none; }
+.ring { width: 2em; height: 2em; flex: none; transform: rotate(-90deg); }
+.ring circle { fill: none; stroke: var(--accent); stroke-width: 4; stroke-dasharray: 100.53; transition: stroke-dashoffset 1s linear; }
+.name { flex: 1; min-width: 0; display: flex; flex-direction: column; }
+.issuer { font-weight: 600; overflow: hidden; text-overflow: ellipsis; }
+.account { color: var(--muted); font-size: 0.9em; overflow: hidden; text-overflow: ellipsis; }
+.code { font-family: ui-monospace, monospace; font-size: 1.5em; letter-spacing: 0.08em; background: none; border: none; color: inherit; cursor: pointer; padding: 0.2em; }
+.qr { color: var(--muted); font-size: 0.8em; }
+#toast { position: fixed; bottom: 1.5em; left: 50%; transform: translateX(-50%); background: #333; color: #fff; padding: 0.5em 1em; border-radius: 1em; }
+.muted { color: var(--muted); font-size: 0.9em; }
+</style></head><body>
+<header>
+<form method="get" action="/" style="display: contents"><input type="search" name="q" id="q" value="{{.Query}}" placeholder="Search" autocomplete="off" autofocus></form>
+{{if .Login}}<form method="post" action="/logout"><button type="submit">Log out</button></form>{{end}}
+</header>
+<p id="error"><strong>{{.Error}}</strong></p>
+<ul id="codes">
+{{range .Codes}}<li data-search="{{.Account}} {{.Issuer}}"{{if not (matches $.Query .)}} hidden{{end}}><svg class="ring" viewBox="0 0 36 36"><circle cx="18" cy="18" r="16"/></svg><div class="name"><span class="issuer">{{.Issuer}}{{with .Owner}} (shared by {{.}}){{end}}</span><span class="account">{{.Account}}</span></div><button type="button" class="code" title="Copy">{{.Code}}</button>{{if and $.QR (not .Owner)}}<a class="qr" href="{{qrURL .}}">QR</a>{{end}}</li>
+{{end}}</ul>
+<p class="muted">Codes change in <span id="expires">{{.ExpiresIn}}</span>s. Tap a code to copy it.</p>
+<div id="toast" hidden>Copied</div>
+<script>
+const period = 30;
+let expires = {{.ExpiresIn}};
+const showQR = {{.QR}};
+let refreshing = false;
+
+function el(tag, cls, text) {
+	const e = document.createElement(tag);
+	if (cls) {
+		e.className = cls;
+	}
+	if (text !== undefined) {
+		e.textContent = text;
+	}
+	return e;
+}
+
+function rings() {
+	const offset = (100.53 * (1 - expires / period)).toFixed(2);
+	for (const circle of document.querySelectorAll(".ring circle")) {
+		circle.style.strokeDashoffset = offset;
+	}
+}
+
+function filter() {
+	const q = document.getElementById("q").value.trim().toLowerCase();
+	for (const li of document.getElementById("codes").children) {
+		li.hidden = !li.dataset.search.toLowerCase().includes(q);
+	}
+}
+
+document.getElementById("q").addEventListener("input", () => {
+	const q = document.getElementById("q").value;
+	history.replaceState(null, "", q ? "?q=" + encodeURIComponent(q) : "/");
+	filter();
+});
+
+async function copy(text) {
+	if (navigator.clipboard && window.isSecureContext) {
+		await navigator.clipboard.writeText(text);
+		return;
+	}
+	// Without HTTPS, the clipboard API is not available.
+	const area = el("textarea");
+	area.value = text;
+	document.body.append(area);
+	area.select();
+	document.execCommand("copy");
+	area.remove();
+}
+
+document.getElementById("codes").addEventListener("click", async e => {
+	const button = e.target.closest(".code");
+	if (!button) {
+		return;
+	}
+	const toast = document.getElementById("toast");
+	try {
+		await copy(button.textContent);
+		toast.textContent = "Copied";
+	} catch (err) {
+		toast.textContent = "Cannot copy: " + err.message;
+	}
+	toast.hidden = false;
+	setTimeout(() => { toast.hidden = true; }, 1500);
+});
+
+async function refresh() {
+	const resp = await fetch("/api/codes", {headers: {"Accept": "application/json"}});
+	if (resp.status === 401) {
+		location.reload();
+		return;
+	}
+	const data = await resp.json();
+	if (!resp.ok) {
+		throw new Error(data.error);
+	}
+	const rows = data.codes.map(code => {
+		const li = el("li");
+		li.dataset.search = code.account + " " + code.issuer;
+		const ring = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+		ring.setAttribute("class", "ring");
+		ring.setAttribute("viewBox", "0 0 36 36");
+		const circle = document.createElementNS("http://www.w3.org/2000/svg", "circle");
+		circle.setAttribute("cx", "18");
+		circle.setAttribute("cy", "18");
+		circle.setAttribute("r", "16");
+		ring.append(circle);
+		const name = el("div", "name");
+		name.append(el("span", "issuer", code.owner ? code.issuer + " (shared by " + code.owner + ")" : code.issuer), el("span", "account", code.account));
+		const button = el("button", "code", code.code);
+		button.type = "button";
+		button.title = "Copy";
+		li.append(ring, name, button);
+		if (showQR && !code.owner) {
+			const qr = el("a", "qr", "QR");
+			qr.href = "/" + encodeURIComponent(code.issuer) + "/" + encodeURIComponent(code.account) + "/qr.png";
+			li.append(qr);
+		}
+		return li;
+	});
+	document.getElementById("codes").replaceChildren(...rows);
+	filter();
+	document.getElementById("error").firstChild.textContent = data.error || "";
+	expires = data.expires_in;
+}
+
+setInterval(async () => {
+	expires--;
+	if (expires <= 0 && !refreshing) {
+		refreshing = true;
+		try {
+			await refresh();
+		} catch (e) {
+			document.getElementById("error").firstChild.textContent = e.message;
+			expires = 5;
+		}
+		refreshing = false;
+	}
+	document.getElementById("expires").textContent = expires;
+	rings();
+}, 1000);
+rings();
+
+if ("serviceWorker" in navigator) {
+	navigator.serviceWorker.register("/sw.js");
+}
+</script>
+</body></html>
+`))
@@ -0,0 +1,91 @@
+// Copyright 2019 github.com/ucirello and https://cirello.io. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ykcs11Modules are the usual install paths of libykcs11, Yubico's PKCS#11
+// module, which comes with yubico-piv-tool.
+var ykcs11Modules = []string{
+	"/usr/lib/x86_64-linux-gnu/libykcs11.so",
+	"/usr/lib/aarch64-linux-gnu/libykcs11.so",
+	"/usr/lib/libykcs11.so",
+	"/usr/local/lib/libykcs11.so",
+	"/usr/local/lib/libykcs11.dylib",
+	"/opt/homebrew/lib/libykcs11.dylib",
+}
+
+// openYubiKey opens the key in a YubiKey PIV slot named by yubikey:SLOT, or
+// yubikey:SLOT?serial=N when several YubiKeys are plugged in. The slot is
+// usually 9d, the key management slot, which holds a RSA or EC key generated
+// with ykman piv keys generate. The key is used through libykcs11, as with a
+// pkcs11: URI: the PIN is asked as the slot's PIN policy requires, and the
+// YubiKey blinks when its touch policy wants it touched.
+func openYubiKey(name string) (keyBackend, error) {
+	slot, rawQuery, _ := strings.Cut(strings.TrimPrefix(name, "yubikey:"), "?")
+	id, err := pivSlotID(slot)
+	if err != nil {
+		return nil, err
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid yubikey: query: %s", err)
+	}
+	uri := "pkcs11:id=%" + fmt.Sprintf("%02x", id)
+	if serial := query.Get("serial"); serial != "" {
+		uri += ";serial=" + url.PathEscape(serial)
+	}
+	module := os.Getenv("OTP_PKCS11_MODULE")
+	for _, fn := range ykcs11Modules {
+		if module != "" {
+			break
+		}
+		if _, err := os.Stat(fn); err == nil {
+			module = fn
+		}
+	}
+	if module == "" {
+		return nil, fmt.Errorf("libykcs11 not found; install yubico-piv-tool or set $OTP_PKCS11_MODULE")
+	}
+	return openPKCS11Key(uri + "?module-path=" + url.QueryEscape(module))
+}
+
+// pivSlotID maps a PIV slot to the CKA_ID libykcs11 gives to its key.
+func pivSlotID(slot string) (int, error) {
+	n, err := strconv.ParseUint(strings.ToLower(slot), 16, 8)
+	switch {
+	case err != nil:
+	case n == 0x9a:
+		return 1, nil
+	case n == 0x9c:
+		return 2, nil
+	case n == 0x9d:
+		return 3, nil
+	case n == 0x9e:
+		return 4, nil
+	case n >= 0x82 && n <= 0x95:
+		// The retired key management slots.
+		return int(n-0x82) + 5, nil
+	case n == 0xf9:
+		return 25, nil
+	}
+	return 0, fmt.Errorf("invalid PIV slot %q; use 9a, 9c, 9d, 9e, 82 to 95, or f9", slot)
+}